@@ -0,0 +1,126 @@
+// Command certverify checks the commit certificates of a network against its validator set, without running a node.
+//
+//	certverify validators -scheme ED25519 -nodes 4 -out validators.json
+//	certverify verify -validators validators.json Certificates/N0/N0_1_CERT Certificates/N0/N0_2_CERT
+//
+// The validators command writes the validator set file from the public key files of the 'Keys' directory, so run it
+// in the directory of the network. It holds the keys the validators started with: the certificates of a network whose
+// validators changed keys verify against the validator set file a node writes with the key changes it executed.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"proof-of-training/fpbft"
+)
+
+const usage = `usage: certverify <command> [flags]
+
+commands:
+  validators   write the validator set file of a network from its public key files
+  verify       check commit certificates against a validator set file
+
+Run 'certverify <command> -h' for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "validators":
+		err = validators(os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "certverify:", err)
+		os.Exit(1)
+	}
+}
+
+func validators(args []string) error {
+	flags := flag.NewFlagSet("validators", flag.ExitOnError)
+	scheme := flags.String("scheme", "ED25519", "signature scheme of the network")
+	nodes := flags.Int("nodes", 4, "number of nodes, N0 to N<nodes-1>")
+	stakes := flags.String("stakes", "", "comma separated voting power of the nodes, 1 each if empty")
+	withBLS := flags.Bool("bls", false, "include the BLS public keys, for the certificates of the quorum certificate mode")
+	out := flags.String("out", "validators.json", "validator set file to write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	powers := make(map[string]int)
+	for i := 0; i < *nodes; i++ {
+		powers["N"+strconv.Itoa(i)] = 1
+	}
+	if *stakes != "" {
+		fields := strings.Split(*stakes, ",")
+		if len(fields) != *nodes {
+			return fmt.Errorf("%d stakes for %d nodes", len(fields), *nodes)
+		}
+		for i, field := range fields {
+			power, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || power < 0 {
+				return fmt.Errorf("the stake %q is not a voting power", field)
+			}
+			powers["N"+strconv.Itoa(i)] = power
+		}
+	}
+	set, err := fpbft.NewValidatorSetFile(fpbft.SignatureScheme(*scheme), powers, *withBLS)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*out, b, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote the %d validators to %s\n", len(set.Validators), *out)
+	return nil
+}
+
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	path := flags.String("validators", "validators.json", "validator set file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("no certificate to verify")
+	}
+	set, err := fpbft.ReadValidatorSetFile(*path)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, file := range flags.Args() {
+		cert, err := fpbft.ReadCommitCertificate(file)
+		if err == nil {
+			err = fpbft.VerifyCommitCertificate(cert, set)
+		}
+		if err != nil {
+			fmt.Printf("%s: INVALID: %v\n", file, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: valid, sequence number %d of view %d, %d requests, digest %s\n", file, cert.SequenceID, cert.View, len(cert.RequestBatch), cert.Digest)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of the %d certificates are not valid", failed, flags.NArg())
+	}
+	return nil
+}
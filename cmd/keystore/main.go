@@ -0,0 +1,251 @@
+// Command keystore creates, imports, exports, lists and rotates the encrypted keys of the nodes.
+//
+//	keystore create -node N0 -tag ED25519
+//	keystore import -node N0 -tag SECP256K1 -in key.pem
+//	keystore export -node N0 -tag ED25519 -out key.pem
+//	keystore list
+//	keystore rotate -node N0 -tag ED25519
+//
+// The password is read from the file given with -password-file, or from the PBFT_KEYSTORE_PASSWORD environment variable.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"proof-of-training/fpbft"
+	"proof-of-training/keystore"
+)
+
+const usage = `usage: keystore <command> [flags]
+
+commands:
+  create   generate a key for a node and encrypt it into its keystore
+  import   encrypt a PEM private key into the keystore of a node
+  export   decrypt the private key of a node to a PEM file
+  list     list the keystores
+  rotate   replace the key of a node with a new one, keeping the old keystore
+
+The tag is the kind of key: ED25519, SECP256K1, RSAPSS, RSA, BLS12381 or X25519.
+Run 'keystore <command> -h' for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "create":
+		err = create(os.Args[2:])
+	case "import":
+		err = importKey(os.Args[2:])
+	case "export":
+		err = export(os.Args[2:])
+	case "list":
+		err = list(os.Args[2:])
+	case "rotate":
+		err = rotate(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "keystore:", err)
+		os.Exit(1)
+	}
+}
+
+// The flags every command shares.
+type options struct {
+	flags        *flag.FlagSet
+	dir          string
+	nodeID       string
+	tag          string
+	passwordFile string
+	light        bool
+}
+
+func newOptions(name string, withKey bool) *options {
+	o := &options{flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	o.flags.StringVar(&o.dir, "dir", keystore.DefaultStore.Dir, "directory of the key files")
+	if withKey {
+		o.flags.StringVar(&o.nodeID, "node", "", "node ID, e.g. N0")
+		o.flags.StringVar(&o.tag, "tag", "ED25519", "kind of key")
+		o.flags.StringVar(&o.passwordFile, "password-file", "", "file holding the password, instead of "+keystore.PasswordEnv)
+		o.flags.BoolVar(&o.light, "light", false, "use the light scrypt parameters of the simulated networks")
+	}
+	return o
+}
+
+func (o *options) parse(args []string) error {
+	if err := o.flags.Parse(args); err != nil {
+		return err
+	}
+	if o.flags.Lookup("node") != nil && o.nodeID == "" {
+		return errors.New("the node is missing, e.g. -node N0")
+	}
+	return nil
+}
+
+func (o *options) store() keystore.Store {
+	return keystore.Store{Dir: o.dir}
+}
+
+func (o *options) params() keystore.ScryptParams {
+	if o.light {
+		return keystore.LightScrypt
+	}
+	return keystore.StandardScrypt
+}
+
+// The password of the keystores. Unlike the simulated networks, the command never falls back to the simulation password.
+func (o *options) password() (string, error) {
+	if o.passwordFile != "" {
+		b, err := ioutil.ReadFile(o.passwordFile)
+		if err != nil {
+			return "", err
+		}
+		password := strings.TrimRight(string(b), "\r\n")
+		if password == "" {
+			return "", fmt.Errorf("%s is empty", o.passwordFile)
+		}
+		return password, nil
+	}
+	if password := os.Getenv(keystore.PasswordEnv); password != "" {
+		return password, nil
+	}
+	return "", fmt.Errorf("set %s or pass -password-file", keystore.PasswordEnv)
+}
+
+func create(args []string) error {
+	o := newOptions("create", true)
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	if o.store().Has(o.nodeID, o.tag) {
+		return fmt.Errorf("%s already exists, rotate the key instead", o.store().Path(o.nodeID, o.tag))
+	}
+	password, err := o.password()
+	if err != nil {
+		return err
+	}
+	prvkey, pubkey, err := fpbft.GenerateNodeKey(o.tag)
+	if err != nil {
+		return err
+	}
+	if err := o.store().Write(o.nodeID, o.tag, prvkey, pubkey, password, o.params()); err != nil {
+		return err
+	}
+	fmt.Printf("created %s\n", o.store().Path(o.nodeID, o.tag))
+	return nil
+}
+
+func importKey(args []string) error {
+	o := newOptions("import", true)
+	in := o.flags.String("in", "", "PEM private key file to import")
+	remove := o.flags.Bool("remove", false, "remove the plaintext file once it is imported")
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return errors.New("the key file is missing, e.g. -in key.pem")
+	}
+	if o.store().Has(o.nodeID, o.tag) {
+		return fmt.Errorf("%s already exists, rotate the key instead", o.store().Path(o.nodeID, o.tag))
+	}
+	password, err := o.password()
+	if err != nil {
+		return err
+	}
+	prvkey, err := ioutil.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	pubkey, err := fpbft.NodePublicKey(o.tag, prvkey)
+	if err != nil {
+		return fmt.Errorf("%s is not a %s private key: %v", *in, o.tag, err)
+	}
+	if err := o.store().Write(o.nodeID, o.tag, prvkey, pubkey, password, o.params()); err != nil {
+		return err
+	}
+	fmt.Printf("imported %s into %s\n", *in, o.store().Path(o.nodeID, o.tag))
+	if *remove {
+		return os.Remove(*in)
+	}
+	return nil
+}
+
+func export(args []string) error {
+	o := newOptions("export", true)
+	out := o.flags.String("out", "", "PEM file to write the private key to, the standard output if empty")
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	password, err := o.password()
+	if err != nil {
+		return err
+	}
+	prvkey, err := o.store().ReadPrivateKey(o.nodeID, o.tag, password)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(prvkey)
+		return err
+	}
+	//O_EXCL, an export never overwrites a file
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(prvkey); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported the %s key of %s to %s, unencrypted\n", o.tag, o.nodeID, *out)
+	return nil
+}
+
+func list(args []string) error {
+	o := newOptions("list", false)
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	keys, err := o.store().List()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		fmt.Printf("%-6s %-20s %s  created %s  scrypt N=%d\n", k.NodeID, k.Tag, k.ID, k.Created.Format("2006-01-02 15:04:05"), k.Crypto.KDFParams.N)
+	}
+	return nil
+}
+
+func rotate(args []string) error {
+	o := newOptions("rotate", true)
+	if err := o.parse(args); err != nil {
+		return err
+	}
+	password, err := o.password()
+	if err != nil {
+		return err
+	}
+	prvkey, pubkey, err := fpbft.GenerateNodeKey(o.tag)
+	if err != nil {
+		return err
+	}
+	if err := o.store().Rotate(o.nodeID, o.tag, prvkey, pubkey, password, o.params()); err != nil {
+		return err
+	}
+	fmt.Printf("rotated %s, the other nodes must be given the new public key %s\n", o.store().Path(o.nodeID, o.tag), o.store().PublicPath(o.nodeID, o.tag))
+	return nil
+}
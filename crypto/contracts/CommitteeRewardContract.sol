@@ -0,0 +1,24 @@
+pragma solidity ^0.8.4;
+
+// Rewards credited by the PBFT committee in one transaction, signed by the validators together with their threshold key.
+contract CommitteeRewardContract {
+	// The EVM address of the threshold key of the committee
+	address public committee;
+
+	// The balance that each address is allowed to withdraw
+	mapping (address => uint) public rewards;
+
+	constructor(address _committee) {
+		require(_committee != address(0), "Invalid committee address.");
+		committee = _committee;
+	}
+
+	function reward(address _destination, uint _value) public onlyCommittee {
+		rewards[_destination] += _value;
+	}
+
+	modifier onlyCommittee() {
+		require(msg.sender == committee, "Only the committee can execute this action");
+		_;
+	}
+}
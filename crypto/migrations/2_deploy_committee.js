@@ -0,0 +1,11 @@
+const CommitteeRewardContract = artifacts.require("CommitteeRewardContract");
+
+module.exports = function(deployer) {
+  // The committee address the nodes print once they have set up their threshold key
+  const committee = process.env.COMMITTEE_ADDRESS;
+  if (!committee) {
+    console.log("COMMITTEE_ADDRESS is not set, skipping the CommitteeRewardContract");
+    return;
+  }
+  deployer.deploy(CommitteeRewardContract, committee);
+};
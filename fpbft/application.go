@@ -0,0 +1,92 @@
+package fpbft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+)
+
+// The replicated state machine driven by the consensus. The consensus orders the requests,
+// and every replica executes them in the same order against its own copy of the application.
+type Application interface {
+	//Check a request before it is proposed, requests that are not valid are never ordered. It must not modify the state.
+	Validate(r Request) error
+	//Execute a committed request and return its result. It must be deterministic: replicas executing
+	//the same requests in the same order reach the same state and return the same results.
+	Execute(r Request) string
+	//Digest of the current state, which the replicas agree on in their checkpoints.
+	StateHash() string
+	//Answer a read-only request against the committed state, without modifying it.
+	Query(r Request) string
+	//Serialize the current state, sent to replicas that lag behind a stable checkpoint.
+	Snapshot() []byte
+	//Replace the current state with a snapshot taken by Snapshot.
+	Restore(snapshot []byte) error
+}
+
+// The default application, which keeps the committed messages in the local message pool.
+type messagePoolApplication struct {
+	// Local message pool (simulating the persistence layer), only after the confirmation of successful commit will the messages be stored in this pool.
+	localMessagePool []Message
+	//Digest chaining the digests of the executed requests
+	stateDigest string
+}
+
+func newMessagePoolApplication() *messagePoolApplication {
+	return &messagePoolApplication{localMessagePool: []Message{}}
+}
+
+func (a *messagePoolApplication) Validate(r Request) error {
+	if r.Content == "" {
+		return errors.New("the message content is empty")
+	}
+	return nil
+}
+
+func (a *messagePoolApplication) Execute(r Request) string {
+	hash := sha256.Sum256([]byte(a.stateDigest + getDigest(r)))
+	a.stateDigest = hex.EncodeToString(hash[:])
+	//The message information is being submitted to the local message pool!
+	a.localMessagePool = append(a.localMessagePool, r.Message)
+	return "msgid:" + strconv.Itoa(r.ID) + " has been put into the local message pool, message content：" + r.Content
+}
+
+func (a *messagePoolApplication) StateHash() string {
+	return a.stateDigest
+}
+
+// Look up the message with the ID of the request in the local message pool.
+func (a *messagePoolApplication) Query(r Request) string {
+	for _, m := range a.localMessagePool {
+		if m.ID == r.ID {
+			return "msgid:" + strconv.Itoa(m.ID) + " is in the local message pool, message content：" + m.Content
+		}
+	}
+	return "msgid:" + strconv.Itoa(r.ID) + " is not in the local message pool"
+}
+
+type messagePoolSnapshot struct {
+	LocalMessagePool []Message
+	StateDigest      string
+}
+
+func (a *messagePoolApplication) Snapshot() []byte {
+	b, err := json.Marshal(messagePoolSnapshot{LocalMessagePool: a.localMessagePool, StateDigest: a.stateDigest})
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+func (a *messagePoolApplication) Restore(snapshot []byte) error {
+	s := new(messagePoolSnapshot)
+	if err := json.Unmarshal(snapshot, s); err != nil {
+		return err
+	}
+	a.localMessagePool = append([]Message{}, s.LocalMessagePool...)
+	a.stateDigest = s.StateDigest
+	return nil
+}
@@ -0,0 +1,152 @@
+package fpbft
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Tag of the key files the session keys are agreed with: Keys/<id>/<id>_X25519_PIV and Keys/<id>/<id>_X25519_PUB.
+const x25519KeyTag = "X25519"
+
+// If the X25519 key files do not exist in the 'Keys' directory of the current directory, generate a key pair for each node.
+func genX25519Keys(numNodes int) {
+	genKeyFiles(x25519KeyTag, numNodes, generateX25519Key)
+}
+
+// Generate an X25519 key pair, PEM encoded as in the key files.
+func generateX25519Key() (prvkey, pubkey []byte, err error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	derPriv, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	derPub, err := x509.MarshalPKIXPublicKey(priv.PublicKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	prvkey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: derPriv})
+	pubkey = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: derPub})
+	return
+}
+
+// Parse the PEM encoded private key of an X25519 key file.
+func parseX25519PrivateKey(prvkey []byte) (*ecdh.PrivateKey, error) {
+	block, _ := pem.Decode(prvkey)
+	if block == nil {
+		return nil, errors.New("private key error")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*ecdh.PrivateKey)
+	if !ok || priv.Curve() != ecdh.X25519() {
+		return nil, errors.New("not an X25519 private key")
+	}
+	return priv, nil
+}
+
+// Parse the PEM encoded public key of an X25519 key file.
+func parseX25519PublicKey(pubkey []byte) (*ecdh.PublicKey, error) {
+	block, _ := pem.Decode(pubkey)
+	if block == nil {
+		return nil, errors.New("public key error")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*ecdh.PublicKey)
+	if !ok || pub.Curve() != ecdh.X25519() {
+		return nil, errors.New("not an X25519 public key")
+	}
+	return pub, nil
+}
+
+// The session key two nodes share: the X25519 shared secret of their keys, expanded with HKDF-SHA256 and bound
+// to both node IDs in a fixed order, so that both nodes derive the same key.
+func sessionKey(priv *ecdh.PrivateKey, pub *ecdh.PublicKey, a, b string) ([]byte, error) {
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	if a > b {
+		a, b = b, a
+	}
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("fpbft session key "+a+" "+b)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Agree on a session key with every other node of the node table from the X25519 key files, when the node starts.
+func (p *pbft) establishSessionKeys() {
+	key, err := readPrivKey(x25519KeyTag, p.node.nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	priv, err := parseX25519PrivateKey(key)
+	if err != nil {
+		log.Panic(err)
+	}
+	p.sessionKeys = make(map[string][]byte)
+	for nodeID := range p.nodeTable {
+		if nodeID == p.node.nodeID {
+			continue
+		}
+		key, err := readPubKey(x25519KeyTag, nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		pub, err := parseX25519PublicKey(key)
+		if err != nil {
+			log.Panic(err)
+		}
+		if p.sessionKeys[nodeID], err = sessionKey(priv, pub, p.node.nodeID, nodeID); err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+// HMAC-SHA256 tag of the data sent by the node, under a session key. The sender is part of the tagged data,
+// so a vote can't be reflected back to the node that sent it as if the other node of the session had sent it.
+func voteMAC(key []byte, sender string, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sender + ":"))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// The authenticator of a vote of the node: a tag for every other node, under the session key it shares with that node.
+func (p *pbft) authenticator(data []byte) map[string][]byte {
+	tags := make(map[string][]byte, len(p.sessionKeys))
+	for nodeID, key := range p.sessionKeys {
+		tags[nodeID] = voteMAC(key, p.node.nodeID, data)
+	}
+	return tags
+}
+
+// Verify the tag for this node in the authenticator of a vote the node sent.
+func (p *pbft) verifyAuthenticator(nodeID string, data []byte, tags map[string][]byte) error {
+	key, ok := p.sessionKeys[nodeID]
+	if !ok {
+		return reject(reasonUnknownSender, "there is no session key with %s", nodeID)
+	}
+	if !hmac.Equal(tags[p.node.nodeID], voteMAC(key, nodeID, data)) {
+		return reject(reasonBadSignature, "the MAC of %s doesn't verify", nodeID)
+	}
+	return nil
+}
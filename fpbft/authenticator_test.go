@@ -0,0 +1,65 @@
+package fpbft
+
+import (
+	"errors"
+	"testing"
+)
+
+// The nodes of idleCluster, authenticating their votes with MACs.
+func macCluster(t *testing.T) map[string]*pbft {
+	t.Helper()
+	nodes := idleCluster(t)
+	genX25519Keys(len(nodes))
+	for _, p := range nodes {
+		p.setVoteAuthentication(authMACs)
+	}
+	return nodes
+}
+
+// Every node derives the session key it shares with another node, and verifies the tag of the other node's vote.
+func TestAuthenticatorRoundTrip(t *testing.T) {
+	nodes := macCluster(t)
+	if string(nodes["N1"].sessionKeys["N2"]) != string(nodes["N2"].sessionKeys["N1"]) {
+		t.Fatal("N1 and N2 don't share their session key")
+	}
+	sign, authenticator := nodes["N1"].authenticateVote(cPrepare, 0, 1, "digest")
+	if sign != nil || len(authenticator) != len(nodes)-1 {
+		t.Fatalf("the vote carries a signature %x and %d tags", sign, len(authenticator))
+	}
+	for nodeID, p := range nodes {
+		if nodeID == "N1" {
+			continue
+		}
+		if err := p.verifyVote("N1", cPrepare, 0, 1, "digest", nil, authenticator); err != nil {
+			t.Errorf("%s: %v", nodeID, err)
+		}
+	}
+}
+
+// A tag doesn't verify for another vote, once altered, at another node, or reflected back to the node that sent it.
+func TestAuthenticatorRejectsTampering(t *testing.T) {
+	nodes := macCluster(t)
+	_, authenticator := nodes["N1"].authenticateVote(cPrepare, 0, 1, "digest")
+	altered := make(map[string][]byte)
+	for nodeID, tag := range authenticator {
+		altered[nodeID] = append([]byte{}, tag...)
+	}
+	altered["N2"][0] ^= 1
+	//N2 holds the tag of N1 for N3, and passes it off as its own
+	stolen := map[string][]byte{"N3": authenticator["N3"]}
+	//The tag N1 made for N2 is sent back to N1 as if N2 had voted
+	reflected := map[string][]byte{"N1": authenticator["N2"]}
+	for name, err := range map[string]error{
+		"another phase":  nodes["N2"].verifyVote("N1", cCommit, 0, 1, "digest", nil, authenticator),
+		"another digest": nodes["N2"].verifyVote("N1", cPrepare, 0, 1, "other", nil, authenticator),
+		"altered":        nodes["N2"].verifyVote("N1", cPrepare, 0, 1, "digest", nil, altered),
+		"another node":   nodes["N3"].verifyVote("N2", cPrepare, 0, 1, "digest", nil, stolen),
+		"reflected":      nodes["N1"].verifyVote("N2", cPrepare, 0, 1, "digest", nil, reflected),
+		"missing":        nodes["N2"].verifyVote("N1", cPrepare, 0, 1, "digest", nil, nil),
+	} {
+		var r *rejection
+		if !errors.As(err, &r) || r.reason != reasonBadSignature {
+			t.Errorf("the vote with a tag of %s was not rejected: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package fpbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Default bounds of a batch of requests ordered by one pre-prepare.
+const (
+	defaultMaxBatchCount = 500
+	defaultMaxBatchBytes = 1024 * 1024
+	defaultMaxBatchWait  = 20 * time.Millisecond
+)
+
+// The primary adds a client request to the next batch, proposing the batch as soon as it is full
+// and otherwise at the latest maxBatchWait after its first request arrived.
+func (p *pbft) addToBatch(r Request) {
+	p.requestBatch = append(p.requestBatch, r)
+	p.requestBatchBytes += requestSize(r)
+	if len(p.requestBatch) >= p.maxBatchCount || p.requestBatchBytes >= p.maxBatchBytes {
+		p.proposeBatch()
+	} else if p.batchTimer == nil {
+		p.startBatchTimer()
+	}
+}
+
+// Start the timer proposing the pending batch when it has waited long enough.
+func (p *pbft) startBatchTimer() {
+	p.batchTimer = time.AfterFunc(p.maxBatchWait, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.batchTimer = nil
+		if p.isPrimary() && !p.viewChanging {
+			p.proposeBatch()
+		}
+	})
+}
+
+// Order the pending requests in batches, each assigned a sequence number and broadcast in one pre-prepare.
+// Requests beyond the high watermark stay pending until the next checkpoint becomes stable.
+func (p *pbft) proposeBatch() {
+	if p.batchTimer != nil {
+		p.batchTimer.Stop()
+		p.batchTimer = nil
+	}
+	for len(p.requestBatch) > 0 {
+		if p.sequenceID+1 > p.highWatermark() {
+			fmt.Println("The sequence number would exceed the high watermark, holding the requests until the next stable checkpoint.")
+			return
+		}
+		//Take requests in their order of arrival until one of the bounds is reached, but at least one request
+		count, size := 0, 0
+		for count < len(p.requestBatch) && count < p.maxBatchCount {
+			s := requestSize(p.requestBatch[count])
+			if count > 0 && size+s > p.maxBatchBytes {
+				break
+			}
+			size += s
+			count++
+		}
+		batch := p.requestBatch[:count:count]
+		p.requestBatch = p.requestBatch[count:]
+		p.requestBatchBytes -= size
+		p.broadcastPrePrepare(batch)
+	}
+}
+
+// Size of the encoded request in bytes, counted against the byte bound of a batch.
+func requestSize(r Request) int {
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Panic(err)
+	}
+	return len(b)
+}
+
+// Drop the requests the node has not ordered, used when it stops being the primary.
+func (p *pbft) dropBatch() {
+	if p.batchTimer != nil {
+		p.batchTimer.Stop()
+		p.batchTimer = nil
+	}
+	p.requestBatch = []Request{}
+	p.requestBatchBytes = 0
+}
+
+// The primary assigns the next sequence number to the batch and broadcasts its pre-prepare.
+func (p *pbft) broadcastPrePrepare(batch []Request) {
+	//add sequence number
+	p.sequenceIDAdd()
+	//fetch digest
+	digest := getBatchDigest(batch)
+	fmt.Printf("A batch of %d requests has been stored in the temporary message pool.\n", len(batch))
+	//Store in the temporary message pool.
+	p.messagePool[digest] = batch
+	//The primary node signs <PRE-PREPARE,v,n,d>.
+	signInfo := p.sign(voteSignContent(cPrePrepare, p.view, p.sequenceID, digest))
+	//Assembled into PrePrepare, ready to be sent to follower nodes.
+	pp := PrePrepare{RequestBatch: batch, Digest: digest, View: p.view, SequenceID: p.sequenceID, Sign: signInfo}
+	p.prePreparePool[instanceKey{p.view, p.sequenceID}] = pp
+	p.recordPrePrepared(pp)
+	if p.dissemination == disseminateTree {
+		//The pre-prepare goes down the dissemination tree, the other nodes relaying it
+		p.disseminatePrePrepare(pp)
+	} else {
+		fmt.Println("Broadcasting PrePrepare to other nodes...")
+		//Broadcast PrePrepare
+		p.broadcast(cPrePrepare, pp)
+		fmt.Println("PrePrepare broadcast completed.")
+	}
+	if p.voteAuth == authQuorumCerts {
+		p.collectPrimaryPrepare(pp)
+	}
+}
@@ -0,0 +1,175 @@
+package fpbft
+
+import (
+	"encoding/pem"
+	"errors"
+	"log"
+
+	"github.com/coinbase/kryptology/pkg/signatures/bls/bls_sig"
+)
+
+// BLS12-381 signatures of the votes aggregated into quorum certificates, with the public keys in G1 and the signatures in G2.
+// Every public key comes with a proof of possession of its private key, so that no node can choose its key
+// to cancel out the keys of the others in an aggregated public key.
+var blsScheme = bls_sig.NewSigPop()
+
+// Tag of the BLS key files: Keys/<id>/<id>_BLS12381_PIV and Keys/<id>/<id>_BLS12381_PUB.
+const blsKeyTag = "BLS12381"
+
+// If the BLS key files do not exist in the 'Keys' directory of the current directory, generate a BLS key pair for each node.
+func genBlsKeys(numNodes int) {
+	genKeyFiles(blsKeyTag, numNodes, generateBlsKey)
+}
+
+// Generate a BLS key pair, PEM encoded as in the key files. The public key file holds the proof of possession after the key.
+func generateBlsKey() (prvkey, pubkey []byte, err error) {
+	pk, sk, err := blsScheme.Keygen()
+	if err != nil {
+		return nil, nil, err
+	}
+	pop, err := blsScheme.PopProve(sk)
+	if err != nil {
+		return nil, nil, err
+	}
+	skBytes, err := sk.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	pkBytes, err := pk.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	popBytes, err := pop.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	prvkey = pem.EncodeToMemory(&pem.Block{Type: "BLS12381 PRIVATE KEY", Bytes: skBytes})
+	pubkey = pem.EncodeToMemory(&pem.Block{Type: "BLS12381 PUBLIC KEY", Bytes: pkBytes})
+	pubkey = append(pubkey, pem.EncodeToMemory(&pem.Block{Type: "BLS12381 PROOF OF POSSESSION", Bytes: popBytes})...)
+	return
+}
+
+// The public key file of a BLS private key, with a new proof of possession.
+func blsPublicKey(prvkey []byte) ([]byte, error) {
+	sk, err := parseBlsSecretKey(prvkey)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := sk.GetPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	pop, err := blsScheme.PopProve(sk)
+	if err != nil {
+		return nil, err
+	}
+	pkBytes, err := pk.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	popBytes, err := pop.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	pubkey := pem.EncodeToMemory(&pem.Block{Type: "BLS12381 PUBLIC KEY", Bytes: pkBytes})
+	return append(pubkey, pem.EncodeToMemory(&pem.Block{Type: "BLS12381 PROOF OF POSSESSION", Bytes: popBytes})...), nil
+}
+
+// Parse the PEM encoded private key of a BLS key file.
+func parseBlsSecretKey(prvkey []byte) (*bls_sig.SecretKey, error) {
+	block, _ := pem.Decode(prvkey)
+	if block == nil || block.Type != "BLS12381 PRIVATE KEY" {
+		return nil, errors.New("not a BLS private key")
+	}
+	sk := new(bls_sig.SecretKey)
+	if err := sk.UnmarshalBinary(block.Bytes); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// Parse the PEM encoded public key of a BLS key file, which is only accepted with a valid proof of possession.
+func parseBlsPublicKey(pubkey []byte) (*bls_sig.PublicKey, error) {
+	block, rest := pem.Decode(pubkey)
+	if block == nil || block.Type != "BLS12381 PUBLIC KEY" {
+		return nil, errors.New("not a BLS public key")
+	}
+	pk := new(bls_sig.PublicKey)
+	if err := pk.UnmarshalBinary(block.Bytes); err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(rest)
+	if block == nil || block.Type != "BLS12381 PROOF OF POSSESSION" {
+		return nil, errors.New("the BLS public key has no proof of possession")
+	}
+	pop := new(bls_sig.ProofOfPossession)
+	if err := pop.UnmarshalBinary(block.Bytes); err != nil {
+		return nil, err
+	}
+	if ok, err := blsScheme.PopVerify(pk, pop); err != nil || !ok {
+		return nil, errors.New("the proof of possession of the BLS public key doesn't verify")
+	}
+	return pk, nil
+}
+
+// Pass the node number to obtain its BLS public key, read from its public key file the first time.
+func (p *pbft) getBlsKey(nodeID string) (*bls_sig.PublicKey, error) {
+	if pk, ok := p.blsKeys[nodeID]; ok {
+		return pk, nil
+	}
+	key, err := readPubKey(blsKeyTag, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := parseBlsPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	p.blsKeys[nodeID] = pk
+	return pk, nil
+}
+
+// Pass the node number and obtain its BLS private key
+func getBlsSecretKey(nodeID string) *bls_sig.SecretKey {
+	key, err := readPrivKey(blsKeyTag, nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	sk, err := parseBlsSecretKey(key)
+	if err != nil {
+		log.Panic(err)
+	}
+	return sk
+}
+
+// BLS signature of the node
+func (p *pbft) blsSign(data []byte) []byte {
+	sig, err := blsScheme.Sign(p.node.blsKey, data)
+	if err != nil {
+		log.Panic(err)
+	}
+	b, err := sig.MarshalBinary()
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Verify the BLS signature of the node on the data, rejected like any other invalid signature.
+func (p *pbft) verifyBlsSignature(nodeID string, data, sign []byte) error {
+	if _, ok := p.nodeTable[nodeID]; !ok {
+		return reject(reasonUnknownSender, "%q is not in the node table", nodeID)
+	}
+	pk, err := p.getBlsKey(nodeID)
+	if err != nil {
+		return reject(reasonUnknownSender, "the BLS public key of %s can't be read", nodeID)
+	}
+	sig := new(bls_sig.Signature)
+	if err := sig.UnmarshalBinary(sign); err != nil {
+		return reject(reasonBadSignature, "the BLS signature of %s is malformed", nodeID)
+	}
+	if ok, err := blsScheme.Verify(pk, data, sig); err != nil || !ok {
+		return reject(reasonBadSignature, "the BLS signature of %s doesn't verify", nodeID)
+	}
+	return nil
+}
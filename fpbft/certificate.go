@@ -0,0 +1,298 @@
+package fpbft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/coinbase/kryptology/pkg/signatures/bls/bls_sig"
+)
+
+// Directory the simulations persist the commit certificates of the nodes to: Certificates/<id>/<id>_<n>_CERT.
+const defaultCertificateDir = "Certificates"
+
+// The proof that validators with more than 2/3 of the voting power committed the batch with the digest at the sequence
+// number in the view. It holds the signed commits of the validators, or the commit quorum certificate in the quorum
+// certificate mode, and the batch itself, so it proves what was agreed to anyone who knows the validator set.
+type CommitCertificate struct {
+	View         int
+	SequenceID   int
+	Digest       string
+	RequestBatch []Request
+	//Signature scheme of the commits
+	Scheme  SignatureScheme
+	Commits []CommitSignature `json:",omitempty"`
+	//The aggregated BLS signature of the commits, in the quorum certificate mode
+	QuorumCert *QuorumCert `json:",omitempty"`
+}
+
+// The signature of a validator on its commit, <COMMIT,v,n,d>.
+type CommitSignature struct {
+	NodeID string
+	Sign   []byte
+}
+
+// The validators of a network with their voting power and PEM public keys, which commit certificates are verified against.
+type ValidatorSetFile struct {
+	Scheme     SignatureScheme
+	Validators []ValidatorInfo
+	//Number of sequence numbers the key replaced by a rotation still signs commits after the new key took effect
+	KeyRotationGrace int `json:",omitempty"`
+}
+
+type ValidatorInfo struct {
+	NodeID string
+	Power  int
+	//The key the validator started with, from its key files
+	PublicKey string
+	//The keys the network changed the key of the validator to, in the order they take effect
+	KeyChanges []ValidatorKey `json:",omitempty"`
+	//The BLS public key with its proof of possession, for the certificates of the quorum certificate mode
+	BLSPublicKey string `json:",omitempty"`
+}
+
+// The PEM public key of a validator from the sequence number From on, empty if a revocation left it without a key.
+type ValidatorKey struct {
+	From       int
+	PublicKey  string
+	Revocation bool `json:",omitempty"`
+}
+
+// Path of the commit certificate of the node for the sequence number.
+func certificateFile(dir, nodeID string, sequenceID int) string {
+	return filepath.Join(dir, nodeID, nodeID+"_"+strconv.Itoa(sequenceID)+"_CERT")
+}
+
+// Write the commit certificates of the node to the directory, which the node writes none to unless it is set.
+func (p *pbft) setCertificateDir(dir string) {
+	p.certificateDir = dir
+}
+
+// Keep the commit certificate of the instance the node has just committed, from the commits it collected or from the
+// commit quorum certificate. Commits authenticated with MACs prove nothing to a third party, so the MAC mode has none.
+// The batch is committed whether the certificate is written or not.
+func (p *pbft) certifyCommit(key instanceKey, qc *QuorumCert) error {
+	if p.certificateDir == "" || p.voteAuth == authMACs {
+		return nil
+	}
+	pp := p.prePreparePool[key]
+	cert := CommitCertificate{View: key.view, SequenceID: key.sequenceID, Digest: pp.Digest, RequestBatch: pp.RequestBatch, Scheme: p.scheme, QuorumCert: qc}
+	if qc == nil {
+		for nodeID, c := range p.commitPool[key] {
+			cert.Commits = append(cert.Commits, CommitSignature{NodeID: nodeID, Sign: c.Sign})
+		}
+		sort.Slice(cert.Commits, func(i, j int) bool {
+			return cert.Commits[i].NodeID < cert.Commits[j].NodeID
+		})
+	}
+	b, err := json.MarshalIndent(cert, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := certificateFile(p.certificateDir, p.node.nodeID, key.sequenceID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// Read a commit certificate file.
+func ReadCommitCertificate(path string) (CommitCertificate, error) {
+	var cert CommitCertificate
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cert, err
+	}
+	if err := json.Unmarshal(b, &cert); err != nil {
+		return cert, fmt.Errorf("%s: %v", path, err)
+	}
+	return cert, nil
+}
+
+// Read a validator set file.
+func ReadValidatorSetFile(path string) (ValidatorSetFile, error) {
+	var set ValidatorSetFile
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return set, err
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return set, fmt.Errorf("%s: %v", path, err)
+	}
+	return set, nil
+}
+
+// The validator set of the nodes with the voting power, with the public keys of their key files in the 'Keys' directory,
+// and their BLS public keys if withBLS is set.
+func NewValidatorSetFile(scheme SignatureScheme, powers map[string]int, withBLS bool) (ValidatorSetFile, error) {
+	set := ValidatorSetFile{Scheme: scheme}
+	for nodeID, power := range powers {
+		key, err := readPubKey(string(scheme), nodeID)
+		if err != nil {
+			return set, err
+		}
+		v := ValidatorInfo{NodeID: nodeID, Power: power, PublicKey: string(key)}
+		if withBLS {
+			key, err := readPubKey(blsKeyTag, nodeID)
+			if err != nil {
+				return set, err
+			}
+			v.BLSPublicKey = string(key)
+		}
+		set.Validators = append(set.Validators, v)
+	}
+	sort.Slice(set.Validators, func(i, j int) bool {
+		return set.Validators[i].NodeID < set.Validators[j].NodeID
+	})
+	return set, nil
+}
+
+// The validator set file of the network as the node knows it after the last executed request: the validators with
+// their voting power, the keys of their key files, and the key changes the network executed.
+func (p *pbft) validatorSetFile(withBLS bool) (ValidatorSetFile, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	set, err := NewValidatorSetFile(p.scheme, p.validators, withBLS)
+	if err != nil {
+		return set, err
+	}
+	for i := range set.Validators {
+		v := &set.Validators[i]
+		for _, e := range p.keyEpochs[v.NodeID] {
+			v.KeyChanges = append(v.KeyChanges, ValidatorKey{From: e.From, PublicKey: string(e.PublicKey), Revocation: e.Revocation})
+		}
+	}
+	set.KeyRotationGrace = p.keyRotationGrace()
+	return set, nil
+}
+
+// Write the validator set file of the network as the node knows it, which the certificates signed after key changes
+// are verified against.
+func (p *pbft) writeValidatorSetFile(path string, withBLS bool) error {
+	set, err := p.validatorSetFile(withBLS)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// The keys the commits of the validator for the sequence number verify with: the key in effect at the sequence number,
+// and for the grace period after a rotation the replaced key, as a replica signs with the key in effect after the last
+// request it executed, which may be behind the sequence number it commits. A revoked key signs nothing after the revocation.
+func (v ValidatorInfo) keysAt(sequenceID, grace int) []string {
+	epochs := append([]ValidatorKey{{PublicKey: v.PublicKey}}, v.KeyChanges...)
+	current := 0
+	for i, e := range epochs {
+		if e.From <= sequenceID {
+			current = i
+		}
+	}
+	keys := []string{epochs[current].PublicKey}
+	if current > 0 && !epochs[current].Revocation && sequenceID < epochs[current].From+grace {
+		keys = append(keys, epochs[current-1].PublicKey)
+	}
+	return keys
+}
+
+// Verify that the validators of the set with more than 2/3 of its voting power committed the batch of the certificate.
+// The commits are verified with the keys of the validators in effect at the sequence number of the certificate.
+func VerifyCommitCertificate(cert CommitCertificate, set ValidatorSetFile) error {
+	if cert.Scheme != set.Scheme {
+		return fmt.Errorf("the certificate is signed with %s, the validators with %s", cert.Scheme, set.Scheme)
+	}
+	if cert.View < 0 || cert.SequenceID <= 0 {
+		return fmt.Errorf("view %d and sequence number %d", cert.View, cert.SequenceID)
+	}
+	if len(cert.RequestBatch) == 0 || getBatchDigest(cert.RequestBatch) != cert.Digest {
+		return errors.New("the batch doesn't match the digest of the certificate")
+	}
+	validators := make(validatorSet)
+	keys := make(map[string]ValidatorInfo)
+	for _, v := range set.Validators {
+		if _, ok := keys[v.NodeID]; ok || v.Power < 0 {
+			return fmt.Errorf("the validator set lists %s twice or with a negative power", v.NodeID)
+		}
+		validators[v.NodeID] = v.Power
+		keys[v.NodeID] = v
+	}
+	data := voteSignContent(cCommit, cert.View, cert.SequenceID, cert.Digest)
+	signers := make(map[string]bool)
+	if cert.QuorumCert != nil {
+		qc := *cert.QuorumCert
+		if qc.Phase != cCommit || qc.View != cert.View || qc.SequenceID != cert.SequenceID || qc.Digest != cert.Digest {
+			return errors.New("the quorum certificate is not the commit quorum certificate of the batch")
+		}
+		var pks []*bls_sig.PublicKey
+		for i := 0; i < len(qc.Signers)*8; i++ {
+			if qc.Signers[i/8]&(1<<(i%8)) == 0 {
+				continue
+			}
+			nodeID := "N" + strconv.Itoa(i)
+			v, ok := keys[nodeID]
+			if !ok || v.BLSPublicKey == "" {
+				return fmt.Errorf("%s is not a validator with a BLS key", nodeID)
+			}
+			pk, err := parseBlsPublicKey([]byte(v.BLSPublicKey))
+			if err != nil {
+				return fmt.Errorf("the BLS public key of %s: %v", nodeID, err)
+			}
+			signers[nodeID] = true
+			pks = append(pks, pk)
+		}
+		if len(pks) == 0 {
+			return errors.New("the quorum certificate has no signers")
+		}
+		aggregatedKey, err := blsScheme.AggregatePublicKeys(pks...)
+		if err != nil {
+			return err
+		}
+		sig := new(bls_sig.MultiSignature)
+		if err := sig.UnmarshalBinary(qc.Sign); err != nil {
+			return errors.New("the aggregated signature is malformed")
+		}
+		if ok, err := blsScheme.VerifyMultiSignature(aggregatedKey, data, sig); err != nil || !ok {
+			return errors.New("the aggregated signature doesn't verify")
+		}
+	} else {
+		for _, c := range cert.Commits {
+			v, ok := keys[c.NodeID]
+			if !ok {
+				return fmt.Errorf("%s is not a validator", c.NodeID)
+			}
+			if signers[c.NodeID] {
+				return fmt.Errorf("the commit of %s is in the certificate twice", c.NodeID)
+			}
+			verified := false
+			for _, key := range v.keysAt(cert.SequenceID, set.KeyRotationGrace) {
+				if key == "" {
+					continue
+				}
+				verifier, err := set.Scheme.parseVerifier([]byte(key))
+				if err != nil {
+					return fmt.Errorf("the public key of %s: %v", c.NodeID, err)
+				}
+				if verifier.Verify(data, c.Sign) {
+					verified = true
+					break
+				}
+			}
+			if !verified {
+				return fmt.Errorf("the commit of %s doesn't verify with its key at %d", c.NodeID, cert.SequenceID)
+			}
+			signers[c.NodeID] = true
+		}
+	}
+	if power := validators.votingPower(signers); !validators.isQuorum(power) {
+		return fmt.Errorf("the signers carry %d of the %d voting power", power, validators.totalPower())
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package fpbft
+
+import (
+	"os"
+	"testing"
+)
+
+// The certificate of the batch at the sequence number, with the commits signed by the nodes with their current keys.
+func signedCertificate(sequenceID int, signers ...*pbft) CommitCertificate {
+	batch := []Request{{Message: Message{Content: "certified"}, Timestamp: 1, ClientAddr: "memory/C1", Client: "C1"}}
+	cert := CommitCertificate{SequenceID: sequenceID, Digest: getBatchDigest(batch), RequestBatch: batch, Scheme: defaultSignatureScheme}
+	for _, p := range signers {
+		sign := p.sign(voteSignContent(cCommit, cert.View, cert.SequenceID, cert.Digest))
+		cert.Commits = append(cert.Commits, CommitSignature{NodeID: p.node.nodeID, Sign: sign})
+	}
+	return cert
+}
+
+// The commits of a certificate verify with the keys in effect at its sequence number, the replaced key of a rotation
+// only during the grace period.
+func TestCommitCertificateKeyChanges(t *testing.T) {
+	nodes := idleCluster(t)
+	n0, n1, n2 := nodes["N0"], nodes["N1"], nodes["N2"]
+	rotation, err := n1.newKeyRotation(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n0.executeKeyChange(rotation, 5)
+	set, err := n0.validatorSetFile(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grace := set.KeyRotationGrace
+	oldKey := map[int]CommitCertificate{}
+	for _, sequenceID := range []int{5, 10, 10 + grace} {
+		oldKey[sequenceID] = signedCertificate(sequenceID, n0, n1, n2)
+	}
+	n1.executeKeyChange(rotation, 5)
+	n1.lastExecuted = 9
+	if err := n1.updateSigner(); err != nil {
+		t.Fatal(err)
+	}
+	for _, sequenceID := range []int{5, 10} {
+		if err := VerifyCommitCertificate(oldKey[sequenceID], set); err != nil {
+			t.Fatalf("the certificate of %d signed with the replaced key: %v", sequenceID, err)
+		}
+	}
+	if err := VerifyCommitCertificate(oldKey[10+grace], set); err == nil {
+		t.Fatal("the replaced key verified after the grace period")
+	}
+	for _, sequenceID := range []int{10, 10 + grace} {
+		if err := VerifyCommitCertificate(signedCertificate(sequenceID, n0, n1, n2), set); err != nil {
+			t.Fatalf("the certificate of %d signed with the new key: %v", sequenceID, err)
+		}
+	}
+	if err := VerifyCommitCertificate(signedCertificate(5, n0, n1, n2), set); err == nil {
+		t.Fatal("the new key verified before it took effect")
+	}
+}
+
+// A certificate that can't be written is reported, and the node writes none without a directory.
+func TestCommitCertificateWriteError(t *testing.T) {
+	nodes := idleCluster(t)
+	p := nodes["N0"]
+	if err := p.certifyCommit(instanceKey{0, 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(defaultCertificateDir); !os.IsNotExist(err) {
+		t.Fatal("a certificate was written without a directory")
+	}
+	if err := os.WriteFile("file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.setCertificateDir("file")
+	if err := p.certifyCommit(instanceKey{0, 1}, nil); err == nil {
+		t.Fatal("the certificate was written into a file")
+	}
+}
@@ -0,0 +1,212 @@
+package fpbft
+
+// A checkpoint is taken every defaultCheckpointPeriod sequence numbers.
+const defaultCheckpointPeriod = 100
+
+// The high watermark H = h + k, where h is the sequence number of the stable checkpoint
+// and k is big enough for the primary to keep ordering requests until the next checkpoint becomes stable.
+func (p *pbft) highWatermark() int {
+	return p.stableSequenceID + 2*p.checkpointPeriod
+}
+
+// Whether the sequence number lies between the low and the high watermark, h < n <= H.
+func (p *pbft) inWatermarks(sequenceID int) bool {
+	return sequenceID > p.stableSequenceID && sequenceID <= p.highWatermark()
+}
+
+// Broadcast the checkpoint of the state after executing the request with this sequence number.
+func (p *pbft) broadcastCheckpoint(sequenceID int) {
+	p.checkpointSnapshots[sequenceID] = p.takeSnapshot(sequenceID)
+	c := Checkpoint{SequenceID: sequenceID, StateDigest: p.currentStateDigest(), NodeID: p.node.nodeID}
+	c.Sign = p.sign(c.signContent())
+	p.broadcast(cCheckpoint, c)
+	p.addCheckpoint(c)
+}
+
+// Process the checkpoint message
+func (p *pbft) handleCheckpoint(content []byte) error {
+	c := new(Checkpoint)
+	if err := decodeMessage(content, c); err != nil {
+		return err
+	}
+	if c.SequenceID <= p.stableSequenceID {
+		//The checkpoint is already stable or older
+		return nil
+	}
+	if err := p.verifySender(c.NodeID, c.signContent(), c.Sign); err != nil {
+		return err
+	}
+	if c.SequenceID%p.checkpointPeriod != 0 {
+		return rejectSigned(reasonInvalidMessage, c.NodeID, "no checkpoint is taken at %d", c.SequenceID)
+	}
+	if old, ok := p.checkpointPool[c.SequenceID][c.NodeID]; ok && old.StateDigest != c.StateDigest {
+		return rejectSigned(reasonEquivocation, c.NodeID, "the checkpoint %d has two state digests", c.SequenceID)
+	}
+	p.addCheckpoint(*c)
+	return nil
+}
+
+// Store a checkpoint message, and make the checkpoint stable once nodes (including itself) with more than 2/3
+// of the voting power agree on its state digest.
+func (p *pbft) addCheckpoint(c Checkpoint) {
+	if _, ok := p.checkpointPool[c.SequenceID]; !ok {
+		p.checkpointPool[c.SequenceID] = make(map[string]Checkpoint)
+	}
+	p.checkpointPool[c.SequenceID][c.NodeID] = c
+
+	//Once the node has executed up to this checkpoint, only the checkpoints agreeing with its own state count.
+	//Before that, a quorum agreeing on any state digest shows that the node lags behind.
+	own, executed := p.checkpointPool[c.SequenceID][p.node.nodeID]
+	proofs := make(map[string][]Checkpoint)
+	for _, checkpoint := range p.checkpointPool[c.SequenceID] {
+		if !executed || checkpoint.StateDigest == own.StateDigest {
+			proofs[checkpoint.StateDigest] = append(proofs[checkpoint.StateDigest], checkpoint)
+		}
+	}
+	for _, proof := range proofs {
+		signers := make(map[string]bool)
+		for _, checkpoint := range proof {
+			signers[checkpoint.NodeID] = true
+		}
+		if p.validators.isQuorum(p.validators.votingPower(signers)) {
+			p.stabilizeCheckpoint(c.SequenceID, proof)
+			return
+		}
+	}
+}
+
+// Verify that the checkpoint proof holds checkpoint messages for the sequence number signed by different nodes
+// with more than 2/3 of the voting power and agreeing on the state digest.
+func (p *pbft) verifyCheckpointProof(sequenceID int, proof []Checkpoint) bool {
+	if sequenceID == 0 {
+		return len(proof) == 0
+	}
+	signers := make(map[string]bool)
+	for _, c := range proof {
+		if c.SequenceID != sequenceID || c.StateDigest != proof[0].StateDigest || signers[c.NodeID] {
+			return false
+		}
+		if p.verifySignature(c.NodeID, c.signContent(), c.Sign) != nil {
+			return false
+		}
+		signers[c.NodeID] = true
+	}
+	return p.validators.isQuorum(p.validators.votingPower(signers))
+}
+
+// Discard the pre-prepares and votes of the instances selected by discard,
+// together with the batches no other instance refers to.
+func (p *pbft) discardInstances(discard func(key instanceKey) bool) {
+	for key := range p.prePreparePool {
+		if discard(key) {
+			delete(p.prePreparePool, key)
+		}
+	}
+	for key := range p.prePareConfirmCount {
+		if discard(key) {
+			delete(p.prePareConfirmCount, key)
+		}
+	}
+	for key := range p.preparePool {
+		if discard(key) {
+			delete(p.preparePool, key)
+		}
+	}
+	for key := range p.commitConfirmCount {
+		if discard(key) {
+			delete(p.commitConfirmCount, key)
+		}
+	}
+	for key := range p.commitPool {
+		if discard(key) {
+			delete(p.commitPool, key)
+		}
+	}
+	for key := range p.isCommitBordcast {
+		if discard(key) {
+			delete(p.isCommitBordcast, key)
+		}
+	}
+	for key := range p.relayedPrePrepares {
+		if discard(key) {
+			delete(p.relayedPrePrepares, key)
+		}
+	}
+	referenced := make(map[string]bool)
+	for _, pp := range p.prePreparePool {
+		referenced[pp.Digest] = true
+	}
+	for _, digest := range p.committedPool {
+		referenced[digest] = true
+	}
+	for digest := range p.messagePool {
+		if !referenced[digest] {
+			delete(p.messagePool, digest)
+			p.stopRequestTimer(digest)
+		}
+	}
+}
+
+// Make the checkpoint the stable checkpoint: move the low watermark to it, and discard the messages,
+// votes and certificates of all requests with lower sequence numbers.
+func (p *pbft) stabilizeCheckpoint(sequenceID int, proof []Checkpoint) {
+	if sequenceID <= p.stableSequenceID {
+		return
+	}
+	if p.lastExecuted < sequenceID {
+		p.fetchState(sequenceID, proof)
+		return
+	}
+	//fmt.Printf("%s has a stable checkpoint at %d\n", p.node.nodeID, sequenceID)
+	p.stableSequenceID = sequenceID
+	p.stableCheckpointProof = proof
+
+	p.discardInstances(func(key instanceKey) bool {
+		return key.sequenceID <= sequenceID
+	})
+	for n := range p.preparedCerts {
+		if n <= sequenceID {
+			delete(p.preparedCerts, n)
+		}
+	}
+	for n := range p.prePreparedSet {
+		if n <= sequenceID {
+			delete(p.prePreparedSet, n)
+		}
+	}
+	for n := range p.checkpointPool {
+		if n <= sequenceID {
+			delete(p.checkpointPool, n)
+		}
+	}
+	for n := range p.checkpointSnapshots {
+		if n < sequenceID {
+			delete(p.checkpointSnapshots, n)
+		}
+	}
+	for key := range p.tempPrePreparePool {
+		if key.sequenceID <= sequenceID {
+			delete(p.tempPrePreparePool, key)
+		}
+	}
+	for key := range p.tempPreparePool {
+		if key.sequenceID <= sequenceID {
+			delete(p.tempPreparePool, key)
+		}
+	}
+	for key := range p.tempCommitPool {
+		if key.sequenceID <= sequenceID {
+			delete(p.tempCommitPool, key)
+		}
+	}
+	for key := range p.tempQuorumCertPool {
+		if key.sequenceID <= sequenceID {
+			delete(p.tempQuorumCertPool, key)
+		}
+	}
+
+	//The high watermark has moved, so the primary can order the requests it was holding back
+	if p.isPrimary() && !p.viewChanging {
+		p.proposeBatch()
+	}
+}
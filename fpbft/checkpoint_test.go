@@ -0,0 +1,49 @@
+package fpbft
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Every node takes a checkpoint every period, makes it stable once a quorum agrees on it, and discards the messages
+// of the instances up to it.
+func TestCheckpointStabilizedAndCollected(t *testing.T) {
+	const period = 2
+	network, nt, nodes := memoryCluster(t, 4, func(p *pbft) {
+		p.checkpointPeriod = period
+	})
+	c := memoryClient(network)
+	for i := 0; i < 2*period+1; i++ {
+		if _, result := c.ClientSendMessageAndListen(nt, fmt.Sprintf("request %d", i), len(nt)); result.Rejected {
+			t.Fatalf("the request %d was rejected: %s", i, result.Result)
+		}
+	}
+	for nodeID, p := range nodes {
+		eventually(t, p, "the checkpoint didn't become stable", func() bool {
+			return p.stableSequenceID == 2*period
+		})
+		p.lock.Lock()
+		for key := range p.prePreparePool {
+			if key.sequenceID <= p.stableSequenceID {
+				t.Errorf("%s kept the pre-prepare of %d", nodeID, key.sequenceID)
+			}
+		}
+		for key := range p.commitPool {
+			if key.sequenceID <= p.stableSequenceID {
+				t.Errorf("%s kept the commits of %d", nodeID, key.sequenceID)
+			}
+		}
+		for sequenceID := range p.checkpointPool {
+			if sequenceID <= p.stableSequenceID {
+				t.Errorf("%s kept the checkpoint messages of %d", nodeID, sequenceID)
+			}
+		}
+		if len(p.stableCheckpointProof) == 0 || !p.verifyCheckpointProof(p.stableSequenceID, p.stableCheckpointProof) {
+			t.Errorf("%s has no valid proof of its stable checkpoint", nodeID)
+		}
+		if len(p.messagePool) > 1 {
+			t.Errorf("%s kept %d batches", nodeID, len(p.messagePool))
+		}
+		p.lock.Unlock()
+	}
+}
@@ -2,80 +2,355 @@ package fpbft
 
 import (
 	"crypto/rand"
-	"encoding/json"
-	"io/ioutil"
+	"crypto/tls"
+	"fmt"
 	"log"
 	"math/big"
-	"net"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
+// Time the client waits for the replies before it broadcasts the request to all replicas.
+const defaultRetransmitTimeout = 5 * time.Second
+
 type client struct {
-	clientAddr string
-	index      int //client ID for convenience purposes
-	bandwidth  float64
-	latency    float64
+	clientAddr        string
+	index             int //client ID for convenience purposes, the client signs as C<index>
+	bandwidth         float64
+	latency           float64
+	view              int                   //the latest view known to the client, used to find the primary node
+	validators        validatorSet          //voting power of the replicas, every node has the same power if not set
+	retransmitTimeout time.Duration         //time to wait for the replies before broadcasting the request, defaultRetransmitTimeout if not set
+	scheme            SignatureScheme       //signature scheme of the replicas, defaultSignatureScheme if not set
+	keys              map[string][]KeyEpoch //keys of the replicas: the key of their public key files, then the key changes the client had executed
+	verifiers         map[string]Verifier   //verifiers of the keys of the replicas, by fingerprint, parsed once
+	signer            Signer                //signs the requests of the client, read from its private key file
+	transport         Transport             //exchanges the messages with the replicas, over TCP if not set, kept from one request to the next
+	security          transportSecurity     //how the client connects to the replicas, plain TCP if not set
+	tlsCertificate    *tls.Certificate      //certificate of the client bound to its key, with mutual TLS
+	tlsVerifiers      map[string]Verifier   //verifiers of the certificates of the replicas, with mutual TLS
+	protocolVersion   int                   //highest version of the wire protocol the client speaks, currentProtocolVersion if not set
+	chainID           uint64                //chain ID of the network of the replicas
 }
 
-func (c *client) ClientSendMessageAndListen(nodeTable nodeTable, data string, numNodes int) float64 {
-	var wg sync.WaitGroup
-
-	//Start local monitoring of the client (mainly used to receive reply information from nodes).
-	go func() {
-		defer wg.Done()
-		c.clientTcpListen(numNodes)
-	}()
-
-	wg.Add(1) // Expect numNodes number of replies
+// The result of a request, accepted once replicas with more than 1/3 of the voting power sent matching replies
+// (more than 2/3 for read-only requests answered without ordering).
+type CommittedResult struct {
+	Result string
+	//The replicas rejected the request, and the result tells why
+	Rejected bool
+	//The replicas that sent the matching replies
+	NodeIDs []string
+}
 
+func (c *client) ClientSendMessageAndListen(nodeTable nodeTable, data string, numNodes int) (float64, CommittedResult) {
 	r := new(Request)
-	r.Timestamp = time.Now().UnixNano()
 	r.ClientAddr = c.clientAddr
 	r.Message.ID = getRandom()
 	//The message content is the user's input
 	r.Message.Content = strings.TrimSpace(data)
-	br, err := json.Marshal(r)
+	return c.sendAndListen(nodeTable, *r, numNodes)
+}
+
+// Send a read-only query, which the replicas answer from their committed state without ordering it.
+func (c *client) ClientQueryAndListen(nodeTable nodeTable, query Message, numNodes int) (float64, CommittedResult) {
+	r := Request{Message: query, ClientAddr: c.clientAddr, ReadOnly: true}
+	return c.sendAndListen(nodeTable, r, numNodes)
+}
+
+// Submit a change of the key of a validator, which the replicas order and execute like a request. Once it is executed
+// the client verifies the replies of the validator with its new key.
+func (c *client) ClientSubmitKeyChange(nodeTable nodeTable, kc KeyChange, numNodes int) (float64, CommittedResult) {
+	r := Request{Message: Message{Content: "key change of " + kc.NodeID, ID: getRandom()}, ClientAddr: c.clientAddr, KeyChange: &kc}
+	elapsed, result := c.sendAndListen(nodeTable, r, numNodes)
+	if !result.Rejected {
+		c.addKeyChange(kc)
+	}
+	return elapsed, result
+}
+
+// Submit a change of the allow-list of the clients, which the replicas order and execute like a request.
+func (c *client) ClientSubmitClientChange(nodeTable nodeTable, cc ClientChange, numNodes int) (float64, CommittedResult) {
+	r := Request{Message: Message{Content: "client change of " + cc.ClientID, ID: getRandom()}, ClientAddr: c.clientAddr, ClientChange: &cc}
+	return c.sendAndListen(nodeTable, r, numNodes)
+}
+
+func (c *client) sendAndListen(nodeTable nodeTable, r Request, numNodes int) (float64, CommittedResult) {
+	if c.validators == nil {
+		c.validators = equalValidatorSet(nodeTable)
+	}
+	if c.retransmitTimeout == 0 {
+		c.retransmitTimeout = defaultRetransmitTimeout
+	}
+	if c.scheme == "" {
+		c.scheme = defaultSignatureScheme
+	}
+	if c.keys == nil {
+		c.keys = make(map[string][]KeyEpoch)
+	}
+	if c.verifiers == nil {
+		c.verifiers = make(map[string]Verifier)
+	}
+	if c.signer == nil {
+		key, err := readPrivKey(string(c.scheme), clientName(c.index))
+		if err != nil {
+			log.Panic(err)
+		}
+		if c.signer, err = c.scheme.parseSigner(key); err != nil {
+			log.Panic(err)
+		}
+	}
+	if c.protocolVersion == 0 {
+		c.protocolVersion = currentProtocolVersion
+	}
+	if c.transport == nil {
+		c.transport = newTCPTransport(clientName(c.index), int(c.bandwidth*1024*1024/8), c.latency)
+	}
+	if c.security == transportMutualTLS && c.tlsCertificate == nil {
+		c.useMutualTLS(nodeTable)
+	}
+	r.Client = clientName(c.index)
+
+	//Start local monitoring of the client (mainly used to receive reply information from nodes).
+	messages, err := c.transport.Listen(c.clientAddr, c.wire())
 	if err != nil {
 		log.Panic(err)
 	}
-	//fmt.Println(string(br))
-	content := jointMessage(cRequest, br)
+	defer c.transport.Close()
+	replies := make(chan Reply)
+	done := make(chan bool)
+	defer close(done)
+	go c.receiveReplies(messages, replies, done)
+
 	currentTime := time.Now()
-	//N0 is the primary node, and the request information is sent directly to N0 by default
-	tcpDial(content, nodeTable["N0"], int(c.bandwidth*1024*1024/8), c.latency)
+	if r.ReadOnly {
+		r.Timestamp = time.Now().UnixNano()
+		c.sign(&r)
+		//The read-only request is sent to all replicas, which answer it immediately
+		c.transport.Broadcast(nodeTable.addrs(), c.wire().encode(r.Client, cReadOnly, r))
+		if result, ok := c.waitForReadOnlyResult(r, replies); ok {
+			return time.Since(currentTime).Seconds(), result
+		}
+		fmt.Println("The replies to the read-only request don't match, sending it as a regular request...")
+	}
+
+	//A new timestamp keeps the replies to the read-only request apart from the replies to the ordered one
+	r.Timestamp = time.Now().UnixNano()
+	c.sign(&r)
+	message := c.wire().encode(r.Client, cRequest, r)
+	//The primary node of view v is N(v mod n), and the request information is sent directly to it
+	primary := "N" + strconv.Itoa(c.view%numNodes)
+	c.transport.Send(nodeTable[primary], message)
 
-	wg.Wait() // Wait for all the replies before proceeding
+	result := c.waitForResult(nodeTable, r, message, replies) // Wait for enough matching replies before proceeding
 
-	return time.Since(currentTime).Seconds()
+	return time.Since(currentTime).Seconds(), result
 
 }
 
-// TCP listening from clinet side
-func (c *client) clientTcpListen(numNodes int) {
-	listen, err := net.Listen("tcp", c.clientAddr)
-	if err != nil {
-		log.Panic(err)
+// Wait until replicas with more than 1/3 of the voting power (f+1 replicas when every node has the same power)
+// sent the same signed result for the request, so at least one of them is honest. Whenever the replies take
+// longer than the retransmission timeout, the request is broadcast to all replicas, which forward it to the primary.
+func (c *client) waitForResult(nodeTable nodeTable, r Request, message *outgoing, replies <-chan Reply) CommittedResult {
+	//The replies received, corresponding according to the result and the node ID.
+	matching := make(map[string]map[string]Reply)
+	timer := time.NewTimer(c.retransmitTimeout)
+	defer timer.Stop()
+	for {
+		var reply Reply
+		select {
+		case reply = <-replies:
+		case <-timer.C:
+			fmt.Println("The client timed out waiting for the replies, broadcasting the request to all replicas...")
+			c.transport.Broadcast(nodeTable.addrs(), message)
+			timer.Reset(c.retransmitTimeout)
+			continue
+		}
+		if !c.addReply(matching, r, reply) {
+			continue
+		}
+		if c.validators.isWeakQuorum(c.matchingPower(matching, reply.Result)) {
+			return c.committedResult(matching, reply.Result)
+		}
 	}
-	defer listen.Close()
-	count := 0
+}
+
+// Wait until replicas with more than 2/3 of the voting power (2f+1 replicas when every node has the same power)
+// sent the same signed result for the read-only request. It fails when the replies can no longer match,
+// because the replicas answered from different states, or when they take longer than the retransmission timeout.
+func (c *client) waitForReadOnlyResult(r Request, replies <-chan Reply) (CommittedResult, bool) {
+	matching := make(map[string]map[string]Reply)
+	replied := make(map[string]bool)
+	timer := time.NewTimer(c.retransmitTimeout)
+	defer timer.Stop()
 	for {
-		conn, err := listen.Accept()
-		if err != nil {
-			log.Panic(err)
+		var reply Reply
+		select {
+		case reply = <-replies:
+		case <-timer.C:
+			return CommittedResult{}, false
 		}
-		b, err := ioutil.ReadAll(conn)
-		if err != nil {
-			log.Panic(err)
+		if replied[reply.NodeID] || !c.addReply(matching, r, reply) {
+			continue
 		}
-		//fmt.Println("client received" + string(b))
-		_ = b
-		count++
-		if count > numNodes/3*2 {
-			break
+		replied[reply.NodeID] = true
+		power := c.matchingPower(matching, reply.Result)
+		if c.validators.isQuorum(power) {
+			return c.committedResult(matching, reply.Result), true
 		}
+		//Even if every replica that has not replied yet sent the most common result, there would be no quorum
+		best := 0
+		for result := range matching {
+			if power := c.matchingPower(matching, result); power > best {
+				best = power
+			}
+		}
+		if !c.validators.isQuorum(best + c.validators.totalPower() - c.validators.votingPower(replied)) {
+			return CommittedResult{}, false
+		}
+	}
+}
+
+// Keep a signed reply to the request, corresponding according to its result and node ID.
+func (c *client) addReply(matching map[string]map[string]Reply, r Request, reply Reply) bool {
+	if reply.Timestamp != r.Timestamp || reply.ClientID != r.ClientAddr {
+		//A reply to another request
+		return false
+	}
+	if _, ok := c.validators[reply.NodeID]; !ok || !c.verifyReply(reply) {
+		fmt.Println("The reply signature verification failed! Refusing the reply")
+		return false
+	}
+	if _, ok := matching[reply.Result]; !ok {
+		matching[reply.Result] = make(map[string]Reply)
+	}
+	matching[reply.Result][reply.NodeID] = reply
+	return true
+}
+
+// Voting power of the replicas that replied with the result.
+func (c *client) matchingPower(matching map[string]map[string]Reply, result string) int {
+	nodes := make(map[string]bool)
+	for nodeID := range matching[result] {
+		nodes[nodeID] = true
+	}
+	return c.validators.votingPower(nodes)
+}
+
+func (c *client) committedResult(matching map[string]map[string]Reply, result string) CommittedResult {
+	committed := CommittedResult{Result: result}
+	for nodeID, reply := range matching[result] {
+		committed.NodeIDs = append(committed.NodeIDs, nodeID)
+		committed.Rejected = reply.Rejected
+		//Keep track of the view so that the next request is sent to the current primary
+		if reply.View > c.view {
+			c.view = reply.View
+		}
+	}
+	sort.Strings(committed.NodeIDs)
+	return committed
+}
+
+// Pass on the replies the transport receives until the client is done with the request. The connections of the
+// replicas are closed then, and they connect again for the replies to the next request.
+func (c *client) receiveReplies(messages <-chan received, replies chan<- Reply, done <-chan bool) {
+	for {
+		var m received
+		select {
+		case m = <-messages:
+		case <-done:
+			return
+		}
+		e, err := parseMessage(m.message)
+		if err != nil || e.Command != cReply || c.wire().check(e, m.version) != nil {
+			continue
+		}
+		reply := new(Reply)
+		if err := decodeMessage(e.Payload, reply); err != nil {
+			fmt.Println("The reply could not be parsed, refusing the reply")
+			continue
+		}
+		select {
+		case replies <- *reply:
+		case <-done:
+			return
+		}
+	}
+}
+
+// The wire protocol of the client, the one of the replicas unless it is configured otherwise.
+func (c *client) wire() wireProtocol {
+	return wireProtocol{version: c.protocolVersion, chainID: c.chainID}
+}
+
+// Sign the request with the private key of the client.
+func (c *client) sign(r *Request) {
+	r.Sign = nil
+	sign, err := c.signer.Sign(r.signContent())
+	if err != nil {
+		log.Panic(err)
+	}
+	r.Sign = sign
+}
+
+// Verify the signature of a reply with the latest key of the replica that sent it. The key a rotation replaced is
+// accepted until the replica signs with its new key, as the client doesn't know when the replica executes up to it.
+// A revoked key is never accepted again.
+func (c *client) verifyReply(reply Reply) bool {
+	epochs, err := c.keyEpochsOf(reply.NodeID)
+	if err != nil {
+		return false
+	}
+	latest := epochs[len(epochs)-1]
+	if c.verifyWith(latest.PublicKey, reply) {
+		//The replica has moved to its latest key, the keys it replaced are not accepted any more
+		c.keys[reply.NodeID] = []KeyEpoch{latest}
+		return true
+	}
+	return len(epochs) > 1 && !latest.Revocation && c.verifyWith(epochs[len(epochs)-2].PublicKey, reply)
+}
+
+// The keys of the replica the client knows of, starting with the key of its public key file.
+func (c *client) keyEpochsOf(nodeID string) ([]KeyEpoch, error) {
+	if epochs, ok := c.keys[nodeID]; ok {
+		return epochs, nil
+	}
+	pubkey, err := readPubKey(string(c.scheme), nodeID)
+	if err != nil {
+		return nil, err
+	}
+	c.keys[nodeID] = []KeyEpoch{{NodeID: nodeID, PublicKey: pubkey}}
+	return c.keys[nodeID], nil
+}
+
+func (c *client) verifyWith(pubkey []byte, reply Reply) bool {
+	if len(pubkey) == 0 {
+		//A revocation left the replica without a key
+		return false
+	}
+	fingerprint := keyFingerprint(pubkey)
+	v, ok := c.verifiers[fingerprint]
+	if !ok {
+		var err error
+		if v, err = c.scheme.parseVerifier(pubkey); err != nil {
+			return false
+		}
+		c.verifiers[fingerprint] = v
+	}
+	return v.Verify(reply.signContent(), reply.Sign)
+}
+
+// Add the key change the replicas executed to the keys of its validator. A key change ordered by another client is not
+// known to the client, which refuses the replies signed with the new key and waits for the replies of the other replicas.
+func (c *client) addKeyChange(kc KeyChange) {
+	epochs, err := c.keyEpochsOf(kc.NodeID)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	c.keys[kc.NodeID] = append(epochs, KeyEpoch{NodeID: kc.NodeID, From: kc.EffectiveSequenceID, PublicKey: kc.PublicKey, Revocation: kc.Revocation})
 }
 
 // Returns a ten-digit random number as msgid
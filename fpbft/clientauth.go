@@ -0,0 +1,205 @@
+package fpbft
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"proof-of-training/keystore"
+)
+
+// An application that restricts what the clients may request, beyond the signature and the allow-list the replicas check.
+// Authorize is called with requests whose client is authenticated, before they are ordered and again when they are
+// executed, against the state at that time. It must be deterministic and must not modify the state.
+type Authorizer interface {
+	Authorize(r Request) error
+}
+
+// The client ID of the client with the index, the name of its key files in the 'Keys' directory.
+func clientName(index int) string {
+	return "C" + strconv.Itoa(index)
+}
+
+// Generate the key files of the scheme for the clients C1 to Cn that don't have them yet.
+func genClientKeys(scheme SignatureScheme, numClients int) {
+	for i := 1; i <= numClients; i++ {
+		clientID := clientName(i)
+		if keystore.DefaultStore.Has(clientID, string(scheme)) {
+			continue
+		}
+		priv, pub, err := scheme.generateKey()
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := writeKeyPair(string(scheme), clientID, priv, pub); err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("the %s public and private keys of the client %s have been generated\n", scheme, clientID)
+	}
+}
+
+// Only the listed clients may send requests to the network it starts with. Like the validator set, every replica
+// must be configured with the same allow-list, which only ordered client changes modify afterwards. Without an
+// allow-list every client whose public key file the node can read may send requests.
+func (p *pbft) setAllowedClients(clientIDs ...string) {
+	p.allowedClients = make(map[string]bool)
+	for _, clientID := range clientIDs {
+		p.allowedClients[clientID] = true
+	}
+}
+
+// The allowed clients in the order of their IDs, nil if any client is allowed.
+func (p *pbft) allowedClientList() []string {
+	if p.allowedClients == nil {
+		return nil
+	}
+	clientIDs := make([]string, 0, len(p.allowedClients))
+	for clientID, allowed := range p.allowedClients {
+		if allowed {
+			clientIDs = append(clientIDs, clientID)
+		}
+	}
+	sort.Strings(clientIDs)
+	return clientIDs
+}
+
+// The verifier of the signatures of the client, read from its public key file once.
+func (p *pbft) clientVerifier(clientID string) (Verifier, error) {
+	if v, ok := p.clientVerifiers[clientID]; ok {
+		return v, nil
+	}
+	key, err := readPubKey(string(p.scheme), clientID)
+	if err != nil {
+		return nil, err
+	}
+	v, err := p.scheme.parseVerifier(key)
+	if err != nil {
+		return nil, err
+	}
+	p.clientVerifiers[clientID] = v
+	return v, nil
+}
+
+// The public key of the client can't be read by this node, which doesn't tell whether the request is signed.
+var errUnknownClient = errors.New("the public key of the client can't be read")
+
+// Check that the request is signed by its client. A request carrying a DKG message is signed by the validator that
+// sent the message. Only a missing or invalid signature proves that the primary ordered a request it should not have,
+// a node that can't read the public key of the client returns errUnknownClient.
+func (p *pbft) authenticateRequest(r Request) error {
+	if r.Client == "" || len(r.Sign) == 0 {
+		return errors.New("the request is not signed")
+	}
+	if r.DKG != nil {
+		return p.checkDKGRequest(r)
+	}
+	v, err := p.clientVerifier(r.Client)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errUnknownClient, r.Client)
+	}
+	if !v.Verify(r.signContent(), r.Sign) {
+		return fmt.Errorf("the signature of %s doesn't verify", r.Client)
+	}
+	return nil
+}
+
+// Check that the client is allowed to send requests, and ask the application whether it may make the request.
+// Both are part of the replicated state, so the replicas agree on the check when they execute the request.
+// Key changes, client changes and DKG messages are not requests of the application.
+func (p *pbft) authorizeRequest(r Request) error {
+	if r.DKG != nil {
+		return nil
+	}
+	if p.allowedClients != nil && !p.allowedClients[r.Client] {
+		return fmt.Errorf("%s is not allowed to send requests", r.Client)
+	}
+	if r.KeyChange != nil || r.ClientChange != nil {
+		return nil
+	}
+	if a, ok := p.app.(Authorizer); ok {
+		return a.Authorize(r)
+	}
+	return nil
+}
+
+// The result of a rejected request, which the replicas reply with.
+func rejectedResult(err error) string {
+	return "request rejected: " + err.Error()
+}
+
+// Answer a request that is not ordered with a signed error reply. The reply is not kept as the last reply to the client,
+// as the request is not executed.
+func (p *pbft) rejectRequest(r Request, err error) {
+	fmt.Printf("The request of %s is rejected: %v\n", r.ClientAddr, err)
+	reply := Reply{View: p.view, Timestamp: r.Timestamp, ClientID: r.ClientAddr, Client: r.Client, NodeID: p.node.nodeID, Result: rejectedResult(err), Rejected: true}
+	reply.Sign = p.sign(reply.signContent())
+	p.sendReply(reply)
+}
+
+// A change of the allow-list, to be approved by the validators, numbered after the client changes this node executed.
+func (p *pbft) newClientChange(clientID string, allowed bool) ClientChange {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return ClientChange{ClientID: clientID, Allowed: allowed, Version: p.clientChanges}
+}
+
+// Approve a change of the allow-list.
+func (p *pbft) approveClientChange(cc ClientChange) ClientChange {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	cc.Approvals = append(cc.Approvals, KeyApproval{NodeID: p.node.nodeID, Sign: p.sign(cc.signContent())})
+	return cc
+}
+
+// Check a client change against the allow-list and the keys of the validators after the last executed request.
+func (p *pbft) checkClientChange(cc ClientChange) error {
+	if p.allowedClients == nil {
+		return errors.New("the network has no allow-list, every client is allowed")
+	}
+	if cc.ClientID == "" {
+		return errors.New("the change names no client")
+	}
+	if cc.Version != p.clientChanges {
+		return fmt.Errorf("the change follows %d client changes, not %d", cc.Version, p.clientChanges)
+	}
+	approvers := make(map[string]bool)
+	for _, a := range cc.Approvals {
+		if approvers[a.NodeID] {
+			return fmt.Errorf("the approval of %s is counted twice", a.NodeID)
+		}
+		if err := p.verifySignature(a.NodeID, cc.signContent(), a.Sign); err != nil {
+			return fmt.Errorf("the approval of %s is not valid: %v", a.NodeID, err)
+		}
+		approvers[a.NodeID] = true
+	}
+	if power := p.validators.votingPower(approvers); !p.validators.isQuorum(power) {
+		return fmt.Errorf("the approvals carry %d of the %d voting power", power, p.validators.totalPower())
+	}
+	return nil
+}
+
+// Execute a client change ordered after the last executed request, and return its result for the client.
+func (p *pbft) executeClientChange(cc ClientChange) string {
+	if err := p.checkClientChange(cc); err != nil {
+		fmt.Printf("The client change of %s is rejected: %v\n", cc.ClientID, err)
+		return "client change rejected: " + err.Error()
+	}
+	p.clientChanges++
+	if cc.Allowed {
+		p.allowedClients[cc.ClientID] = true
+		return fmt.Sprintf("%s is allowed to send requests", cc.ClientID)
+	}
+	delete(p.allowedClients, cc.ClientID)
+	return fmt.Sprintf("%s is not allowed to send requests any more", cc.ClientID)
+}
+
+// Replace the allow-list with the one of a fetched state.
+func (p *pbft) setAllowedClientList(clientIDs []string, clientChanges int) {
+	p.allowedClients = nil
+	if clientIDs != nil {
+		p.setAllowedClients(clientIDs...)
+	}
+	p.clientChanges = clientChanges
+}
@@ -0,0 +1,90 @@
+package fpbft
+
+import (
+	"errors"
+	"testing"
+)
+
+// A request of the client C1 signed with its key file.
+func signedRequest(t *testing.T, content string) Request {
+	t.Helper()
+	key, err := readPrivKey(string(defaultSignatureScheme), "C1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := defaultSignatureScheme.parseSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Request{Message: Message{Content: content, ID: 1}, Timestamp: 1, ClientAddr: "memory/C1", Client: "C1"}
+	if r.Sign, err = signer.Sign(r.signContent()); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// The pre-prepare of the batch signed by the primary of view 0.
+func signedPrePrepare(primary *pbft, sequenceID int, batch ...Request) *PrePrepare {
+	pp := &PrePrepare{RequestBatch: batch, Digest: getBatchDigest(batch), SequenceID: sequenceID}
+	pp.Sign = primary.sign(voteSignContent(cPrePrepare, pp.View, pp.SequenceID, pp.Digest))
+	return pp
+}
+
+// A backup blames the primary for a request with an invalid signature, but neither for a client whose key it can't
+// read nor for a client missing from its allow-list, which is checked when the request is executed.
+func TestPrePrepareBlamesOnlyInvalidClientSignatures(t *testing.T) {
+	nodes := idleCluster(t)
+	genClientKeys(defaultSignatureScheme, 1)
+	primary, backup := nodes["N0"], nodes["N1"]
+	backup.setAllowedClients("C2")
+
+	if err := backup.processPrePrepare(signedPrePrepare(primary, 1, signedRequest(t, "allowed later"))); err != nil {
+		t.Fatalf("a request of a client missing from the allow-list was blamed on the primary: %v", err)
+	}
+	unknown := signedRequest(t, "unknown key")
+	unknown.Client = "C9"
+	if err := backup.processPrePrepare(signedPrePrepare(primary, 2, unknown)); err != nil {
+		t.Fatalf("a request of a client whose key the backup can't read was blamed on the primary: %v", err)
+	}
+	forged := signedRequest(t, "forged")
+	forged.Content = "forged by the primary"
+	err := backup.processPrePrepare(signedPrePrepare(primary, 3, forged))
+	var r *rejection
+	if !errors.As(err, &r) || r.signer != "N0" {
+		t.Fatalf("a request with an invalid signature was not blamed on the primary: %v", err)
+	}
+}
+
+// The allow-list is changed by client changes approved by a quorum of the validators, which can't be replayed,
+// and it is part of the state digest.
+func TestClientChangeApproval(t *testing.T) {
+	nodes := idleCluster(t)
+	for _, p := range nodes {
+		p.setAllowedClients("C1")
+	}
+	p := nodes["N0"]
+	r := Request{Client: "C2"}
+	if err := p.authorizeRequest(r); err == nil {
+		t.Fatal("a client missing from the allow-list was authorized")
+	}
+	before := p.currentStateDigest()
+	cc := p.newClientChange("C2", true)
+	for _, nodeID := range []string{"N0", "N1", "N2"} {
+		if err := p.checkClientChange(cc); err == nil {
+			t.Fatalf("a client change approved by %d validators was accepted", len(cc.Approvals))
+		}
+		cc = nodes[nodeID].approveClientChange(cc)
+	}
+	if result := p.executeClientChange(cc); result != "C2 is allowed to send requests" {
+		t.Fatal(result)
+	}
+	if err := p.authorizeRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if p.currentStateDigest() == before {
+		t.Fatal("the allow-list is not part of the state digest")
+	}
+	if err := p.checkClientChange(cc); err == nil {
+		t.Fatal("a client change was replayed")
+	}
+}
@@ -4,49 +4,293 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
+
+	"github.com/coinbase/kryptology/pkg/paillier"
+	"github.com/coinbase/kryptology/pkg/tecdsa/gg20/dealer"
+	"github.com/coinbase/kryptology/pkg/tecdsa/gg20/proof"
 )
 
 // Node table for broadcasting
 type nodeTable map[string]string
 
+// The addresses of the nodes.
+func (t nodeTable) addrs() []string {
+	addrs := make([]string, 0, len(t))
+	for _, addr := range t {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
 // <REQUEST,o,t,c>
 type Request struct {
 	Message
 	Timestamp int64
 	//相当于clientID
 	ClientAddr string
+	//ID of the client signing the request, which names its key files
+	Client string
+	//Read-only requests do not modify the state, they are answered with the result of a query
+	ReadOnly bool
+	//A change of the key of a validator, executed by the replicas instead of the application
+	KeyChange *KeyChange `json:",omitempty"`
+	//A message of a DKG session, sent by the validator signing the request and executed by the replicas
+	DKG *DKGMessage `json:",omitempty"`
+	//A change of the allow-list of the clients, executed by the replicas instead of the application
+	ClientChange *ClientChange `json:",omitempty"`
+	//Signature of the client over the request
+	Sign []byte
+}
+
+// <KEY-CHANGE,i,k,e,r>: the validator i signs with the public key k from the sequence number e on, instead of the key r.
+// A rotation is signed by the key r, and a revocation, for a key r that may be compromised, is approved by the other
+// validators with more than 2/3 of their voting power and takes effect at once. The new key signs the change as well.
+type KeyChange struct {
+	NodeID string
+	//PEM public key of the signature scheme, empty for a revocation leaving the validator without a key
+	PublicKey []byte
+	//Sequence number the new key of a rotation takes effect at
+	EffectiveSequenceID int
+	//Fingerprint of the latest key of the validator, which the change replaces
+	ReplacedKey string
+	Revocation  bool
+	Sign        []byte
+	NewKeySign  []byte
+	Approvals   []KeyApproval
+}
+
+// The approval of a revocation or of a client change by a validator, signing the change.
+type KeyApproval struct {
+	NodeID string
+	Sign   []byte
+}
+
+// <CLIENT-CHANGE,c,a,k>: the client c is allowed to send requests from now on if a is set, and not any more otherwise.
+// k is the number of client changes the network executed before, so that the change can't be replayed. It is approved
+// by the validators with more than 2/3 of the voting power.
+type ClientChange struct {
+	ClientID  string
+	Allowed   bool
+	Version   int
+	Approvals []KeyApproval
 }
 
-// <<PRE-PREPARE,v,n,d>,m>
+// <<PRE-PREPARE,v,n,d>,m>, where m is a batch of requests and d is the batch digest
 type PrePrepare struct {
-	RequestMessage Request
-	Digest         string
-	SequenceID     int
-	Sign           []byte
+	RequestBatch []Request
+	Digest       string
+	View         int
+	SequenceID   int
+	Sign         []byte
 }
 
 // <PREPARE,v,n,d,i>
 type Prepare struct {
 	Digest     string
+	View       int
 	SequenceID int
 	NodeID     string
 	Sign       []byte
+	//The MACs of the vote for the other nodes, instead of the signature in the MAC mode
+	Authenticator map[string][]byte `json:",omitempty"`
 }
 
 // <COMMIT,v,n,D(m),i>
 type Commit struct {
 	Digest     string
+	View       int
 	SequenceID int
 	NodeID     string
 	Sign       []byte
+	//The MACs of the vote for the other nodes, instead of the signature in the MAC mode
+	Authenticator map[string][]byte `json:",omitempty"`
 }
 
-// <REPLY,v,t,c,i,r>
-type Reply struct {
-	MessageID int
+// A pre-prepare together with matching prepares from different backups, carrying more than 2/3 of the voting power,
+// proving that the request was prepared at sequence number n in view v.
+// In the quorum certificate mode the prepares are replaced by the prepare quorum certificate, and in the MAC mode,
+// where the prepares can't convince other nodes, the certificate is only a claim of the node that prepared.
+type PreparedCert struct {
+	PrePrepare  PrePrepare
+	Prepares    []Prepare
+	PrepareCert *QuorumCert `json:",omitempty"`
+}
+
+// <PHASE,v,n,d> signed by the nodes of the signer bitmap, whose BLS signatures are aggregated into one.
+// Bit i%8 of byte i/8 of the bitmap stands for the node Ni.
+type QuorumCert struct {
+	//The phase of the votes, prepare or commit
+	Phase      command
+	View       int
+	SequenceID int
+	Digest     string
+	Signers    []byte
+	Sign       []byte
+}
+
+// <CHECKPOINT,n,d,i>
+type Checkpoint struct {
+	SequenceID int
+	//Digest of the state after executing the requests up to the sequence number
+	StateDigest string
+	NodeID      string
+	Sign        []byte
+}
+
+// <VIEW-CHANGE,v+1,n,C,P,i>
+type ViewChange struct {
+	NewView int
+	//Sequence number of the last stable checkpoint
+	StableSequenceID int
+	//A quorum of checkpoint messages proving the stable checkpoint
+	CheckpointProof []Checkpoint
+	//Prepared certificates for requests with sequence numbers higher than the stable checkpoint
+	PreparedSet []PreparedCert
+	//In the MAC mode, the latest pre-prepare accepted for every batch and sequence number higher than the stable checkpoint
+	PrePreparedSet []PrePrepare `json:",omitempty"`
+	NodeID         string
+	Sign           []byte
+}
+
+// <NEW-VIEW,v+1,V,O>
+type NewView struct {
+	View int
+	//The quorum of view-change messages received by the new primary
+	ViewChanges []ViewChange
+	//Pre-prepares re-proposing the prepared requests in the new view
+	PrePrepares []PrePrepare
+	NodeID      string
+	Sign        []byte
+}
+
+// Request of a lagging node for the state at a stable checkpoint it has not reached.
+type FetchState struct {
+	SequenceID int
+	NodeID     string
+}
+
+// A pre-prepare sent down the dissemination tree, every node relaying it to its children. The primary signs the tree
+// and the fanout, so a relay can withhold the pre-prepare from its subtree, to whose nodes the primary then sends it
+// directly, but can't redirect it or make the other nodes send more copies.
+type TreePrePrepare struct {
+	PrePrepare PrePrepare
+	//The node IDs in the order of the tree, the primary first: the children of the i-th node are the nodes Fanout*i+1 to Fanout*i+Fanout
+	Tree   []string
+	Fanout int
+	Sign   []byte
+}
+
+// The state of a node at its stable checkpoint, sent to a lagging node. It is not signed,
+// as the lagging node checks it against the state digest of the checkpoint proof.
+type StateSnapshot struct {
+	SequenceID int
+	//Snapshot of the application state
+	AppState []byte
+	//The last reply sent to every client, in the order of the client IDs
+	LastReplies []Reply
+	//The key changes of the validators, in the order of the node IDs
+	ValidatorKeys []KeyEpoch
+	//The clients allowed to send requests in the order of their IDs, any client if nil, and the number of client changes executed
+	AllowedClients  []string
+	ClientChanges   int
+	CheckpointProof []Checkpoint
+	NodeID          string
+}
+
+// <DKG-DEAL,s,i,C,E>: the commitments of the dealer i to the coefficients of its secret polynomial in the DKG session s,
+// and the share of every other node, encrypted under the session key the dealer shares with that node.
+type DKGDeal struct {
+	Session     string
+	Dealer      string
+	Commitments [][]byte
+	Shares      map[string][]byte
+	Sign        []byte
+}
+
+// <DKG-COMPLAINT,s,i,D>: the dealers whose share the node i couldn't verify against their commitments.
+// Every node sends one, with no dealer if it has no complaint.
+type DKGComplaint struct {
+	Session string
+	NodeID  string
+	Dealers []string
+	Sign    []byte
+}
+
+// <DKG-JUSTIFICATION,s,i,S>: the answer of the dealer i to the complaints against it, the plaintext shares of the nodes
+// that complained.
+type DKGJustification struct {
+	Session string
+	Dealer  string
+	Shares  map[string][]byte
+	Sign    []byte
+}
+
+// <DKG-PHASE-END,s,p,i>: the node i votes to end the phase p of the DKG session s, which has lasted long enough for it.
+// It is not signed itself, only the request carrying it.
+type DKGPhaseEnd struct {
+	Session string
+	Phase   int
+	NodeID  string
+}
+
+// A message of a DKG session, carried by a request of the validator that sent it, so that the messages are ordered and
+// every node computes the key from the same ones. Exactly one of the messages is set.
+type DKGMessage struct {
+	Deal          *DKGDeal          `json:",omitempty"`
+	Complaint     *DKGComplaint     `json:",omitempty"`
+	Justification *DKGJustification `json:",omitempty"`
+	PhaseEnd      *DKGPhaseEnd      `json:",omitempty"`
+}
+
+// <TECDSA-SETUP,s,i,pk,N~,h1,h2,π>: the Paillier key pk of the node i and the parameters of its range proofs, for threshold
+// ECDSA signatures with the key of the DKG session s, with the proofs that h1 and h2 generate the same group and that
+// the Paillier modulus is square-free.
+type TECDSASetup struct {
+	Session     string
+	NodeID      string
+	PaillierKey *paillier.PublicKey
+	ProofParams *dealer.ProofParams
+	CDLProofs   []*proof.CdlProof
+	PSFProof    paillier.PsfProof
+	Sign        []byte
+}
+
+// <TECDSA-SIGN,h,a,r,i,B,P>: the messages of the cosigner i in the round r of the attempt a to sign the transaction hash h,
+// its broadcast B and the messages P to every other cosigner, corresponding according to the node ID.
+type TECDSASignRound struct {
+	Session string
+	Attempt int
+	Round   int
+	NodeID  string
+	Bcast   json.RawMessage            `json:",omitempty"`
+	P2P     map[string]json.RawMessage `json:",omitempty"`
+	Sign    []byte
+}
+
+// <TECDSA-SIGNATURE,h,a,i,σ>: the threshold signature σ of the transaction hash h that the cosigner i assembled in the attempt a,
+// signed by the cosigner. σ verifies with the committee key.
+type TECDSASignature struct {
+	Session   string
+	Attempt   int
 	NodeID    string
-	Result    bool
+	Signature []byte
+	Sign      []byte
+}
+
+// <REPLY,v,t,c,i,r>, signed by the replica i
+type Reply struct {
+	View      int
+	Timestamp int64
+	ClientID  string
+	//ID of the client that signed the request
+	Client string
+	NodeID string
+	Result string
+	//The request was rejected, and the result tells why
+	Rejected bool
+	Sign     []byte
 }
 
 type Message struct {
@@ -59,10 +303,22 @@ const prefixCMDLength = 12
 type command string
 
 const (
-	cRequest    command = "request"
-	cPrePrepare command = "preprepare"
-	cPrepare    command = "prepare"
-	cCommit     command = "commit"
+	cRequest        command = "request"
+	cPrePrepare     command = "preprepare"
+	cPrepare        command = "prepare"
+	cCommit         command = "commit"
+	cViewChange     command = "viewchange"
+	cNewView        command = "newview"
+	cCheckpoint     command = "checkpoint"
+	cReply          command = "reply"
+	cReadOnly       command = "readonly"
+	cFetchState     command = "fetchstate"
+	cStateSnapshot  command = "snapshot"
+	cQuorumCert     command = "quorumcert"
+	cTECDSASetup    command = "tecdsasetup"
+	cTECDSASign     command = "tecdsasign"
+	cTECDSASig      command = "tecdsasig"
+	cTreePrePrepare command = "treepreprep"
 )
 
 // Join command and content in bytes.
@@ -78,8 +334,12 @@ func jointMessage(cmd command, content []byte) []byte {
 }
 
 // Split command and content in bytes.
-// The default first twelve bytes are the command name.
-func splitMessage(message []byte) (cmd string, content []byte) {
+// The default first twelve bytes are the command name, a shorter message is malformed.
+func splitMessage(message []byte) (cmd string, content []byte, err error) {
+	if len(message) < prefixCMDLength {
+		err = fmt.Errorf("the message is %d bytes long, shorter than the command", len(message))
+		return
+	}
 	cmdBytes := message[:prefixCMDLength]
 	newCMDBytes := make([]byte, 0)
 	for _, v := range cmdBytes {
@@ -92,6 +352,176 @@ func splitMessage(message []byte) (cmd string, content []byte) {
 	return
 }
 
+// Content signed by the nodes for pre-prepare, prepare and commit messages: <phase,v,n,d>.
+func voteSignContent(phase command, view, sequenceID int, digest string) []byte {
+	return []byte(fmt.Sprintf("%s:%d:%d:%s", phase, view, sequenceID, digest))
+}
+
+// Content signed by the primary for the dissemination tree of a pre-prepare, bound to its instance and batch.
+func (t TreePrePrepare) signContent() []byte {
+	tree, err := json.Marshal(t.Tree)
+	if err != nil {
+		log.Panic(err)
+	}
+	pp := t.PrePrepare
+	return []byte(fmt.Sprintf("%s:%d:%d:%s:%d:%s", cTreePrePrepare, pp.View, pp.SequenceID, pp.Digest, t.Fanout, tree))
+}
+
+// Content signed by the nodes for checkpoint messages, the message with its signature cleared.
+func (c Checkpoint) signContent() []byte {
+	c.Sign = nil
+	b, err := json.Marshal(c)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the nodes for view-change messages, the message with its signature cleared.
+func (vc ViewChange) signContent() []byte {
+	vc.Sign = nil
+	b, err := json.Marshal(vc)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the new primary for new-view messages, the message with its signature cleared.
+func (nv NewView) signContent() []byte {
+	nv.Sign = nil
+	b, err := json.Marshal(nv)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the dealers for DKG deal messages, the message with its signature cleared.
+func (d DKGDeal) signContent() []byte {
+	d.Sign = nil
+	b, err := json.Marshal(d)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the nodes for DKG complaint messages, the message with its signature cleared.
+func (c DKGComplaint) signContent() []byte {
+	c.Sign = nil
+	b, err := json.Marshal(c)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the dealers for DKG justification messages, the message with its signature cleared.
+func (j DKGJustification) signContent() []byte {
+	j.Sign = nil
+	b, err := json.Marshal(j)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the nodes for threshold ECDSA setup messages, the message with its signature cleared.
+func (s TECDSASetup) signContent() []byte {
+	s.Sign = nil
+	b, err := json.Marshal(s)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the cosigners for threshold ECDSA signing messages, the message with its signature cleared.
+func (m TECDSASignRound) signContent() []byte {
+	m.Sign = nil
+	b, err := json.Marshal(m)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the cosigners for threshold ECDSA signature messages, the message with its signature cleared.
+func (ts TECDSASignature) signContent() []byte {
+	ts.Sign = nil
+	b, err := json.Marshal(ts)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed for key changes, by the validator, the new key and the approving validators: the change without its signatures.
+func (kc KeyChange) signContent() []byte {
+	kc.Sign, kc.NewKeySign, kc.Approvals = nil, nil, nil
+	b, err := json.Marshal(kc)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the approving validators for client changes, the change without its approvals.
+func (cc ClientChange) signContent() []byte {
+	cc.Approvals = nil
+	b, err := json.Marshal(cc)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the clients for requests, the request with its signature cleared.
+func (r Request) signContent() []byte {
+	r.Sign = nil
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// Content signed by the replicas for reply messages, the message with its signature cleared.
+func (r Reply) signContent() []byte {
+	r.Sign = nil
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// The batch holding only the null request, proposed for sequence numbers left empty by a view change.
+// The null request carries the sequence number as its timestamp so that the batch digest is unique.
+func nullBatch(sequenceID int) []Request {
+	return []Request{{Timestamp: int64(sequenceID)}}
+}
+
+// Whether the request is a null request, which is never executed or replied to.
+func (r Request) isNull() bool {
+	return r.ClientAddr == ""
+}
+
+// get the hash of a batch of requests, covering the digests of the requests in their order
+func getBatchDigest(batch []Request) string {
+	digests := make([]string, 0, len(batch))
+	for _, r := range batch {
+		digests = append(digests, getDigest(r))
+	}
+	b, err := json.Marshal(digests)
+	if err != nil {
+		log.Panic(err)
+	}
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
+
 // get message hash (ID)
 func getDigest(request Request) string {
 	b, err := json.Marshal(request)
@@ -0,0 +1,154 @@
+package fpbft
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// How the primary sends its pre-prepares, which carry the whole batch, to the other nodes. The votes are always sent directly.
+type dissemination int
+
+const (
+	//The primary sends every pre-prepare to every node itself
+	disseminateDirect dissemination = iota
+	//The pre-prepares go down a k-ary tree rooted at the primary, every node relaying them to its children, so the
+	//uplink of the primary carries k copies of a batch instead of one per node
+	disseminateTree
+)
+
+// Children of a node in the dissemination tree.
+const defaultTreeFanout = 3
+
+// Time the primary waits for the prepares of a batch sent down the tree before it sends the batch directly to the nodes
+// that have not prepared it. It must leave the batch the time to go down the tree.
+const defaultDisseminationTimeout = 5 * time.Second
+
+// Send the pre-prepares with the dissemination, down a tree with the fanout, or defaultTreeFanout if it is 0. All the
+// nodes of a network use the same dissemination.
+func (p *pbft) setDissemination(d dissemination, fanout int) {
+	p.dissemination = d
+	if fanout <= 0 {
+		fanout = defaultTreeFanout
+	}
+	p.treeFanout = fanout
+}
+
+// The order of the tree of the sequence number, the primary first. The relays rotate from one sequence number to the
+// next, so no node relays every batch, and the nodes that didn't prepare the last instance the primary executed are
+// moved to the leaves. The tree is rebuilt this way for every batch, around the nodes that are down or too slow.
+func (p *pbft) disseminationTree(sequenceID int) []string {
+	others := make([]string, 0, len(p.nodeTable)-1)
+	for nodeID := range p.nodeTable {
+		if nodeID != p.node.nodeID {
+			others = append(others, nodeID)
+		}
+	}
+	sort.Strings(others)
+	if len(others) > 0 {
+		shift := sequenceID % len(others)
+		others = append(others[shift:], others[:shift]...)
+	}
+	if prepared, ok := p.preparePool[instanceKey{p.view, p.lastExecuted}]; ok {
+		sort.SliceStable(others, func(i, j int) bool {
+			_, iPrepared := prepared[others[i]]
+			_, jPrepared := prepared[others[j]]
+			return iPrepared && !jPrepared
+		})
+	}
+	return append([]string{p.node.nodeID}, others...)
+}
+
+// The primary signs the tree and sends the pre-prepare to its children in it, and to the nodes it has not reached once
+// the dissemination timeout has passed.
+func (p *pbft) disseminatePrePrepare(pp PrePrepare) {
+	t := TreePrePrepare{PrePrepare: pp, Tree: p.disseminationTree(pp.SequenceID), Fanout: p.treeFanout}
+	t.Sign = p.sign(t.signContent())
+	fmt.Printf("Sending PrePrepare down the dissemination tree with fanout %d...\n", t.Fanout)
+	p.relayPrePrepare(t)
+	p.scheduleRepair(instanceKey{pp.View, pp.SequenceID})
+}
+
+// Repair the dissemination of the instance once the timeout has passed. The batch is sent directly only once, a node
+// that still misses it catches up with the state transfer at the next stable checkpoint.
+func (p *pbft) scheduleRepair(key instanceKey) {
+	time.AfterFunc(p.disseminationTimeout, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.repairDissemination(key)
+	})
+}
+
+// Send the pre-prepare to the children of this node in the tree, with the fanout the node is configured with, once per
+// instance.
+func (p *pbft) relayPrePrepare(t TreePrePrepare) {
+	key := instanceKey{t.PrePrepare.View, t.PrePrepare.SequenceID}
+	if _, ok := p.relayedPrePrepares[key]; ok {
+		return
+	}
+	p.relayedPrePrepares[key] = true
+	index := 0
+	for i, nodeID := range t.Tree {
+		if nodeID == p.node.nodeID {
+			index = i
+		}
+	}
+	addrs := make([]string, 0, p.treeFanout)
+	for i := p.treeFanout*index + 1; i <= p.treeFanout*index+p.treeFanout && i < len(t.Tree); i++ {
+		addrs = append(addrs, p.nodeTable[t.Tree[i]])
+	}
+	if len(addrs) > 0 {
+		p.transport.Broadcast(addrs, p.wire.encode(p.node.nodeID, cTreePrePrepare, t))
+	}
+}
+
+// Handle a pre-prepare received down the tree, and relay it once it passed the validation.
+func (p *pbft) handleTreePrePrepare(content []byte) error {
+	t := new(TreePrePrepare)
+	if err := decodeMessage(content, t); err != nil {
+		return err
+	}
+	if t.Fanout != p.treeFanout || len(t.Tree) != len(p.nodeTable) {
+		return reject(reasonInvalidMessage, "a dissemination tree of %d nodes with fanout %d", len(t.Tree), t.Fanout)
+	}
+	inTree := make(map[string]bool)
+	for _, nodeID := range t.Tree {
+		if _, ok := p.nodeTable[nodeID]; !ok || inTree[nodeID] {
+			return reject(reasonInvalidMessage, "the dissemination tree doesn't hold every node once")
+		}
+		inTree[nodeID] = true
+	}
+	if t.Tree[0] != p.primaryOf(t.PrePrepare.View) {
+		return reject(reasonInvalidMessage, "the dissemination tree of view %d is rooted at %s", t.PrePrepare.View, t.Tree[0])
+	}
+	//A tree the primary didn't sign has been altered by the relay, which the rejection is counted against
+	if err := p.verifySignature(t.Tree[0], t.signContent(), t.Sign); err != nil {
+		return err
+	}
+	if err := p.processPrePrepare(&t.PrePrepare); err != nil {
+		return err
+	}
+	p.relayPrePrepare(*t)
+	return nil
+}
+
+// Send the pre-prepare directly to the nodes whose prepare has not reached the primary, the nodes below a relay that is
+// down or that withheld it, unless the instance has committed at the primary or the view has changed. The prepares of
+// every node go to the primary, whether it collects them or not, so this works with every kind of vote.
+func (p *pbft) repairDissemination(key instanceKey) {
+	pp, ok := p.prePreparePool[key]
+	if _, committed := p.committedPool[key.sequenceID]; !ok || committed || key.sequenceID <= p.lastExecuted || key.view != p.view {
+		return
+	}
+	addrs := make([]string, 0)
+	for nodeID, addr := range p.nodeTable {
+		if _, prepared := p.preparePool[key][nodeID]; !prepared && nodeID != p.node.nodeID {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	fmt.Printf("%d nodes have not prepared sequence number %d, sending them the PrePrepare directly...\n", len(addrs), key.sequenceID)
+	p.transport.Broadcast(addrs, p.wire.encode(p.node.nodeID, cPrePrepare, pp))
+}
@@ -0,0 +1,117 @@
+package fpbft
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// The idle nodes, sending over an in-memory network where N3 listens, with the messages it receives.
+func treeCluster(t *testing.T) (map[string]*pbft, <-chan received) {
+	t.Helper()
+	nodes := idleCluster(t)
+	genClientKeys(defaultSignatureScheme, 1)
+	network := newMemoryNetwork()
+	for _, p := range nodes {
+		p.setDissemination(disseminateTree, 2)
+		p.transport = network.transport(p.node.addr, 0, 0)
+	}
+	messages, err := nodes["N3"].transport.Listen("memory/N3", nodes["N3"].wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nodes["N3"].transport.Close)
+	return nodes, messages
+}
+
+// A relay can't rewrite the tree or the fanout the primary signed.
+func TestTreePrePrepareSigned(t *testing.T) {
+	nodes, _ := treeCluster(t)
+	primary, relay := nodes["N0"], nodes["N1"]
+	signed := func(sequenceID int) TreePrePrepare {
+		pp := signedPrePrepare(primary, sequenceID, signedRequest(t, "tree"))
+		tree := TreePrePrepare{PrePrepare: *pp, Tree: primary.disseminationTree(sequenceID), Fanout: primary.treeFanout}
+		tree.Sign = primary.sign(tree.signContent())
+		return tree
+	}
+	handle := func(tree TreePrePrepare) error {
+		payload, _ := encodeBinary(tree)
+		return relay.handleTreePrePrepare(payload)
+	}
+
+	rewritten := signed(1)
+	rewritten.Tree[1], rewritten.Tree[3] = rewritten.Tree[3], rewritten.Tree[1]
+	var r *rejection
+	if err := handle(rewritten); !errors.As(err, &r) || r.reason != reasonBadSignature || r.signer != "" {
+		t.Fatalf("a rewritten tree was not blamed on the relay: %v", err)
+	}
+	amplified := signed(2)
+	amplified.Fanout = len(amplified.Tree)
+	amplified.Sign = primary.sign(amplified.signContent())
+	if err := handle(amplified); err == nil {
+		t.Fatal("a fanout other than the one of the node was accepted")
+	}
+	if _, ok := relay.prePreparePool[instanceKey{0, 1}]; ok {
+		t.Fatal("the pre-prepare of a rewritten tree was kept")
+	}
+	if err := handle(signed(3)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The primary sends the pre-prepare directly to a node that hasn't prepared once the timeout has passed, and only once,
+// unless the node has prepared, the instance has committed or the view has changed.
+func TestDisseminationRepairedOnce(t *testing.T) {
+	nodes, messages := treeCluster(t)
+	primary := nodes["N0"]
+	primary.disseminationTimeout = 20 * time.Millisecond
+	pp := signedPrePrepare(primary, 1, signedRequest(t, "repair"))
+	key := instanceKey{0, 1}
+	repaired := func(change func()) int {
+		primary.lock.Lock()
+		primary.prePreparePool[key] = *pp
+		primary.preparePool[key] = map[string]Prepare{"N1": {}, "N2": {}}
+		change()
+		primary.scheduleRepair(key)
+		primary.lock.Unlock()
+		count := 0
+		for deadline := time.After(200 * time.Millisecond); ; {
+			select {
+			case m := <-messages:
+				if e, err := parseMessage(m.message); err != nil || e.Command != cPrePrepare {
+					t.Fatalf("N3 received a %s", e.Command)
+				}
+				count++
+			case <-deadline:
+				return count
+			}
+		}
+	}
+	if count := repaired(func() {}); count != 1 {
+		t.Fatalf("the pre-prepare was sent %d times to the node that hasn't prepared", count)
+	}
+	if count := repaired(func() { primary.preparePool[key]["N3"] = Prepare{} }); count != 0 {
+		t.Fatalf("the pre-prepare was sent %d times after the node prepared", count)
+	}
+	if count := repaired(func() { primary.committedPool[1] = pp.Digest }); count != 0 {
+		t.Fatalf("the pre-prepare was sent %d times after the instance committed", count)
+	}
+	if count := repaired(func() {
+		delete(primary.committedPool, 1)
+		primary.view = 1
+	}); count != 0 {
+		t.Fatalf("the pre-prepare was sent %d times after the view changed", count)
+	}
+}
+
+// A network without a bandwidth limit commits with shared uplinks and the tree dissemination.
+func TestTreeDisseminationWithoutBandwidthLimit(t *testing.T) {
+	network, nt, _ := memoryCluster(t, 4, func(p *pbft) {
+		p.shareUplink()
+		p.setDissemination(disseminateTree, 2)
+	})
+	c := memoryClient(network)
+	if _, result := c.ClientSendMessageAndListen(nt, "down the tree", len(nt)); result.Rejected {
+		t.Fatalf("the request was rejected: %s", result.Result)
+	}
+}
@@ -0,0 +1,1005 @@
+package fpbft
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/coinbase/kryptology/pkg/core/curves"
+	"github.com/coinbase/kryptology/pkg/sharing"
+)
+
+// The threshold key of the committee is a secp256k1 key, like the validator keys taken from the EVM wallets.
+var dkgCurve = curves.K256()
+
+// A phase of the DKG ends once the messages of all the nodes have been ordered, or once f+1 nodes have voted to end it.
+// A node votes when the phase has lasted defaultDKGPhaseTimeout for it, and sends its votes and messages again every
+// defaultDKGPhaseTimeout until they are ordered.
+const defaultDKGPhaseTimeout = 3 * time.Second
+
+const (
+	//Sessions a validator may have opened at a time, that is sessions whose first ordered message it sent
+	maxDKGSessionsPerNode = 4
+	//A session without an ordered message for that many sequence numbers is dropped at the next checkpoint
+	dkgSessionLifetime = 10 * defaultCheckpointPeriod
+)
+
+// The session ID is part of the names of the key files.
+var dkgSessionPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+type dkgPhase int
+
+const (
+	//Every node deals shares of a secret of its own
+	dkgDealing dkgPhase = iota
+	//Every node complains about the dealers whose share is invalid
+	dkgComplaining
+	//The dealers answer the complaints by revealing the shares of the nodes that complained
+	dkgJustifying
+	dkgDone
+)
+
+// A run of the distributed key generation, identified by its session ID. Its messages are ordered like requests, and
+// the session moves from phase to phase as they are executed, so every correct node holds the same messages in every
+// phase, whether it takes part in the session or not.
+type dkgSession struct {
+	id string
+	//The validator whose message opened the session
+	opener string
+	//Sequence number of the last message of the session executed
+	lastSequenceID int
+	//The threshold of most deals, set when the dealing phase ends
+	threshold int
+	phase     dkgPhase
+	//Messages ordered in their phase, corresponding according to the node ID.
+	deals          map[string]DKGDeal
+	complaints     map[string]DKGComplaint
+	justifications map[string]DKGJustification
+	//The nodes that voted to end the current phase
+	phaseEnds map[string]bool
+}
+
+// The part this node takes in a DKG session it started.
+type dkgParticipation struct {
+	//The threshold this node deals its shares with
+	threshold int
+	//The phases this node has acted in
+	acted map[dkgPhase]bool
+	//The shares of this node that verified against the commitments of their dealer, corresponding according to the dealer.
+	shares map[string]curves.Scalar
+	//The shares this node dealt, corresponding according to the node ID, revealed if a node complains.
+	dealtShares map[string][]byte
+	//The requests of this node in the current phase that have not been executed yet, corresponding according to their kind
+	pending map[string]Request
+	timer   *time.Timer
+	result  chan DKGResult
+}
+
+// The key the nodes established in a DKG session.
+type DKGResult struct {
+	Session   string
+	Threshold int
+	//The dealers whose secrets make up the key
+	Qualified []string
+	//The threshold public key, a compressed secp256k1 point
+	PublicKey []byte
+	//The public keys of the shares of the nodes, corresponding according to the node ID, which verify their partial signatures.
+	PublicShares map[string][]byte
+}
+
+// The messages of a DKG session ordered in their phase, recorded by a node that took part in it. The result follows from
+// the signed messages, so anyone with the public keys of the nodes can check it afterwards, and compare the transcripts of the nodes.
+type DKGTranscript struct {
+	Session        string
+	Threshold      int
+	Scheme         SignatureScheme
+	Nodes          []string
+	Deals          []DKGDeal
+	Complaints     []DKGComplaint
+	Justifications []DKGJustification
+	Result         DKGResult
+	NodeID         string
+	Sign           []byte
+}
+
+// Content signed by the node that recorded the transcript, the transcript with its signature cleared.
+func (t DKGTranscript) signContent() []byte {
+	t.Sign = nil
+	b, err := json.Marshal(t)
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+// The threshold of a committee of n nodes: the n - f nodes that are not faulty can sign with the key, the f faulty ones can't.
+func defaultDKGThreshold(n int) int {
+	t := n - (n-1)/3
+	if t < 2 {
+		t = 2
+	}
+	return t
+}
+
+// Node Ni holds the value of the polynomials at i+1.
+func dkgShareID(nodeID string) (uint32, error) {
+	if len(nodeID) < 2 || nodeID[0] != 'N' {
+		return 0, fmt.Errorf("%q can't hold a DKG share", nodeID)
+	}
+	i, err := strconv.Atoi(nodeID[1:])
+	if err != nil || i < 0 || i >= 255 {
+		return 0, fmt.Errorf("%q can't hold a DKG share", nodeID)
+	}
+	return uint32(i + 1), nil
+}
+
+// The nodes of the node table, in the order of their shares.
+func (p *pbft) dkgNodes() []string {
+	nodes := make([]string, 0, len(p.nodeTable))
+	for nodeID := range p.nodeTable {
+		nodes = append(nodes, nodeID)
+	}
+	sortByShareID(nodes)
+	return nodes
+}
+
+func sortByShareID(nodes []string) {
+	sort.Slice(nodes, func(i, j int) bool {
+		a, _ := dkgShareID(nodes[i])
+		b, _ := dkgShareID(nodes[j])
+		return a < b
+	})
+}
+
+// The phase of the session, the dealing phase until its first message is executed.
+func (p *pbft) dkgPhaseOf(id string) dkgPhase {
+	if s, ok := p.dkgSessions[id]; ok {
+		return s.phase
+	}
+	return dkgDealing
+}
+
+// Start the distributed key generation of the session with the other nodes of the node table, which start it too.
+// Any threshold of the shares can sign with the key. The result is sent on the channel once the key is established,
+// and the channel is closed without a result if the session fails.
+func (p *pbft) startDKG(session string, threshold int) <-chan DKGResult {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !dkgSessionPattern.MatchString(session) {
+		log.Panicf("%q can't be the ID of a DKG session", session)
+	}
+	if threshold <= (p.nodeCount-1)/3 || threshold > p.nodeCount {
+		log.Panicf("the threshold of %d nodes can't be %d", p.nodeCount, threshold)
+	}
+	if _, ok := p.dkgParticipations[session]; ok || p.dkgFinished[session] {
+		log.Panicf("the DKG session %s has already been started", session)
+	}
+	if p.sessionKeys == nil {
+		p.establishSessionKeys()
+	}
+	part := &dkgParticipation{
+		threshold:   threshold,
+		acted:       make(map[dkgPhase]bool),
+		shares:      make(map[string]curves.Scalar),
+		dealtShares: make(map[string][]byte),
+		pending:     make(map[string]Request),
+		result:      make(chan DKGResult, 1),
+	}
+	p.dkgParticipations[session] = part
+	fmt.Printf("%s is starting the DKG session %s, any %d of the %d shares will sign with the key...\n", p.node.nodeID, session, threshold, p.nodeCount)
+	p.actDKG(session, part)
+	p.resetDKGTimer(session, part)
+	return part.result
+}
+
+// Take the part of this node in the current phase of the session, once per phase. A node that starts the session late
+// doesn't deal, but still complains, and gets its share of the key if no node complained about the qualified dealers.
+func (p *pbft) actDKG(id string, part *dkgParticipation) {
+	phase := p.dkgPhaseOf(id)
+	if part.acted[phase] {
+		return
+	}
+	part.acted[phase] = true
+	s := p.dkgSessions[id]
+	switch phase {
+	case dkgDealing:
+		p.dealDKG(id, part)
+	case dkgComplaining:
+		p.complainDKG(s, part)
+	case dkgJustifying:
+		p.justifyDKG(s, part)
+	}
+}
+
+// Sign a message of this node in the session as a request and send it to every node, this node included, to be ordered.
+// The request is sent again with the votes of the node until it is executed.
+func (p *pbft) submitDKG(id string, part *dkgParticipation, kind string, m DKGMessage) {
+	r := Request{Message: Message{Content: "DKG " + kind + " of " + p.node.nodeID + " in " + id, ID: getRandom()}, Timestamp: time.Now().UnixNano(), ClientAddr: p.node.addr, Client: p.node.nodeID, DKG: &m}
+	r.Sign = p.sign(r.signContent())
+	part.pending[kind] = r
+	p.sendDKGRequest(r)
+}
+
+// Requests of the DKG go to every node, so that the backups forward them and change the view if the primary ignores them.
+func (p *pbft) sendDKGRequest(r Request) {
+	p.transport.Broadcast(p.nodeTable.addrs(), p.wire.encode(p.node.nodeID, cRequest, r))
+}
+
+// Vote to end the current phase of the session when it has lasted defaultDKGPhaseTimeout,
+// and send the requests of this node that have not been executed yet again.
+func (p *pbft) resetDKGTimer(id string, part *dkgParticipation) {
+	if part.timer != nil {
+		part.timer.Stop()
+	}
+	phase := p.dkgPhaseOf(id)
+	part.timer = time.AfterFunc(defaultDKGPhaseTimeout, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if p.dkgParticipations[id] != part || p.dkgPhaseOf(id) != phase {
+			return
+		}
+		for _, r := range part.pending {
+			p.sendDKGRequest(r)
+		}
+		_, voting := part.pending["end"]
+		if s, ok := p.dkgSessions[id]; !voting && (!ok || !s.phaseEnds[p.node.nodeID]) {
+			fmt.Printf("%s votes to end the phase %d of the DKG session %s\n", p.node.nodeID, phase, id)
+			p.submitDKG(id, part, "end", DKGMessage{PhaseEnd: &DKGPhaseEnd{Session: id, Phase: int(phase), NodeID: p.node.nodeID}})
+		}
+		p.resetDKGTimer(id, part)
+	})
+}
+
+// Deal the shares of a random secret with Feldman's VSS: commit to the coefficients of the polynomial,
+// and encrypt the share of every other node under the session key shared with it.
+func (p *pbft) dealDKG(id string, part *dkgParticipation) {
+	feldman, err := sharing.NewFeldman(uint32(part.threshold), uint32(p.nodeCount), dkgCurve)
+	if err != nil {
+		log.Panic(err)
+	}
+	verifier, shares, err := feldman.Split(dkgCurve.Scalar.Random(rand.Reader), rand.Reader)
+	if err != nil {
+		log.Panic(err)
+	}
+	deal := DKGDeal{Session: id, Dealer: p.node.nodeID, Shares: make(map[string][]byte)}
+	for _, c := range verifier.Commitments {
+		deal.Commitments = append(deal.Commitments, c.ToAffineCompressed())
+	}
+	for nodeID := range p.nodeTable {
+		shareID, err := dkgShareID(nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		share := shares[shareID-1].Value
+		part.dealtShares[nodeID] = share
+		if nodeID != p.node.nodeID {
+			deal.Shares[nodeID] = p.encryptDKGShare(id, nodeID, share)
+		}
+	}
+	deal.Sign = p.sign(deal.signContent())
+	p.submitDKG(id, part, "deal", DKGMessage{Deal: &deal})
+}
+
+// The key a dealer encrypts the share of a node with, derived from the session key of the two nodes for the DKG session only.
+func dkgShareKey(sessionKey []byte, session string) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("fpbft dkg share " + session))
+	return mac.Sum(nil)
+}
+
+// AES-GCM encryption of the share of the node, bound to the session, the dealer and the node. The nonce comes first.
+func (p *pbft) encryptDKGShare(session, nodeID string, share []byte) []byte {
+	block, err := aes.NewCipher(dkgShareKey(p.sessionKeys[nodeID], session))
+	if err != nil {
+		log.Panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Panic(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		log.Panic(err)
+	}
+	return gcm.Seal(nonce, nonce, share, []byte(session+":"+p.node.nodeID+":"+nodeID))
+}
+
+// Decrypt the share of this node that the dealer encrypted.
+func (p *pbft) decryptDKGShare(session, dealer string, ciphertext []byte) ([]byte, error) {
+	key, ok := p.sessionKeys[dealer]
+	if !ok {
+		return nil, fmt.Errorf("there is no session key with %s", dealer)
+	}
+	block, err := aes.NewCipher(dkgShareKey(key, session))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("the encrypted share is too short")
+	}
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], []byte(session+":"+dealer+":"+p.node.nodeID))
+}
+
+// Parse the commitments of a deal, one for each coefficient of a polynomial of degree threshold-1.
+func parseDKGCommitments(deal DKGDeal, threshold int) (*sharing.FeldmanVerifier, error) {
+	if len(deal.Commitments) != threshold {
+		return nil, fmt.Errorf("%d commitments for the threshold %d", len(deal.Commitments), threshold)
+	}
+	verifier := new(sharing.FeldmanVerifier)
+	for _, c := range deal.Commitments {
+		point, err := dkgCurve.Point.FromAffineCompressed(c)
+		if err != nil {
+			return nil, fmt.Errorf("malformed commitment: %v", err)
+		}
+		verifier.Commitments = append(verifier.Commitments, point)
+	}
+	return verifier, nil
+}
+
+// Verify a share of the node against the commitments of its dealer.
+func verifyDKGShare(verifier *sharing.FeldmanVerifier, nodeID string, value []byte) (curves.Scalar, error) {
+	id, err := dkgShareID(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifier.Verify(&sharing.ShamirShare{Id: id, Value: value}); err != nil {
+		return nil, fmt.Errorf("the share doesn't match the commitments: %v", err)
+	}
+	return dkgCurve.Scalar.SetBytes(value)
+}
+
+// Check the session ID of a DKG message.
+func checkDKGSession(session string) error {
+	if !dkgSessionPattern.MatchString(session) {
+		return reject(reasonInvalidMessage, "%q can't be the ID of a DKG session", session)
+	}
+	return nil
+}
+
+// The kind of the message, its session and the node that sent it. Exactly one message is set.
+func (m DKGMessage) origin() (kind, session, nodeID string, err error) {
+	set := 0
+	if d := m.Deal; d != nil {
+		kind, session, nodeID = "deal", d.Session, d.Dealer
+		set++
+	}
+	if c := m.Complaint; c != nil {
+		kind, session, nodeID = "complaint", c.Session, c.NodeID
+		set++
+	}
+	if j := m.Justification; j != nil {
+		kind, session, nodeID = "justification", j.Session, j.Dealer
+		set++
+	}
+	if e := m.PhaseEnd; e != nil {
+		kind, session, nodeID = "end", e.Session, e.NodeID
+		set++
+	}
+	if set != 1 {
+		return "", "", "", fmt.Errorf("the request carries %d DKG messages", set)
+	}
+	return kind, session, nodeID, nil
+}
+
+// Check a request carrying a DKG message: the validator that sent the message signed the request, and the message is
+// well formed. The signature of the message itself, which the transcripts keep, is verified when it is executed.
+func (p *pbft) checkDKGRequest(r Request) error {
+	_, session, nodeID, err := r.DKG.origin()
+	if err != nil {
+		return err
+	}
+	if nodeID != r.Client {
+		return fmt.Errorf("%s sent the DKG message of %s", r.Client, nodeID)
+	}
+	if err := checkDKGSession(session); err != nil {
+		return err
+	}
+	if c := r.DKG.Complaint; c != nil {
+		for _, dealer := range c.Dealers {
+			if _, ok := p.nodeTable[dealer]; !ok {
+				return fmt.Errorf("%s complained about %q, which is not in the node table", c.NodeID, dealer)
+			}
+		}
+	}
+	if e := r.DKG.PhaseEnd; e != nil && (e.Phase < int(dkgDealing) || e.Phase >= int(dkgDone)) {
+		return fmt.Errorf("%s voted to end the phase %d of a DKG session", e.NodeID, e.Phase)
+	}
+	return p.verifySignature(r.Client, r.signContent(), r.Sign)
+}
+
+// Whether the DKG message of the request can no longer be kept, as its session has finished, its phase is over,
+// or the message of its kind from its node has been executed. It is not ordered again.
+func (p *pbft) staleDKGRequest(r Request) bool {
+	kind, id, nodeID, err := r.DKG.origin()
+	if err != nil {
+		return false
+	}
+	if p.dkgFinished[id] {
+		return true
+	}
+	s, ok := p.dkgSessions[id]
+	if !ok {
+		return false
+	}
+	switch kind {
+	case "deal":
+		_, ok = s.deals[nodeID]
+		return ok || s.phase > dkgDealing
+	case "complaint":
+		_, ok = s.complaints[nodeID]
+		return ok || s.phase > dkgComplaining
+	case "justification":
+		_, ok = s.justifications[nodeID]
+		return ok || s.phase > dkgJustifying
+	}
+	return r.DKG.PhaseEnd.Phase < int(s.phase) || (r.DKG.PhaseEnd.Phase == int(s.phase) && s.phaseEnds[nodeID])
+}
+
+// Execute an ordered DKG message. A message that comes after the phase it belongs to, or after another message of its
+// kind from its node, is ignored, so every correct node keeps the same messages.
+func (p *pbft) executeDKG(r Request, sequenceID int) {
+	m := *r.DKG
+	kind, id, nodeID, _ := m.origin()
+	if part, ok := p.dkgParticipations[id]; ok && nodeID == p.node.nodeID {
+		delete(part.pending, kind)
+	}
+	s := p.openDKGSession(id, nodeID)
+	if s == nil {
+		return
+	}
+	s.lastSequenceID = sequenceID
+	switch {
+	case m.Deal != nil:
+		_, dealt := s.deals[nodeID]
+		if dealt || s.phase != dkgDealing || !p.verifyDKGMessage(nodeID, kind, m.Deal.signContent(), m.Deal.Sign) {
+			return
+		}
+		s.deals[nodeID] = *m.Deal
+	case m.Complaint != nil:
+		_, complained := s.complaints[nodeID]
+		if complained || s.phase != dkgComplaining || !p.verifyDKGMessage(nodeID, kind, m.Complaint.signContent(), m.Complaint.Sign) {
+			return
+		}
+		s.complaints[nodeID] = *m.Complaint
+	case m.Justification != nil:
+		_, justified := s.justifications[nodeID]
+		if justified || s.phase != dkgJustifying || !p.complainedDealers(s)[nodeID] || !p.verifyDKGMessage(nodeID, kind, m.Justification.signContent(), m.Justification.Sign) {
+			return
+		}
+		s.justifications[nodeID] = *m.Justification
+	case m.PhaseEnd != nil:
+		if m.PhaseEnd.Phase != int(s.phase) {
+			return
+		}
+		s.phaseEnds[nodeID] = true
+	}
+	p.advanceDKG(s)
+}
+
+// Verify the signature of an ordered DKG message, which is ignored if it doesn't verify.
+func (p *pbft) verifyDKGMessage(nodeID, kind string, data, sign []byte) bool {
+	if err := p.verifySignature(nodeID, data, sign); err != nil {
+		fmt.Printf("The DKG %s of %s is ignored: %v\n", kind, nodeID, err)
+		return false
+	}
+	return true
+}
+
+// The session of the ID, opened by the first of its messages executed, unless the validator that sent the message has
+// opened maxDKGSessionsPerNode sessions already, or the session has finished.
+func (p *pbft) openDKGSession(id, opener string) *dkgSession {
+	if s, ok := p.dkgSessions[id]; ok {
+		return s
+	}
+	if p.dkgFinished[id] {
+		return nil
+	}
+	opened := 0
+	for _, s := range p.dkgSessions {
+		if s.opener == opener {
+			opened++
+		}
+	}
+	if opened >= maxDKGSessionsPerNode {
+		fmt.Printf("%s has opened %d DKG sessions, refusing to open the session %s\n", opener, opened, id)
+		return nil
+	}
+	s := &dkgSession{
+		id:             id,
+		opener:         opener,
+		deals:          make(map[string]DKGDeal),
+		complaints:     make(map[string]DKGComplaint),
+		justifications: make(map[string]DKGJustification),
+		phaseEnds:      make(map[string]bool),
+	}
+	p.dkgSessions[id] = s
+	return s
+}
+
+// Drop the sessions without a message executed for dkgSessionLifetime sequence numbers, at a checkpoint.
+func (p *pbft) collectDKGSessions(sequenceID int) {
+	for _, s := range p.dkgSessions {
+		if sequenceID-s.lastSequenceID < dkgSessionLifetime {
+			continue
+		}
+		fmt.Printf("The DKG session %s has had no message since sequence number %d, it is dropped\n", s.id, s.lastSequenceID)
+		if part := p.closeDKGSession(s); part != nil {
+			close(part.result)
+		}
+	}
+}
+
+// Forget the session, and return the part of this node in it, nil if it didn't start it.
+func (p *pbft) closeDKGSession(s *dkgSession) *dkgParticipation {
+	delete(p.dkgSessions, s.id)
+	part, ok := p.dkgParticipations[s.id]
+	if !ok {
+		return nil
+	}
+	delete(p.dkgParticipations, s.id)
+	if part.timer != nil {
+		part.timer.Stop()
+	}
+	return part
+}
+
+// Move the session on once the messages of all the nodes of the phase have been executed, or f+1 nodes have voted
+// to end the phase, at least one of them correct.
+func (p *pbft) advanceDKG(s *dkgSession) {
+	for s.phase != dkgDone && p.dkgPhaseOver(s) {
+		p.endDKGPhase(s)
+	}
+}
+
+func (p *pbft) dkgPhaseOver(s *dkgSession) bool {
+	if len(s.phaseEnds) > (p.nodeCount-1)/3 {
+		return true
+	}
+	switch s.phase {
+	case dkgDealing:
+		return len(s.deals) == p.nodeCount
+	case dkgComplaining:
+		return len(s.complaints) == p.nodeCount
+	}
+	for dealer := range p.complainedDealers(s) {
+		if _, ok := s.justifications[dealer]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// The dealers some other node complained about.
+func (p *pbft) complainedDealers(s *dkgSession) map[string]bool {
+	dealers := make(map[string]bool)
+	for _, c := range s.complaints {
+		for _, dealer := range c.Dealers {
+			if _, ok := s.deals[dealer]; ok && dealer != c.NodeID {
+				dealers[dealer] = true
+			}
+		}
+	}
+	return dealers
+}
+
+func (p *pbft) endDKGPhase(s *dkgSession) {
+	s.phaseEnds = make(map[string]bool)
+	switch s.phase {
+	case dkgDealing:
+		if s.threshold = p.agreedDKGThreshold(s); s.threshold == 0 {
+			fmt.Printf("No threshold was dealt by more than f nodes in the DKG session %s\n", s.id)
+			s.phase = dkgDone
+			p.dkgFinished[s.id] = true
+			if part := p.closeDKGSession(s); part != nil {
+				close(part.result)
+			}
+			return
+		}
+	case dkgJustifying:
+		p.finishDKG(s)
+		return
+	}
+	s.phase++
+	if part, ok := p.dkgParticipations[s.id]; ok {
+		part.pending = make(map[string]Request)
+		p.actDKG(s.id, part)
+		p.resetDKGTimer(s.id, part)
+	}
+}
+
+// The threshold of the session, the one the most deals were dealt with, the lowest of a tie, provided more than f deals
+// were. The deals with another threshold are disqualified.
+func (p *pbft) agreedDKGThreshold(s *dkgSession) int {
+	f := (p.nodeCount - 1) / 3
+	counts := make(map[int]int)
+	for _, d := range s.deals {
+		counts[len(d.Commitments)]++
+	}
+	threshold := 0
+	for t, n := range counts {
+		if t <= f || t > p.nodeCount || n <= f {
+			continue
+		}
+		if threshold == 0 || n > counts[threshold] || (n == counts[threshold] && t < threshold) {
+			threshold = t
+		}
+	}
+	return threshold
+}
+
+// Verify the share of every ordered deal and submit the complaint of this node about the dealers whose share is invalid.
+func (p *pbft) complainDKG(s *dkgSession, part *dkgParticipation) {
+	if part.threshold != s.threshold {
+		fmt.Printf("%s dealt with the threshold %d, the DKG session %s has the threshold %d\n", p.node.nodeID, part.threshold, s.id, s.threshold)
+	}
+	c := DKGComplaint{Session: s.id, NodeID: p.node.nodeID}
+	for _, dealer := range p.dkgNodes() {
+		if _, ok := s.deals[dealer]; !ok || dealer == p.node.nodeID {
+			continue
+		}
+		share, err := p.receiveDKGShare(s, dealer)
+		if err != nil {
+			fmt.Printf("%s complains about the deal of %s: %v\n", p.node.nodeID, dealer, err)
+			c.Dealers = append(c.Dealers, dealer)
+			continue
+		}
+		part.shares[dealer] = share
+	}
+	c.Sign = p.sign(c.signContent())
+	p.submitDKG(s.id, part, "complaint", DKGMessage{Complaint: &c})
+}
+
+// Decrypt the share of this node in the deal of the dealer and verify it against the commitments.
+func (p *pbft) receiveDKGShare(s *dkgSession, dealer string) (curves.Scalar, error) {
+	deal, ok := s.deals[dealer]
+	if !ok {
+		return nil, errors.New("the deal was not ordered")
+	}
+	verifier, err := parseDKGCommitments(deal, s.threshold)
+	if err != nil {
+		return nil, err
+	}
+	share, err := p.decryptDKGShare(s.id, dealer, deal.Shares[p.node.nodeID])
+	if err != nil {
+		return nil, fmt.Errorf("the share can't be decrypted: %v", err)
+	}
+	return verifyDKGShare(verifier, p.node.nodeID, share)
+}
+
+// Answer the complaints against this node by revealing the shares of the nodes that complained.
+func (p *pbft) justifyDKG(s *dkgSession, part *dkgParticipation) {
+	j := DKGJustification{Session: s.id, Dealer: p.node.nodeID, Shares: make(map[string][]byte)}
+	for nodeID, c := range s.complaints {
+		for _, dealer := range c.Dealers {
+			if dealer == p.node.nodeID && nodeID != p.node.nodeID {
+				j.Shares[nodeID] = part.dealtShares[nodeID]
+			}
+		}
+	}
+	if len(j.Shares) > 0 {
+		fmt.Printf("%s is revealing the shares of the %d nodes that complained about its deal...\n", p.node.nodeID, len(j.Shares))
+		j.Sign = p.sign(j.signContent())
+		p.submitDKG(s.id, part, "justification", DKGMessage{Justification: &j})
+	}
+}
+
+// The transcript of the ordered messages of the session.
+func (p *pbft) dkgTranscript(s *dkgSession) DKGTranscript {
+	t := DKGTranscript{Session: s.id, Threshold: s.threshold, Scheme: p.scheme, Nodes: p.dkgNodes(), NodeID: p.node.nodeID}
+	for _, nodeID := range t.Nodes {
+		if d, ok := s.deals[nodeID]; ok {
+			t.Deals = append(t.Deals, d)
+		}
+		if c, ok := s.complaints[nodeID]; ok {
+			t.Complaints = append(t.Complaints, c)
+		}
+		if j, ok := s.justifications[nodeID]; ok {
+			t.Justifications = append(t.Justifications, j)
+		}
+	}
+	return t
+}
+
+// Establish the key from the ordered messages of the session: the public key is the sum of the secrets of the qualified
+// dealers in the exponent, and the share of this node the sum of their shares. The share, the public key and the transcript
+// are written to the Keys directory of the node. A session is finished once, whether this node started it or not.
+func (p *pbft) finishDKG(s *dkgSession) {
+	s.phase = dkgDone
+	p.dkgFinished[s.id] = true
+	part := p.closeDKGSession(s)
+	if part == nil {
+		return
+	}
+	t := p.dkgTranscript(s)
+	result, err := computeDKGResult(t)
+	var share curves.Scalar
+	if err == nil {
+		share, err = p.dkgKeyShare(s, part, result)
+	}
+	if err != nil {
+		fmt.Printf("%s failed the DKG session %s: %v\n", p.node.nodeID, s.id, err)
+		close(part.result)
+		return
+	}
+	t.Result = result
+	t.Sign = p.sign(t.signContent())
+	if err := writeDKGKeys(p.node.nodeID, result, share, t); err != nil {
+		fmt.Printf("%s can't write the key of the DKG session %s: %v\n", p.node.nodeID, s.id, err)
+		close(part.result)
+		return
+	}
+	fmt.Printf("%s has established the key %x of the DKG session %s with %d qualified dealers\n", p.node.nodeID, result.PublicKey, s.id, len(result.Qualified))
+	part.result <- result
+}
+
+// The share of this node in the key, the sum of its shares from the qualified dealers.
+func (p *pbft) dkgKeyShare(s *dkgSession, part *dkgParticipation, result DKGResult) (curves.Scalar, error) {
+	share := dkgCurve.Scalar.Zero()
+	for _, dealer := range result.Qualified {
+		value, ok := part.shares[dealer]
+		var err error
+		switch {
+		case ok:
+		case dealer == p.node.nodeID:
+			value, err = dkgCurve.Scalar.SetBytes(part.dealtShares[dealer])
+		default:
+			if revealed, ok := s.justifications[dealer].Shares[p.node.nodeID]; ok {
+				//The dealer revealed the share after this node complained, it is verified with the result
+				value, err = dkgCurve.Scalar.SetBytes(revealed)
+			} else {
+				//This node started the session after the complaining phase
+				value, err = p.receiveDKGShare(s, dealer)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("the share dealt by %s: %v", dealer, err)
+		}
+		share = share.Add(value)
+	}
+	if !bytes.Equal(dkgCurve.ScalarBaseMult(share).ToAffineCompressed(), result.PublicShares[p.node.nodeID]) {
+		return nil, errors.New("the share of the node doesn't match its public key")
+	}
+	return share, nil
+}
+
+// The result of a session that follows from the messages of its transcript. A dealer is disqualified when its deal is missing
+// or malformed, when it doesn't reveal a valid share for every node that complained about it, or when so many nodes complained
+// that the revealed shares, together with the shares of the f faulty nodes, would reach the threshold.
+// The public key depends only on the signed messages, so every node whose transcript holds the same messages establishes the same key.
+//
+// This is the Joint-Feldman DKG: the public key is fixed by the commitments of the dealers, which a faulty dealer sees before
+// the complaints, so it can bias the key by getting itself disqualified (Gennaro, Jarecki, Krawczyk and Rabin). The key is
+// still uniform enough for threshold Schnorr and ECDSA signatures, which is what the committee signs with.
+func computeDKGResult(t DKGTranscript) (DKGResult, error) {
+	f := (len(t.Nodes) - 1) / 3
+	deals := make(map[string]DKGDeal)
+	for _, d := range t.Deals {
+		deals[d.Dealer] = d
+	}
+	justifications := make(map[string]DKGJustification)
+	for _, j := range t.Justifications {
+		justifications[j.Dealer] = j
+	}
+	complainers := make(map[string]map[string]bool)
+	for _, c := range t.Complaints {
+		for _, dealer := range c.Dealers {
+			if dealer == c.NodeID {
+				continue
+			}
+			if complainers[dealer] == nil {
+				complainers[dealer] = make(map[string]bool)
+			}
+			complainers[dealer][c.NodeID] = true
+		}
+	}
+	result := DKGResult{Session: t.Session, Threshold: t.Threshold, PublicShares: make(map[string][]byte)}
+	commitments := make([]curves.Point, t.Threshold)
+	for i := range commitments {
+		commitments[i] = dkgCurve.Point.Identity()
+	}
+	for _, dealer := range t.Nodes {
+		verifier, err := qualifyDealer(t, deals, justifications[dealer], complainers[dealer], dealer, f)
+		if err != nil {
+			fmt.Printf("%s is disqualified from the DKG session %s: %v\n", dealer, t.Session, err)
+			continue
+		}
+		result.Qualified = append(result.Qualified, dealer)
+		for i, c := range verifier.Commitments {
+			commitments[i] = commitments[i].Add(c)
+		}
+	}
+	if len(result.Qualified) <= f {
+		return result, fmt.Errorf("only %d dealers are qualified, the faulty nodes may know the key", len(result.Qualified))
+	}
+	result.PublicKey = commitments[0].ToAffineCompressed()
+	for _, nodeID := range t.Nodes {
+		id, err := dkgShareID(nodeID)
+		if err != nil {
+			return result, err
+		}
+		//The public key of the share is the sum of the commitments of the qualified dealers evaluated at the share ID
+		x := dkgCurve.Scalar.New(int(id))
+		xi := dkgCurve.Scalar.One()
+		publicShare := commitments[0]
+		for _, c := range commitments[1:] {
+			xi = xi.Mul(x)
+			publicShare = publicShare.Add(c.Mul(xi))
+		}
+		result.PublicShares[nodeID] = publicShare.ToAffineCompressed()
+	}
+	return result, nil
+}
+
+// Check that the dealer is qualified, and return the commitments of its deal.
+func qualifyDealer(t DKGTranscript, deals map[string]DKGDeal, j DKGJustification, complainers map[string]bool, dealer string, f int) (*sharing.FeldmanVerifier, error) {
+	deal, ok := deals[dealer]
+	if !ok {
+		return nil, errors.New("it didn't deal")
+	}
+	verifier, err := parseDKGCommitments(deal, t.Threshold)
+	if err != nil {
+		return nil, err
+	}
+	if len(complainers) >= t.Threshold-f {
+		return nil, fmt.Errorf("%d nodes complained about its deal", len(complainers))
+	}
+	for nodeID := range complainers {
+		if j.Dealer != dealer {
+			return nil, fmt.Errorf("it didn't answer the complaint of %s", nodeID)
+		}
+		if _, err := verifyDKGShare(verifier, nodeID, j.Shares[nodeID]); err != nil {
+			return nil, fmt.Errorf("the share it revealed to %s is invalid: %v", nodeID, err)
+		}
+	}
+	return verifier, nil
+}
+
+// Write the key share of the node, the threshold public key and the transcript of the session:
+// Keys/<id>/<id>_DKG-<session>_PIV, Keys/<id>/<id>_DKG-<session>_PUB and Keys/<id>/<id>_DKG-<session>_TRANSCRIPT.
+func writeDKGKeys(nodeID string, result DKGResult, share curves.Scalar, t DKGTranscript) error {
+	tag := "DKG-" + result.Session
+	headers := map[string]string{"Session": result.Session, "Threshold": strconv.Itoa(result.Threshold)}
+	if pub, err := btcec.ParsePubKey(result.PublicKey, btcec.S256()); err == nil {
+		headers["Address"] = evmAddress(pub)
+	}
+	prvkey := pem.EncodeToMemory(&pem.Block{Type: "DKG KEY SHARE", Headers: headers, Bytes: share.Bytes()})
+	pubkey := pem.EncodeToMemory(&pem.Block{Type: "DKG PUBLIC KEY", Headers: headers, Bytes: result.PublicKey})
+	if err := writeKeyPair(tag, nodeID, prvkey, pubkey); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile(tag, nodeID, "TRANSCRIPT"), b, 0644)
+}
+
+// Audit the transcripts of a DKG session that the nodes recorded, reading the public keys of the nodes from the key files.
+// Every message must carry a valid signature of its sender, the result of every transcript must follow from its messages,
+// and the transcripts must agree on the messages of every node, as the messages are ordered before the nodes keep them.
+func AuditDKGTranscripts(paths ...string) (DKGResult, error) {
+	var result DKGResult
+	if len(paths) == 0 {
+		return result, errors.New("there is no transcript to audit")
+	}
+	seen := make(map[string][]byte)
+	for i, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return result, err
+		}
+		var t DKGTranscript
+		if err := json.Unmarshal(b, &t); err != nil {
+			return result, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := auditDKGTranscript(t, seen); err != nil {
+			return result, fmt.Errorf("%s: %v", path, err)
+		}
+		if i == 0 {
+			result = t.Result
+			continue
+		}
+		want, err := json.Marshal(result)
+		if err != nil {
+			return result, err
+		}
+		got, err := json.Marshal(t.Result)
+		if err != nil {
+			return result, err
+		}
+		if !bytes.Equal(want, got) {
+			return result, fmt.Errorf("%s: the key of %s differs from the key of %s", path, t.NodeID, paths[0])
+		}
+	}
+	return result, nil
+}
+
+// Audit a transcript. The messages of every node are checked against the messages seen in the transcripts audited before.
+func auditDKGTranscript(t DKGTranscript, seen map[string][]byte) error {
+	verifiers := make(map[string]Verifier)
+	verify := func(nodeID string, data, sign []byte) error {
+		v, ok := verifiers[nodeID]
+		if !ok {
+			key, err := readPubKey(string(t.Scheme), nodeID)
+			if err != nil {
+				return err
+			}
+			if v, err = t.Scheme.parseVerifier(key); err != nil {
+				return err
+			}
+			verifiers[nodeID] = v
+		}
+		if !v.Verify(data, sign) {
+			return fmt.Errorf("the signature of %s doesn't verify", nodeID)
+		}
+		return nil
+	}
+	//Every node sends one message of a kind, the same to all the nodes
+	record := func(kind, session, nodeID string, data, sign []byte) error {
+		if session != t.Session {
+			return fmt.Errorf("the %s of %s belongs to the session %s", kind, nodeID, session)
+		}
+		if err := verify(nodeID, data, sign); err != nil {
+			return err
+		}
+		key := kind + " " + nodeID
+		if other, ok := seen[key]; ok && !bytes.Equal(other, data) {
+			return fmt.Errorf("%s sent different messages of the kind %s", nodeID, kind)
+		}
+		seen[key] = data
+		return nil
+	}
+	if err := verify(t.NodeID, t.signContent(), t.Sign); err != nil {
+		return err
+	}
+	for _, d := range t.Deals {
+		if err := record("deal", d.Session, d.Dealer, d.signContent(), d.Sign); err != nil {
+			return err
+		}
+	}
+	for _, c := range t.Complaints {
+		if err := record("complaint", c.Session, c.NodeID, c.signContent(), c.Sign); err != nil {
+			return err
+		}
+	}
+	for _, j := range t.Justifications {
+		if err := record("justification", j.Session, j.Dealer, j.signContent(), j.Sign); err != nil {
+			return err
+		}
+	}
+	result, err := computeDKGResult(t)
+	if err != nil {
+		return err
+	}
+	want, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	got, err := json.Marshal(t.Result)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(want, got) {
+		return fmt.Errorf("the key recorded by %s doesn't follow from its messages", t.NodeID)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package fpbft
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func dkgTranscriptPaths(session string, nodeIDs ...string) []string {
+	paths := make([]string, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		paths = append(paths, keyFile("DKG-"+session, nodeID, "TRANSCRIPT"))
+	}
+	return paths
+}
+
+func waitDKG(t *testing.T, nodeID string, ch <-chan DKGResult) DKGResult {
+	t.Helper()
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			t.Fatalf("%s failed the DKG session", nodeID)
+		}
+		return r
+	case <-time.After(30 * time.Second):
+		t.Fatalf("%s did not finish the DKG session", nodeID)
+	}
+	return DKGResult{}
+}
+
+// A dealer whose share a node can't decrypt reveals it, stays qualified, and every node records the same transcript.
+func TestDKGJustifiedDealer(t *testing.T) {
+	_, _, nodes := memoryCluster(t, 4, nil)
+	for _, p := range nodes {
+		p.establishSessionKeys()
+	}
+	nodes["N3"].sessionKeys["N1"] = make([]byte, 32)
+	results := make(map[string]<-chan DKGResult)
+	for nodeID, p := range nodes {
+		results[nodeID] = p.startDKG("justified", 3)
+	}
+	var key []byte
+	for nodeID, ch := range results {
+		r := waitDKG(t, nodeID, ch)
+		if len(r.Qualified) != 4 {
+			t.Errorf("%s qualified %v", nodeID, r.Qualified)
+		}
+		if key != nil && !bytes.Equal(key, r.PublicKey) {
+			t.Errorf("%s established another key", nodeID)
+		}
+		key = r.PublicKey
+	}
+	if _, err := AuditDKGTranscripts(dkgTranscriptPaths("justified", "N0", "N1", "N2", "N3")...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A node that starts the session after the others voted to end the dealing phase is not a dealer, but the nodes
+// agree on the qualified dealers and the key, and it still gets its share.
+func TestDKGLateNodeAgrees(t *testing.T) {
+	_, _, nodes := memoryCluster(t, 4, nil)
+	results := make(map[string]<-chan DKGResult)
+	for _, nodeID := range []string{"N0", "N1", "N2"} {
+		results[nodeID] = nodes[nodeID].startDKG("late", 3)
+	}
+	late := nodes["N3"]
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		late.lock.Lock()
+		phase := late.dkgPhaseOf("late")
+		late.lock.Unlock()
+		if phase != dkgDealing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the dealing phase did not end")
+		}
+	}
+	results["N3"] = late.startDKG("late", 3)
+	var key []byte
+	for nodeID, ch := range results {
+		r := waitDKG(t, nodeID, ch)
+		if len(r.Qualified) != 3 {
+			t.Errorf("%s qualified %v", nodeID, r.Qualified)
+		}
+		if key != nil && !bytes.Equal(key, r.PublicKey) {
+			t.Errorf("%s established another key", nodeID)
+		}
+		key = r.PublicKey
+	}
+	if _, err := AuditDKGTranscripts(dkgTranscriptPaths("late", "N0", "N1", "N2", "N3")...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A validator opens a bounded number of sessions, which are dropped at a checkpoint once idle, and a finished session
+// is never opened again.
+func TestDKGSessionsBounded(t *testing.T) {
+	inTempDir(t)
+	genKeys(defaultSignatureScheme, 4)
+	nt := nodeTable{"N0": "memory/N0", "N1": "memory/N1", "N2": "memory/N2", "N3": "memory/N3"}
+	p := NewPBFT("N0", nt["N0"], nt, len(nt), 0, 0)
+	end := func(session string, sequenceID int) {
+		p.executeDKG(Request{Client: "N1", DKG: &DKGMessage{PhaseEnd: &DKGPhaseEnd{Session: session, NodeID: "N1"}}}, sequenceID)
+	}
+	for i := 0; i <= maxDKGSessionsPerNode; i++ {
+		end(string(rune('a'+i)), 1)
+	}
+	if len(p.dkgSessions) != maxDKGSessionsPerNode {
+		t.Fatalf("N1 opened %d sessions", len(p.dkgSessions))
+	}
+	p.collectDKGSessions(dkgSessionLifetime)
+	if len(p.dkgSessions) != maxDKGSessionsPerNode {
+		t.Fatalf("%d sessions are left before their lifetime", len(p.dkgSessions))
+	}
+	p.collectDKGSessions(dkgSessionLifetime + 1)
+	if len(p.dkgSessions) != 0 {
+		t.Fatalf("%d idle sessions are left", len(p.dkgSessions))
+	}
+	p.dkgFinished["done"] = true
+	end("done", 2)
+	if _, ok := p.dkgSessions["done"]; ok {
+		t.Fatal("a finished session was opened again")
+	}
+}
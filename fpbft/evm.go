@@ -0,0 +1,140 @@
+package fpbft
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// A legacy EVM transaction, signed for its chain as in EIP-155.
+type EVMTransaction struct {
+	ChainID  uint64
+	Nonce    uint64
+	GasPrice *big.Int
+	Gas      uint64
+	//EVM address of the receiver, the contract called
+	To    string
+	Value *big.Int
+	//ABI encoded call
+	Data []byte
+}
+
+// The hash the sender signs, Keccak-256 of the RLP encoding of the transaction with the chain ID in place of the signature.
+func (tx EVMTransaction) signingHash() ([]byte, error) {
+	fields, err := tx.rlpFields()
+	if err != nil {
+		return nil, err
+	}
+	chainID := new(big.Int).SetUint64(tx.ChainID)
+	return keccak256(rlpList(append(fields, rlpInt(chainID), rlpInt(nil), rlpInt(nil))...)), nil
+}
+
+// The raw transaction with the signature [R || S || V] of its sender, V being 27 + the recovery ID like the signatures
+// of the secp256k1 scheme. It can be sent to any node of the chain with eth_sendRawTransaction.
+func (tx EVMTransaction) rawTransaction(sign []byte) ([]byte, error) {
+	if len(sign) != 65 || (sign[64] != 27 && sign[64] != 28) {
+		return nil, errors.New("not an EVM signature")
+	}
+	fields, err := tx.rlpFields()
+	if err != nil {
+		return nil, err
+	}
+	v := new(big.Int).SetUint64(tx.ChainID)
+	v.Mul(v, big.NewInt(2)).Add(v, big.NewInt(int64(35+sign[64]-27)))
+	r := new(big.Int).SetBytes(sign[:32])
+	s := new(big.Int).SetBytes(sign[32:64])
+	return rlpList(append(fields, rlpInt(v), rlpInt(r), rlpInt(s))...), nil
+}
+
+func (tx EVMTransaction) rlpFields() ([][]byte, error) {
+	to, err := parseEVMAddress(tx.To)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{
+		rlpInt(new(big.Int).SetUint64(tx.Nonce)),
+		rlpInt(tx.GasPrice),
+		rlpInt(new(big.Int).SetUint64(tx.Gas)),
+		rlpBytes(to),
+		rlpInt(tx.Value),
+		rlpBytes(tx.Data),
+	}, nil
+}
+
+// RLP encoding of a byte string.
+func rlpBytes(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return b
+	}
+	return append(rlpLength(len(b), 0x80), b...)
+}
+
+// RLP encoding of an integer, the big-endian bytes without leading zeros. Nil is 0.
+func rlpInt(i *big.Int) []byte {
+	if i == nil {
+		return rlpBytes(nil)
+	}
+	return rlpBytes(i.Bytes())
+}
+
+// RLP encoding of a list of encoded items.
+func rlpList(items ...[]byte) []byte {
+	body := bytes.Join(items, nil)
+	return append(rlpLength(len(body), 0xc0), body...)
+}
+
+func rlpLength(n int, offset byte) []byte {
+	if n < 56 {
+		return []byte{offset + byte(n)}
+	}
+	length := big.NewInt(int64(n)).Bytes()
+	return append([]byte{offset + 55 + byte(len(length))}, length...)
+}
+
+// Parse a hex encoded EVM address, with or without the 0x prefix.
+func parseEVMAddress(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil || len(b) != 20 {
+		return nil, errors.New("not an EVM address: " + s)
+	}
+	return b, nil
+}
+
+// ABI encoding of a call of the function with the signature, e.g. reward(address,uint256), with 32-byte arguments.
+func abiCall(signature string, args ...[]byte) []byte {
+	data := keccak256([]byte(signature))[:4]
+	for _, arg := range args {
+		word := make([]byte, 32)
+		copy(word[32-len(arg):], arg)
+		data = append(data, word...)
+	}
+	return data
+}
+
+// The signature [R || S || V] of the hash by the public key, finding the recovery ID that ecrecover needs.
+func evmSignature(pub *btcec.PublicKey, hash []byte, r, s *big.Int) ([]byte, error) {
+	sign := make([]byte, 65)
+	r.FillBytes(sign[:32])
+	s.FillBytes(sign[32:64])
+	for v := byte(27); v <= 28; v++ {
+		sign[64] = v
+		if verifyEVMSignature(pub, hash, sign) {
+			return sign, nil
+		}
+	}
+	return nil, errors.New("the signature doesn't verify with the public key")
+}
+
+// Verify the signature [R || S || V] of the hash, recovering the public key as ecrecover does.
+func verifyEVMSignature(pub *btcec.PublicKey, hash []byte, sign []byte) bool {
+	if len(sign) != 65 || (sign[64] != 27 && sign[64] != 28) {
+		return false
+	}
+	compact := append([]byte{sign[64]}, sign[:64]...)
+	recovered, _, err := btcec.RecoverCompact(btcec.S256(), compact, hash)
+	return err == nil && recovered.IsEqual(pub)
+}
@@ -0,0 +1,92 @@
+package fpbft
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"proof-of-training/keystore"
+)
+
+// Run the test in a directory of its own, where the key files, certificates and transactions it generates are written.
+// The keystores are locked with the simulation password unless PBFT_KEYSTORE_PASSWORD is set.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	keystore.EnableSimulation()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+}
+
+// Start n nodes N0 to Nn-1 on an in-memory network, with their key files written to the directory of the test.
+// The nodes are changed with configure, if it is not nil, before they listen.
+func memoryCluster(t *testing.T, n int, configure func(*pbft)) (*memoryNetwork, nodeTable, map[string]*pbft) {
+	t.Helper()
+	inTempDir(t)
+	genKeys(defaultSignatureScheme, n)
+	genBlsKeys(n)
+	genX25519Keys(n)
+	network := newMemoryNetwork()
+	nt := nodeTable{}
+	for i := 0; i < n; i++ {
+		nt[fmt.Sprintf("N%d", i)] = fmt.Sprintf("memory/N%d", i)
+	}
+	ready := make(chan bool, n)
+	nodes := make(map[string]*pbft, n)
+	for nodeID, addr := range nt {
+		p := NewPBFT(nodeID, addr, nt, n, 0, 0)
+		p.transport = network.transport(addr, 0, 0)
+		if configure != nil {
+			configure(p)
+		}
+		nodes[nodeID] = p
+		go p.listen(ready)
+	}
+	for i := 0; i < n; i++ {
+		<-ready
+	}
+	return network, nt, nodes
+}
+
+// Four nodes N0 to N3 that don't listen, for the tests that call their handlers directly.
+func idleCluster(t *testing.T) map[string]*pbft {
+	t.Helper()
+	inTempDir(t)
+	genKeys(defaultSignatureScheme, 4)
+	nt := nodeTable{"N0": "memory/N0", "N1": "memory/N1", "N2": "memory/N2", "N3": "memory/N3"}
+	nodes := make(map[string]*pbft)
+	for nodeID, addr := range nt {
+		nodes[nodeID] = NewPBFT(nodeID, addr, nt, len(nt), 0, 0)
+	}
+	return nodes
+}
+
+// The client C1 on the in-memory network, with its key files written to the directory of the test.
+func memoryClient(network *memoryNetwork) *client {
+	genClientKeys(defaultSignatureScheme, 1)
+	return &client{clientAddr: "memory/C1", index: 1, transport: network.transport("memory/C1", 0, 0)}
+}
+
+// Wait until the condition holds on the node, checked under its lock, for up to 30 seconds.
+func eventually(t *testing.T, p *pbft, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		p.lock.Lock()
+		ok := condition()
+		p.lock.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %s", p.node.nodeID, what)
+		}
+	}
+}
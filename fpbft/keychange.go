@@ -0,0 +1,342 @@
+package fpbft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The key of a validator from the sequence number From on. The first key of a validator is the one of its key files,
+// the later ones are set by the key changes the network executed, which are part of the replicated state.
+type KeyEpoch struct {
+	NodeID string
+	From   int
+	//PEM public key of the signature scheme, empty if a revocation left the validator without a key
+	PublicKey []byte
+	//The key replaced a revoked key, which is never accepted again
+	Revocation bool
+}
+
+// Fingerprint of a public key, which names the key in the key changes and in the keystore.
+func keyFingerprint(pubkey []byte) string {
+	if len(pubkey) == 0 {
+		return ""
+	}
+	h := sha256.Sum256(pubkey)
+	return hex.EncodeToString(h[:8])
+}
+
+// Tag of the keystore of the key of the epoch, the tag of the scheme for the first key of the node.
+func (p *pbft) keyTag(e KeyEpoch) string {
+	if e.From == 0 {
+		return string(p.scheme)
+	}
+	return p.newKeyTag(e.PublicKey)
+}
+
+// Tag of the keystore of a key the node replaced its first key with.
+func (p *pbft) newKeyTag(pubkey []byte) string {
+	return string(p.scheme) + "-" + keyFingerprint(pubkey)
+}
+
+// Number of sequence numbers the key replaced by a rotation is still accepted after the new key took effect,
+// for the messages of the replicas that have not executed up to the new key yet.
+func (p *pbft) keyRotationGrace() int {
+	return 4 * p.checkpointPeriod
+}
+
+// The keys of the validator in the order they take effect, starting with the key of its key files.
+func (p *pbft) keyEpochsOf(nodeID string) ([]KeyEpoch, error) {
+	key, ok := p.genesisKeys[nodeID]
+	if !ok {
+		var err error
+		if key, err = readPubKey(string(p.scheme), nodeID); err != nil {
+			return nil, err
+		}
+		p.genesisKeys[nodeID] = key
+	}
+	return append([]KeyEpoch{{NodeID: nodeID, PublicKey: key}}, p.keyEpochs[nodeID]...), nil
+}
+
+// The key changes executed by the network, in the order of the node IDs, kept in the checkpoints.
+func (p *pbft) keyEpochList() []KeyEpoch {
+	epochs := []KeyEpoch{}
+	for _, e := range p.keyEpochs {
+		epochs = append(epochs, e...)
+	}
+	sort.SliceStable(epochs, func(i, j int) bool {
+		return epochs[i].NodeID < epochs[j].NodeID
+	})
+	return epochs
+}
+
+// Replace the key changes with the ones of a fetched state.
+func (p *pbft) setKeyEpochs(epochs []KeyEpoch) {
+	p.keyEpochs = make(map[string][]KeyEpoch)
+	for _, e := range epochs {
+		p.keyEpochs[e.NodeID] = append(p.keyEpochs[e.NodeID], e)
+	}
+}
+
+// The public keys the signatures of the validator are accepted with: the key in effect after the last executed request,
+// the key a rotation has announced, and, for a while after a rotation took effect, the replaced key.
+// A revoked key is never accepted once the revocation has been executed.
+func (p *pbft) acceptedKeys(nodeID string) ([][]byte, error) {
+	epochs, err := p.keyEpochsOf(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	next := p.lastExecuted + 1
+	current := 0
+	for i, e := range epochs {
+		if e.From <= next {
+			current = i
+		}
+	}
+	keys := [][]byte{epochs[current].PublicKey}
+	if current+1 < len(epochs) {
+		keys = append(keys, epochs[current+1].PublicKey)
+	}
+	if current > 0 && !epochs[current].Revocation && next < epochs[current].From+p.keyRotationGrace() {
+		keys = append(keys, epochs[current-1].PublicKey)
+	}
+	return keys, nil
+}
+
+// The verifier of a public key, parsed once.
+func (p *pbft) keyVerifier(pubkey []byte) (Verifier, error) {
+	fingerprint := keyFingerprint(pubkey)
+	if v, ok := p.verifiers[fingerprint]; ok {
+		return v, nil
+	}
+	v, err := p.scheme.parseVerifier(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	p.verifiers[fingerprint] = v
+	return v, nil
+}
+
+// Switch the signer of the node to its key in effect after the last executed request. A node left without a key can't
+// sign any more, and its messages are rejected by the other nodes. A node that can't read the new key of a rotation
+// from its keystore keeps signing with the replaced key while the other nodes accept it, and tries again after every batch.
+func (p *pbft) updateSigner() error {
+	epochs, err := p.keyEpochsOf(p.node.nodeID)
+	if err != nil {
+		return err
+	}
+	next := p.lastExecuted + 1
+	current := 0
+	for i, epoch := range epochs {
+		if epoch.From <= next {
+			current = i
+		}
+	}
+	e := epochs[current]
+	fingerprint := keyFingerprint(e.PublicKey)
+	if fingerprint == p.node.keyFingerprint {
+		return nil
+	}
+	if len(e.PublicKey) == 0 {
+		fmt.Printf("The key of %s has been revoked, it can't sign any more\n", p.node.nodeID)
+		p.node.signer, p.node.keyFingerprint = revokedSigner{}, fingerprint
+		return nil
+	}
+	signer, err := p.loadSigner(e)
+	if err != nil {
+		err = fmt.Errorf("%s can't sign with its key %s: %v", p.node.nodeID, fingerprint, err)
+		if current > 0 && !e.Revocation && keyFingerprint(epochs[current-1].PublicKey) == p.node.keyFingerprint && next < e.From+p.keyRotationGrace() {
+			return fmt.Errorf("%v, it signs with its key %s until %d", err, p.node.keyFingerprint, e.From+p.keyRotationGrace())
+		}
+		p.node.signer = revokedSigner{}
+		return err
+	}
+	p.node.signer, p.node.keyFingerprint = signer, fingerprint
+	fmt.Printf("%s signs with its key %s from %d on\n", p.node.nodeID, fingerprint, next)
+	return nil
+}
+
+// The signer of the key of the epoch, read from the keystore of the node.
+func (p *pbft) loadSigner(e KeyEpoch) (Signer, error) {
+	key, err := readPrivKey(p.keyTag(e), p.node.nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return p.scheme.parseSigner(key)
+}
+
+// The signer of a node without a key. Its signatures are empty, and fail the verification.
+type revokedSigner struct{}
+
+func (revokedSigner) Sign(data []byte) ([]byte, error) {
+	return nil, nil
+}
+
+func (revokedSigner) Verifier() Verifier {
+	return revokedSigner{}
+}
+
+func (revokedSigner) Verify(data, sign []byte) bool {
+	return false
+}
+
+// Check a key change against the keys in effect when the request with the sequence number is executed.
+func (p *pbft) checkKeyChange(kc KeyChange, sequenceID int) error {
+	if _, ok := p.validators[kc.NodeID]; !ok {
+		return fmt.Errorf("%q is not a validator", kc.NodeID)
+	}
+	epochs, err := p.keyEpochsOf(kc.NodeID)
+	if err != nil {
+		return fmt.Errorf("the public key of %s can't be read", kc.NodeID)
+	}
+	latest := epochs[len(epochs)-1]
+	if kc.ReplacedKey != keyFingerprint(latest.PublicKey) {
+		return fmt.Errorf("the key %q is not the latest key of %s", kc.ReplacedKey, kc.NodeID)
+	}
+	if len(kc.PublicKey) > 0 {
+		for _, e := range epochs {
+			if keyFingerprint(e.PublicKey) == keyFingerprint(kc.PublicKey) {
+				return fmt.Errorf("%s has used the key %s before", kc.NodeID, keyFingerprint(kc.PublicKey))
+			}
+		}
+		//The new key signs the change, so a validator can't announce a key it doesn't hold
+		v, err := p.keyVerifier(kc.PublicKey)
+		if err != nil {
+			return fmt.Errorf("the new key is not a %s public key", p.scheme)
+		}
+		if !v.Verify(kc.signContent(), kc.NewKeySign) {
+			return errors.New("the change is not signed by the new key")
+		}
+	}
+	if !kc.Revocation {
+		if len(kc.PublicKey) == 0 {
+			return errors.New("the rotation has no new key")
+		}
+		if latest.From > sequenceID {
+			return fmt.Errorf("the key of %s rotates at %d already", kc.NodeID, latest.From)
+		}
+		if kc.EffectiveSequenceID <= sequenceID {
+			return fmt.Errorf("the new key must take effect after %d", sequenceID)
+		}
+		if len(latest.PublicKey) == 0 {
+			return fmt.Errorf("%s has no key to sign the rotation with", kc.NodeID)
+		}
+		v, err := p.keyVerifier(latest.PublicKey)
+		if err != nil || !v.Verify(kc.signContent(), kc.Sign) {
+			return fmt.Errorf("the rotation is not signed by the key of %s", kc.NodeID)
+		}
+		return nil
+	}
+	if kc.EffectiveSequenceID != 0 {
+		return errors.New("a revocation takes effect at once")
+	}
+	//The validator whose key is revoked has no say, its key may be the one that is compromised
+	approvers := make(map[string]bool)
+	for _, a := range kc.Approvals {
+		if a.NodeID == kc.NodeID || approvers[a.NodeID] {
+			return fmt.Errorf("the approval of %s can't be counted", a.NodeID)
+		}
+		if err := p.verifySignature(a.NodeID, kc.signContent(), a.Sign); err != nil {
+			return fmt.Errorf("the approval of %s is not valid: %v", a.NodeID, err)
+		}
+		approvers[a.NodeID] = true
+	}
+	power, others := p.validators.votingPower(approvers), p.validators.totalPower()-p.validators[kc.NodeID]
+	if 3*power <= 2*others {
+		return fmt.Errorf("the approvals carry %d of the %d voting power of the other validators", power, others)
+	}
+	return nil
+}
+
+// Execute a key change ordered at the sequence number, and return its result for the client, or why the key changes
+// executed before have made it invalid. A rotation takes effect at the sequence number it announces, a revocation
+// right after its own sequence number, and it cancels a rotation that has not taken effect yet.
+func (p *pbft) executeKeyChange(kc KeyChange, sequenceID int) (string, error) {
+	if err := p.checkKeyChange(kc, sequenceID); err != nil {
+		return "", fmt.Errorf("the key change is not valid: %v", err)
+	}
+	if !kc.Revocation {
+		p.keyEpochs[kc.NodeID] = append(p.keyEpochs[kc.NodeID], KeyEpoch{NodeID: kc.NodeID, From: kc.EffectiveSequenceID, PublicKey: kc.PublicKey})
+		return fmt.Sprintf("the key %s of %s is replaced by %s from %d on", kc.ReplacedKey, kc.NodeID, keyFingerprint(kc.PublicKey), kc.EffectiveSequenceID), nil
+	}
+	epochs := []KeyEpoch{}
+	for _, e := range p.keyEpochs[kc.NodeID] {
+		if e.From <= sequenceID {
+			epochs = append(epochs, e)
+		}
+	}
+	p.keyEpochs[kc.NodeID] = append(epochs, KeyEpoch{NodeID: kc.NodeID, From: sequenceID + 1, PublicKey: kc.PublicKey, Revocation: true})
+	if len(kc.PublicKey) == 0 {
+		return fmt.Sprintf("the key %s of %s is revoked, it has no key left", kc.ReplacedKey, kc.NodeID), nil
+	}
+	return fmt.Sprintf("the key %s of %s is revoked and replaced by %s", kc.ReplacedKey, kc.NodeID, keyFingerprint(kc.PublicKey)), nil
+}
+
+// Generate a new key of the node into its keystore, and the rotation to it from the sequence number on,
+// signed by the current key of the node.
+func (p *pbft) newKeyRotation(effectiveSequenceID int) (KeyChange, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	epochs, err := p.keyEpochsOf(p.node.nodeID)
+	if err != nil {
+		return KeyChange{}, err
+	}
+	kc := KeyChange{NodeID: p.node.nodeID, EffectiveSequenceID: effectiveSequenceID, ReplacedKey: keyFingerprint(epochs[len(epochs)-1].PublicKey)}
+	if err := p.addNewKey(&kc); err != nil {
+		return kc, err
+	}
+	kc.Sign = p.sign(kc.signContent())
+	return kc, nil
+}
+
+// A revocation of the latest key of the validator, to be approved by the other validators. On the validator itself
+// a new key is generated into its keystore to replace the revoked one, anywhere else the validator is left without a key.
+func (p *pbft) newKeyRevocation(nodeID string) (KeyChange, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	epochs, err := p.keyEpochsOf(nodeID)
+	if err != nil {
+		return KeyChange{}, err
+	}
+	kc := KeyChange{NodeID: nodeID, ReplacedKey: keyFingerprint(epochs[len(epochs)-1].PublicKey), Revocation: true}
+	if nodeID == p.node.nodeID {
+		if err := p.addNewKey(&kc); err != nil {
+			return kc, err
+		}
+	}
+	return kc, nil
+}
+
+// Generate a new key of the node into its keystore, and sign the change with it.
+func (p *pbft) addNewKey(kc *KeyChange) error {
+	prvkey, pubkey, err := p.scheme.generateKey()
+	if err != nil {
+		return err
+	}
+	if err := writeKeyPair(p.newKeyTag(pubkey), p.node.nodeID, prvkey, pubkey); err != nil {
+		return fmt.Errorf("the new key can't be written to the keystore: %v", err)
+	}
+	signer, err := p.scheme.parseSigner(prvkey)
+	if err != nil {
+		return err
+	}
+	kc.PublicKey = pubkey
+	kc.NewKeySign, err = signer.Sign(kc.signContent())
+	return err
+}
+
+// Approve the revocation of the key of another validator.
+func (p *pbft) approveKeyRevocation(kc KeyChange) (KeyChange, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !kc.Revocation {
+		return kc, errors.New("the key change is not a revocation")
+	}
+	if kc.NodeID == p.node.nodeID {
+		return kc, errors.New("a validator doesn't approve the revocation of its own key")
+	}
+	kc.Approvals = append(kc.Approvals, KeyApproval{NodeID: p.node.nodeID, Sign: p.sign(kc.signContent())})
+	return kc, nil
+}
@@ -0,0 +1,175 @@
+package fpbft
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"proof-of-training/keystore"
+)
+
+// Whether the keys accepted for the validator after the sequence number are exactly the keys.
+func acceptsKeys(t *testing.T, p *pbft, nodeID string, lastExecuted int, keys ...[]byte) {
+	t.Helper()
+	p.lastExecuted = lastExecuted
+	accepted, err := p.acceptedKeys(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accepted) != len(keys) {
+		t.Fatalf("after %d %d keys of %s are accepted, not %d", lastExecuted, len(accepted), nodeID, len(keys))
+	}
+	for i := range keys {
+		if !bytes.Equal(accepted[i], keys[i]) {
+			t.Fatalf("after %d the key %s of %s is accepted instead of %s", lastExecuted, keyFingerprint(accepted[i]), nodeID, keyFingerprint(keys[i]))
+		}
+	}
+}
+
+func TestKeyRotationWindow(t *testing.T) {
+	nodes := idleCluster(t)
+	p, n1 := nodes["N0"], nodes["N1"]
+	genesis := genesisKey(t, p, "N1")
+	rotation, err := n1.newKeyRotation(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkKeyChange(rotation, 10); err == nil {
+		t.Fatal("a rotation taking effect at its own sequence number was accepted")
+	}
+	if err := p.checkKeyChange(rotation, 5); err != nil {
+		t.Fatal(err)
+	}
+	p.executeKeyChange(rotation, 5)
+	//The announced key is accepted before it takes effect, the replaced key for the grace period after
+	acceptsKeys(t, p, "N1", 5, genesis, rotation.PublicKey)
+	acceptsKeys(t, p, "N1", 9, rotation.PublicKey, genesis)
+	grace := p.keyRotationGrace()
+	acceptsKeys(t, p, "N1", 10+grace-2, rotation.PublicKey, genesis)
+	acceptsKeys(t, p, "N1", 10+grace-1, rotation.PublicKey)
+	//A second rotation must replace the latest key
+	p.lastExecuted = 6
+	again, err := n1.newKeyRotation(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkKeyChange(again, 6); err == nil {
+		t.Fatal("a rotation of a replaced key was accepted")
+	}
+}
+
+func TestKeyRevocationWindow(t *testing.T) {
+	nodes := idleCluster(t)
+	p := nodes["N0"]
+	genesis := genesisKey(t, p, "N2")
+	revocation, err := p.newKeyRevocation("N2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nodeID := range []string{"N0", "N1", "N3"} {
+		if err := p.checkKeyChange(revocation, 7); err == nil {
+			t.Fatalf("a revocation approved by %d validators was accepted", len(revocation.Approvals))
+		}
+		if revocation, err = nodes[nodeID].approveKeyRevocation(revocation); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.checkKeyChange(revocation, 7); err != nil {
+		t.Fatal(err)
+	}
+	p.executeKeyChange(revocation, 7)
+	//The revoked key is accepted until the revocation is executed, and never after, without a grace period
+	acceptsKeys(t, p, "N2", 6, genesis, nil)
+	acceptsKeys(t, p, "N2", 7, nil)
+	acceptsKeys(t, p, "N2", 7+p.keyRotationGrace(), nil)
+	if err := p.checkKeyChange(revocation, 8); err == nil {
+		t.Fatal("a revoked key was revoked again")
+	}
+}
+
+// A node that can't read the private key of its rotation keeps signing with the replaced key while it is accepted.
+func TestKeyRotationKeepsSigningDuringGrace(t *testing.T) {
+	nodes := idleCluster(t)
+	p := nodes["N1"]
+	genesis := p.node.keyFingerprint
+	rotation, err := p.newKeyRotation(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.executeKeyChange(rotation, 5)
+	if err := os.Remove(keystore.DefaultStore.Path("N1", p.newKeyTag(rotation.PublicKey))); err != nil {
+		t.Fatal(err)
+	}
+	p.lastExecuted = 9
+	if err := p.updateSigner(); err == nil {
+		t.Fatal("the missing key was not reported")
+	}
+	if _, revoked := p.node.signer.(revokedSigner); revoked || p.node.keyFingerprint != genesis {
+		t.Fatal("the node stopped signing with its replaced key during the grace period")
+	}
+	p.lastExecuted = 10 + p.keyRotationGrace() - 1
+	if err := p.updateSigner(); err == nil {
+		t.Fatal("the missing key was not reported")
+	}
+	if _, revoked := p.node.signer.(revokedSigner); !revoked {
+		t.Fatal("the node signs with its replaced key after the grace period")
+	}
+}
+
+// The client verifies the replies of a validator with the key its rotation took effect with, and refuses the replaced
+// key once the validator signed with the new one.
+func TestClientVerifiesRotatedKey(t *testing.T) {
+	network, nt, nodes := memoryCluster(t, 4, nil)
+	c := memoryClient(network)
+	n1 := nodes["N1"]
+	//The rotation is ordered at 1, and N1 signs with its new key from 2 on
+	rotation, err := n1.newKeyRotation(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, result := c.ClientSubmitKeyChange(nt, rotation, len(nt)); result.Rejected {
+		t.Fatalf("the rotation was rejected: %s", result.Result)
+	}
+	if _, result := c.ClientSendMessageAndListen(nt, "after the rotation", len(nt)); result.Rejected {
+		t.Fatalf("the request was rejected: %s", result.Result)
+	}
+	eventually(t, n1, "N1 didn't sign with its new key", func() bool {
+		return n1.lastExecuted == 2
+	})
+	n1.lock.Lock()
+	reply := n1.lastReplies["C1"]
+	n1.lock.Unlock()
+	if !c.verifyReply(reply) {
+		t.Fatal("the reply signed with the new key was refused")
+	}
+	key, err := readPrivKey(string(defaultSignatureScheme), "N1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := defaultSignatureScheme.parseSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Sign, err = replaced.Sign(reply.signContent()); err != nil {
+		t.Fatal(err)
+	}
+	if c.verifyReply(reply) {
+		t.Fatal("the reply signed with the replaced key was accepted after N1 signed with its new key")
+	}
+	//A key change the replicas rejected is not added to the keys of the validator
+	if _, result := c.ClientSubmitKeyChange(nt, rotation, len(nt)); !result.Rejected {
+		t.Fatalf("the rotation was executed twice: %s", result.Result)
+	}
+	if len(c.keys["N1"]) != 1 || !bytes.Equal(c.keys["N1"][0].PublicKey, rotation.PublicKey) {
+		t.Fatalf("the client knows %d keys of N1", len(c.keys["N1"]))
+	}
+}
+
+func genesisKey(t *testing.T, p *pbft, nodeID string) []byte {
+	t.Helper()
+	epochs, err := p.keyEpochsOf(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return epochs[0].PublicKey
+}
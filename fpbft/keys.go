@@ -0,0 +1,188 @@
+package fpbft
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"proof-of-training/keystore"
+)
+
+// The EVM wallets generated by crypto/wallet/generate.js, relative to the fpbft directory.
+// Node Ni of a secp256k1 network takes the i-th wallet as its validator key.
+const defaultWalletKeysFile = "../crypto/wallet/keys.json"
+
+// Path of a file of the node in the 'Keys' directory, tagged with the signature scheme or the kind of key: Keys/<id>/<id>_<tag>_<kind>.
+func keyFile(tag string, nodeID string, kind string) string {
+	return "Keys/" + nodeID + "/" + nodeID + "_" + tag + "_" + kind
+}
+
+// If the key files of the scheme do not exist in the 'Keys' directory of the current directory, create the directory,
+// and generate public and private keys for each node. The keys of a secp256k1 network are taken from the EVM wallets if there are.
+func genKeys(scheme SignatureScheme, numNodes int) {
+	if scheme == SchemeSecp256k1 && isExist(defaultWalletKeysFile) {
+		if err := importWalletKeys(defaultWalletKeysFile, numNodes); err != nil {
+			log.Panic(err)
+		}
+	}
+	genKeyFiles(string(scheme), numNodes, scheme.generateKey)
+}
+
+// Generate the key files of the tag for each node that doesn't have them yet. The plaintext private key files
+// written before the keystores are moved into the keystore instead.
+func genKeyFiles(tag string, numNodes int, generate func() (prvkey, pubkey []byte, err error)) {
+	generated := false
+	for i := 0; i <= numNodes; i++ {
+		nodeID := "N" + strconv.Itoa(i)
+		if keystore.DefaultStore.Has(nodeID, tag) {
+			continue
+		}
+		if keystore.DefaultStore.HasPlaintext(nodeID, tag) {
+			password, err := keystore.Password()
+			if err != nil {
+				log.Panic(err)
+			}
+			if err := keystore.DefaultStore.Migrate(nodeID, tag, password, keystore.LightScrypt); err != nil {
+				log.Panic(err)
+			}
+			fmt.Printf("the %s private key of %s has been moved into its keystore\n", tag, nodeID)
+			continue
+		}
+		if !generated {
+			fmt.Printf("the %s public and private keys have not been generated yet, generating public and private keys...\n", tag)
+			generated = true
+		}
+		priv, pub, err := generate()
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := writeKeyPair(tag, nodeID, priv, pub); err != nil {
+			log.Panic(err)
+		}
+	}
+	if generated {
+		fmt.Printf("%s public and private keys have been generated for the nodes.\n", tag)
+	}
+}
+
+// Generate the RSA public and private keys of the first networks.
+func genRsaKeys(numNodes int) {
+	genKeys(SchemeRSA, numNodes)
+}
+
+// An EVM wallet as written to keys.json by crypto/wallet/generate.js.
+type walletKey struct {
+	PrivateKey string `json:"privateKey"`
+	Address    string `json:"address"`
+}
+
+// Write the secp256k1 key files of the nodes that don't have one yet from the EVM wallets in the file,
+// node Ni taking the i-th wallet. The address of every wallet is checked against its private key.
+func importWalletKeys(path string, numNodes int) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var wallets []walletKey
+	if err := json.Unmarshal(b, &wallets); err != nil {
+		return err
+	}
+	for i, w := range wallets {
+		if i > numNodes {
+			break
+		}
+		nodeID := "N" + strconv.Itoa(i)
+		if keystore.DefaultStore.Has(nodeID, string(SchemeSecp256k1)) {
+			continue
+		}
+		priv, err := parseEvmPrivateKey(w.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("wallet %d: %v", i, err)
+		}
+		if address := evmAddress(priv.PubKey()); !strings.EqualFold(address, w.Address) {
+			return fmt.Errorf("wallet %d: the private key belongs to %s, not to %s", i, address, w.Address)
+		}
+		prvkey, pubkey := encodeSecp256k1Key(priv)
+		if err := writeKeyPair(string(SchemeSecp256k1), nodeID, prvkey, pubkey); err != nil {
+			return err
+		}
+		fmt.Printf("%s takes the wallet %s as its validator key\n", nodeID, w.Address)
+	}
+	return nil
+}
+
+// Write the key files of the node, the private key encrypted into its keystore.
+// The simulated networks unlock the keys of all their nodes, so their keystores use the light scrypt parameters.
+func writeKeyPair(tag string, nodeID string, priv, pub []byte) error {
+	password, err := keystore.Password()
+	if err != nil {
+		return err
+	}
+	return keystore.DefaultStore.Write(nodeID, tag, priv, pub, password, keystore.LightScrypt)
+}
+
+// Read the public key of the node from the generated public key file.
+func readPubKey(tag string, nodeID string) ([]byte, error) {
+	return keystore.DefaultStore.ReadPublicKey(nodeID, tag)
+}
+
+// Read the private key of the node from its keystore.
+func readPrivKey(tag string, nodeID string) ([]byte, error) {
+	password, err := keystore.Password()
+	if err != nil {
+		return nil, err
+	}
+	return keystore.DefaultStore.ReadPrivateKey(nodeID, tag, password)
+}
+
+// Generate a node key of the tag: a signature scheme, BLS12381 or X25519, PEM encoded as in the key files.
+func GenerateNodeKey(tag string) (prvkey, pubkey []byte, err error) {
+	switch tag {
+	case blsKeyTag:
+		return generateBlsKey()
+	case x25519KeyTag:
+		return generateX25519Key()
+	}
+	return SignatureScheme(tag).generateKey()
+}
+
+// The public key file of a PEM encoded private key of the tag, to import a key generated elsewhere.
+func NodePublicKey(tag string, prvkey []byte) ([]byte, error) {
+	switch tag {
+	case blsKeyTag:
+		return blsPublicKey(prvkey)
+	case x25519KeyTag:
+		priv, err := parseX25519PrivateKey(prvkey)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKIXPublicKey(priv.PublicKey())
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+	}
+	return SignatureScheme(tag).publicKey(prvkey)
+}
+
+// Determine whether the file or folder exists.
+func isExist(path string) bool {
+	_, err := os.Stat(path)
+	if err != nil {
+		if os.IsExist(err) {
+			return true
+		}
+		if os.IsNotExist(err) {
+			return false
+		}
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
@@ -1,32 +1,66 @@
 package fpbft
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"log"
+	"math/big"
 	"math/rand"
 	"net"
 	"sync"
 	"time"
+
+	"proof-of-training/keystore"
 )
 
 func genPBFTSynchronize(numNodes int, data string, clientAddr string, bandwidth float64, latency float64) float64 {
+	stakes := make([]int, numNodes)
+	for i := range stakes {
+		stakes[i] = 1
+	}
+	return genStakedPBFTSynchronize(stakes, defaultSignatureScheme, authSignatures, data, clientAddr, bandwidth, latency)
+}
+
+// Node Ni stakes stakes[i], and its votes weigh according to its stake. The nodes sign with the signature scheme,
+// and authenticate their votes with signatures, quorum certificates or MACs.
+func genStakedPBFTSynchronize(stakes []int, scheme SignatureScheme, auth voteAuthentication, data string, clientAddr string, bandwidth float64, latency float64) float64 {
+	return genSecuredPBFTSynchronize(stakes, scheme, auth, transportPlain, data, clientAddr, bandwidth, latency)
+}
+
+// The nodes and the client connect with plain TCP, or with mutually authenticated TLS.
+func genSecuredPBFTSynchronize(stakes []int, scheme SignatureScheme, auth voteAuthentication, security transportSecurity, data string, clientAddr string, bandwidth float64, latency float64) float64 {
+	keystore.EnableSimulation()
 
 	var wg sync.WaitGroup
 	var elapsedTime float64
 
-	genRsaKeys(numNodes)
+	numNodes := len(stakes)
+	genKeys(scheme, numNodes)
+	genClientKeys(scheme, 1)
+	switch auth {
+	case authQuorumCerts:
+		genBlsKeys(numNodes)
+	case authMACs:
+		genX25519Keys(numNodes)
+	}
 
 	nodeTable := make(map[string]string) // Initialize the map
+	validators := make(validatorSet)
 	for i := 0; i < numNodes; i++ {
 		nodeID := fmt.Sprintf("N%d", i)
 		nodeTable[nodeID] = fmt.Sprintf("127.0.0.1:%d", 8000+i)
+		validators[nodeID] = stakes[i]
 	}
 
 	ready := make(chan bool, numNodes) // Create a buffered channel
 	for i := 0; i < numNodes; i++ {
 		nodeID := fmt.Sprintf("N%d", i)
-		p := NewPBFT(nodeID, nodeTable[nodeID], nodeTable, numNodes, bandwidth, latency)
-		go p.tcpListen(ready) // Pass the 'ready' channel to tcpListen
+		p := NewStakedPBFT(nodeID, nodeTable[nodeID], nodeTable, validators, newMessagePoolApplication(), scheme, bandwidth, latency)
+		p.setVoteAuthentication(auth)
+		p.setTransportSecurity(security)
+		p.setCertificateDir(defaultCertificateDir)
+		go p.listen(ready) // Pass the 'ready' channel to listen
 	}
 
 	for i := 0; i < numNodes; i++ {
@@ -40,25 +74,265 @@ func genPBFTSynchronize(numNodes int, data string, clientAddr string, bandwidth
 		index:      1,
 		bandwidth:  bandwidth,
 		latency:    latency,
+		validators: validators,
+		scheme:     scheme,
+		security:   security,
 	}
+	var result CommittedResult
 	wg.Add(1) // We are adding 1 goroutine we want to wait for
 	go func() {
-		elapsedTime = myClient.ClientSendMessageAndListen(nodeTable, data, numNodes)
+		elapsedTime, result = myClient.ClientSendMessageAndListen(nodeTable, data, numNodes)
 		wg.Done() // Signal that the goroutine is finished
 	}()
 	wg.Wait() // Wait until all goroutines have finished
+	fmt.Printf("The nodes %v replied with the committed result: %s\n", result.NodeIDs, result.Result)
+	return elapsedTime
+}
+
+// Run numNodes nodes and the client in this process over an in-memory network, which exchanges their messages over
+// channels instead of sockets, with the bandwidth and latency of the senders. No port is bound, so networks of hundreds
+// of nodes, or several networks, can run side by side.
+func genMemoryPBFTSynchronize(numNodes int, data string, bandwidth float64, latency float64) float64 {
+	return genMemoryNetworkSynchronize(numNodes, data, bandwidth, latency, nil)
+}
+
+// Run the in-memory network with the connections of every node sharing its uplink, and the primary sending its
+// pre-prepares with the dissemination: directly, its uplink carrying one copy of the batch per node, or down a k-ary
+// tree with the fanout, its uplink carrying fanout copies.
+func genDisseminationPBFTSynchronize(numNodes int, d dissemination, fanout int, data string, bandwidth float64, latency float64) float64 {
+	return genMemoryNetworkSynchronize(numNodes, data, bandwidth, latency, func(p *pbft) {
+		p.shareUplink()
+		p.setDissemination(d, fanout)
+	})
+}
+
+// Every node is configured before it starts, if configure is set.
+func genMemoryNetworkSynchronize(numNodes int, data string, bandwidth float64, latency float64, configure func(p *pbft)) float64 {
+	keystore.EnableSimulation()
+	genKeys(defaultSignatureScheme, numNodes)
+	genClientKeys(defaultSignatureScheme, 1)
+
+	network := newMemoryNetwork()
+	nodeTable := make(map[string]string)
+	for i := 0; i < numNodes; i++ {
+		nodeID := fmt.Sprintf("N%d", i)
+		nodeTable[nodeID] = "memory/" + nodeID
+	}
+
+	ready := make(chan bool, numNodes)
+	for i := 0; i < numNodes; i++ {
+		nodeID := fmt.Sprintf("N%d", i)
+		p := NewPBFT(nodeID, nodeTable[nodeID], nodeTable, numNodes, bandwidth, latency)
+		p.transport = network.transport(nodeTable[nodeID], p.bandwidth, p.latency)
+		if configure != nil {
+			configure(p)
+		}
+		go p.listen(ready)
+	}
+	for i := 0; i < numNodes; i++ {
+		<-ready
+	}
+
+	myClient := client{
+		clientAddr: "memory/C1",
+		index:      1,
+		bandwidth:  bandwidth,
+		latency:    latency,
+		transport:  network.transport("memory/C1", int(bandwidth*1024*1024/8), latency),
+	}
+	elapsedTime, result := myClient.ClientSendMessageAndListen(nodeTable, data, numNodes)
+	fmt.Printf("The nodes %v replied with the committed result: %s\n", result.NodeIDs, result.Result)
 	return elapsedTime
 }
 
-func applyLatency(t float64) {
+// Run the distributed key generation of the session among numNodes nodes signing with the scheme, and return the key
+// they established. Every node writes its key share and the transcript of the session to its directory in 'Keys'.
+func genDKGSynchronize(numNodes int, scheme SignatureScheme, session string) DKGResult {
+	keystore.EnableSimulation()
+	genKeys(scheme, numNodes)
+	genX25519Keys(numNodes)
+
+	nodeTable := make(map[string]string)
+	for i := 0; i < numNodes; i++ {
+		nodeID := fmt.Sprintf("N%d", i)
+		nodeTable[nodeID] = fmt.Sprintf("127.0.0.1:%d", 8000+i)
+	}
+
+	ready := make(chan bool, numNodes)
+	nodes := make([]*pbft, 0, numNodes)
+	for i := 0; i < numNodes; i++ {
+		nodeID := fmt.Sprintf("N%d", i)
+		p := NewStakedPBFT(nodeID, nodeTable[nodeID], nodeTable, equalValidatorSet(nodeTable), newMessagePoolApplication(), scheme, 100, 0)
+		nodes = append(nodes, p)
+		go p.listen(ready)
+	}
+	for i := 0; i < numNodes; i++ {
+		<-ready
+	}
+
+	results := make([]<-chan DKGResult, 0, numNodes)
+	for _, p := range nodes {
+		results = append(results, p.startDKG(session, defaultDKGThreshold(numNodes)))
+	}
+	var result DKGResult
+	for i, ch := range results {
+		r, ok := <-ch
+		if !ok {
+			log.Panicf("N%d failed the DKG session %s", i, session)
+		}
+		if i > 0 && !bytes.Equal(r.PublicKey, result.PublicKey) {
+			log.Panicf("N%d established the key %x instead of %x", i, r.PublicKey, result.PublicKey)
+		}
+		result = r
+	}
+	fmt.Printf("The nodes %v established the threshold key %x\n", result.Qualified, result.PublicKey)
+	return result
+}
+
+// Rotate the key of N1 and revoke the key of N2 in a running network of numNodes nodes signing with the scheme,
+// and show that the network keeps committing requests with the new keys.
+func genKeyChangeSynchronize(numNodes int, scheme SignatureScheme, clientAddr string) {
+	keystore.EnableSimulation()
+	genKeys(scheme, numNodes)
+	genClientKeys(scheme, 1)
+
+	nodeTable := make(map[string]string)
+	for i := 0; i < numNodes; i++ {
+		nodeID := fmt.Sprintf("N%d", i)
+		nodeTable[nodeID] = fmt.Sprintf("127.0.0.1:%d", 8000+i)
+	}
+
+	ready := make(chan bool, numNodes)
+	nodes := make([]*pbft, 0, numNodes)
+	for i := 0; i < numNodes; i++ {
+		nodeID := fmt.Sprintf("N%d", i)
+		p := NewStakedPBFT(nodeID, nodeTable[nodeID], nodeTable, equalValidatorSet(nodeTable), newMessagePoolApplication(), scheme, 100, 0)
+		p.setCertificateDir(defaultCertificateDir)
+		nodes = append(nodes, p)
+		go p.listen(ready)
+	}
+	for i := 0; i < numNodes; i++ {
+		<-ready
+	}
+
+	myClient := client{clientAddr: clientAddr, index: 1, bandwidth: 100, scheme: scheme}
+	_, result := myClient.ClientSendMessageAndListen(nodeTable, "before the key changes", numNodes)
+	fmt.Printf("The nodes %v replied with the committed result: %s\n", result.NodeIDs, result.Result)
+
+	//The rotation is ordered at 2, and N1 signs with its new key from 3 on
+	rotation, err := nodes[1].newKeyRotation(3)
+	if err != nil {
+		log.Panic(err)
+	}
+	_, result = myClient.ClientSubmitKeyChange(nodeTable, rotation, numNodes)
+	fmt.Printf("The nodes %v replied with the committed result: %s\n", result.NodeIDs, result.Result)
+
+	//N2 has lost its key, the other nodes revoke it and leave N2 without a key
+	revocation, err := nodes[0].newKeyRevocation("N2")
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, p := range nodes {
+		if p.node.nodeID == "N2" {
+			continue
+		}
+		if revocation, err = p.approveKeyRevocation(revocation); err != nil {
+			log.Panic(err)
+		}
+	}
+	_, result = myClient.ClientSubmitKeyChange(nodeTable, revocation, numNodes)
+	fmt.Printf("The nodes %v replied with the committed result: %s\n", result.NodeIDs, result.Result)
+
+	_, result = myClient.ClientSendMessageAndListen(nodeTable, "after the key changes", numNodes)
+	fmt.Printf("The nodes %v replied with the committed result: %s\n", result.NodeIDs, result.Result)
+
+	//The certificates signed before and after the key changes verify against the validator set file with the key changes
+	if err := nodes[0].writeValidatorSetFile("validators.json", false); err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("The validator set with the key changes has been written to validators.json")
+}
+
+// Establish the committee key of the session among numNodes nodes signing with the scheme, set it up for threshold ECDSA,
+// and reward the EVM address through the task application. The committee signs the transaction paying out the reward
+// on the chain with the ID, calling the CommitteeRewardContract at the contract address, and the transaction is returned.
+func genTECDSASynchronize(numNodes int, scheme SignatureScheme, session string, chainID uint64, contract string, receiver string, clientAddr string) SignedTransaction {
+	keystore.EnableSimulation()
+	genKeys(scheme, numNodes)
+	genX25519Keys(numNodes)
+	genClientKeys(scheme, 1)
+
+	nodeTable := make(map[string]string)
+	for i := 0; i < numNodes; i++ {
+		nodeID := fmt.Sprintf("N%d", i)
+		nodeTable[nodeID] = fmt.Sprintf("127.0.0.1:%d", 8000+i)
+	}
+
+	ready := make(chan bool, numNodes)
+	nodes := make([]*pbft, 0, numNodes)
+	for i := 0; i < numNodes; i++ {
+		nodeID := fmt.Sprintf("N%d", i)
+		app := newTaskApplication()
+		app.contract = &rewardContract{ChainID: chainID, Address: contract, GasPrice: big.NewInt(10000000000), Gas: 100000}
+		p := NewStakedPBFT(nodeID, nodeTable[nodeID], nodeTable, equalValidatorSet(nodeTable), app, scheme, 100, 0)
+		p.signedTransactions = make(chan SignedTransaction, 1)
+		nodes = append(nodes, p)
+		go p.listen(ready)
+	}
+	for i := 0; i < numNodes; i++ {
+		<-ready
+	}
+
+	results := make([]<-chan DKGResult, 0, numNodes)
+	for _, p := range nodes {
+		results = append(results, p.startDKG(session, defaultDKGThreshold(numNodes)))
+	}
+	for i, ch := range results {
+		if _, ok := <-ch; !ok {
+			log.Panicf("N%d failed the DKG session %s", i, session)
+		}
+	}
+	addresses := make([]<-chan string, numNodes)
+	for i, p := range nodes {
+		go func(i int, p *pbft) {
+			addresses[i] = p.startTECDSASetup(session)
+			ready <- true
+		}(i, p)
+	}
+	for i := 0; i < numNodes; i++ {
+		<-ready
+	}
+	for i, ch := range addresses {
+		address, ok := <-ch
+		if !ok {
+			log.Panicf("N%d failed the threshold ECDSA setup %s", i, session)
+		}
+		fmt.Printf("N%d pays out the rewards from the committee address %s\n", i, address)
+	}
+
+	myClient := client{clientAddr: clientAddr, index: 1, bandwidth: 100, scheme: scheme}
+	_, result := myClient.ClientSendMessageAndListen(nodeTable, "task T1 train a classifier", numNodes)
+	fmt.Printf("The nodes %v replied with the committed result: %s\n", result.NodeIDs, result.Result)
+	_, result = myClient.ClientSendMessageAndListen(nodeTable, "reward T1 "+receiver+" 100", numNodes)
+	fmt.Printf("The nodes %v replied with the committed result: %s\n", result.NodeIDs, result.Result)
+
+	tx := <-nodes[0].signedTransactions
+	fmt.Printf("The committee signed the transaction %s: %s\n", tx.Hash, tx.RawTransaction)
+	return tx
+}
+
+// A random latency between 0.1t and t milliseconds.
+func randomLatency(t float64) time.Duration {
 	r := rand.Float64()            // generates a random float between 0.0 and 1.0
 	latency := 0.1*t + r*(t-0.1*t) // calculate latency in range of 0.1t to t
-	time.Sleep(time.Duration(latency) * time.Millisecond)
+	return time.Duration(latency) * time.Millisecond
 }
 
 type throttledWriter struct {
 	w              io.Writer
 	bandwidthLimit int
+	//The uplink the connection shares with the other connections of the sender, nil if it has the bandwidth to itself
+	uplink *sharedUplink
 }
 
 func (tw *throttledWriter) Write(p []byte) (n int, err error) {
@@ -67,12 +341,17 @@ func (tw *throttledWriter) Write(p []byte) (n int, err error) {
 	for len(p) > 0 {
 		//println("writing the " + strconv.Itoa(kk) + "th chunk....")
 		kk++
-		time.Sleep(time.Second / 10) // Simulate bandwidth limit
 		chunk := p
 		//println(len(chunk))
 		if len(chunk) > chunkSize {
 			chunk = chunk[:chunkSize]
 		}
+		// Simulate bandwidth limit, a full chunk takes a tenth of a second
+		if tw.uplink != nil {
+			tw.uplink.wait(len(chunk))
+		} else {
+			time.Sleep(time.Duration(len(chunk)) * time.Second / time.Duration(tw.bandwidthLimit))
+		}
 		n, err = tw.w.Write(chunk)
 
 		// Check if an error occurred
@@ -91,6 +370,47 @@ func (tw *throttledWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+// The uplink of a sender, shared by all its connections like a real network interface: the bytes sent to any peer
+// wait for the bytes queued before them, so sending a message to n peers takes n times as long as to one.
+type sharedUplink struct {
+	lock           sync.Mutex
+	bandwidthLimit int
+	//When the bytes queued so far will have been sent
+	free time.Time
+}
+
+func newSharedUplink(bandwidthLimit int) *sharedUplink {
+	return &sharedUplink{bandwidthLimit: bandwidthLimit}
+}
+
+// Wait until n bytes have been sent after the ones queued before them.
+func (u *sharedUplink) wait(n int) {
+	u.lock.Lock()
+	start := time.Now()
+	if u.free.After(start) {
+		start = u.free
+	}
+	u.free = start.Add(time.Duration(n) * time.Second / time.Duration(u.bandwidthLimit))
+	free := u.free
+	u.lock.Unlock()
+	time.Sleep(time.Until(free))
+}
+
+// The connections of the node share its bandwidth instead of each having it, so a broadcast is limited by the uplink
+// of the sender. A node without a bandwidth limit has no uplink to share.
+func (p *pbft) shareUplink() {
+	if p.bandwidth <= 0 {
+		return
+	}
+	u := newSharedUplink(p.bandwidth)
+	switch t := p.transport.(type) {
+	case *tcpTransport:
+		t.pool.uplink = u
+	case *memoryTransport:
+		t.uplink = u
+	}
+}
+
 // Generate a random string with the size of `length` bytes
 func randomString(length int) string {
 	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -1,21 +1,15 @@
 package fpbft
 
 import (
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
-	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net"
 	"strconv"
 	"sync"
+	"time"
+
+	"github.com/coinbase/kryptology/pkg/signatures/bls/bls_sig"
 )
 
 type node struct {
@@ -23,10 +17,30 @@ type node struct {
 	nodeID string
 	//Node Listening Address
 	addr string
-	//RSA private key
-	rsaPrivKey []byte
-	//RSA public key
-	rsaPubKey []byte
+	//Signs the messages of the node with its private key
+	signer Signer
+	//Fingerprint of the public key of the signer
+	keyFingerprint string
+	//BLS private key signing the votes of the node in the quorum certificate mode
+	blsKey *bls_sig.SecretKey
+}
+
+// A consensus instance is identified by its view and sequence number.
+type instanceKey struct {
+	view       int
+	sequenceID int
+}
+
+// The vote of a node for an instance, the temporary pools keep one of each.
+type voteKey struct {
+	instanceKey
+	nodeID string
+}
+
+// The quorum certificate of a phase of an instance, the temporary pool keeps one of each.
+type phaseKey struct {
+	instanceKey
+	phase command
 }
 
 type pbft struct {
@@ -34,460 +48,963 @@ type pbft struct {
 	node node
 	//Each request increases the sequence number.
 	sequenceID int
-	//lock
+	//Current view number, the primary of view v is the node N(v mod nodeCount).
+	view int
+	//Whether the node has left its view and waits for the new-view message of p.view.
+	viewChanging bool
+	//lock, held while handling a message or a timer event
 	lock sync.Mutex
 	//
-	//Temporary message pool, the message digest corresponds to the message body.
-	messagePool map[string]Request
+	//Temporary message pool, the batch digest corresponds to the batch of requests.
+	messagePool map[string][]Request
+	//
+	//The nodes whose prepares were received (together with the primary they need more than 2/3 of the voting power), corresponding according to the instance.
+	prePareConfirmCount map[instanceKey]map[string]bool
+	//
+	//Stores the nodes whose commits were received (they need more than 2/3 of the voting power), corresponding according to the instance.
+	commitConfirmCount map[instanceKey]map[string]bool
+	//
+	//Has the broadcast for this instance already been committed
+	isCommitBordcast map[instanceKey]bool
+	//
+	//Batches committed locally and waiting for the lower sequence numbers to be executed, the sequence number corresponds to the batch digest.
+	committedPool map[int]string
+	//
+	//Accepted pre-prepares, corresponding according to the instance.
+	prePreparePool map[instanceKey]PrePrepare
+	//
+	//Prepares received (including its own), corresponding according to the instance and the node ID.
+	preparePool map[instanceKey]map[string]Prepare
+	//
+	//Commits received (including its own), corresponding according to the instance and the node ID.
+	commitPool map[instanceKey]map[string]Commit
+	//
+	//Prepared certificates of this node, corresponding according to the sequence number, sent in view-change messages.
+	preparedCerts map[int]PreparedCert
+	//
+	//In the MAC mode, the latest pre-prepare accepted for every batch, corresponding according to the sequence number and the digest, sent in view-change messages.
+	prePreparedSet map[int]map[string]PrePrepare
+	//
+	//View-change messages received, corresponding according to the new view and the node ID.
+	viewChangePool map[int]map[string]ViewChange
+	//
+	//Has the new-view message already been broadcast for this view (only used by the primary of the view)
+	isNewViewBroadcast map[int]bool
+	//
+	//Timers of the requests the backup is waiting to execute, corresponding according to the digest.
+	requestTimers map[string]*time.Timer
+	//
+	//Timer waiting for the new-view message during a view change
+	viewChangeTimer *time.Timer
+	//
+	//Time a request may wait before the backup suspects the primary, doubled after each failed view change.
+	viewChangeTimeout time.Duration
+	//
+	//Sequence number of the last executed request
+	lastExecuted int
+	//
+	//The last reply sent to every client, corresponding according to the ID of the client that signed the request.
+	//A request is executed only if its timestamp is higher than the one of the last reply, and a retransmitted request
+	//is answered with the cached reply.
+	lastReplies map[string]Reply
+	//
+	//Checkpoint messages received, corresponding according to the sequence number and the node ID.
+	checkpointPool map[int]map[string]Checkpoint
+	//
+	//Sequence number of the stable checkpoint, which is the low watermark h
+	stableSequenceID int
+	//
+	//Matching checkpoint messages with more than 2/3 of the voting power proving the stable checkpoint
+	stableCheckpointProof []Checkpoint
+	//
+	//A checkpoint is taken every checkpointPeriod sequence numbers
+	checkpointPeriod int
 	//
-	//The number of prepares received (at least 2f are needed to be received and confirmed), corresponding according to the digest.
-	prePareConfirmCount map[string]map[string]bool
+	//Directory the commit certificates of the node are written to, none are written if it is empty
+	certificateDir string
 	//
-	//Stores the number of commits received (at least 2f+1 are needed to be received and confirmed), corresponding according to the digest.
-	commitConfirmCount map[string]map[string]bool
+	//Snapshots of the state at the checkpoints taken by this node since the stable one, corresponding according to the sequence number.
+	checkpointSnapshots map[int]StateSnapshot
 	//
-	//Has the broadcast for this message already been committed
-	isCommitBordcast map[string]bool
+	//Sequence number of the stable checkpoint whose state is being fetched from the other nodes, 0 if none
+	fetchingSequenceID int
 	//
-	//Has this message already been replied to the client?
-	isReply map[string]bool
+	//Timer asking the other nodes for the state again if it has not arrived in time
+	stateTransferTimer *time.Timer
+	//
+	//The clients allowed to send requests, corresponding according to the client ID, any client if nil. It is part of
+	//the replicated state, set by the configuration the network starts with and changed by ordered client changes.
+	allowedClients map[string]bool
+	//
+	//Number of client changes executed, which the next client change must name
+	clientChanges int
+	//
+	//Verifiers of the signatures of the clients, corresponding according to the client ID, read from the key files once.
+	clientVerifiers map[string]Verifier
+	//
+	//Rejected messages of the peers, corresponding according to the node ID or the connection the messages are blamed on.
+	misbehaviours map[string]*misbehaviour
+	//
+	//A peer is banned for banDuration once banThreshold of its messages were rejected
+	banThreshold int
+	banDuration  time.Duration
 
 	nodeTable nodeTable
 
 	nodeCount int
 
-	// Local message pool (simulating the persistence layer), only after the confirmation of successful commit will the messages be stored in this pool.
-	localMessagePool []Message
+	//Signature scheme of the network
+	scheme SignatureScheme
+
+	//Verifiers of the signatures of the nodes, corresponding according to the fingerprint of the public key, parsed once.
+	verifiers map[string]Verifier
+
+	//The first public keys of the nodes, corresponding according to the node ID, read from the key files once.
+	genesisKeys map[string][]byte
+
+	//The keys the nodes rotated to, or were given by a revocation, corresponding according to the node ID.
+	//They are part of the replicated state.
+	keyEpochs map[string][]KeyEpoch
+
+	//How the nodes authenticate their prepare and commit votes
+	voteAuth voteAuthentication
+
+	//BLS public keys of the nodes, corresponding according to the node ID, read from the key files once.
+	blsKeys map[string]*bls_sig.PublicKey
+
+	//Session keys shared with the other nodes in the MAC mode, corresponding according to the node ID.
+	sessionKeys map[string][]byte
+
+	//Runs of the distributed key generation, corresponding according to the session ID.
+	dkgSessions map[string]*dkgSession
+	//The part of this node in the DKG sessions it started, corresponding according to the session ID.
+	dkgParticipations map[string]*dkgParticipation
+	//The DKG sessions that have finished, whose messages are ignored
+	dkgFinished map[string]bool
+
+	//Setups of DKG keys for threshold ECDSA, corresponding according to the session ID.
+	tecdsaSetups map[string]*tecdsaSetupSession
+
+	//Signings of transactions with the committee key, corresponding according to the transaction hash.
+	tecdsaSignings map[string]*tecdsaSigning
+
+	//The threshold key the committee signs the transactions of the application with, nil if the node has none
+	committee *tecdsaCommittee
+
+	//Receives the transactions the committee signed, if it is set
+	signedTransactions chan SignedTransaction
+
+	//Validator set, quorums need more than 2/3 of its total voting power
+	validators validatorSet
+
+	//The replicated application executing the committed requests
+	app Application
 
 	// Temp prepare pool (simulating the unconfirmed layer), only after getting the prepare from view will this be moved forward.
-	tempPreparePool []Prepare
+	//One prepare per node and instance, of the views up to maxFutureViews above the current one.
+	tempPreparePool map[voteKey]Prepare
 
 	//Temp commit pool (simulating the unconfirmed layer), only after getting the map true
-	tempCommitPool []Commit
+	tempCommitPool map[voteKey]Commit
+
+	//Temp pre-prepare pool, holding pre-prepares of a view the node has not entered yet, one per instance.
+	tempPrePreparePool map[instanceKey]PrePrepare
+
+	//Temp quorum certificate pool, holding the certificates of instances whose pre-prepare has not been accepted yet, one per phase.
+	tempQuorumCertPool map[phaseKey]QuorumCert
+
+	//Requests received by the primary and not yet ordered, waiting to fill the next batch.
+	requestBatch []Request
+
+	//Size of the requests in requestBatch, in bytes
+	requestBatchBytes int
+
+	//Timer proposing the batch once its first request has waited maxBatchWait
+	batchTimer *time.Timer
+
+	//Bounds of a batch: number of requests, size in bytes and time its first request may wait
+	maxBatchCount int
+	maxBatchBytes int
+	maxBatchWait  time.Duration
 
 	//Bandwidth of nodes, in Mbps
 	bandwidth int
 
 	//latency in milliseconds
 	latency float64
+
+	//Exchanges the messages with the other nodes and the clients, over TCP unless it is set otherwise
+	transport Transport
+
+	//How the node secures its TCP connections to the other nodes and the clients
+	security transportSecurity
+
+	//TLS key and certificate of the node, with mutual TLS
+	tlsIdentity *tlsIdentity
+	//The node IDs of the addresses of the node table, which the node dials expecting their certificates. It is taken
+	//when mutual TLS is set up, so the dials read it without the lock.
+	tlsPeers map[string]string
+
+	//The highest version of the wire protocol the node speaks, and the chain ID of its network
+	wire wireProtocol
+
+	//How the primary sends its pre-prepares, and the fanout of the dissemination tree
+	dissemination dissemination
+	treeFanout    int
+	//Time the primary waits for the prepares of a batch sent down the tree, before it sends the batch directly to the
+	//nodes that have not prepared it
+	disseminationTimeout time.Duration
+	//Pre-prepares the node has relayed down the dissemination tree, corresponding according to the instance
+	relayedPrePrepares map[instanceKey]bool
 }
 
 func NewPBFT(nodeID, addr string, nodeTable nodeTable, nodeCount int, bandwidth float64, latency float64) *pbft {
+	return NewStakedPBFT(nodeID, addr, nodeTable, equalValidatorSet(nodeTable), newMessagePoolApplication(), defaultSignatureScheme, bandwidth, latency)
+}
+
+// Create a node of a network whose validators vote with the power they have staked, replicating the application.
+// The nodes of the network sign with the signature scheme.
+func NewStakedPBFT(nodeID, addr string, nodeTable nodeTable, validators validatorSet, app Application, scheme SignatureScheme, bandwidth float64, latency float64) *pbft {
 	p := new(pbft)
 	p.node.nodeID = nodeID
 	p.node.addr = addr
-	p.node.rsaPrivKey = p.getPivKey(nodeID) //Read from the generated private key file.
-	p.node.rsaPubKey = p.getPubKey(nodeID)  //Read from the generated private key file.
+	p.scheme = scheme
+	p.node.signer = p.getSigner(nodeID) //Read from the generated private key file.
+	p.verifiers = make(map[string]Verifier)
+	p.genesisKeys = make(map[string][]byte)
+	p.keyEpochs = make(map[string][]KeyEpoch)
+	epochs, err := p.keyEpochsOf(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	p.node.keyFingerprint = keyFingerprint(epochs[0].PublicKey)
+	p.blsKeys = make(map[string]*bls_sig.PublicKey)
+	p.dkgSessions = make(map[string]*dkgSession)
+	p.dkgParticipations = make(map[string]*dkgParticipation)
+	p.dkgFinished = make(map[string]bool)
+	p.tecdsaSetups = make(map[string]*tecdsaSetupSession)
+	p.tecdsaSignings = make(map[string]*tecdsaSigning)
 	p.sequenceID = 0
-	p.messagePool = make(map[string]Request)
-	p.prePareConfirmCount = make(map[string]map[string]bool)
-	p.commitConfirmCount = make(map[string]map[string]bool)
-	p.isCommitBordcast = make(map[string]bool)
-	p.isReply = make(map[string]bool)
+	p.messagePool = make(map[string][]Request)
+	p.prePareConfirmCount = make(map[instanceKey]map[string]bool)
+	p.commitConfirmCount = make(map[instanceKey]map[string]bool)
+	p.isCommitBordcast = make(map[instanceKey]bool)
+	p.committedPool = make(map[int]string)
+	p.prePreparePool = make(map[instanceKey]PrePrepare)
+	p.preparePool = make(map[instanceKey]map[string]Prepare)
+	p.commitPool = make(map[instanceKey]map[string]Commit)
+	p.preparedCerts = make(map[int]PreparedCert)
+	p.prePreparedSet = make(map[int]map[string]PrePrepare)
+	p.viewChangePool = make(map[int]map[string]ViewChange)
+	p.isNewViewBroadcast = make(map[int]bool)
+	p.requestTimers = make(map[string]*time.Timer)
+	p.viewChangeTimeout = defaultViewChangeTimeout
+	p.lastReplies = make(map[string]Reply)
+	p.checkpointPool = make(map[int]map[string]Checkpoint)
+	p.checkpointPeriod = defaultCheckpointPeriod
+	p.checkpointSnapshots = make(map[int]StateSnapshot)
+	p.clientVerifiers = make(map[string]Verifier)
+	p.misbehaviours = make(map[string]*misbehaviour)
+	p.banThreshold = defaultBanThreshold
+	p.banDuration = defaultBanDuration
 	p.nodeTable = nodeTable
-	p.nodeCount = nodeCount
-	p.localMessagePool = []Message{}
-	p.tempPreparePool = []Prepare{}
-	p.tempCommitPool = []Commit{}
+	p.nodeCount = len(nodeTable)
+	p.validators = validators
+	p.app = app
+	p.tempPreparePool = make(map[voteKey]Prepare)
+	p.tempCommitPool = make(map[voteKey]Commit)
+	p.tempPrePreparePool = make(map[instanceKey]PrePrepare)
+	p.tempQuorumCertPool = make(map[phaseKey]QuorumCert)
+	p.requestBatch = []Request{}
+	p.maxBatchCount = defaultMaxBatchCount
+	p.maxBatchBytes = defaultMaxBatchBytes
+	p.maxBatchWait = defaultMaxBatchWait
 	p.bandwidth = int(bandwidth * 1024 * 1024 / 8)
 	p.latency = latency
+	p.wire = wireProtocol{version: currentProtocolVersion}
+	p.transport = newTCPTransport(nodeID, p.bandwidth, p.latency)
+	p.treeFanout = defaultTreeFanout
+	p.disseminationTimeout = defaultDisseminationTimeout
+	p.relayedPrePrepares = make(map[instanceKey]bool)
 	return p
 }
 
-func (p *pbft) handleRequest(data []byte) {
-	//Split the message and call different functions based on the message command.
-	cmd, content := splitMessage(data)
-	switch command(cmd) {
+// Handle a message received from the peer. A message that doesn't pass the validation is dropped
+// and counted against the peer it is blamed on, and the messages of banned peers are dropped.
+func (p *pbft) handleRequest(m received) {
+	peer := m.peer
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.isBanned(peer) {
+		return
+	}
+	//Open the envelope of the message and call different functions based on the message command.
+	e, err := parseMessage(m.message)
+	if err != nil {
+		p.recordRejection(peer, reject(reasonMalformed, "%v", err))
+		return
+	}
+	if err := p.wire.check(e, m.version); err != nil {
+		p.recordRejection(peer, err)
+		return
+	}
+	cmd, content := e.Command, e.Payload
+	switch cmd {
 	case cRequest:
-		p.handleClientRequest(content)
+		err = p.handleClientRequest(content)
+	case cReadOnly:
+		err = p.handleReadOnlyRequest(content)
 	case cPrePrepare:
-		p.handlePrePrepare(content)
+		err = p.handlePrePrepare(content)
+	case cTreePrePrepare:
+		err = p.handleTreePrePrepare(content)
 	case cPrepare:
-		p.handlePrepare(content)
+		err = p.handlePrepare(content)
 	case cCommit:
-		p.handleCommit(content)
+		err = p.handleCommit(content)
+	case cViewChange:
+		err = p.handleViewChange(content)
+	case cNewView:
+		err = p.handleNewView(content)
+	case cCheckpoint:
+		err = p.handleCheckpoint(content)
+	case cFetchState:
+		err = p.handleFetchState(content)
+	case cStateSnapshot:
+		err = p.handleStateSnapshot(content)
+	case cQuorumCert:
+		err = p.handleQuorumCert(content)
+	case cTECDSASetup:
+		err = p.handleTECDSASetup(content)
+	case cTECDSASign:
+		err = p.handleTECDSASignRound(content)
+	case cTECDSASig:
+		err = p.handleTECDSASignature(content)
+	default:
+		err = reject(reasonUnknownCommand, "%q", cmd)
+	}
+	if err != nil {
+		p.recordRejection(peer, err)
 	}
 }
 
 // Handle requests coming from the client.
-func (p *pbft) handleClientRequest(content []byte) {
+func (p *pbft) handleClientRequest(content []byte) error {
 	fmt.Println("The primary node has received a request from the client...")
 	//Parsing the Request structure using JSON.
 	r := new(Request)
-	err := json.Unmarshal(content, r)
-	if err != nil {
-		log.Panic(err)
+	if err := decodeMessage(content, r); err != nil {
+		return err
 	}
-	//add sequence number
-	p.sequenceIDAdd()
-	//fetch digest
-	digest := getDigest(*r)
-	fmt.Println("The request has been stored in the temporary message pool.")
-	//Store in the temporary message pool.
-	p.messagePool[digest] = *r
-	//The primary node signs the message digest.
-	digestByte, _ := hex.DecodeString(digest)
-	signInfo := p.RsaSignWithSha256(digestByte, p.node.rsaPrivKey)
-	//Assembled into PrePrepare, ready to be sent to follower nodes.
-	pp := PrePrepare{*r, digest, p.sequenceID, signInfo}
-	b, err := json.Marshal(pp)
-	if err != nil {
-		log.Panic(err)
+	if r.ClientAddr == "" {
+		return reject(reasonInvalidMessage, "the request has no client address")
+	}
+	if r.DKG != nil && p.staleDKGRequest(*r) {
+		return nil
+	}
+	if last, ok := p.lastReplies[r.Client]; ok && r.Timestamp <= last.Timestamp {
+		//The request has been executed already, a retransmission of the last one is answered from the cache
+		if r.Timestamp == last.Timestamp {
+			p.sendReply(last)
+		}
+		return nil
+	}
+	//Requests that are not signed by their client, or that the client may not make, are answered with an error
+	if err := p.authenticateRequest(*r); err != nil {
+		if r.DKG != nil {
+			//The validator that sent the DKG message is not a client waiting for a reply
+			return reject(reasonInvalidMessage, "the DKG request of %s can't be ordered: %v", r.Client, err)
+		}
+		p.rejectRequest(*r, err)
+		return nil
+	}
+	//Read-only requests do not modify the state, so only the other requests are validated.
+	//Key changes, client changes and DKG messages are not requests of the application, they are checked against the keys of the validators.
+	if r.KeyChange != nil {
+		if err := p.checkKeyChange(*r.KeyChange, p.lastExecuted+1); err != nil {
+			p.rejectRequest(*r, fmt.Errorf("the key change is not valid: %v", err))
+			return nil
+		}
+	} else if r.ClientChange != nil {
+		if err := p.checkClientChange(*r.ClientChange); err != nil {
+			p.rejectRequest(*r, fmt.Errorf("the client change is not valid: %v", err))
+			return nil
+		}
+	} else if !r.ReadOnly && r.DKG == nil {
+		if err := p.app.Validate(*r); err != nil {
+			p.rejectRequest(*r, fmt.Errorf("the request is not valid: %v", err))
+			return nil
+		}
+	}
+	if err := p.authorizeRequest(*r); err != nil {
+		p.rejectRequest(*r, err)
+		return nil
+	}
+	if p.viewChanging {
+		fmt.Println("This node is changing its view, refuse to assign a sequence number")
+		return nil
+	}
+	if !p.isPrimary() {
+		p.forwardClientRequest(*r)
+		return nil
+	}
+	for _, pending := range p.requestBatch {
+		if pending.Client == r.Client && pending.Timestamp == r.Timestamp {
+			//A retransmission of a request that is waiting to be ordered
+			return nil
+		}
+	}
+	p.addToBatch(*r)
+	return nil
+}
+
+// Answer a read-only request immediately from the committed state, without ordering it.
+// The reply is not kept as the last reply to the client, as the request is not executed by the other replicas in order.
+func (p *pbft) handleReadOnlyRequest(content []byte) error {
+	r := new(Request)
+	if err := decodeMessage(content, r); err != nil {
+		return err
+	}
+	if r.ClientAddr == "" {
+		return reject(reasonInvalidMessage, "the request has no client address")
+	}
+	if !r.ReadOnly {
+		fmt.Println("The request is not read-only, refusing to answer it without ordering it")
+		return nil
+	}
+	if err := p.authenticateRequest(*r); err != nil {
+		p.rejectRequest(*r, err)
+		return nil
+	}
+	if err := p.authorizeRequest(*r); err != nil {
+		p.rejectRequest(*r, err)
+		return nil
 	}
-	fmt.Println("Broadcasting PrePrepare to other nodes...")
-	//Broadcast PrePrepare
-	p.broadcast(cPrePrepare, b)
-	fmt.Println("PrePrepare broadcast completed.")
+	reply := Reply{View: p.view, Timestamp: r.Timestamp, ClientID: r.ClientAddr, Client: r.Client, NodeID: p.node.nodeID, Result: p.app.Query(*r)}
+	reply.Sign = p.sign(reply.signContent())
+	p.sendReply(reply)
+	return nil
+}
+
+// A backup forwards a request the client broadcast to the primary, and suspects the primary
+// if the request is not executed in time. Each request is forwarded once per view.
+func (p *pbft) forwardClientRequest(r Request) {
+	digest := getDigest(r)
+	if _, ok := p.requestTimers[digest]; ok {
+		return
+	}
+	fmt.Printf("%s is forwarding the request to the primary %s\n", p.node.nodeID, p.primaryOf(p.view))
+	p.send(cRequest, r, p.nodeTable[p.primaryOf(p.view)])
+	p.startRequestTimer(digest)
 }
 
 // Process PrePrepare message
-func (p *pbft) handlePrePrepare(content []byte) {
+func (p *pbft) handlePrePrepare(content []byte) error {
 	//fmt.Println("This node has received the PrePrepare message sent by the primary node ...")
 	//Parse out the PrePrepare structure using JSON
 	pp := new(PrePrepare)
-	err := json.Unmarshal(content, pp)
-	if err != nil {
-		log.Panic(err)
+	if err := decodeMessage(content, pp); err != nil {
+		return err
 	}
-	//To obtain the public key of the primary node for digital signature verification
-	primaryNodePubKey := p.getPubKey("N0")
-	digestByte, _ := hex.DecodeString(pp.Digest)
-	if digest := getDigest(pp.RequestMessage); digest != pp.Digest {
-		fmt.Println("The digest doesn't match, refuse to broadcast prepare")
-	} else if p.sequenceID+1 != pp.SequenceID {
-		fmt.Println("The message sequence number doesn't match, refuse to broadcast prepare")
-	} else if !p.RsaVerySignWithSha256(digestByte, pp.Sign, primaryNodePubKey) {
-		fmt.Println("The primary node signature verification failed! Refusing to broadcast prepare")
-	} else {
-		//Assigning the sequence number
-		p.sequenceID = pp.SequenceID
-		//Storing the information in the temporary message pool
-		//fmt.Println("The message has been stored in the temporary node pool")
-		p.messagePool[pp.Digest] = pp.RequestMessage
-		//The node signs it with its private key
-		// Handles the tempPreparePool and tempCommitPool and execute prepare or commit
-		//it will be broadcasted by primary node so it will be executed only once
-		p.handleTempPool()
+	return p.processPrePrepare(pp)
+}
 
-		sign := p.RsaSignWithSha256(digestByte, p.node.rsaPrivKey)
-		//Concatenate to form a Prepare message
-		pre := Prepare{pp.Digest, pp.SequenceID, p.node.nodeID, sign}
-		bPre, err := json.Marshal(pre)
-		if err != nil {
-			log.Panic(err)
+// Validate a pre-prepare received directly or down the dissemination tree, and accept it if it is for the current view.
+func (p *pbft) processPrePrepare(pp *PrePrepare) error {
+	if err := checkVote(pp.View, pp.SequenceID, pp.Digest); err != nil {
+		return err
+	}
+	if len(pp.RequestBatch) == 0 || getBatchDigest(pp.RequestBatch) != pp.Digest {
+		//The signature covers the digest only, so the batch may have been replaced by anyone
+		return reject(reasonBadDigest, "the batch doesn't match the digest of the pre-prepare")
+	}
+	//Verify the signature of the primary node of the view before the message is kept
+	primary := p.primaryOf(pp.View)
+	if err := p.verifySender(primary, voteSignContent(cPrePrepare, pp.View, pp.SequenceID, pp.Digest), pp.Sign); err != nil {
+		return err
+	}
+	if !p.inViewWindow(pp.View) {
+		return rejectSigned(reasonInvalidMessage, primary, "the pre-prepare is for view %d, too far above view %d", pp.View, p.view)
+	}
+	//A correct primary only orders signed requests. Whether the client is allowed to send them is checked when they
+	//are executed, against the allow-list of the replicated state, which may change before.
+	for _, r := range pp.RequestBatch {
+		if r.isNull() {
+			continue
 		}
+		if err := p.authenticateRequest(r); errors.Is(err, errUnknownClient) {
+			//The primary may know a key this node doesn't, which proves nothing against it
+			fmt.Printf("The batch of sequence number %d holds a request this node can't authenticate: %v\n", pp.SequenceID, err)
+		} else if err != nil {
+			return rejectSigned(reasonInvalidMessage, primary, "the batch of sequence number %d holds a request that can't be ordered: %v", pp.SequenceID, err)
+		}
+	}
+	//Pre-prepares may arrive in any order, but the primary must not assign a sequence number twice in a view
+	if accepted, ok := p.prePreparePool[instanceKey{pp.View, pp.SequenceID}]; ok {
+		if accepted.Digest != pp.Digest {
+			return rejectSigned(reasonEquivocation, primary, "sequence number %d of view %d has been assigned to another batch", pp.SequenceID, pp.View)
+		}
+		//Duplicate of an accepted pre-prepare
+		return nil
+	}
+	if pp.View > p.view || (pp.View == p.view && p.viewChanging) {
+		//The node has not entered this view yet, keep it until the new-view message arrives, one per instance
+		key := instanceKey{pp.View, pp.SequenceID}
+		if _, kept := p.tempPrePreparePool[key]; !kept && p.inWatermarks(pp.SequenceID) {
+			p.tempPrePreparePool[key] = *pp
+		}
+	} else if pp.View != p.view {
+		fmt.Println("The message view doesn't match, refuse to broadcast prepare")
+	} else if !p.inWatermarks(pp.SequenceID) {
+		fmt.Println("The message sequence number is out of the watermarks, refuse to broadcast prepare")
+	} else {
+		//Keep track of the highest assigned sequence number
+		if pp.SequenceID > p.sequenceID {
+			p.sequenceID = pp.SequenceID
+		}
+		p.acceptPrePrepare(*pp)
+	}
+	return nil
+}
 
-		//fmt.Println("broadcasting the Prepare message...")
-		p.broadcast(cPrepare, bPre)
-		//fmt.Println("Prepare broadcast is completed.")
-
+// Store an accepted pre-prepare, broadcast the prepare of this node and start waiting for the request.
+func (p *pbft) acceptPrePrepare(pp PrePrepare) {
+	//Storing the information in the temporary message pool
+	//fmt.Println("The message has been stored in the temporary node pool")
+	p.messagePool[pp.Digest] = pp.RequestBatch
+	p.prePreparePool[instanceKey{pp.View, pp.SequenceID}] = pp
+	p.recordPrePrepared(pp)
+	if pp.SequenceID > p.lastExecuted && !pp.RequestBatch[0].isNull() {
+		p.startRequestTimer(pp.Digest)
+	}
+	//The node signs it with its private key
+	sign, authenticator := p.authenticateVote(cPrepare, pp.View, pp.SequenceID, pp.Digest)
+	//Concatenate to form a Prepare message
+	pre := Prepare{Digest: pp.Digest, View: pp.View, SequenceID: pp.SequenceID, NodeID: p.node.nodeID, Sign: sign, Authenticator: authenticator}
+	if p.voteAuth == authQuorumCerts {
+		//The collector answers with the prepare quorum certificate
+		p.sendToCollector(cPrepare, pre, pp.View)
+		p.handleTempPool()
+		return
 	}
+
+	//fmt.Println("broadcasting the Prepare message...")
+	p.broadcast(cPrepare, pre)
+	//fmt.Println("Prepare broadcast is completed.")
+
+	// Handles the tempPreparePool and tempCommitPool and execute prepare or commit
+	//it will be broadcasted by primary node so it will be executed only once
+	p.handleTempPool()
+	p.prepareStageHandle(pre)
 }
 
 // Process the Prepare message
-func (p *pbft) handlePrepare(content []byte) {
+func (p *pbft) handlePrepare(content []byte) error {
 	//Parse out the Prepare structure using JSON
 	pre := new(Prepare)
-	err := json.Unmarshal(content, pre)
-	if err != nil {
-		log.Panic(err)
+	if err := decodeMessage(content, pre); err != nil {
+		return err
 	}
 	//fmt.Printf("The node has received Prepare from node %s ... \n", pre.NodeID)
-	//To obtain the public key of the message source node for digital signature verification
-	MessageNodePubKey := p.getPubKey(pre.NodeID)
-	digestByte, _ := hex.DecodeString(pre.Digest)
-	if _, ok := p.messagePool[pre.Digest]; !ok {
-		p.tempPreparePool = append(p.tempPreparePool, *pre)
-	} else if p.sequenceID != pre.SequenceID {
-		fmt.Println("The message sequence number doesn't match. Refusing to execute commit broadcast")
-	} else if !p.RsaVerySignWithSha256(digestByte, pre.Sign, MessageNodePubKey) {
-		fmt.Println("The node signature verification failed! Refusing to execute commit broadcast")
+	if err := checkVote(pre.View, pre.SequenceID, pre.Digest); err != nil {
+		return err
+	}
+	//Verify the signature of the message source node before the message is kept
+	if err := p.verifyVote(pre.NodeID, cPrepare, pre.View, pre.SequenceID, pre.Digest, pre.Sign, pre.Authenticator); err != nil {
+		return err
+	}
+	if pre.NodeID == p.primaryOf(pre.View) {
+		//The pre-prepare counts as the prepare of the primary, a second vote would count twice
+		return rejectSigned(reasonInvalidMessage, pre.NodeID, "the primary of view %d sent a prepare", pre.View)
+	}
+	if p.voteAuth == authQuorumCerts && !p.isCollector(pre.View) {
+		return rejectSigned(reasonInvalidMessage, pre.NodeID, "the prepare was sent to %s, which doesn't collect the votes of view %d", p.node.nodeID, pre.View)
+	}
+	if !p.inViewWindow(pre.View) {
+		return rejectSigned(reasonInvalidMessage, pre.NodeID, "the prepare is for view %d, too far above view %d", pre.View, p.view)
+	}
+	pp, ok := p.prePreparePool[instanceKey{pre.View, pre.SequenceID}]
+	if !p.inWatermarks(pre.SequenceID) {
+		fmt.Println("The message sequence number is out of the watermarks. Refusing to execute commit broadcast")
+	} else if pre.View > p.view || (pre.View == p.view && p.viewChanging) || (pre.View == p.view && !ok) {
+		key := voteKey{instanceKey{pre.View, pre.SequenceID}, pre.NodeID}
+		if _, kept := p.tempPreparePool[key]; !kept {
+			p.tempPreparePool[key] = *pre
+		}
+	} else if pre.View != p.view {
+		fmt.Println("The message view doesn't match. Refusing to execute commit broadcast")
+	} else if pp.Digest != pre.Digest {
+		fmt.Println("The digest doesn't match. Refusing to execute commit broadcast")
 	} else {
-		p.prepareStageHandle(*pre, digestByte)
+		p.prepareStageHandle(*pre)
 	}
+	return nil
 }
 
 // Processing the commit
-func (p *pbft) handleCommit(content []byte) {
+func (p *pbft) handleCommit(content []byte) error {
 	//Parse out the Commit structure using JSON
 	c := new(Commit)
-	err := json.Unmarshal(content, c)
-	if err != nil {
-		log.Panic(err)
+	if err := decodeMessage(content, c); err != nil {
+		return err
 	}
 	//fmt.Printf("The node has received Commit from node %s ... \n", c.NodeID)
-	//To obtain the public key of the message source node for digital signature verification
-	MessageNodePubKey := p.getPubKey(c.NodeID)
-	digestByte, _ := hex.DecodeString(c.Digest)
-
-	if _, ok := p.prePareConfirmCount[c.Digest]; !ok {
-		p.tempCommitPool = append(p.tempCommitPool, *c)
-	} else if p.sequenceID != c.SequenceID {
-		fmt.Println("The message sequence number doesn't match. Refusing to persist the information to the local message pool")
-	} else if !p.RsaVerySignWithSha256(digestByte, c.Sign, MessageNodePubKey) {
-		fmt.Println("The node signature verification failed! Refusing to persist the information to the local message pool")
-	} else {
-		p.setCommitConfirmMap(c.Digest, c.NodeID, true)
-		count := 0
-		for range p.commitConfirmCount[c.Digest] {
-			count++
-		}
-		//If a node has received at least 2f+1 commit messages (including itself), and the node has not replied before,
-		//and a commit broadcast has been performed, then the information is submitted to the local message pool,
-		//and a successful flag is replied to the client!
-		p.lock.Lock()
-		if count >= p.nodeCount/3*2 && !p.isReply[c.Digest] && p.isCommitBordcast[c.Digest] {
-			//fmt.Println("This node has received at least 2f + 1 Commit messages (including the local node) from other nodes ...")
-			//The message information is being submitted to the local message pool!
-			p.localMessagePool = append(p.localMessagePool, p.messagePool[c.Digest].Message)
-			info := p.node.nodeID + "node has put msgid:" + strconv.Itoa(p.messagePool[c.Digest].ID) + "into the local message pool,message content：" + p.messagePool[c.Digest].Content
-			//fmt.Println(info)
-			//fmt.Println("Replying to client ...")
-			tcpDial([]byte(info), p.messagePool[c.Digest].ClientAddr, p.bandwidth, p.latency)
-			p.isReply[c.Digest] = true
-			//fmt.Println("replying done!")
+	if err := checkVote(c.View, c.SequenceID, c.Digest); err != nil {
+		return err
+	}
+	//Verify the signature of the message source node before the message is kept
+	if err := p.verifyVote(c.NodeID, cCommit, c.View, c.SequenceID, c.Digest, c.Sign, c.Authenticator); err != nil {
+		return err
+	}
+	if p.voteAuth == authQuorumCerts && !p.isCollector(c.View) {
+		return rejectSigned(reasonInvalidMessage, c.NodeID, "the commit was sent to %s, which doesn't collect the votes of view %d", p.node.nodeID, c.View)
+	}
+	if !p.inViewWindow(c.View) {
+		return rejectSigned(reasonInvalidMessage, c.NodeID, "the commit is for view %d, too far above view %d", c.View, p.view)
+	}
+	pp, ok := p.prePreparePool[instanceKey{c.View, c.SequenceID}]
+
+	if !p.inWatermarks(c.SequenceID) {
+		fmt.Println("The message sequence number is out of the watermarks. Refusing to persist the information to the local message pool")
+	} else if c.View > p.view || (c.View == p.view && p.viewChanging) || (c.View == p.view && !ok) {
+		key := voteKey{instanceKey{c.View, c.SequenceID}, c.NodeID}
+		if _, kept := p.tempCommitPool[key]; !kept {
+			p.tempCommitPool[key] = *c
 		}
-		p.lock.Unlock()
+	} else if c.View != p.view {
+		fmt.Println("The message view doesn't match. Refusing to persist the information to the local message pool")
+	} else if pp.Digest != c.Digest {
+		fmt.Println("The digest doesn't match. Refusing to persist the information to the local message pool")
+	} else {
+		p.commitStageHandle(*c)
 	}
+	return nil
 }
 
 // Add sequenceID
 func (p *pbft) sequenceIDAdd() {
-	p.lock.Lock()
 	p.sequenceID++
-	p.lock.Unlock()
 }
 
-// Broadcasting to other nodes except itself
-func (p *pbft) broadcast(cmd command, content []byte) {
-	message := jointMessage(cmd, content)
+// The node ID of the primary of the view.
+func (p *pbft) primaryOf(view int) string {
+	return "N" + strconv.Itoa(view%p.nodeCount)
+}
+
+// Whether this node is the primary of its current view.
+func (p *pbft) isPrimary() bool {
+	return p.primaryOf(p.view) == p.node.nodeID
+}
+
+// Send a message to the node or client at the address
+func (p *pbft) send(cmd command, msg interface{}, addr string) {
+	p.transport.Send(addr, p.wire.encode(p.node.nodeID, cmd, msg))
+}
+
+// Broadcasting to other nodes except itself, the message is encoded once for all of them
+func (p *pbft) broadcast(cmd command, msg interface{}) {
+	addrs := make([]string, 0, len(p.nodeTable))
 	for i := range p.nodeTable {
 		if i == p.node.nodeID {
 			continue
 		}
-
-		go tcpDial(message, p.nodeTable[i], p.bandwidth, p.latency)
+		addrs = append(addrs, p.nodeTable[i])
 	}
+	p.transport.Broadcast(addrs, p.wire.encode(p.node.nodeID, cmd, msg))
 }
 
 // Allocating assignment for multiple mappings
-func (p *pbft) setPrePareConfirmMap(val, val2 string, b bool) {
-	if _, ok := p.prePareConfirmCount[val]; !ok {
-		p.prePareConfirmCount[val] = make(map[string]bool)
+func (p *pbft) setPrePareConfirmMap(key instanceKey, nodeID string, b bool) {
+	if _, ok := p.prePareConfirmCount[key]; !ok {
+		p.prePareConfirmCount[key] = make(map[string]bool)
 	}
-	p.prePareConfirmCount[val][val2] = b
+	p.prePareConfirmCount[key][nodeID] = b
 }
 
 // Allocating assignment for multiple mappings
-func (p *pbft) setCommitConfirmMap(val, val2 string, b bool) {
-	if _, ok := p.commitConfirmCount[val]; !ok {
-		p.commitConfirmCount[val] = make(map[string]bool)
+func (p *pbft) setCommitConfirmMap(key instanceKey, nodeID string, b bool) {
+	if _, ok := p.commitConfirmCount[key]; !ok {
+		p.commitConfirmCount[key] = make(map[string]bool)
 	}
-	p.commitConfirmCount[val][val2] = b
+	p.commitConfirmCount[key][nodeID] = b
 }
 
-// Pass the node number to obtain the corresponding public key
-func (p *pbft) getPubKey(nodeID string) []byte {
-	key, err := ioutil.ReadFile("Keys/" + nodeID + "/" + nodeID + "_RSA_PUB")
+// Pass the node number and obtain the signer of its private key
+func (p *pbft) getSigner(nodeID string) Signer {
+	key, err := readPrivKey(string(p.scheme), nodeID)
 	if err != nil {
 		log.Panic(err)
 	}
-	return key
-}
-
-// Pass the node number and obtain the corresponding private key
-func (p *pbft) getPivKey(nodeID string) []byte {
-	key, err := ioutil.ReadFile("Keys/" + nodeID + "/" + nodeID + "_RSA_PIV")
+	signer, err := p.scheme.parseSigner(key)
 	if err != nil {
 		log.Panic(err)
 	}
-	return key
+	return signer
 }
 
-// Digital signature
-func (p *pbft) RsaSignWithSha256(data []byte, keyBytes []byte) []byte {
-	h := sha256.New()
-	h.Write(data)
-	hashed := h.Sum(nil)
-	block, _ := pem.Decode(keyBytes)
-	if block == nil {
-		panic(errors.New("private key error"))
-	}
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		fmt.Println("ParsePKCS8PrivateKey err", err)
-		panic(err)
-	}
-
-	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed)
+// Digital signature of the node
+func (p *pbft) sign(data []byte) []byte {
+	signature, err := p.node.signer.Sign(data)
 	if err != nil {
-		fmt.Printf("Error from signing: %s\n", err)
-		panic(err)
+		log.Panic(err)
 	}
-
 	return signature
 }
 
-// Verify signature
-func (p *pbft) RsaVerySignWithSha256(data, signData, keyBytes []byte) bool {
-	block, _ := pem.Decode(keyBytes)
-	if block == nil {
-		panic(errors.New("public key error"))
-	}
-	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err != nil {
-		panic(err)
-	}
-
-	hashed := sha256.Sum256(data)
-	err = rsa.VerifyPKCS1v15(pubKey.(*rsa.PublicKey), crypto.SHA256, hashed[:], signData)
-	if err != nil {
-		panic(err)
-	}
-	return true
-}
-
-// TCP listening from node side
-func (p *pbft) tcpListen(ready chan<- bool) {
-
-	//println("starting")
-	listen, err := net.Listen("tcp", p.node.addr)
+// Listen on the address of the node, and handle the messages the transport receives one after the other
+func (p *pbft) listen(ready chan<- bool) {
+	messages, err := p.transport.Listen(p.node.addr, p.wire)
 	if err != nil {
 		log.Panic(err)
 	}
 	//fmt.Printf("Node listening starts, address：%s\n", p.node.addr)
-	defer listen.Close()
-
 	ready <- true // Signal that the server is ready
-	for {
-		conn, err := listen.Accept()
-		if err != nil {
-			log.Panic(err)
-		}
-		b, err := ioutil.ReadAll(conn)
-		if err != nil {
-			log.Panic(err)
-		}
-		p.handleRequest(b)
+	for m := range messages {
+		p.handleRequest(m)
 	}
-
 }
 
-func (p *pbft) prepareStageHandle(pre Prepare, digestByte []byte) {
+func (p *pbft) prepareStageHandle(pre Prepare) {
 
-	p.setPrePareConfirmMap(pre.Digest, pre.NodeID, true)
-
-	count := p.getPrepareCount(pre)
+	key := instanceKey{pre.View, pre.SequenceID}
+	p.setPrePareConfirmMap(key, pre.NodeID, true)
+	if _, ok := p.preparePool[key]; !ok {
+		p.preparePool[key] = make(map[string]Prepare)
+	}
+	p.preparePool[key][pre.NodeID] = pre
 
-	specifiedCount := p.getSpecifiedPrepareCount()
+	power := p.getPreparePower(pre)
+	if p.voteAuth != authQuorumCerts {
+		//The pre-prepare of the primary counts as its prepare, except in the quorum certificate mode where the primary adds one
+		power += p.validators[p.primaryOf(pre.View)]
+	}
 
-	//To obtain the public key of the message source node for digital signature verification
-	if count >= specifiedCount && !p.isCommitBordcast[pre.Digest] {
+	if p.validators.isQuorum(power) && !p.isCommitBordcast[key] {
 
-		p.finalizePrepare(digestByte, pre)
+		if p.voteAuth == authQuorumCerts {
+			if err := p.broadcastQuorumCert(cPrepare, key); err != nil {
+				fmt.Printf("%s can't certify the prepares of %d: %v\n", p.node.nodeID, key.sequenceID, err)
+			}
+		} else {
+			p.finalizePrepare(pre)
+		}
 
 	}
 
 }
 
-func (p *pbft) getSpecifiedPrepareCount() int {
-	//Because the primary node does not send Prepare, it does not include itself
-	specifiedCount := 0
-	if p.node.nodeID == "N0" {
-		specifiedCount = p.nodeCount / 3 * 2
-	} else {
-		specifiedCount = (p.nodeCount / 3 * 2) - 1
-	}
-	return specifiedCount
+// Voting power of the backups whose prepares were received, including the node's own (the primary node does not send Prepare)
+func (p *pbft) getPreparePower(pre Prepare) int {
+	return p.validators.votingPower(p.prePareConfirmCount[instanceKey{pre.View, pre.SequenceID}])
 }
 
-func (p *pbft) getPrepareCount(pre Prepare) int {
-	count := 0
-	for range p.prePareConfirmCount[pre.Digest] {
-		count++
-	}
-	return count
-}
-
-func (p *pbft) finalizePrepare(digestByte []byte, pre Prepare) {
-	//If a node has received at least 2f Prepare messages (including itself) and
+func (p *pbft) finalizePrepare(pre Prepare) {
+	//If the prepares received (including its own) and the pre-prepare carry more than 2/3 of the voting power and
 	//has not yet performed a commit broadcast, it will proceed with a commit broadcast
-	p.lock.Lock()
 	//fmt.Println("This node has received at least 2f Prepare messages (including the local node) from other nodes ...")
-	//The node signs it with its private key
-	sign := p.RsaSignWithSha256(digestByte, p.node.rsaPrivKey)
-	c := Commit{pre.Digest, pre.SequenceID, p.node.nodeID, sign}
-	bc, err := json.Marshal(c)
-	if err != nil {
-		log.Panic(err)
+	key := instanceKey{pre.View, pre.SequenceID}
+	//Keep the prepared certificate in case the view has to be changed
+	cert := PreparedCert{PrePrepare: p.prePreparePool[key]}
+	//The prepares of the MAC mode can't convince other nodes, so its certificate is only a claim
+	if p.voteAuth == authSignatures {
+		for _, prepare := range p.preparePool[key] {
+			cert.Prepares = append(cert.Prepares, prepare)
+		}
 	}
+	p.preparedCerts[pre.SequenceID] = cert
+	//The node signs it with its private key
+	sign, authenticator := p.authenticateVote(cCommit, pre.View, pre.SequenceID, pre.Digest)
+	c := Commit{Digest: pre.Digest, View: pre.View, SequenceID: pre.SequenceID, NodeID: p.node.nodeID, Sign: sign, Authenticator: authenticator}
 	//Broadcasting the commit message
 	//fmt.Println("broadcasting the commit message...")
-	p.broadcast(cCommit, bc)
-	p.isCommitBordcast[pre.Digest] = true
+	p.broadcast(cCommit, c)
+	p.isCommitBordcast[key] = true
 	//fmt.Println("commit broadcast is completed")
-	p.lock.Unlock()
+	p.commitStageHandle(c)
 }
 
 func (p *pbft) commitStageHandle(c Commit) {
 
-	p.setCommitConfirmMap(c.Digest, c.NodeID, true)
+	key := instanceKey{c.View, c.SequenceID}
+	p.setCommitConfirmMap(key, c.NodeID, true)
+	if _, ok := p.commitPool[key]; !ok {
+		p.commitPool[key] = make(map[string]Commit)
+	}
+	p.commitPool[key][c.NodeID] = c
+
+	power := p.getCommitPower(c)
+
+	//If the commits received (including its own) carry more than 2/3 of the voting power, the batch has not been committed before,
+	//and a commit broadcast has been performed, then the batch is committed and executed once all lower sequence numbers are.
+	_, isCommitted := p.committedPool[c.SequenceID]
+	if p.validators.isQuorum(power) && p.isCommitBordcast[key] && !isCommitted && c.SequenceID > p.lastExecuted {
+		if p.voteAuth == authQuorumCerts {
+			if err := p.broadcastQuorumCert(cCommit, key); err != nil {
+				fmt.Printf("%s can't certify the commits of %d: %v\n", p.node.nodeID, key.sequenceID, err)
+			}
+		} else {
+			if err := p.certifyCommit(key, nil); err != nil {
+				fmt.Printf("%s can't write the commit certificate of %d: %v\n", p.node.nodeID, key.sequenceID, err)
+			}
+			p.finalizeCommit(c)
+		}
+	}
 
-	count := p.getCommitCount(c)
+}
 
-	specifiedCount := p.getSpecifiedCommitCount()
+// Voting power of the nodes whose commits were received, including its own
+func (p *pbft) getCommitPower(c Commit) int {
+	return p.validators.votingPower(p.commitConfirmCount[instanceKey{c.View, c.SequenceID}])
+}
 
-	//If a node has received at least 2f+1 commit messages (including itself), and the node has not replied before,
-	//and a commit broadcast has been performed, then the information is submitted to the local message pool,
-	//and a successful flag is replied to the client!
+func (p *pbft) finalizeCommit(c Commit) {
+	p.committedPool[c.SequenceID] = c.Digest
+	p.executeCommitted()
+}
 
-	if count >= specifiedCount && !p.isReply[c.Digest] && p.isCommitBordcast[c.Digest] {
-		p.finalizeCommit(c)
+// Batches are executed strictly in the order of their sequence numbers, so a batch committed
+// out of order waits for the gap to be filled.
+func (p *pbft) executeCommitted() {
+	for {
+		digest, ok := p.committedPool[p.lastExecuted+1]
+		if !ok {
+			return
+		}
+		delete(p.committedPool, p.lastExecuted+1)
+		p.executeBatch(p.lastExecuted+1, digest)
 	}
-
 }
 
-func (p *pbft) getCommitCount(c Commit) int {
-	count := 0
-	for range p.commitConfirmCount[c.Digest] {
-		count++
+func (p *pbft) executeBatch(sequenceID int, digest string) {
+	p.stopRequestTimer(digest)
+	p.lastExecuted = sequenceID
+	if sequenceID%p.checkpointPeriod == 0 {
+		defer p.broadcastCheckpoint(sequenceID)
+		defer p.collectDKGSessions(sequenceID)
+		defer p.collectTECDSASignings(sequenceID)
+	}
+	//fmt.Println("This node has received at least 2f + 1 Commit messages (including the local node) from other nodes ...")
+	//Every request of the batch is executed in its order and replied to its client individually
+	for _, r := range p.messagePool[digest] {
+		if r.isNull() {
+			continue
+		}
+		p.stopRequestTimer(getDigest(r))
+		if r.DKG != nil {
+			//A DKG message moves its session on, it is not replied to
+			p.executeDKG(r, sequenceID)
+			continue
+		}
+		if last, ok := p.lastReplies[r.Client]; ok && r.Timestamp <= last.Timestamp {
+			//The request has been ordered more than once, it is executed only the first time
+			continue
+		}
+		var result string
+		if err := p.authorizeRequest(r); err != nil {
+			//The state has changed since the request was validated, the client may no longer make it
+			fmt.Printf("The request of %s is rejected: %v\n", r.ClientAddr, err)
+			p.reply(r, rejectedResult(err), true)
+			continue
+		}
+		if r.KeyChange != nil {
+			var err error
+			if result, err = p.executeKeyChange(*r.KeyChange, sequenceID); err != nil {
+				//The rejection tells the client the key change didn't take effect
+				fmt.Printf("The key change of %s is rejected: %v\n", r.KeyChange.NodeID, err)
+				p.reply(r, rejectedResult(err), true)
+				continue
+			}
+		} else if r.ClientChange != nil {
+			result = p.executeClientChange(*r.ClientChange)
+		} else if r.ReadOnly {
+			//A read-only request whose replies did not match in the fast path is ordered, but still does not modify the state
+			result = p.app.Query(r)
+		} else {
+			result = p.app.Execute(r)
+			if s, ok := p.app.(Settler); ok {
+				if tx, ok := s.Settle(r); ok {
+					p.cosignTransaction(tx)
+				}
+			}
+		}
+		//fmt.Println("Replying to client ...")
+		p.reply(r, result, false)
+		//fmt.Println("replying done!")
+	}
+	//A key change may take effect with the next sequence number
+	if err := p.updateSigner(); err != nil {
+		fmt.Println(err)
 	}
-	return count
 }
 
-func (p *pbft) getSpecifiedCommitCount() int {
-	return p.nodeCount / 3 * 2
+// Send the signed result of an executed request to its client, and keep it as the last reply to the client.
+func (p *pbft) reply(r Request, result string, rejected bool) {
+	reply := Reply{View: p.view, Timestamp: r.Timestamp, ClientID: r.ClientAddr, Client: r.Client, NodeID: p.node.nodeID, Result: result, Rejected: rejected}
+	reply.Sign = p.sign(reply.signContent())
+	p.lastReplies[r.Client] = reply
+	p.sendReply(reply)
 }
 
-func (p *pbft) finalizeCommit(c Commit) {
-	p.lock.Lock()
-	//fmt.Println("This node has received at least 2f + 1 Commit messages (including the local node) from other nodes ...")
-	//The message information is being submitted to the local message pool!
-	p.localMessagePool = append(p.localMessagePool, p.messagePool[c.Digest].Message)
-	info := p.node.nodeID + "node has put msgid:" + strconv.Itoa(p.messagePool[c.Digest].ID) + "into the local message pool,message content：" + p.messagePool[c.Digest].Content
-	//fmt.Println(info)
-	//fmt.Println("Replying to client ...")
-	tcpDial([]byte(info), p.messagePool[c.Digest].ClientAddr, p.bandwidth, p.latency)
-	p.isReply[c.Digest] = true
-	//fmt.Println("replying done!")
-	p.lock.Unlock()
+func (p *pbft) sendReply(reply Reply) {
+	p.send(cReply, reply, reply.ClientID)
 }
 
 func (p *pbft) handleTempPool() {
-	p.lock.Lock()
-	for _, prepare := range p.tempPreparePool {
-		content, _ := json.Marshal(prepare)
-		p.handlePrepare(content)
+	//Messages that still cannot be handled are put back into the emptied pools, the ones of a view the node has not
+	//entered yet without being handled again.
+	//They were validated before they were kept, a rejection on the replay is logged and counted against its signer.
+	waiting := func(view int) bool {
+		return view > p.view || p.viewChanging
+	}
+	prePreparePool := p.tempPrePreparePool
+	p.tempPrePreparePool = make(map[instanceKey]PrePrepare)
+	for key, pp := range prePreparePool {
+		if waiting(pp.View) {
+			p.tempPrePreparePool[key] = pp
+			continue
+		}
+		content, _ := json.Marshal(pp)
+		if err := p.handlePrePrepare(content); err != nil {
+			p.recordRejection("", err)
+		}
 	}
 
-	p.tempPreparePool = []Prepare{}
+	preparePool := p.tempPreparePool
+	p.tempPreparePool = make(map[voteKey]Prepare)
+	for key, prepare := range preparePool {
+		if waiting(prepare.View) {
+			p.tempPreparePool[key] = prepare
+			continue
+		}
+		content, _ := json.Marshal(prepare)
+		if err := p.handlePrepare(content); err != nil {
+			p.recordRejection("", err)
+		}
+	}
 
-	for _, commit := range p.tempCommitPool {
+	commitPool := p.tempCommitPool
+	p.tempCommitPool = make(map[voteKey]Commit)
+	for key, commit := range commitPool {
+		if waiting(commit.View) {
+			p.tempCommitPool[key] = commit
+			continue
+		}
 		content, _ := json.Marshal(commit)
-		p.handleCommit(content)
+		if err := p.handleCommit(content); err != nil {
+			p.recordRejection("", err)
+		}
 	}
 
-	p.tempCommitPool = []Commit{}
-
-	p.lock.Unlock()
+	quorumCertPool := p.tempQuorumCertPool
+	p.tempQuorumCertPool = make(map[phaseKey]QuorumCert)
+	for key, qc := range quorumCertPool {
+		if waiting(qc.View) {
+			p.tempQuorumCertPool[key] = qc
+			continue
+		}
+		content, _ := json.Marshal(qc)
+		if err := p.handleQuorumCert(content); err != nil {
+			p.recordRejection("", err)
+		}
+	}
 }
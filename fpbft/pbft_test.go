@@ -0,0 +1,59 @@
+package fpbft
+
+import (
+	"testing"
+	"time"
+)
+
+// A request the client sends again once it was executed is answered from the last reply of every replica, and is
+// executed only once.
+func TestDuplicateRequestExecutedOnce(t *testing.T) {
+	network, nt, nodes := memoryCluster(t, 4, nil)
+	genClientKeys(defaultSignatureScheme, 1)
+	c := network.transport("memory/C1", 0, 0)
+	wire := nodes["N0"].wire
+	messages, err := c.Listen("memory/C1", wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	receive := func() map[string]Reply {
+		replies := make(map[string]Reply)
+		for timeout := time.After(10 * time.Second); len(replies) < len(nt); {
+			select {
+			case m := <-messages:
+				e, err := parseMessage(m.message)
+				if err != nil || e.Command != cReply {
+					t.Fatalf("the client received a %s: %v", e.Command, err)
+				}
+				var reply Reply
+				if err := decodeMessage(e.Payload, &reply); err != nil {
+					t.Fatal(err)
+				}
+				replies[reply.NodeID] = reply
+			case <-timeout:
+				t.Fatalf("only %d replicas replied", len(replies))
+			}
+		}
+		return replies
+	}
+
+	r := signedRequest(t, "once")
+	c.Send(nt["N0"], wire.encode(r.Client, cRequest, r))
+	first := receive()
+	//The client retransmits the request to every replica, as it does when the replies take too long
+	c.Broadcast(nt.addrs(), wire.encode(r.Client, cRequest, r))
+	for nodeID, reply := range receive() {
+		if reply.Timestamp != r.Timestamp || reply.Rejected || reply.Result != first[nodeID].Result {
+			t.Errorf("%s answered the retransmission with %+v", nodeID, reply)
+		}
+	}
+	for nodeID, p := range nodes {
+		p.lock.Lock()
+		executed := len(p.app.(*messagePoolApplication).localMessagePool)
+		p.lock.Unlock()
+		if executed != 1 {
+			t.Errorf("%s executed %d requests", nodeID, executed)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package fpbft
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/coinbase/kryptology/pkg/signatures/bls/bls_sig"
+)
+
+// In the quorum certificate mode the votes of an instance are collected by the primary of its view.
+func (p *pbft) isCollector(view int) bool {
+	return p.voteAuth == authQuorumCerts && p.primaryOf(view) == p.node.nodeID
+}
+
+// Send a vote to the primary of its view, which collects the votes into a quorum certificate.
+func (p *pbft) sendToCollector(cmd command, msg interface{}, view int) {
+	p.send(cmd, msg, p.nodeTable[p.primaryOf(view)])
+}
+
+// The primary's BLS signature is needed in the prepare quorum certificate, so besides the pre-prepare it adds a prepare of its own.
+func (p *pbft) collectPrimaryPrepare(pp PrePrepare) {
+	pre := Prepare{Digest: pp.Digest, View: pp.View, SequenceID: pp.SequenceID, NodeID: p.node.nodeID}
+	pre.Sign = p.signVote(cPrepare, pp.View, pp.SequenceID, pp.Digest)
+	p.prepareStageHandle(pre)
+}
+
+// The place of the node in the signer bitmap, the i of its ID N<i>.
+func (p *pbft) signerIndex(nodeID string) (int, error) {
+	if len(nodeID) < 2 || nodeID[0] != 'N' {
+		return 0, reject(reasonUnknownSender, "%q has no place in the signer bitmap", nodeID)
+	}
+	i, err := strconv.Atoi(nodeID[1:])
+	//N01 or N+1 would take the place of N1
+	if err != nil || i < 0 || i >= p.nodeCount || "N"+strconv.Itoa(i) != nodeID {
+		return 0, reject(reasonUnknownSender, "%q has no place in the signer bitmap", nodeID)
+	}
+	return i, nil
+}
+
+// The bitmap of the nodes whose votes are in the set.
+func (p *pbft) signerBitmap(nodeIDs map[string]bool) ([]byte, error) {
+	bitmap := make([]byte, (p.nodeCount+7)/8)
+	for nodeID := range nodeIDs {
+		i, err := p.signerIndex(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		bitmap[i/8] |= 1 << (i % 8)
+	}
+	return bitmap, nil
+}
+
+// The collector aggregates the BLS signatures of the votes it has collected for an instance into a quorum certificate,
+// broadcasts the certificate and goes on with it like the other nodes. The votes were verified before they were kept,
+// so an error leaves the instance without a certificate instead of stopping the node.
+func (p *pbft) broadcastQuorumCert(phase command, key instanceKey) error {
+	qc := QuorumCert{Phase: phase, View: key.view, SequenceID: key.sequenceID, Digest: p.prePreparePool[key].Digest}
+	signers := make(map[string]bool)
+	var sigs []*bls_sig.Signature
+	addVote := func(nodeID string, sign []byte) error {
+		sig := new(bls_sig.Signature)
+		if err := sig.UnmarshalBinary(sign); err != nil {
+			return rejectSigned(reasonBadSignature, nodeID, "the BLS signature of %s is malformed", nodeID)
+		}
+		signers[nodeID] = true
+		sigs = append(sigs, sig)
+		return nil
+	}
+	if phase == cPrepare {
+		for nodeID, pre := range p.preparePool[key] {
+			if err := addVote(nodeID, pre.Sign); err != nil {
+				return err
+			}
+		}
+	} else {
+		for nodeID, c := range p.commitPool[key] {
+			if err := addVote(nodeID, c.Sign); err != nil {
+				return err
+			}
+		}
+	}
+	var err error
+	if qc.Signers, err = p.signerBitmap(signers); err != nil {
+		return err
+	}
+	aggregated, err := blsScheme.AggregateSignatures(sigs...)
+	if err != nil {
+		return err
+	}
+	if qc.Sign, err = aggregated.MarshalBinary(); err != nil {
+		return err
+	}
+	p.broadcast(cQuorumCert, qc)
+	p.acceptQuorumCert(qc)
+	return nil
+}
+
+// Verify a quorum certificate: the nodes of the signer bitmap must carry more than 2/3 of the voting power,
+// and the aggregated signature is verified with a single pairing check against the aggregate of their public keys.
+func (p *pbft) verifyQuorumCert(qc QuorumCert) error {
+	if qc.Phase != cPrepare && qc.Phase != cCommit {
+		return reject(reasonInvalidMessage, "quorum certificate of the phase %q", qc.Phase)
+	}
+	if err := checkVote(qc.View, qc.SequenceID, qc.Digest); err != nil {
+		return err
+	}
+	if len(qc.Signers) != (p.nodeCount+7)/8 {
+		return reject(reasonInvalidMessage, "the signer bitmap is %d bytes long", len(qc.Signers))
+	}
+	signers := make(map[string]bool)
+	var keys []*bls_sig.PublicKey
+	for i := 0; i < len(qc.Signers)*8; i++ {
+		if qc.Signers[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		nodeID := "N" + strconv.Itoa(i)
+		if _, ok := p.nodeTable[nodeID]; !ok {
+			return reject(reasonUnknownSender, "%q is not in the node table", nodeID)
+		}
+		key, err := p.getBlsKey(nodeID)
+		if err != nil {
+			return reject(reasonUnknownSender, "the BLS public key of %s can't be read", nodeID)
+		}
+		signers[nodeID] = true
+		keys = append(keys, key)
+	}
+	if !p.validators.isQuorum(p.validators.votingPower(signers)) {
+		return reject(reasonInvalidProof, "the signers of the %s quorum certificate for %d don't carry more than 2/3 of the voting power", qc.Phase, qc.SequenceID)
+	}
+	aggregatedKey, err := blsScheme.AggregatePublicKeys(keys...)
+	if err != nil {
+		return reject(reasonInvalidProof, "%v", err)
+	}
+	sig := new(bls_sig.MultiSignature)
+	if err := sig.UnmarshalBinary(qc.Sign); err != nil {
+		return reject(reasonBadSignature, "the aggregated signature is malformed")
+	}
+	if ok, err := blsScheme.VerifyMultiSignature(aggregatedKey, voteSignContent(qc.Phase, qc.View, qc.SequenceID, qc.Digest), sig); err != nil || !ok {
+		return reject(reasonBadSignature, "the aggregated signature of the %s quorum certificate for %d doesn't verify", qc.Phase, qc.SequenceID)
+	}
+	return nil
+}
+
+// Process the quorum certificate broadcast by the collector. The certificate proves itself, so it is not signed by the collector.
+func (p *pbft) handleQuorumCert(content []byte) error {
+	qc := new(QuorumCert)
+	if err := decodeMessage(content, qc); err != nil {
+		return err
+	}
+	if qc.View < p.view {
+		//The votes of the previous views don't count any more
+		return nil
+	}
+	if !p.inViewWindow(qc.View) {
+		//Rejected before the aggregated signature is verified, so it is blamed on the peer that sent it
+		return reject(reasonInvalidMessage, "the %s quorum certificate is for view %d, too far above view %d", qc.Phase, qc.View, p.view)
+	}
+	if err := p.verifyQuorumCert(*qc); err != nil {
+		return err
+	}
+	pp, ok := p.prePreparePool[instanceKey{qc.View, qc.SequenceID}]
+	if !p.inWatermarks(qc.SequenceID) {
+		fmt.Println("The message sequence number is out of the watermarks. Refusing to accept the quorum certificate")
+	} else if qc.View > p.view || p.viewChanging || !ok {
+		key := phaseKey{instanceKey{qc.View, qc.SequenceID}, qc.Phase}
+		if _, kept := p.tempQuorumCertPool[key]; !kept {
+			p.tempQuorumCertPool[key] = *qc
+		}
+	} else if pp.Digest != qc.Digest {
+		fmt.Println("The digest doesn't match. Refusing to accept the quorum certificate")
+	} else {
+		p.acceptQuorumCert(*qc)
+	}
+	return nil
+}
+
+// With the prepare quorum certificate the node has prepared the batch and sends its commit to the collector,
+// with the commit quorum certificate the batch is committed.
+func (p *pbft) acceptQuorumCert(qc QuorumCert) {
+	key := instanceKey{qc.View, qc.SequenceID}
+	if qc.Phase == cPrepare {
+		if p.isCommitBordcast[key] {
+			return
+		}
+		//Keep the prepared certificate in case the view has to be changed
+		p.preparedCerts[qc.SequenceID] = PreparedCert{PrePrepare: p.prePreparePool[key], PrepareCert: &qc}
+		c := Commit{Digest: qc.Digest, View: qc.View, SequenceID: qc.SequenceID, NodeID: p.node.nodeID}
+		c.Sign = p.signVote(cCommit, qc.View, qc.SequenceID, qc.Digest)
+		p.isCommitBordcast[key] = true
+		if p.isCollector(qc.View) {
+			p.commitStageHandle(c)
+			return
+		}
+		p.sendToCollector(cCommit, c, qc.View)
+		return
+	}
+	_, isCommitted := p.committedPool[qc.SequenceID]
+	if !isCommitted && qc.SequenceID > p.lastExecuted {
+		if err := p.certifyCommit(key, &qc); err != nil {
+			fmt.Printf("%s can't write the commit certificate of %d: %v\n", p.node.nodeID, key.sequenceID, err)
+		}
+		p.finalizeCommit(Commit{Digest: qc.Digest, View: qc.View, SequenceID: qc.SequenceID})
+	}
+}
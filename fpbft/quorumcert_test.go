@@ -0,0 +1,107 @@
+package fpbft
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/coinbase/kryptology/pkg/signatures/bls/bls_sig"
+)
+
+// The quorum certificate of the votes of N0, N1 and N2 for the instance, encoded as it is broadcast.
+func signedQuorumCert(t *testing.T, nodes map[string]*pbft, phase command, view, sequenceID int) []byte {
+	t.Helper()
+	qc := QuorumCert{Phase: phase, View: view, SequenceID: sequenceID, Digest: "digest"}
+	signers := make(map[string]bool)
+	var sigs []*bls_sig.Signature
+	for _, nodeID := range []string{"N0", "N1", "N2"} {
+		sig := new(bls_sig.Signature)
+		if err := sig.UnmarshalBinary(nodes[nodeID].signVote(phase, view, sequenceID, "digest")); err != nil {
+			t.Fatal(err)
+		}
+		signers[nodeID] = true
+		sigs = append(sigs, sig)
+	}
+	var err error
+	if qc.Signers, err = nodes["N0"].signerBitmap(signers); err != nil {
+		t.Fatal(err)
+	}
+	aggregated, err := blsScheme.AggregateSignatures(sigs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qc.Sign, err = aggregated.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(qc)
+	return payload
+}
+
+func TestSignerIndex(t *testing.T) {
+	p := &pbft{nodeCount: 4}
+	for _, nodeID := range []string{"N0", "N3"} {
+		if _, err := p.signerIndex(nodeID); err != nil {
+			t.Errorf("%s: %v", nodeID, err)
+		}
+	}
+	for _, nodeID := range []string{"", "N", "V3", "N4", "N-1", "N01", "N+1"} {
+		if _, err := p.signerIndex(nodeID); err == nil {
+			t.Errorf("%q has a place in the signer bitmap", nodeID)
+		}
+	}
+	if _, err := p.signerBitmap(map[string]bool{"N1": true, "V3": true}); err == nil {
+		t.Error("the signer bitmap holds V3")
+	}
+}
+
+// A vote of a validator that has no place in the signer bitmap is rejected when it arrives, instead of stopping the
+// collector once it aggregates the votes.
+func TestQuorumCertRejectsUnplaceableVoter(t *testing.T) {
+	inTempDir(t)
+	genKeys(defaultSignatureScheme, 4)
+	genBlsKeys(4)
+	nt := nodeTable{"N0": "memory/N0", "N1": "memory/N1", "N2": "memory/N2", "V3": "memory/V3"}
+	p := NewPBFT("N0", nt["N0"], nt, len(nt), 0, 0)
+	p.setVoteAuthentication(authQuorumCerts)
+	for _, phase := range []command{cPrepare, cCommit} {
+		content, _ := json.Marshal(Prepare{Digest: "digest", View: 0, SequenceID: 1, NodeID: "V3", Sign: []byte{1}})
+		var err error
+		if phase == cPrepare {
+			err = p.handlePrepare(content)
+		} else {
+			err = p.handleCommit(content)
+		}
+		var r *rejection
+		if !errors.As(err, &r) || r.reason != reasonUnknownSender {
+			t.Errorf("the %s of V3 was not rejected as an unknown sender: %v", phase, err)
+		}
+	}
+}
+
+// The quorum certificates of the views the node has not entered are kept once per phase and instance, and only for the
+// views close above its own.
+func TestTempQuorumCertsBounded(t *testing.T) {
+	nodes := idleCluster(t)
+	genBlsKeys(len(nodes))
+	for _, p := range nodes {
+		p.setVoteAuthentication(authQuorumCerts)
+	}
+	p := nodes["N3"]
+	for i := 0; i < 3; i++ {
+		for _, phase := range []command{cPrepare, cCommit} {
+			if err := p.handleQuorumCert(signedQuorumCert(t, nodes, phase, 1, 1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(p.tempQuorumCertPool) != 2 {
+		t.Fatalf("%d quorum certificates are kept", len(p.tempQuorumCertPool))
+	}
+	var r *rejection
+	if err := p.handleQuorumCert(signedQuorumCert(t, nodes, cPrepare, 1+maxFutureViews, 1)); !errors.As(err, &r) {
+		t.Fatalf("a quorum certificate too far ahead was not rejected: %v", err)
+	}
+	if len(p.tempQuorumCertPool) != 2 {
+		t.Fatalf("%d quorum certificates are kept", len(p.tempQuorumCertPool))
+	}
+}
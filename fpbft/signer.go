@@ -0,0 +1,306 @@
+package fpbft
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/sha3"
+)
+
+// The signature scheme of a network. Every node of a network signs with the same scheme,
+// and the key files of a node are tagged with the name of the scheme.
+type SignatureScheme string
+
+const (
+	SchemeEd25519 SignatureScheme = "ED25519"
+	//ECDSA over secp256k1, with the recoverable signatures of the EVM, so validator keys can be EVM wallets
+	SchemeSecp256k1 SignatureScheme = "SECP256K1"
+	//RSA-PSS with 2048-bit keys
+	SchemeRSAPSS SignatureScheme = "RSAPSS"
+	//RSA PKCS#1 v1.5 with 1024-bit keys, the scheme of the first networks, kept to read their key files
+	SchemeRSA SignatureScheme = "RSA"
+)
+
+// The scheme new networks sign with.
+const defaultSignatureScheme = SchemeEd25519
+
+// Signs messages with the private key of a node.
+type Signer interface {
+	Sign(data []byte) ([]byte, error)
+	//The verifier of the signatures made by this signer
+	Verifier() Verifier
+}
+
+// Verifies the signatures of a node with its public key. A malformed signature fails the verification.
+type Verifier interface {
+	Verify(data, sign []byte) bool
+}
+
+// Generate a key pair of the scheme, PEM encoded as in the key files.
+func (s SignatureScheme) generateKey() (prvkey, pubkey []byte, err error) {
+	switch s {
+	case SchemeEd25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return encodeEd25519Key(priv, pub)
+	case SchemeSecp256k1:
+		//A private key is a random scalar between 1 and the order of the curve
+		b := make([]byte, 32)
+		for {
+			if _, err := rand.Read(b); err != nil {
+				return nil, nil, err
+			}
+			if k := new(big.Int).SetBytes(b); k.Sign() > 0 && k.Cmp(btcec.S256().N) < 0 {
+				break
+			}
+		}
+		priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), b)
+		prvkey, pubkey = encodeSecp256k1Key(priv)
+		return prvkey, pubkey, nil
+	case SchemeRSAPSS:
+		return generateRsaKey(2048)
+	case SchemeRSA:
+		return generateRsaKey(1024)
+	}
+	return nil, nil, fmt.Errorf("unknown signature scheme %q", s)
+}
+
+// The public key file of a PEM encoded private key of the scheme.
+func (s SignatureScheme) publicKey(prvkey []byte) ([]byte, error) {
+	signer, err := s.parseSigner(prvkey)
+	if err != nil {
+		return nil, err
+	}
+	switch k := signer.(type) {
+	case ed25519Signer:
+		priv := ed25519.PrivateKey(k)
+		_, pubkey, err := encodeEd25519Key(priv, priv.Public().(ed25519.PublicKey))
+		return pubkey, err
+	case *secp256k1Signer:
+		_, pubkey := encodeSecp256k1Key((*btcec.PrivateKey)(k))
+		return pubkey, nil
+	case *rsaSigner:
+		derPkix, err := x509.MarshalPKIXPublicKey(&k.key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: derPkix}), nil
+	}
+	return nil, fmt.Errorf("unknown signature scheme %q", s)
+}
+
+// Parse the PEM encoded private key of a key file into a signer.
+func (s SignatureScheme) parseSigner(prvkey []byte) (Signer, error) {
+	block, _ := pem.Decode(prvkey)
+	if block == nil {
+		return nil, errors.New("private key error")
+	}
+	switch s {
+	case SchemeEd25519:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an Ed25519 private key")
+		}
+		return ed25519Signer(priv), nil
+	case SchemeSecp256k1:
+		if block.Type != "SECP256K1 PRIVATE KEY" || len(block.Bytes) != 32 {
+			return nil, errors.New("not a secp256k1 private key")
+		}
+		priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), block.Bytes)
+		return (*secp256k1Signer)(priv), nil
+	case SchemeRSAPSS, SchemeRSA:
+		priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return &rsaSigner{key: priv, pss: s == SchemeRSAPSS}, nil
+	}
+	return nil, fmt.Errorf("unknown signature scheme %q", s)
+}
+
+// Parse the PEM encoded public key of a key file into a verifier.
+func (s SignatureScheme) parseVerifier(pubkey []byte) (Verifier, error) {
+	block, _ := pem.Decode(pubkey)
+	if block == nil {
+		return nil, errors.New("public key error")
+	}
+	switch s {
+	case SchemeEd25519:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("not an Ed25519 public key")
+		}
+		return ed25519Verifier(pub), nil
+	case SchemeSecp256k1:
+		if block.Type != "SECP256K1 PUBLIC KEY" {
+			return nil, errors.New("not a secp256k1 public key")
+		}
+		pub, err := btcec.ParsePubKey(block.Bytes, btcec.S256())
+		if err != nil {
+			return nil, err
+		}
+		return (*secp256k1Verifier)(pub), nil
+	case SchemeRSAPSS, SchemeRSA:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA public key")
+		}
+		return &rsaVerifier{key: pub, pss: s == SchemeRSAPSS}, nil
+	}
+	return nil, fmt.Errorf("unknown signature scheme %q", s)
+}
+
+// Ed25519 signs the data itself, without hashing it first.
+type ed25519Signer ed25519.PrivateKey
+
+func (k ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(k), data), nil
+}
+
+func (k ed25519Signer) Verifier() Verifier {
+	return ed25519Verifier(ed25519.PrivateKey(k).Public().(ed25519.PublicKey))
+}
+
+type ed25519Verifier ed25519.PublicKey
+
+func (k ed25519Verifier) Verify(data, sign []byte) bool {
+	return len(sign) == ed25519.SignatureSize && ed25519.Verify(ed25519.PublicKey(k), data, sign)
+}
+
+func encodeEd25519Key(priv ed25519.PrivateKey, pub ed25519.PublicKey) (prvkey, pubkey []byte, err error) {
+	derPriv, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	derPub, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	prvkey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: derPriv})
+	pubkey = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: derPub})
+	return
+}
+
+// secp256k1 signs the Keccak-256 hash of the data like an EVM wallet, the signature is [R || S || V]
+// with V = 27 + the recovery ID, as expected by ecrecover.
+type secp256k1Signer btcec.PrivateKey
+
+func (k *secp256k1Signer) Sign(data []byte) ([]byte, error) {
+	//SignCompact returns [27 + recovery ID || R || S]
+	compact, err := btcec.SignCompact(btcec.S256(), (*btcec.PrivateKey)(k), keccak256(data), false)
+	if err != nil {
+		return nil, err
+	}
+	return append(compact[1:], compact[0]), nil
+}
+
+func (k *secp256k1Signer) Verifier() Verifier {
+	return (*secp256k1Verifier)((*btcec.PrivateKey)(k).PubKey())
+}
+
+type secp256k1Verifier btcec.PublicKey
+
+func (k *secp256k1Verifier) Verify(data, sign []byte) bool {
+	return verifyEVMSignature((*btcec.PublicKey)(k), keccak256(data), sign)
+}
+
+func encodeSecp256k1Key(priv *btcec.PrivateKey) (prvkey, pubkey []byte) {
+	headers := map[string]string{"Address": evmAddress(priv.PubKey())}
+	prvkey = pem.EncodeToMemory(&pem.Block{Type: "SECP256K1 PRIVATE KEY", Headers: headers, Bytes: priv.Serialize()})
+	pubkey = pem.EncodeToMemory(&pem.Block{Type: "SECP256K1 PUBLIC KEY", Headers: headers, Bytes: priv.PubKey().SerializeCompressed()})
+	return
+}
+
+// The EVM address of a secp256k1 public key, the last 20 bytes of the Keccak-256 hash of the uncompressed key.
+func evmAddress(pub *btcec.PublicKey) string {
+	return "0x" + hex.EncodeToString(keccak256(pub.SerializeUncompressed()[1:])[12:])
+}
+
+func keccak256(data []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Parse the hex encoded private key of an EVM wallet, with or without the 0x prefix.
+func parseEvmPrivateKey(s string) (*btcec.PrivateKey, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	if k := new(big.Int).SetBytes(b); len(b) != 32 || k.Sign() == 0 || k.Cmp(btcec.S256().N) >= 0 {
+		return nil, errors.New("not a secp256k1 private key")
+	}
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), b)
+	return priv, nil
+}
+
+// RSA signs the SHA-256 hash of the data, with PSS or with PKCS#1 v1.5.
+type rsaSigner struct {
+	key *rsa.PrivateKey
+	pss bool
+}
+
+func (k *rsaSigner) Sign(data []byte) ([]byte, error) {
+	hashed := sha256.Sum256(data)
+	if k.pss {
+		return rsa.SignPSS(rand.Reader, k.key, crypto.SHA256, hashed[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	}
+	return rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, hashed[:])
+}
+
+func (k *rsaSigner) Verifier() Verifier {
+	return &rsaVerifier{key: &k.key.PublicKey, pss: k.pss}
+}
+
+type rsaVerifier struct {
+	key *rsa.PublicKey
+	pss bool
+}
+
+func (k *rsaVerifier) Verify(data, sign []byte) bool {
+	hashed := sha256.Sum256(data)
+	if k.pss {
+		return rsa.VerifyPSS(k.key, crypto.SHA256, hashed[:], sign, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	}
+	return rsa.VerifyPKCS1v15(k.key, crypto.SHA256, hashed[:], sign) == nil
+}
+
+func generateRsaKey(bits int) (prvkey, pubkey []byte, err error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	prvkey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	derPkix, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubkey = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: derPkix})
+	return
+}
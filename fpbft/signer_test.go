@@ -0,0 +1,86 @@
+package fpbft
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var signatureSchemes = []SignatureScheme{SchemeEd25519, SchemeSecp256k1, SchemeRSAPSS, SchemeRSA}
+
+// The key files of every scheme are read back into a signer and a verifier that agree on the signatures.
+func TestSignatureSchemesRoundTrip(t *testing.T) {
+	data := []byte("the content signed by the node")
+	for _, s := range signatureSchemes {
+		prvkey, pubkey, err := s.generateKey()
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if derived, err := s.publicKey(prvkey); err != nil || !bytes.Equal(derived, pubkey) {
+			t.Fatalf("%s: the public key derived from the private key differs: %v", s, err)
+		}
+		signer, err := s.parseSigner(prvkey)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		verifier, err := s.parseVerifier(pubkey)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		sign, err := signer.Sign(data)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if !verifier.Verify(data, sign) || !signer.Verifier().Verify(data, sign) {
+			t.Fatalf("%s: the signature doesn't verify", s)
+		}
+	}
+}
+
+// A signature of other data, altered, cut short or made with another key doesn't verify, and a key of another scheme
+// is not parsed.
+func TestSignatureSchemesRejectTampering(t *testing.T) {
+	data := []byte("the content signed by the node")
+	for _, s := range signatureSchemes {
+		prvkey, _, _ := s.generateKey()
+		signer, _ := s.parseSigner(prvkey)
+		_, otherPubkey, _ := s.generateKey()
+		other, _ := s.parseVerifier(otherPubkey)
+		sign, _ := signer.Sign(data)
+		altered := append([]byte{}, sign...)
+		altered[len(altered)/2] ^= 1
+		verifier := signer.Verifier()
+		for name, ok := range map[string]bool{
+			"other data":  verifier.Verify([]byte("other content"), sign),
+			"altered":     verifier.Verify(data, altered),
+			"cut short":   verifier.Verify(data, sign[:len(sign)-1]),
+			"empty":       verifier.Verify(data, nil),
+			"another key": other.Verify(data, sign),
+		} {
+			if ok {
+				t.Errorf("%s: a signature of %s verifies", s, name)
+			}
+		}
+	}
+	ed25519Key, _, _ := SchemeEd25519.generateKey()
+	if _, err := SchemeSecp256k1.parseSigner(ed25519Key); err == nil {
+		t.Error("an Ed25519 key was parsed as a secp256k1 key")
+	}
+	if _, err := SchemeRSAPSS.parseSigner(ed25519Key); err == nil {
+		t.Error("an Ed25519 key was parsed as an RSA key")
+	}
+}
+
+// The key of an EVM wallet is taken with the address of its wallet.
+func TestEvmWalletKey(t *testing.T) {
+	priv, err := parseEvmPrivateKey("0x" + strings.Repeat("0", 63) + "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address := evmAddress(priv.PubKey()); !strings.EqualFold(address, "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf") {
+		t.Fatalf("the wallet of the key 1 has the address %s", address)
+	}
+	if _, err := parseEvmPrivateKey(strings.Repeat("0", 64)); err == nil {
+		t.Fatal("the key 0 was parsed")
+	}
+}
@@ -0,0 +1,191 @@
+package fpbft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time a lagging node waits to catch up by itself before it fetches the state, and for the state before it asks again.
+const defaultStateTransferTimeout = 2 * time.Second
+
+// Digest of the state of a replica, the state of the application together with the last reply sent to every client,
+// the key changes of the validators and the allow-list of the clients. The view, node ID and signature of a reply
+// are not part of the state, as they differ between the replicas.
+func stateDigest(appStateHash string, lastReplies []Reply, keys []KeyEpoch, allowedClients []string, clientChanges int) string {
+	h := sha256.New()
+	h.Write([]byte(appStateHash))
+	for _, r := range lastReplies {
+		h.Write([]byte(r.Client + ":" + r.ClientID + ":" + strconv.FormatInt(r.Timestamp, 10) + ":" + r.Result + ":" + strconv.FormatBool(r.Rejected) + ";"))
+	}
+	for _, e := range keys {
+		h.Write([]byte(e.NodeID + ":" + strconv.Itoa(e.From) + ":" + keyFingerprint(e.PublicKey) + ":" + strconv.FormatBool(e.Revocation) + ";"))
+	}
+	if allowedClients != nil {
+		h.Write([]byte("allowed:" + strconv.Itoa(clientChanges) + ":" + strings.Join(allowedClients, ",") + ";"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// The last reply sent to every client, in the order of the IDs of the clients that signed the requests.
+func (p *pbft) lastReplyList() []Reply {
+	replies := make([]Reply, 0, len(p.lastReplies))
+	for _, r := range p.lastReplies {
+		replies = append(replies, r)
+	}
+	sort.Slice(replies, func(i, j int) bool {
+		return replies[i].Client < replies[j].Client
+	})
+	return replies
+}
+
+// Digest of the current state of the node, agreed on in the checkpoints.
+func (p *pbft) currentStateDigest() string {
+	return stateDigest(p.app.StateHash(), p.lastReplyList(), p.keyEpochList(), p.allowedClientList(), p.clientChanges)
+}
+
+// Snapshot of the current state, kept with the checkpoint taken at this sequence number.
+func (p *pbft) takeSnapshot(sequenceID int) StateSnapshot {
+	return StateSnapshot{SequenceID: sequenceID, AppState: p.app.Snapshot(), LastReplies: p.lastReplyList(), ValidatorKeys: p.keyEpochList(), AllowedClients: p.allowedClientList(), ClientChanges: p.clientChanges}
+}
+
+// The node has learned that a checkpoint it has not reached is stable. Unless it executes up to the checkpoint
+// by itself in the meantime, it fetches the state at that checkpoint from the nodes that proved it.
+func (p *pbft) fetchState(sequenceID int, proof []Checkpoint) {
+	if sequenceID <= p.fetchingSequenceID {
+		//The state at this checkpoint or a later one is already being fetched
+		return
+	}
+	p.fetchingSequenceID = sequenceID
+	if p.stateTransferTimer != nil {
+		p.stateTransferTimer.Stop()
+	}
+	p.stateTransferTimer = time.AfterFunc(defaultStateTransferTimeout, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if p.fetchingSequenceID != sequenceID {
+			return
+		}
+		if p.lastExecuted >= sequenceID {
+			p.fetchingSequenceID = 0
+			p.stateTransferTimer = nil
+			return
+		}
+		fmt.Printf("%s lags behind the stable checkpoint %d, the last executed request is %d, fetching the state...\n", p.node.nodeID, sequenceID, p.lastExecuted)
+		p.sendFetchState(sequenceID, proof)
+		p.stateTransferTimer.Reset(defaultStateTransferTimeout)
+	})
+}
+
+// Ask the nodes of the checkpoint proof for their state.
+func (p *pbft) sendFetchState(sequenceID int, proof []Checkpoint) {
+	f := FetchState{SequenceID: sequenceID, NodeID: p.node.nodeID}
+	addrs := make([]string, 0, len(proof))
+	for _, c := range proof {
+		if c.NodeID != p.node.nodeID {
+			addrs = append(addrs, p.nodeTable[c.NodeID])
+		}
+	}
+	p.transport.Broadcast(addrs, p.wire.encode(p.node.nodeID, cFetchState, f))
+}
+
+// Answer a lagging node with the state at the stable checkpoint, if it is not older than the one the node asked for.
+func (p *pbft) handleFetchState(content []byte) error {
+	f := new(FetchState)
+	if err := decodeMessage(content, f); err != nil {
+		return err
+	}
+	if err := p.checkSender(f.NodeID); err != nil {
+		return err
+	}
+	if f.NodeID == p.node.nodeID {
+		return nil
+	}
+	snapshot, ok := p.checkpointSnapshots[p.stableSequenceID]
+	if !ok || p.stableSequenceID < f.SequenceID {
+		//The checkpoint is not stable at this node yet, the lagging node will ask again
+		return nil
+	}
+	snapshot.CheckpointProof = p.stableCheckpointProof
+	snapshot.NodeID = p.node.nodeID
+	p.send(cStateSnapshot, snapshot, p.nodeTable[f.NodeID])
+	return nil
+}
+
+// Install a state fetched from another node once it is verified against the checkpoint proof it carries.
+func (p *pbft) handleStateSnapshot(content []byte) error {
+	s := new(StateSnapshot)
+	if err := decodeMessage(content, s); err != nil {
+		return err
+	}
+	if err := p.checkSender(s.NodeID); err != nil {
+		return err
+	}
+	if s.SequenceID <= p.lastExecuted {
+		//The node has reached this state already
+		return nil
+	}
+	if !p.verifyCheckpointProof(s.SequenceID, s.CheckpointProof) {
+		return reject(reasonInvalidProof, "the checkpoint proof of the state at %d is not valid", s.SequenceID)
+	}
+	backup := p.app.Snapshot()
+	if err := p.app.Restore(s.AppState); err != nil || stateDigest(p.app.StateHash(), s.LastReplies, s.ValidatorKeys, s.AllowedClients, s.ClientChanges) != s.CheckpointProof[0].StateDigest {
+		if err := p.app.Restore(backup); err != nil {
+			log.Panic(err)
+		}
+		return reject(reasonBadDigest, "the state doesn't match the stable checkpoint %d", s.SequenceID)
+	}
+	p.installState(*s)
+	return nil
+}
+
+// Move the node to the fetched state, make its checkpoint stable and carry on with the batches committed after it.
+func (p *pbft) installState(s StateSnapshot) {
+	fmt.Printf("%s has fetched the state at the stable checkpoint %d from %s\n", p.node.nodeID, s.SequenceID, s.NodeID)
+	p.lastExecuted = s.SequenceID
+	if p.sequenceID < s.SequenceID {
+		p.sequenceID = s.SequenceID
+	}
+	p.setKeyEpochs(s.ValidatorKeys)
+	p.setAllowedClientList(s.AllowedClients, s.ClientChanges)
+	if err := p.updateSigner(); err != nil {
+		fmt.Println(err)
+	}
+	//The cached replies are signed again by this node
+	p.lastReplies = make(map[string]Reply)
+	for _, r := range s.LastReplies {
+		r.NodeID = p.node.nodeID
+		r.Sign = p.sign(r.signContent())
+		p.lastReplies[r.Client] = r
+	}
+	p.checkpointSnapshots[s.SequenceID] = p.takeSnapshot(s.SequenceID)
+	for n := range p.committedPool {
+		if n <= s.SequenceID {
+			delete(p.committedPool, n)
+		}
+	}
+	if p.fetchingSequenceID <= s.SequenceID {
+		p.fetchingSequenceID = 0
+		if p.stateTransferTimer != nil {
+			p.stateTransferTimer.Stop()
+			p.stateTransferTimer = nil
+		}
+	}
+	p.stabilizeCheckpoint(s.SequenceID, s.CheckpointProof)
+
+	//The requests the node was waiting for may have been executed as part of the state
+	p.stopRequestTimers()
+	if !p.viewChanging {
+		for key, pp := range p.prePreparePool {
+			if key.view == p.view && pp.SequenceID > p.lastExecuted && !pp.RequestBatch[0].isNull() {
+				p.startRequestTimer(pp.Digest)
+			}
+		}
+	}
+	p.executeCommitted()
+}
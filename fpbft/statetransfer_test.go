@@ -0,0 +1,54 @@
+package fpbft
+
+import (
+	"fmt"
+	"testing"
+)
+
+// A replica that missed the requests up to a stable checkpoint fetches the state at the next checkpoint from the
+// nodes that proved it, and carries on from there.
+func TestLaggingReplicaFetchesState(t *testing.T) {
+	const period = 2
+	network, nt, nodes := memoryCluster(t, 4, func(p *pbft) {
+		p.checkpointPeriod = period
+	})
+	c := memoryClient(network)
+	send := func(i int) {
+		if _, result := c.ClientSendMessageAndListen(nt, fmt.Sprintf("request %d", i), len(nt)); result.Rejected {
+			t.Fatalf("the request %d was rejected: %s", i, result.Result)
+		}
+	}
+
+	//The messages to the lagging replica are lost while it is cut off
+	lagging := nodes["N3"]
+	lagging.transport.Close()
+	cutOff := network.transport("memory/N3", 0, 0)
+	lost, err := cutOff.Listen("memory/N3", lagging.wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range lost {
+		}
+	}()
+	for i := 0; i < 2*period+1; i++ {
+		send(i)
+	}
+	cutOff.Close()
+	ready := make(chan bool, 1)
+	go lagging.listen(ready)
+	<-ready
+	send(2*period + 1)
+
+	eventually(t, lagging, "the state was not fetched", func() bool {
+		return lagging.lastExecuted == 3*period && lagging.stableSequenceID == 3*period
+	})
+	lagging.lock.Lock()
+	defer lagging.lock.Unlock()
+	if lagging.currentStateDigest() != lagging.stableCheckpointProof[0].StateDigest {
+		t.Fatal("the fetched state doesn't match the one of the checkpoint")
+	}
+	if got := len(lagging.app.(*messagePoolApplication).localMessagePool); got != 3*period {
+		t.Fatalf("the fetched state holds %d requests", got)
+	}
+}
@@ -0,0 +1,210 @@
+package fpbft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A training task posted by a client, and the rewards its owner has granted for it, corresponding according to the receiver.
+type trainingTask struct {
+	Owner       string
+	Description string
+	Rewards     map[string]int
+}
+
+// An application keeping the training tasks of the clients and their rewards. The requests are
+//
+//	task <task ID> <description>          posts a task owned by the client
+//	reward <task ID> <receiver> <amount>  grants a reward for the task, only its owner may
+//
+// and the read-only requests 'task <task ID>' look a task up. With a reward contract, the rewards granted to EVM addresses
+// are paid out on the L2 chain by a transaction the committee signs with its threshold key.
+type taskApplication struct {
+	tasks map[string]*trainingTask
+	//The contract paying out the rewards, none if nil
+	contract *rewardContract
+	//Nonce of the next transaction of the committee address
+	nonce uint64
+	//The transaction of the request executed last, until it is settled
+	settlement *EVMTransaction
+}
+
+// The CommitteeRewardContract of crypto/contracts on an L2 chain, which credits the rewards it is called with by the committee
+// address only: one transaction of the committee instead of the proposeTransaction, confirmTransaction and executeTransaction
+// calls of the owners of the MultiSigContract.
+type rewardContract struct {
+	ChainID  uint64
+	Address  string
+	GasPrice *big.Int
+	Gas      uint64
+}
+
+// The call of reward(address,uint256) paying the amount to the receiver, sent from the committee address with the nonce.
+func (c rewardContract) rewardTransaction(nonce uint64, receiver []byte, amount int) EVMTransaction {
+	data := abiCall("reward(address,uint256)", receiver, big.NewInt(int64(amount)).Bytes())
+	return EVMTransaction{ChainID: c.ChainID, Nonce: nonce, GasPrice: c.GasPrice, Gas: c.Gas, To: c.Address, Value: new(big.Int), Data: data}
+}
+
+// The replicated state of the application, the tasks and the nonce of the committee address.
+type taskState struct {
+	Tasks map[string]*trainingTask
+	Nonce uint64
+}
+
+func newTaskApplication() *taskApplication {
+	return &taskApplication{tasks: make(map[string]*trainingTask)}
+}
+
+// A task or reward request, parsed from the content of the message.
+type taskOperation struct {
+	op          string
+	taskID      string
+	description string
+	receiver    string
+	amount      int
+}
+
+func parseTaskOperation(content string) (taskOperation, error) {
+	fields := strings.Fields(content)
+	if len(fields) < 2 {
+		return taskOperation{}, errors.New("the request is neither 'task <task ID> <description>' nor 'reward <task ID> <receiver> <amount>'")
+	}
+	o := taskOperation{op: fields[0], taskID: fields[1]}
+	switch o.op {
+	case "task":
+		o.description = strings.Join(fields[2:], " ")
+	case "reward":
+		if len(fields) != 4 {
+			return o, errors.New("a reward is 'reward <task ID> <receiver> <amount>'")
+		}
+		o.receiver = fields[2]
+		amount, err := strconv.Atoi(fields[3])
+		if err != nil || amount <= 0 {
+			return o, fmt.Errorf("the amount %q is not a positive number", fields[3])
+		}
+		o.amount = amount
+	default:
+		return o, fmt.Errorf("unknown operation %q", o.op)
+	}
+	return o, nil
+}
+
+func (a *taskApplication) Validate(r Request) error {
+	o, err := parseTaskOperation(r.Content)
+	if err != nil {
+		return err
+	}
+	if o.op == "task" && o.description == "" {
+		return errors.New("the task has no description")
+	}
+	return nil
+}
+
+// Anyone may post a task whose ID is free, but only the owner of a task may reward it.
+func (a *taskApplication) Authorize(r Request) error {
+	if r.ReadOnly {
+		return nil
+	}
+	o, err := parseTaskOperation(r.Content)
+	if err != nil {
+		return err
+	}
+	task, ok := a.tasks[o.taskID]
+	switch {
+	case o.op == "task" && ok:
+		return fmt.Errorf("the task %s has been posted by %s already", o.taskID, task.Owner)
+	case o.op == "reward" && !ok:
+		return fmt.Errorf("there is no task %s", o.taskID)
+	case o.op == "reward" && task.Owner != r.Client:
+		return fmt.Errorf("only %s, the owner of the task %s, may post its rewards", task.Owner, o.taskID)
+	}
+	return nil
+}
+
+// Execute a request the replicas have authorized.
+func (a *taskApplication) Execute(r Request) string {
+	o, err := parseTaskOperation(r.Content)
+	if err != nil {
+		return "request rejected: " + err.Error()
+	}
+	if o.op == "task" {
+		a.tasks[o.taskID] = &trainingTask{Owner: r.Client, Description: o.description, Rewards: make(map[string]int)}
+		return fmt.Sprintf("the task %s has been posted by %s", o.taskID, r.Client)
+	}
+	task := a.tasks[o.taskID]
+	task.Rewards[o.receiver] += o.amount
+	result := fmt.Sprintf("%s has been rewarded %d for the task %s, %d in total", o.receiver, o.amount, o.taskID, task.Rewards[o.receiver])
+	if receiver, err := parseEVMAddress(o.receiver); err == nil && a.contract != nil {
+		tx := a.contract.rewardTransaction(a.nonce, receiver, o.amount)
+		a.settlement = &tx
+		result += fmt.Sprintf(", paid out by the committee transaction with nonce %d", a.nonce)
+		a.nonce++
+	}
+	return result
+}
+
+// The transaction paying out the reward the request granted, if it was granted to an EVM address.
+func (a *taskApplication) Settle(r Request) (EVMTransaction, bool) {
+	tx := a.settlement
+	a.settlement = nil
+	if tx == nil {
+		return EVMTransaction{}, false
+	}
+	return *tx, true
+}
+
+func (a *taskApplication) StateHash() string {
+	h := sha256.Sum256(a.Snapshot())
+	return hex.EncodeToString(h[:])
+}
+
+// Look up the task with the ID in the content of the request.
+func (a *taskApplication) Query(r Request) string {
+	fields := strings.Fields(r.Content)
+	if len(fields) != 2 || fields[0] != "task" {
+		return "a query is 'task <task ID>'"
+	}
+	task, ok := a.tasks[fields[1]]
+	if !ok {
+		return "there is no task " + fields[1]
+	}
+	receivers := make([]string, 0, len(task.Rewards))
+	for receiver := range task.Rewards {
+		receivers = append(receivers, receiver)
+	}
+	sort.Strings(receivers)
+	rewards := make([]string, 0, len(receivers))
+	for _, receiver := range receivers {
+		rewards = append(rewards, receiver+"="+strconv.Itoa(task.Rewards[receiver]))
+	}
+	return fmt.Sprintf("the task %s of %s: %s, rewards: %s", fields[1], task.Owner, task.Description, strings.Join(rewards, " "))
+}
+
+// The tasks are serialized in the order of their IDs, so the snapshots of the replicas are identical.
+func (a *taskApplication) Snapshot() []byte {
+	b, err := json.Marshal(taskState{Tasks: a.tasks, Nonce: a.nonce})
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+func (a *taskApplication) Restore(snapshot []byte) error {
+	state := taskState{Tasks: make(map[string]*trainingTask)}
+	if err := json.Unmarshal(snapshot, &state); err != nil {
+		return err
+	}
+	if state.Tasks == nil {
+		state.Tasks = make(map[string]*trainingTask)
+	}
+	a.tasks, a.nonce, a.settlement = state.Tasks, state.Nonce, nil
+	return nil
+}
@@ -1,27 +1,380 @@
 package fpbft
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
-// TCP send messages
-func tcpDial(context []byte, addr string, bandwidthLimit int, latency float64) {
-	conn, err := net.Dial("tcp", addr)
+// The messages are sent over one long-lived connection per peer, as frames: the length of the message as 4 big-endian
+// bytes followed by the message. A frame longer than maxFrameSize closes the connection.
+const (
+	maxFrameSize = 64 << 20
+	//Messages waiting for the connection to a peer, the oldest one is dropped to make room for a new one
+	peerQueueLength = 4096
+	//A message is dropped once writing it failed maxSendAttempts times
+	maxSendAttempts = 5
+	//Time to wait before redialing a peer that is down, doubling up to maxRedialBackoff
+	minRedialBackoff = 50 * time.Millisecond
+	maxRedialBackoff = time.Second
+	//Time to wait for the answer to the hello, a peer that doesn't answer speaks protocolV1
+	helloTimeout = time.Second
+)
+
+var errFrameTooLarge = errors.New("the frame is longer than the maximum frame size")
+
+// Write the message as a frame.
+func writeFrame(w io.Writer, message []byte) error {
+	if len(message) > maxFrameSize {
+		return errFrameTooLarge
+	}
+	frame := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	copy(frame[4:], message)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Read the next frame, the message it holds.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	message := make([]byte, n)
+	if _, err := io.ReadFull(r, message); err != nil {
+		if err == io.EOF {
+			//The connection was closed after the header, in the middle of the frame
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// The connections of a node or a client to its peers, corresponding according to the address, every one with the
+// bandwidth and the latency of the sender.
+type peerPool struct {
+	lock           sync.Mutex
+	peers          map[string]*peerConn
+	bandwidthLimit int
+	latency        float64
+	//The uplink the connections share, nil if every connection has the bandwidth
+	uplink *sharedUplink
+	//Opens a connection to the address, plain TCP unless the transport is secured
+	dial func(addr string) (net.Conn, error)
+	//The node or client the messages are sent by, and the wire protocol it speaks
+	sender string
+	wire   wireProtocol
+}
+
+// The TCP transport: the messages are sent over the connections of a peer pool, and received over the connections the
+// listener accepts.
+type tcpTransport struct {
+	pool *peerPool
+	//Completes the handshake of an accepted connection, nil with plain TCP
+	accept   func(conn net.Conn) (net.Conn, error)
+	lock     sync.Mutex
+	listener net.Listener
+	//Closed by Close, which closes the accepted connections
+	done chan struct{}
+}
+
+func newTCPTransport(sender string, bandwidthLimit int, latency float64) *tcpTransport {
+	return &tcpTransport{pool: newPeerPool(sender, bandwidthLimit, latency)}
+}
+
+func (t *tcpTransport) Listen(addr string, wire wireProtocol) (<-chan received, error) {
+	listen, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Println("connect error", err)
-		return
+		return nil, err
 	}
-	defer conn.Close()
+	t.pool.lock.Lock()
+	t.pool.wire = wire
+	t.pool.lock.Unlock()
+	done := make(chan struct{})
+	t.lock.Lock()
+	t.listener, t.done = listen, done
+	t.lock.Unlock()
+	messages := make(chan received)
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				//The listener has been closed
+				return
+			}
+			go func() {
+				<-done
+				conn.Close()
+			}()
+			//Every peer keeps its connection open and sends its messages over it one frame after the other
+			go t.serve(conn, wire, messages, done)
+		}
+	}()
+	return messages, nil
+}
+
+// Pass on the messages of an accepted connection, once the peer completed the handshake.
+func (t *tcpTransport) serve(conn net.Conn, wire wireProtocol, messages chan<- received, done <-chan struct{}) {
+	logUnlessClosed := func(format string, a ...interface{}) {
+		select {
+		case <-done:
+		default:
+			log.Printf(format, a...)
+		}
+	}
+	if t.accept != nil {
+		accepted, err := t.accept(conn)
+		if err != nil {
+			conn.Close()
+			logUnlessClosed("%s refused a connection from %s: %v\n", t.pool.sender, conn.RemoteAddr(), err)
+			return
+		}
+		conn = accepted
+	}
+	peer := remotePeer(conn)
+	err := serveFrames(conn, wire, func(message []byte, version int) {
+		select {
+		case messages <- received{message: message, peer: peer, version: version}:
+		case <-done:
+		}
+	})
+	if err != nil {
+		//The connection broke in the middle of a frame, or the frame was too long
+		logUnlessClosed("%v\n", err)
+	}
+}
 
-	tw := throttledWriter{w: conn, bandwidthLimit: bandwidthLimit}
+func (t *tcpTransport) Send(addr string, message *outgoing) {
+	t.pool.send(message, addr)
+}
 
-	// Apply latency before writing
-	applyLatency(latency)
+func (t *tcpTransport) Broadcast(addrs []string, message *outgoing) {
+	for _, addr := range addrs {
+		t.pool.send(message, addr)
+	}
+}
 
-	if _, err := tw.Write(context); err != nil {
-		log.Println(err)
+func (t *tcpTransport) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.listener == nil {
 		return
 	}
+	t.listener.Close()
+	close(t.done)
+	t.listener = nil
+}
 
+func newPeerPool(sender string, bandwidthLimit int, latency float64) *peerPool {
+	return &peerPool{
+		peers:          make(map[string]*peerConn),
+		bandwidthLimit: bandwidthLimit,
+		latency:        latency,
+		dial:           dialTCP,
+		sender:         sender,
+		wire:           wireProtocol{version: currentProtocolVersion},
+	}
+}
+
+func dialTCP(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+// Send the message to the address, written once the latency has passed, without waiting for it to be written.
+func (pool *peerPool) send(o *outgoing, addr string) {
+	pool.peer(addr).enqueue(o)
+}
+
+// The connection to the address, started the first time a message is sent to it.
+func (pool *peerPool) peer(addr string) *peerConn {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	c, ok := pool.peers[addr]
+	if !ok {
+		c = &peerConn{
+			addr:           addr,
+			bandwidthLimit: pool.bandwidthLimit,
+			uplink:         pool.uplink,
+			dial:           pool.dial,
+			sender:         pool.sender,
+			wire:           pool.wire,
+			latency:        pool.latency,
+			queue:          make(chan queued, peerQueueLength),
+		}
+		pool.peers[addr] = c
+		go c.run()
+	}
+	return c
+}
+
+// The connection to a peer, written by its own goroutine in the order the messages were queued.
+type peerConn struct {
+	addr           string
+	bandwidthLimit int
+	uplink         *sharedUplink
+	dial           func(addr string) (net.Conn, error)
+	sender         string
+	wire           wireProtocol
+	latency        float64
+	queue          chan queued
+	conn           net.Conn
+	writer         io.Writer
+	//The version of the connection, which every message sent over it is encoded with
+	version int
+	//Closed once the peer has closed the connection
+	closed chan struct{}
+}
+
+func (c *peerConn) enqueue(o *outgoing) {
+	enqueueDroppingOldest(c.queue, o, c.latency, c.addr)
+}
+
+func (c *peerConn) run() {
+	for q := range c.queue {
+		q.wait()
+		o := q.o
+		for attempt := 0; attempt < maxSendAttempts; attempt++ {
+			c.connect()
+			message := o.with(c.version)
+			if len(message) > maxFrameSize {
+				log.Printf("the %s message to %s is %d bytes long, longer than the maximum frame size\n", o.cmd, c.addr, len(message))
+				break
+			}
+			if err := writeFrame(c.writer, message); err != nil {
+				log.Println(err)
+				c.disconnect()
+				continue
+			}
+			break
+		}
+	}
+}
+
+// Dial the peer unless the connection is open, and while the peer is down redial it after a backoff doubling up to
+// maxRedialBackoff, holding the queued messages back. A node that speaks protocolV2 or later first sends its hello and
+// waits for the answer, so the peer can reject the messages of an older version once the version is agreed.
+func (c *peerConn) connect() {
+	if c.conn != nil {
+		select {
+		case <-c.closed:
+			c.disconnect()
+		default:
+			return
+		}
+	}
+	backoff := minRedialBackoff
+	var r *bufio.Reader
+	for {
+		conn, err := c.dial(c.addr)
+		if err == nil {
+			r = bufio.NewReader(conn)
+			if c.version, err = c.hello(conn, r); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			if backoff > minRedialBackoff {
+				log.Printf("%s is up again\n", c.addr)
+			}
+			c.conn = conn
+			break
+		}
+		if backoff == minRedialBackoff {
+			log.Println("connect error", err)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRedialBackoff {
+			backoff = maxRedialBackoff
+		}
+	}
+	c.writer = c.conn
+	if c.bandwidthLimit > 0 {
+		c.writer = &throttledWriter{w: c.conn, bandwidthLimit: c.bandwidthLimit, uplink: c.uplink}
+	}
+	//The peer writes nothing after the answer to the hello, reading on tells when the peer has closed the connection
+	closed := make(chan struct{})
+	c.closed = closed
+	go func() {
+		defer close(closed)
+		for {
+			if _, err := readFrame(r); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Send the hello over the new connection and return the version of the connection from the answer. A peer that
+// doesn't answer within helloTimeout hasn't been upgraded, and the connection is of protocolV1.
+func (c *peerConn) hello(conn net.Conn, r *bufio.Reader) (int, error) {
+	if c.wire.version < protocolV2 {
+		return protocolV1, nil
+	}
+	if err := writeFrame(conn, c.wire.hello(c.sender, c.wire.version)); err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	message, err := readFrame(r)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return protocolV1, nil
+		}
+		return 0, err
+	}
+	e, err := parseMessage(message)
+	if err != nil || e.Command != cHello || e.Version > c.wire.version {
+		return 0, fmt.Errorf("%s answered the hello with a malformed message", c.addr)
+	}
+	return e.Version, nil
+}
+
+func (c *peerConn) disconnect() {
+	c.conn.Close()
+	c.conn, c.writer = nil, nil
+}
+
+// Read the frames of a connection until it is closed, passing on every message with the version of the connection.
+// The hello of a peer is answered with the version of the connection, protocolV1 until then, and the connection of a
+// peer of another network is closed.
+func serveFrames(conn net.Conn, wire wireProtocol, handle func(message []byte, version int)) error {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	connVersion := protocolV1
+	for {
+		message, err := readFrame(r)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("the connection from %s: %v", conn.RemoteAddr(), err)
+		}
+		if wire.version >= protocolV2 && len(message) > 0 && message[0] == envelopeMagic {
+			if e, err := parseMessage(message); err == nil && e.Command == cHello {
+				version, err := wire.answerHello(e)
+				if err != nil {
+					return fmt.Errorf("the connection from %s: %v", conn.RemoteAddr(), err)
+				}
+				if err := writeFrame(conn, wire.hello("", version)); err != nil {
+					return err
+				}
+				connVersion = version
+				continue
+			}
+		}
+		handle(message, connVersion)
+	}
 }
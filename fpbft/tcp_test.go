@@ -0,0 +1,78 @@
+package fpbft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	messages := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{7}, 1<<16)}
+	var buf bytes.Buffer
+	for _, m := range messages {
+		if err := writeFrame(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range messages {
+		got, err := readFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, m) {
+			t.Fatalf("a frame of %d bytes was read as %d bytes", len(m), len(got))
+		}
+	}
+	if _, err := readFrame(&buf); err != io.EOF {
+		t.Fatalf("reading past the last frame: %v", err)
+	}
+}
+
+// A frame longer than maxFrameSize is neither written nor read, and a frame cut short is not read.
+func TestFrameRejected(t *testing.T) {
+	if err := writeFrame(io.Discard, make([]byte, maxFrameSize+1)); err != errFrameTooLarge {
+		t.Fatalf("writing a frame too large: %v", err)
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxFrameSize+1)
+	if _, err := readFrame(bytes.NewReader(header[:])); err != errFrameTooLarge {
+		t.Fatalf("reading a frame too large: %v", err)
+	}
+	var buf bytes.Buffer
+	writeFrame(&buf, []byte("cut short"))
+	frame := buf.Bytes()
+	for _, n := range []int{2, 4, len(frame) - 1} {
+		if _, err := readFrame(bytes.NewReader(frame[:n])); err != io.ErrUnexpectedEOF {
+			t.Fatalf("reading %d of the %d bytes of a frame: %v", n, len(frame), err)
+		}
+	}
+}
+
+// A peer sending a frame too large is disconnected, after the frames it sent before were handled.
+func TestConnectionClosedOnFrameTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	handled := make(chan []byte, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serveFrames(server, wireProtocol{version: currentProtocolVersion}, func(message []byte, version int) {
+			handled <- message
+		})
+	}()
+	go func() {
+		writeFrame(client, []byte("before"))
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], maxFrameSize+1)
+		client.Write(header[:])
+	}()
+	if m := <-handled; string(m) != "before" {
+		t.Fatalf("the frame %q was handled", m)
+	}
+	if err := <-served; err == nil {
+		t.Fatal("the connection sending a frame too large was served on")
+	}
+	if _, err := client.Write([]byte{0}); err == nil {
+		t.Fatal("the connection is still open")
+	}
+}
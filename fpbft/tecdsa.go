@@ -0,0 +1,1023 @@
+package fpbft
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/coinbase/kryptology/pkg/core"
+	"github.com/coinbase/kryptology/pkg/core/curves"
+	"github.com/coinbase/kryptology/pkg/paillier"
+	v1 "github.com/coinbase/kryptology/pkg/sharing/v1"
+	"github.com/coinbase/kryptology/pkg/tecdsa/gg20/dealer"
+	"github.com/coinbase/kryptology/pkg/tecdsa/gg20/participant"
+	"github.com/coinbase/kryptology/pkg/tecdsa/gg20/proof"
+
+	"proof-of-training/keystore"
+)
+
+// The GG20 threshold ECDSA of kryptology works on the secp256k1 curve of btcec, the curve of the DKG keys.
+var tecdsaCurve = btcec.S256()
+
+const (
+	//The setup of a key fails if the messages of all the nodes have not arrived after defaultTECDSASetupTimeout.
+	//The nodes generate their Paillier keys before they send them, which takes minutes the first time.
+	defaultTECDSASetupTimeout = 10 * time.Minute
+	//The cosigners of an attempt to sign a transaction give up after defaultTECDSASignTimeout, and the next cosigners try.
+	defaultTECDSASignTimeout = 30 * time.Second
+	//Tag of the Paillier key of a node and the secrets of its range proof parameters in its keystore
+	paillierKeyTag = "PAILLIER"
+	//Directory the nodes write the transactions the committee signed to: Transactions/<id>/<id>_<nonce>_TX.
+	defaultTransactionDir = "Transactions"
+	//A node may open maxTECDSASigningsPerNode signings of transactions this node has not executed yet
+	maxTECDSASigningsPerNode = 16
+	//Signings that are done, or whose transaction this node has not executed, are dropped at the first checkpoint
+	//tecdsaSigningLifetime sequence numbers after they were opened
+	tecdsaSigningLifetime = 10 * defaultCheckpointPeriod
+)
+
+// A signing session is identified by the hex encoded hash of its transaction.
+var tecdsaSessionPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// An application whose requests pay out on the L2 chain. Settle is called once a request has been executed, and returns the
+// EVM transaction of the request, which the committee signs with its threshold key. It must be deterministic, like Execute.
+type Settler interface {
+	Settle(r Request) (EVMTransaction, bool)
+}
+
+// The Paillier key of a node and the secrets of the parameters of its range proofs, N~ = P~Q~, h1 and h2 = h1^alpha.
+// They are generated once and kept in the keystore of the node, whatever keys they are set up for.
+type paillierKeys struct {
+	P, Q           *big.Int
+	ProofP, ProofQ *big.Int
+	H1, Alpha      *big.Int
+}
+
+// Generate a Paillier key and range proof parameters from four 1024-bit safe primes.
+func generatePaillierKeys() (paillierKeys, error) {
+	var k paillierKeys
+	primes := make([]*big.Int, 4)
+	errs := make(chan error, len(primes))
+	for i := range primes {
+		go func(i int) {
+			var err error
+			primes[i], err = core.GenerateSafePrime(paillier.PaillierPrimeBits)
+			errs <- err
+		}(i)
+	}
+	for range primes {
+		if err := <-errs; err != nil {
+			return k, err
+		}
+	}
+	if primes[0].Cmp(primes[1]) == 0 || primes[2].Cmp(primes[3]) == 0 {
+		return k, errors.New("the safe primes of a modulus are equal")
+	}
+	k = paillierKeys{P: primes[0], Q: primes[1], ProofP: primes[2], ProofQ: primes[3]}
+	n := new(big.Int).Mul(k.ProofP, k.ProofQ)
+	f, err := core.Rand(n)
+	if err != nil {
+		return k, err
+	}
+	k.H1 = new(big.Int).Mod(new(big.Int).Mul(f, f), n)
+	//alpha must be invertible modulo p~q~ for the second proof
+	for k.Alpha == nil || k.beta() == nil {
+		if k.Alpha, err = core.Rand(n); err != nil {
+			return k, err
+		}
+	}
+	return k, nil
+}
+
+// The inverse of alpha modulo p~q~, where P~ = 2p~+1 and Q~ = 2q~+1, so that h1 = h2^beta.
+func (k paillierKeys) beta() *big.Int {
+	pq := new(big.Int).Mul(new(big.Int).Rsh(k.ProofP, 1), new(big.Int).Rsh(k.ProofQ, 1))
+	return new(big.Int).ModInverse(k.Alpha, pq)
+}
+
+func (k paillierKeys) proofParams() *dealer.ProofParams {
+	n := new(big.Int).Mul(k.ProofP, k.ProofQ)
+	return &dealer.ProofParams{N: n, H1: k.H1, H2: new(big.Int).Exp(k.H1, k.Alpha, n)}
+}
+
+// Read the Paillier key of the node from its keystore, generating it the first time.
+func loadPaillierKeys(nodeID string) (paillierKeys, error) {
+	var k paillierKeys
+	if !keystore.DefaultStore.Has(nodeID, paillierKeyTag) {
+		fmt.Printf("%s is generating its Paillier key, which takes a few minutes...\n", nodeID)
+		var err error
+		if k, err = generatePaillierKeys(); err != nil {
+			return k, err
+		}
+		sk, err := paillier.NewSecretKey(k.P, k.Q)
+		if err != nil {
+			return k, err
+		}
+		prvkey, err := json.Marshal(k)
+		if err != nil {
+			return k, err
+		}
+		pubkey, err := json.Marshal(TECDSASetup{NodeID: nodeID, PaillierKey: &sk.PublicKey, ProofParams: k.proofParams()})
+		if err != nil {
+			return k, err
+		}
+		return k, writeKeyPair(paillierKeyTag, nodeID, prvkey, pubkey)
+	}
+	b, err := readPrivKey(paillierKeyTag, nodeID)
+	if err != nil {
+		return k, err
+	}
+	err = json.Unmarshal(b, &k)
+	return k, err
+}
+
+// The setup message of the node for the key y, with the proofs bound to y and to the share ID of the node.
+func (k paillierKeys) setup(session, nodeID string, y *curves.EcPoint) (TECDSASetup, error) {
+	s := TECDSASetup{Session: session, NodeID: nodeID, ProofParams: k.proofParams()}
+	id, err := dkgShareID(nodeID)
+	if err != nil {
+		return s, err
+	}
+	sk, err := paillier.NewSecretKey(k.P, k.Q)
+	if err != nil {
+		return s, err
+	}
+	s.PaillierKey = &sk.PublicKey
+	pi, qi := new(big.Int).Rsh(k.ProofP, 1), new(big.Int).Rsh(k.ProofQ, 1)
+	pp := s.ProofParams
+	proof1, err := proof.CdlProofParams{Curve: tecdsaCurve, Pi: pi, Qi: qi, H1: pp.H1, H2: pp.H2, ScalarX: k.Alpha, N: pp.N}.Prove()
+	if err != nil {
+		return s, err
+	}
+	proof2, err := proof.CdlProofParams{Curve: tecdsaCurve, Pi: pi, Qi: qi, H1: pp.H2, H2: pp.H1, ScalarX: k.beta(), N: pp.N}.Prove()
+	if err != nil {
+		return s, err
+	}
+	s.CDLProofs = []*proof.CdlProof{proof1, proof2}
+	psf := paillier.PsfProofParams{Curve: tecdsaCurve, SecretKey: sk, Pi: id, Y: y}
+	if s.PSFProof, err = psf.Prove(); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// Verify the setup message of a node for the key y. The Paillier modulus must have 2048 bits, against the attack of
+// https://eprint.iacr.org/2021/1621.pdf, and the proofs must verify.
+func verifyTECDSASetup(s TECDSASetup, y *curves.EcPoint) error {
+	if s.PaillierKey == nil || s.PaillierKey.N == nil || s.ProofParams == nil || s.ProofParams.N == nil ||
+		s.ProofParams.H1 == nil || s.ProofParams.H2 == nil || len(s.CDLProofs) != 2 || s.CDLProofs[0] == nil || s.CDLProofs[1] == nil {
+		return errors.New("the setup is incomplete")
+	}
+	if bits := s.PaillierKey.N.BitLen(); bits != 2*paillier.PaillierPrimeBits && bits != 2*paillier.PaillierPrimeBits-1 {
+		return fmt.Errorf("the Paillier modulus has %d bits", bits)
+	}
+	id, err := dkgShareID(s.NodeID)
+	if err != nil {
+		return err
+	}
+	pp := s.ProofParams
+	if err := s.CDLProofs[0].Verify(&proof.CdlVerifyParams{Curve: tecdsaCurve, H1: pp.H1, H2: pp.H2, N: pp.N}); err != nil {
+		return fmt.Errorf("h2 is not a power of h1: %v", err)
+	}
+	if err := s.CDLProofs[1].Verify(&proof.CdlVerifyParams{Curve: tecdsaCurve, H1: pp.H2, H2: pp.H1, N: pp.N}); err != nil {
+		return fmt.Errorf("h1 is not a power of h2: %v", err)
+	}
+	if err := s.PSFProof.Verify(&paillier.PsfVerifyParams{Curve: tecdsaCurve, PublicKey: s.PaillierKey, Pi: id, Y: y}); err != nil {
+		return fmt.Errorf("the Paillier modulus is not square-free: %v", err)
+	}
+	return nil
+}
+
+// A compressed secp256k1 point as a point of kryptology's GG20.
+func tecdsaPoint(b []byte) (*curves.EcPoint, error) {
+	pub, err := btcec.ParsePubKey(b, tecdsaCurve)
+	if err != nil {
+		return nil, err
+	}
+	return &curves.EcPoint{Curve: tecdsaCurve, X: pub.X, Y: pub.Y}, nil
+}
+
+// The node holding the DKG share with the ID.
+func dkgShareNode(id uint32) string {
+	return "N" + strconv.Itoa(int(id)-1)
+}
+
+// Read the share of the node in the key of the DKG session, and the key the node established, from its transcript.
+func readDKGKey(session, nodeID string) (*big.Int, DKGResult, error) {
+	var t DKGTranscript
+	prvkey, err := readPrivKey("DKG-"+session, nodeID)
+	if err != nil {
+		return nil, t.Result, err
+	}
+	block, _ := pem.Decode(prvkey)
+	if block == nil || block.Type != "DKG KEY SHARE" {
+		return nil, t.Result, fmt.Errorf("the DKG key share of %s is malformed", nodeID)
+	}
+	b, err := ioutil.ReadFile(keyFile("DKG-"+session, nodeID, "TRANSCRIPT"))
+	if err != nil {
+		return nil, t.Result, err
+	}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, t.Result, err
+	}
+	return new(big.Int).SetBytes(block.Bytes), t.Result, nil
+}
+
+// The threshold ECDSA key share of a node, kept in its keystore under the tag TECDSA-<session>: its DKG share,
+// its Paillier key, and the public shares, Paillier keys and range proof parameters of the other nodes.
+type tecdsaKeyShare struct {
+	Session   string
+	Threshold int
+	//The nodes of the committee, in the order of their shares
+	Nodes []string
+	Data  *dealer.ParticipantData
+}
+
+// The committee key a node signs the transactions of the application with.
+type tecdsaCommittee struct {
+	tecdsaKeyShare
+	publicKey *btcec.PublicKey
+	address   string
+}
+
+func newTECDSACommittee(share tecdsaKeyShare) (*tecdsaCommittee, error) {
+	if share.Data == nil || share.Data.EcdsaPublicKey == nil {
+		return nil, errors.New("the key share is incomplete")
+	}
+	pub := &btcec.PublicKey{Curve: tecdsaCurve, X: share.Data.EcdsaPublicKey.X, Y: share.Data.EcdsaPublicKey.Y}
+	return &tecdsaCommittee{tecdsaKeyShare: share, publicKey: pub, address: evmAddress(pub)}, nil
+}
+
+// The cosigners of the attempt to sign the transaction with the nonce: threshold nodes, starting at a node that moves
+// on with the nonce, so the transactions are shared among the nodes, and with every attempt, so a faulty node is skipped.
+func (c *tecdsaCommittee) cosigners(nonce uint64, attempt int) []string {
+	cosigners := make([]string, 0, c.Threshold)
+	for i := 0; i < c.Threshold; i++ {
+		cosigners = append(cosigners, c.Nodes[(int(nonce%uint64(len(c.Nodes)))+attempt+i)%len(c.Nodes)])
+	}
+	return cosigners
+}
+
+// Sign the transactions of the application with the threshold key set up for the DKG session, read from the keystore.
+func (p *pbft) useCommitteeKey(session string) error {
+	b, err := readPrivKey("TECDSA-"+session, p.node.nodeID)
+	if err != nil {
+		return err
+	}
+	var share tecdsaKeyShare
+	if err := json.Unmarshal(b, &share); err != nil {
+		return err
+	}
+	committee, err := newTECDSACommittee(share)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.committee = committee
+	return nil
+}
+
+// A setup of the key of a DKG session for threshold ECDSA.
+type tecdsaSetupSession struct {
+	id string
+	//Whether this node has started the setup, the messages of the other nodes may arrive before
+	started bool
+	done    bool
+	//Messages received, including the one of this node, corresponding according to the node ID.
+	setups map[string]TECDSASetup
+	keys   paillierKeys
+	share  *big.Int
+	dkg    DKGResult
+	timer  *time.Timer
+	result chan string
+}
+
+// The setup of the session, created when its first message arrives.
+func (p *pbft) getTECDSASetup(id string) *tecdsaSetupSession {
+	s, ok := p.tecdsaSetups[id]
+	if !ok {
+		s = &tecdsaSetupSession{id: id, setups: make(map[string]TECDSASetup)}
+		p.tecdsaSetups[id] = s
+	}
+	return s
+}
+
+// Set up the key of the DKG session for threshold ECDSA signatures with the other nodes of the node table, which set it up too:
+// every node sends its Paillier key and the parameters of its range proofs, with the proofs that they are well formed.
+// Once the messages of all the nodes have arrived and verified, the key becomes the committee key of the node, which
+// signs the transactions of the application, and its EVM address is sent on the channel. The channel is closed without
+// an address if the setup fails.
+func (p *pbft) startTECDSASetup(session string) <-chan string {
+	if !dkgSessionPattern.MatchString(session) {
+		log.Panicf("%q can't be the ID of a DKG session", session)
+	}
+	//Generating the Paillier key and the proofs takes a while, the node keeps handling messages meanwhile
+	keys, err := loadPaillierKeys(p.node.nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	share, result, err := readDKGKey(session, p.node.nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	y, err := tecdsaPoint(result.PublicKey)
+	if err != nil {
+		log.Panic(err)
+	}
+	setup, err := keys.setup(session, p.node.nodeID, y)
+	if err != nil {
+		log.Panic(err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s := p.getTECDSASetup(session)
+	if s.started {
+		log.Panicf("the threshold ECDSA setup %s has already been started", session)
+	}
+	s.started = true
+	s.keys, s.share, s.dkg = keys, share, result
+	s.result = make(chan string, 1)
+	fmt.Printf("%s is setting up the key of the DKG session %s for threshold ECDSA...\n", p.node.nodeID, session)
+	setup.Sign = p.sign(setup.signContent())
+	s.setups[p.node.nodeID] = setup
+	p.broadcast(cTECDSASetup, setup)
+	s.timer = time.AfterFunc(defaultTECDSASetupTimeout, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if !s.done {
+			fmt.Printf("%s failed the threshold ECDSA setup %s: the setups of %d of the %d nodes have arrived\n", p.node.nodeID, s.id, len(s.setups), p.nodeCount)
+			s.done = true
+			close(s.result)
+		}
+	})
+	p.advanceTECDSASetup(s)
+	return s.result
+}
+
+// Keep the setup message of a node.
+func (p *pbft) handleTECDSASetup(content []byte) error {
+	m := new(TECDSASetup)
+	if err := decodeMessage(content, m); err != nil {
+		return err
+	}
+	if err := checkDKGSession(m.Session); err != nil {
+		return err
+	}
+	if err := p.verifySender(m.NodeID, m.signContent(), m.Sign); err != nil {
+		return err
+	}
+	s := p.getTECDSASetup(m.Session)
+	if kept, ok := s.setups[m.NodeID]; ok {
+		if !bytes.Equal(kept.signContent(), m.signContent()) {
+			return rejectSigned(reasonEquivocation, m.NodeID, "%s sent two setups for the key %s", m.NodeID, m.Session)
+		}
+		return nil
+	}
+	if m.NodeID == p.node.nodeID || s.done {
+		return nil
+	}
+	s.setups[m.NodeID] = *m
+	p.advanceTECDSASetup(s)
+	return nil
+}
+
+func (p *pbft) advanceTECDSASetup(s *tecdsaSetupSession) {
+	if s.started && !s.done && len(s.setups) == p.nodeCount {
+		p.finishTECDSASetup(s)
+	}
+}
+
+// Verify the setups of all the nodes and write the threshold ECDSA key share of this node to its keystore. The proofs
+// of the Paillier keys are verified off the lock, no more setup message is kept once the session is done.
+func (p *pbft) finishTECDSASetup(s *tecdsaSetupSession) {
+	s.done = true
+	s.timer.Stop()
+	nodes := p.dkgNodes()
+	go func() {
+		committee, err := p.setUpCommitteeKey(s, nodes)
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if err != nil {
+			fmt.Printf("%s failed the threshold ECDSA setup %s: %v\n", p.node.nodeID, s.id, err)
+			close(s.result)
+			return
+		}
+		p.committee = committee
+		fmt.Printf("%s has set up the key of the DKG session %s for threshold ECDSA, the committee address is %s\n", p.node.nodeID, s.id, committee.address)
+		s.result <- committee.address
+	}()
+}
+
+// The committee key of the nodes from the setups of the session, with the key share of this node written to its keystore.
+func (p *pbft) setUpCommitteeKey(s *tecdsaSetupSession, nodes []string) (*tecdsaCommittee, error) {
+	share, err := p.tecdsaKeyShare(s, nodes)
+	if err != nil {
+		return nil, err
+	}
+	committee, err := newTECDSACommittee(share)
+	if err != nil {
+		return nil, err
+	}
+	prvkey, err := json.Marshal(share)
+	if err != nil {
+		return nil, err
+	}
+	pubkey, err := readPubKey("DKG-"+s.id, p.node.nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyPair("TECDSA-"+s.id, p.node.nodeID, prvkey, pubkey); err != nil {
+		return nil, fmt.Errorf("the key share can't be written: %v", err)
+	}
+	return committee, nil
+}
+
+// The key share of this node among the nodes from the verified setups of the nodes and its DKG share.
+func (p *pbft) tecdsaKeyShare(s *tecdsaSetupSession, nodes []string) (tecdsaKeyShare, error) {
+	share := tecdsaKeyShare{Session: s.id, Threshold: s.dkg.Threshold, Nodes: nodes}
+	y, err := tecdsaPoint(s.dkg.PublicKey)
+	if err != nil {
+		return share, err
+	}
+	id, err := dkgShareID(p.node.nodeID)
+	if err != nil {
+		return share, err
+	}
+	sk, err := paillier.NewSecretKey(s.keys.P, s.keys.Q)
+	if err != nil {
+		return share, err
+	}
+	point, err := curves.NewScalarBaseMult(tecdsaCurve, s.share)
+	if err != nil {
+		return share, err
+	}
+	data := &dealer.ParticipantData{
+		Id:             id,
+		DecryptKey:     sk,
+		SecretKeyShare: &dealer.Share{ShamirShare: v1.NewShamirShare(id, s.share.Bytes(), curves.NewField(tecdsaCurve.N)), Point: point},
+		EcdsaPublicKey: y,
+		PublicShares:   make(map[uint32]*dealer.PublicShare),
+		EncryptKeys:    make(map[uint32]*paillier.PublicKey),
+	}
+	params := make(map[uint32]*dealer.ProofParams)
+	for _, nodeID := range share.Nodes {
+		setup := s.setups[nodeID]
+		if err := verifyTECDSASetup(setup, y); err != nil {
+			return share, fmt.Errorf("the setup of %s: %v", nodeID, err)
+		}
+		publicShare, err := tecdsaPoint(s.dkg.PublicShares[nodeID])
+		if err != nil {
+			return share, fmt.Errorf("the public share of %s: %v", nodeID, err)
+		}
+		nodeShareID, _ := dkgShareID(nodeID)
+		data.PublicShares[nodeShareID] = &dealer.PublicShare{Point: publicShare}
+		data.EncryptKeys[nodeShareID] = setup.PaillierKey
+		params[nodeShareID] = setup.ProofParams
+	}
+	if !data.PublicShares[id].Point.Equals(point) {
+		return share, errors.New("the DKG share of the node doesn't match its public share")
+	}
+	data.KeyGenType = dealer.DistributedKeyGenType{ProofParams: params}
+	share.Data = data
+	return share, nil
+}
+
+// A transaction the committee signed, as the nodes write it to the Transactions directory.
+type SignedTransaction struct {
+	Transaction EVMTransaction
+	Hash        string
+	//The committee address, the sender of the transaction
+	From      string
+	Cosigners []string
+	//The signed transaction, hex encoded, to send with eth_sendRawTransaction
+	RawTransaction string
+}
+
+// A signing of a transaction hash with the committee key.
+type tecdsaSigning struct {
+	id string
+	//The transaction, known once this node has executed its request
+	tx   *EVMTransaction
+	hash []byte
+	done bool
+	//The node whose message opened the signing before this node executed the request, empty once it has,
+	//and the last sequence number this node had executed when the signing was opened or its request executed
+	opener   string
+	openedAt int
+	//The current attempt, and its cosigners
+	attempt   int
+	cosigners []string
+	//The signer of this node in the current attempt, nil if the node is not a cosigner or has failed
+	signer *participant.Signer
+	//The round whose messages the signer waits for
+	round int
+	//The signer is running a round off the lock
+	running bool
+	//Messages received, corresponding according to the attempt, the round and the node ID.
+	messages map[int]map[int]map[string]TECDSASignRound
+	//Signatures that arrived before this node executed the request, corresponding according to the cosigner
+	signatures map[string]TECDSASignature
+	timer      *time.Timer
+}
+
+// The signing of the session. A message of another node opens it before this node has executed the request, unless
+// that node has opened maxTECDSASigningsPerNode such signings already, in which case nil is returned.
+func (p *pbft) openTECDSASigning(id, opener string) *tecdsaSigning {
+	if s, ok := p.tecdsaSignings[id]; ok {
+		return s
+	}
+	opened := 0
+	for _, s := range p.tecdsaSignings {
+		if s.tx == nil && s.opener == opener {
+			opened++
+		}
+	}
+	if opened >= maxTECDSASigningsPerNode {
+		fmt.Printf("%s has opened %d signings of transactions this node has not executed, refusing to open %s\n", opener, opened, id)
+		return nil
+	}
+	s := &tecdsaSigning{id: id, opener: opener, openedAt: p.lastExecuted, messages: make(map[int]map[int]map[string]TECDSASignRound), signatures: make(map[string]TECDSASignature)}
+	p.tecdsaSignings[id] = s
+	return s
+}
+
+// Drop the signings that are done, or whose transaction this node has not executed, tecdsaSigningLifetime sequence
+// numbers after they were opened, at a checkpoint. A signing still in progress ends with its last attempt.
+func (p *pbft) collectTECDSASignings(sequenceID int) {
+	for id, s := range p.tecdsaSignings {
+		if (s.tx != nil && !s.done) || sequenceID-s.openedAt < tecdsaSigningLifetime {
+			continue
+		}
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		delete(p.tecdsaSignings, id)
+	}
+}
+
+// Sign the transaction of an executed request with the committee key. Every node executes the request, so every node knows
+// the transaction, and the cosigners of an attempt only sign the hash they computed themselves.
+func (p *pbft) cosignTransaction(tx EVMTransaction) {
+	if p.committee == nil {
+		fmt.Printf("%s has no committee key to sign the transaction with nonce %d\n", p.node.nodeID, tx.Nonce)
+		return
+	}
+	hash, err := tx.signingHash()
+	if err != nil {
+		fmt.Printf("The transaction with nonce %d can't be signed: %v\n", tx.Nonce, err)
+		return
+	}
+	s := p.openTECDSASigning(hex.EncodeToString(hash), "")
+	if s.tx != nil {
+		return
+	}
+	s.tx, s.hash = &tx, hash
+	s.opener, s.openedAt = "", p.lastExecuted
+	//The signatures that arrived before are verified now, a single one that verifies finishes the signing
+	signatures := s.signatures
+	s.signatures = nil
+	for nodeID, ts := range signatures {
+		if err := p.checkTECDSASignature(s, ts); err != nil {
+			p.recordRejection("", err)
+			continue
+		}
+		if err := p.acceptTECDSASignature(s, ts); err != nil {
+			fmt.Printf("%s can't keep the transaction with nonce %d signed by %s: %v\n", p.node.nodeID, tx.Nonce, nodeID, err)
+		}
+		return
+	}
+	p.startTECDSAAttempt(s, 0)
+}
+
+// Start the attempt of the signing. Only its cosigners run the GG20 rounds, the other nodes wait for the signature.
+func (p *pbft) startTECDSAAttempt(s *tecdsaSigning, attempt int) {
+	//A round of the previous attempt still running is ignored when it returns
+	s.attempt, s.signer, s.round, s.running = attempt, nil, 0, false
+	s.cosigners = p.committee.cosigners(s.tx.Nonce, attempt)
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(defaultTECDSASignTimeout, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if s.done || s.attempt != attempt {
+			return
+		}
+		if attempt+1 == len(p.committee.Nodes) {
+			fmt.Printf("%s gives up signing the transaction with nonce %d, every attempt has failed\n", p.node.nodeID, s.tx.Nonce)
+			s.done = true
+			return
+		}
+		fmt.Printf("The cosigners %v have not signed the transaction with nonce %d in time, the next cosigners try\n", s.cosigners, s.tx.Nonce)
+		p.startTECDSAAttempt(s, attempt+1)
+	})
+	ids := make([]uint32, 0, len(s.cosigners))
+	cosigner := false
+	for _, nodeID := range s.cosigners {
+		id, _ := dkgShareID(nodeID)
+		ids = append(ids, id)
+		cosigner = cosigner || nodeID == p.node.nodeID
+	}
+	if !cosigner {
+		return
+	}
+	fmt.Printf("%s is cosigning the transaction with nonce %d with %v...\n", p.node.nodeID, s.tx.Nonce, s.cosigners)
+	data := p.committee.Data
+	p.runTECDSARound(s, func() (tecdsaRoundOutput, error) {
+		signer, err := participant.NewSigner(data, ids)
+		if err != nil {
+			return tecdsaRoundOutput{}, err
+		}
+		bcast, p2p, err := signer.SignRound1()
+		if err != nil {
+			return tecdsaRoundOutput{}, err
+		}
+		out := tecdsaRoundOutput{signer: signer, bcast: bcast, p2p: make(map[string]interface{})}
+		for id, m := range p2p {
+			out.p2p[dkgShareNode(id)] = m
+		}
+		return out, nil
+	})
+}
+
+// What a GG20 round of a cosigner produced: the signer it started with in the first round, the messages it sends to
+// the other cosigners, or the signature once the last round is over.
+type tecdsaRoundOutput struct {
+	signer *participant.Signer
+	bcast  interface{}
+	p2p    map[string]interface{}
+	sig    *curves.EcdsaSignature
+}
+
+// Run a round of the signer of the current attempt off the lock, as the range proofs of the Paillier encryptions
+// take a while, and carry on with its output under the lock unless the attempt is over by then.
+func (p *pbft) runTECDSARound(s *tecdsaSigning, round func() (tecdsaRoundOutput, error)) {
+	s.running = true
+	attempt, signer := s.attempt, s.signer
+	go func() {
+		out, err := round()
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if s.done || s.attempt != attempt || s.signer != signer {
+			return
+		}
+		s.running = false
+		if err != nil {
+			fmt.Printf("%s failed round %d of the attempt %d to sign the transaction with nonce %d: %v\n", p.node.nodeID, s.round+1, s.attempt, s.tx.Nonce, err)
+			s.signer = nil
+			return
+		}
+		if out.signer != nil {
+			s.signer = out.signer
+		}
+		s.round++
+		if out.sig != nil {
+			p.finishTECDSASigning(s, out.sig)
+			return
+		}
+		p.sendTECDSARound(s, out.bcast, out.p2p)
+		p.advanceTECDSASign(s)
+	}()
+}
+
+// Broadcast the messages of this node in the round the signer has just completed.
+func (p *pbft) sendTECDSARound(s *tecdsaSigning, bcast interface{}, p2p map[string]interface{}) {
+	m := TECDSASignRound{Session: s.id, Attempt: s.attempt, Round: s.round, NodeID: p.node.nodeID}
+	var err error
+	if bcast != nil {
+		if m.Bcast, err = json.Marshal(bcast); err != nil {
+			log.Panic(err)
+		}
+	}
+	if len(p2p) > 0 {
+		m.P2P = make(map[string]json.RawMessage)
+		for nodeID, v := range p2p {
+			if m.P2P[nodeID], err = json.Marshal(v); err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+	m.Sign = p.sign(m.signContent())
+	p.broadcast(cTECDSASign, m)
+}
+
+// Check that the node is a member of the committee, and may send messages to sign its transactions. A node that has
+// not set up the committee key yet keeps the messages of any node, the cosigners of an attempt are checked later.
+func (p *pbft) checkCosigner(nodeID string) error {
+	if p.committee == nil {
+		return nil
+	}
+	for _, member := range p.committee.Nodes {
+		if member == nodeID {
+			return nil
+		}
+	}
+	return rejectSigned(reasonInvalidMessage, nodeID, "%s is not a member of the committee", nodeID)
+}
+
+// Keep the message of a cosigner.
+func (p *pbft) handleTECDSASignRound(content []byte) error {
+	m := new(TECDSASignRound)
+	if err := decodeMessage(content, m); err != nil {
+		return err
+	}
+	if !tecdsaSessionPattern.MatchString(m.Session) {
+		return reject(reasonInvalidMessage, "%q is not a transaction hash", m.Session)
+	}
+	if m.Round < 1 || m.Round > 6 || m.Attempt < 0 || m.Attempt >= p.nodeCount {
+		return reject(reasonInvalidMessage, "round %d of the attempt %d", m.Round, m.Attempt)
+	}
+	if err := p.verifySender(m.NodeID, m.signContent(), m.Sign); err != nil {
+		return err
+	}
+	if err := p.checkCosigner(m.NodeID); err != nil {
+		return err
+	}
+	s := p.openTECDSASigning(m.Session, m.NodeID)
+	if s == nil || s.done {
+		return nil
+	}
+	if s.messages[m.Attempt] == nil {
+		s.messages[m.Attempt] = make(map[int]map[string]TECDSASignRound)
+	}
+	if s.messages[m.Attempt][m.Round] == nil {
+		s.messages[m.Attempt][m.Round] = make(map[string]TECDSASignRound)
+	}
+	if kept, ok := s.messages[m.Attempt][m.Round][m.NodeID]; ok {
+		if !bytes.Equal(kept.signContent(), m.signContent()) {
+			return rejectSigned(reasonEquivocation, m.NodeID, "%s sent two messages in round %d of the attempt %d to sign %s", m.NodeID, m.Round, m.Attempt, m.Session)
+		}
+		return nil
+	}
+	s.messages[m.Attempt][m.Round][m.NodeID] = *m
+	p.advanceTECDSASign(s)
+	return nil
+}
+
+// Run the next round of the signer once the messages of all the other cosigners in the round it waits for have arrived.
+func (p *pbft) advanceTECDSASign(s *tecdsaSigning) {
+	if s.signer == nil || s.done || s.running {
+		return
+	}
+	messages := s.messages[s.attempt][s.round]
+	for _, nodeID := range s.cosigners {
+		if _, ok := messages[nodeID]; !ok && nodeID != p.node.nodeID {
+			return
+		}
+	}
+	signer, round, hash, cosigners := s.signer, s.round, s.hash, s.cosigners
+	p.runTECDSARound(s, func() (tecdsaRoundOutput, error) {
+		return tecdsaRound(signer, round, hash, p.node.nodeID, cosigners, messages)
+	})
+}
+
+// Decode the broadcasts of the other cosigners in their messages, or the messages they sent to the node.
+func tecdsaInputs(nodeID string, cosigners []string, messages map[string]TECDSASignRound, p2p bool, decode func(id uint32, b []byte) error) error {
+	for _, cosigner := range cosigners {
+		if cosigner == nodeID {
+			continue
+		}
+		b := []byte(messages[cosigner].Bcast)
+		if p2p {
+			b = messages[cosigner].P2P[nodeID]
+		}
+		if len(b) == 0 {
+			return fmt.Errorf("%s sent nothing", cosigner)
+		}
+		id, _ := dkgShareID(cosigner)
+		if err := decode(id, b); err != nil {
+			return fmt.Errorf("the message of %s: %v", cosigner, err)
+		}
+	}
+	return nil
+}
+
+// Run the next GG20 round of the signer of the node with the messages the other cosigners sent in the round it waits for.
+// It only touches the signer, which no other round of the node runs with meanwhile.
+func tecdsaRound(signer *participant.Signer, round int, hash []byte, nodeID string, cosigners []string, messages map[string]TECDSASignRound) (tecdsaRoundOutput, error) {
+	var out tecdsaRoundOutput
+	inputs := func(p2p bool, decode func(id uint32, b []byte) error) error {
+		return tecdsaInputs(nodeID, cosigners, messages, p2p, decode)
+	}
+	switch round {
+	case 1:
+		bcasts := make(map[uint32]*participant.Round1Bcast)
+		proofs := make(map[uint32]*participant.Round1P2PSend)
+		if err := inputs(false, func(id uint32, b []byte) error {
+			bcasts[id] = new(participant.Round1Bcast)
+			return json.Unmarshal(b, bcasts[id])
+		}); err != nil {
+			return out, err
+		}
+		if err := inputs(true, func(id uint32, b []byte) error {
+			proofs[id] = new(participant.Round1P2PSend)
+			return json.Unmarshal(b, proofs[id])
+		}); err != nil {
+			return out, err
+		}
+		p2p, err := signer.SignRound2(bcasts, proofs)
+		if err != nil {
+			return out, err
+		}
+		out.p2p = make(map[string]interface{})
+		for id, m := range p2p {
+			out.p2p[dkgShareNode(id)] = m
+		}
+	case 2:
+		in := make(map[uint32]*participant.P2PSend)
+		if err := inputs(true, func(id uint32, b []byte) error {
+			in[id] = new(participant.P2PSend)
+			return json.Unmarshal(b, in[id])
+		}); err != nil {
+			return out, err
+		}
+		bcast, err := signer.SignRound3(in)
+		if err != nil {
+			return out, err
+		}
+		out.bcast = bcast
+	case 3:
+		in := make(map[uint32]*participant.Round3Bcast)
+		if err := inputs(false, func(id uint32, b []byte) error {
+			in[id] = new(participant.Round3Bcast)
+			return json.Unmarshal(b, in[id])
+		}); err != nil {
+			return out, err
+		}
+		bcast, err := signer.SignRound4(in)
+		if err != nil {
+			return out, err
+		}
+		out.bcast = bcast
+	case 4:
+		in := make(map[uint32]*participant.Round4Bcast)
+		if err := inputs(false, func(id uint32, b []byte) error {
+			in[id] = new(participant.Round4Bcast)
+			return json.Unmarshal(b, in[id])
+		}); err != nil {
+			return out, err
+		}
+		bcast, p2p, err := signer.SignRound5(in)
+		if err != nil {
+			return out, err
+		}
+		out.bcast, out.p2p = bcast, make(map[string]interface{})
+		for id, m := range p2p {
+			out.p2p[dkgShareNode(id)] = m
+		}
+	case 5:
+		bcasts := make(map[uint32]*participant.Round5Bcast)
+		proofs := make(map[uint32]*participant.Round5P2PSend)
+		if err := inputs(false, func(id uint32, b []byte) error {
+			bcasts[id] = new(participant.Round5Bcast)
+			return json.Unmarshal(b, bcasts[id])
+		}); err != nil {
+			return out, err
+		}
+		if err := inputs(true, func(id uint32, b []byte) error {
+			proofs[id] = new(participant.Round5P2PSend)
+			return json.Unmarshal(b, proofs[id])
+		}); err != nil {
+			return out, err
+		}
+		bcast, err := signer.SignRound6Full(hash, bcasts, proofs)
+		if err != nil {
+			return out, err
+		}
+		out.bcast = bcast
+	case 6:
+		in := make(map[uint32]*participant.Round6FullBcast)
+		if err := inputs(false, func(id uint32, b []byte) error {
+			in[id] = new(participant.Round6FullBcast)
+			return json.Unmarshal(b, in[id])
+		}); err != nil {
+			return out, err
+		}
+		sig, err := signer.SignOutput(in)
+		if err != nil {
+			return out, err
+		}
+		out.sig = sig
+	}
+	return out, nil
+}
+
+// Broadcast the signature the signer of this node assembled in the last round, and finish the signing with it.
+func (p *pbft) finishTECDSASigning(s *tecdsaSigning, sig *curves.EcdsaSignature) {
+	s.signer = nil
+	sign, err := evmSignature(p.committee.publicKey, s.hash, sig.R, sig.S)
+	if err != nil {
+		fmt.Printf("%s assembled a signature of the transaction with nonce %d that doesn't verify: %v\n", p.node.nodeID, s.tx.Nonce, err)
+		return
+	}
+	ts := TECDSASignature{Session: s.id, Attempt: s.attempt, NodeID: p.node.nodeID, Signature: sign}
+	ts.Sign = p.sign(ts.signContent())
+	p.broadcast(cTECDSASig, ts)
+	if err := p.acceptTECDSASignature(s, ts); err != nil {
+		fmt.Printf("%s can't keep the transaction with nonce %d: %v\n", p.node.nodeID, s.tx.Nonce, err)
+	}
+}
+
+// Keep the signature a cosigner assembled. Until this node has executed the request it can't tell whether the signature
+// is the one of the transaction, so it keeps one signature of every member of the committee, and verifies them later.
+func (p *pbft) handleTECDSASignature(content []byte) error {
+	ts := new(TECDSASignature)
+	if err := decodeMessage(content, ts); err != nil {
+		return err
+	}
+	if !tecdsaSessionPattern.MatchString(ts.Session) {
+		return reject(reasonInvalidMessage, "%q is not a transaction hash", ts.Session)
+	}
+	if err := p.verifySender(ts.NodeID, ts.signContent(), ts.Sign); err != nil {
+		return err
+	}
+	if err := p.checkCosigner(ts.NodeID); err != nil {
+		return err
+	}
+	s := p.openTECDSASigning(ts.Session, ts.NodeID)
+	if s == nil || s.done {
+		return nil
+	}
+	if s.tx == nil {
+		if _, ok := s.signatures[ts.NodeID]; !ok {
+			s.signatures[ts.NodeID] = *ts
+		}
+		return nil
+	}
+	if err := p.checkTECDSASignature(s, *ts); err != nil {
+		return err
+	}
+	if err := p.acceptTECDSASignature(s, *ts); err != nil {
+		fmt.Printf("%s can't keep the transaction with nonce %d: %v\n", p.node.nodeID, s.tx.Nonce, err)
+	}
+	return nil
+}
+
+// Check that the signature of a cosigner of the attempt verifies with the committee key. The cosigner signed the message,
+// so a signature that doesn't verify is blamed on it.
+func (p *pbft) checkTECDSASignature(s *tecdsaSigning, ts TECDSASignature) error {
+	if ts.Attempt < 0 || ts.Attempt >= len(p.committee.Nodes) {
+		return rejectSigned(reasonInvalidMessage, ts.NodeID, "the attempt %d to sign the transaction with nonce %d", ts.Attempt, s.tx.Nonce)
+	}
+	cosigner := false
+	for _, nodeID := range p.committee.cosigners(s.tx.Nonce, ts.Attempt) {
+		cosigner = cosigner || nodeID == ts.NodeID
+	}
+	if !cosigner {
+		return rejectSigned(reasonInvalidMessage, ts.NodeID, "%s is not a cosigner of the attempt %d to sign the transaction with nonce %d", ts.NodeID, ts.Attempt, s.tx.Nonce)
+	}
+	if !verifyEVMSignature(p.committee.publicKey, s.hash, ts.Signature) {
+		return rejectSigned(reasonBadSignature, ts.NodeID, "the signature of the transaction with nonce %d doesn't verify with the committee key", s.tx.Nonce)
+	}
+	return nil
+}
+
+// Finish the signing with a signature that verifies with the committee key, and write the signed transaction.
+// The signing is done even if the transaction can't be written.
+func (p *pbft) acceptTECDSASignature(s *tecdsaSigning, ts TECDSASignature) error {
+	s.done = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.messages, s.signer, s.signatures = nil, nil, nil
+	raw, err := s.tx.rawTransaction(ts.Signature)
+	if err != nil {
+		return err
+	}
+	signed := SignedTransaction{
+		Transaction:    *s.tx,
+		Hash:           "0x" + hex.EncodeToString(keccak256(raw)),
+		From:           p.committee.address,
+		Cosigners:      p.committee.cosigners(s.tx.Nonce, ts.Attempt),
+		RawTransaction: "0x" + hex.EncodeToString(raw),
+	}
+	fmt.Printf("%s has the transaction %s with nonce %d signed by the committee %s\n", p.node.nodeID, signed.Hash, s.tx.Nonce, signed.From)
+	if p.signedTransactions != nil {
+		select {
+		case p.signedTransactions <- signed:
+		default:
+		}
+	}
+	b, err := json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(defaultTransactionDir, p.node.nodeID, p.node.nodeID+"_"+strconv.FormatUint(s.tx.Nonce, 10)+"_TX")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
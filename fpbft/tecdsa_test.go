@@ -0,0 +1,57 @@
+package fpbft
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A signature of the transaction hash, sent by the node before the receiver has executed the transaction.
+func pendingSignature(t *testing.T, sender *pbft, session string) []byte {
+	t.Helper()
+	ts := TECDSASignature{Session: session, NodeID: sender.node.nodeID, Signature: []byte("not verified yet")}
+	ts.Sign = sender.sign(ts.signContent())
+	content, err := json.Marshal(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// The signatures of a transaction this node has not executed are kept for every sender, a node opens a bounded number
+// of signings, and the signings are dropped at a checkpoint once their lifetime is over.
+func TestTECDSASigningsBounded(t *testing.T) {
+	nodes := idleCluster(t)
+	p, n1, n2 := nodes["N0"], nodes["N1"], nodes["N2"]
+	session := strings.Repeat("ab", 32)
+	for _, sender := range []*pbft{n1, n2} {
+		if err := p.handleTECDSASignature(pendingSignature(t, sender, session)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if kept := len(p.tecdsaSignings[session].signatures); kept != 2 {
+		t.Fatalf("%d of the 2 signatures are kept", kept)
+	}
+	forged := pendingSignature(t, n1, strings.Repeat("cd", 32))
+	forged = []byte(strings.Replace(string(forged), `"N1"`, `"N2"`, 1))
+	if err := p.handleTECDSASignature(forged); err == nil {
+		t.Fatal("a signature sent on behalf of another node was kept")
+	}
+	for i := 0; i < maxTECDSASigningsPerNode; i++ {
+		if err := p.handleTECDSASignature(pendingSignature(t, n1, fmt.Sprintf("%064x", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opened := len(p.tecdsaSignings); opened != maxTECDSASigningsPerNode {
+		t.Fatalf("N1 opened %d signings", opened)
+	}
+	p.collectTECDSASignings(tecdsaSigningLifetime - 1)
+	if len(p.tecdsaSignings) == 0 {
+		t.Fatal("the signings were dropped before their lifetime")
+	}
+	p.collectTECDSASignings(tecdsaSigningLifetime)
+	if len(p.tecdsaSignings) != 0 {
+		t.Fatalf("%d signings are left after their lifetime", len(p.tecdsaSignings))
+	}
+}
@@ -0,0 +1,302 @@
+package fpbft
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"time"
+)
+
+// How the nodes and the clients connect to each other.
+type transportSecurity int
+
+const (
+	//Plain TCP: any process that can connect may send messages, which are only checked once received. For benchmarks.
+	transportPlain transportSecurity = iota
+	//Mutually authenticated TLS 1.3: the certificate of every peer is bound to its consensus key, the key of a validator
+	//or of a client, and the connections of peers with unknown identities are refused during the handshake
+	transportMutualTLS
+)
+
+// Time a peer has to complete the TLS handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// The certificate extension holding the signature that binds the certificate to the consensus key of its subject,
+// under the unassigned arc 1.3.9999 used for experimental OIDs.
+var tlsKeyBindingOID = asn1.ObjectIdentifier{1, 3, 9999, 2718, 1}
+
+// The TLS key and certificate of a node or a client. The key lives as long as the process, and the certificate,
+// self-signed with it, is bound to the consensus key of its subject by a signature with that key.
+type tlsIdentity struct {
+	key *ecdsa.PrivateKey
+	//The certificate, and the fingerprint of the consensus key it is bound to
+	certificate    *tls.Certificate
+	keyFingerprint string
+}
+
+func newTLSIdentity() *tlsIdentity {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &tlsIdentity{key: key}
+}
+
+// The content the subject signs with its consensus key, its ID and the hash of the public key of the certificate.
+func tlsBindingContent(subject string, publicKeyInfo []byte) []byte {
+	h := sha256.Sum256(publicKeyInfo)
+	return []byte("tls certificate of " + subject + ": " + hex.EncodeToString(h[:]))
+}
+
+// The certificate of the subject, bound to the consensus key of the signer with the fingerprint. It is issued again
+// once the subject signs with another key.
+func (id *tlsIdentity) certificateOf(subject string, signer Signer, keyFingerprint string) (*tls.Certificate, error) {
+	if id.certificate != nil && id.keyFingerprint == keyFingerprint {
+		return id.certificate, nil
+	}
+	publicKeyInfo, err := x509.MarshalPKIXPublicKey(&id.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := signer.Sign(tlsBindingContent(subject, publicKeyInfo))
+	if err != nil {
+		return nil, err
+	}
+	binding, err := asn1.Marshal(sign)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: subject},
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().AddDate(1, 0, 0),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{{Id: tlsKeyBindingOID, Value: binding}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &id.key.PublicKey, id.key)
+	if err != nil {
+		return nil, err
+	}
+	id.certificate = &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: id.key}
+	id.keyFingerprint = keyFingerprint
+	return id.certificate, nil
+}
+
+// Check the certificate a peer presented in the handshake, returning its subject. The subject must be the expected one
+// unless expected is empty, and verifyBinding must accept the signature binding the certificate to the consensus key
+// of the subject. The handshake itself proves that the peer holds the key of the certificate.
+func verifyTLSPeer(rawCerts [][]byte, expected string, verifyBinding func(subject string, data, sign []byte) error) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New("the peer presented no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return "", err
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return "", fmt.Errorf("the certificate of %s has expired or is not valid yet", cert.Subject.CommonName)
+	}
+	subject := cert.Subject.CommonName
+	if expected != "" && subject != expected {
+		return "", fmt.Errorf("the peer presented the certificate of %s instead of %s", subject, expected)
+	}
+	var sign []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(tlsKeyBindingOID) {
+			if _, err := asn1.Unmarshal(ext.Value, &sign); err != nil {
+				return "", fmt.Errorf("the key binding of the certificate of %s is malformed", subject)
+			}
+		}
+	}
+	if sign == nil {
+		return "", fmt.Errorf("the certificate of %s is not bound to a key", subject)
+	}
+	if err := verifyBinding(subject, tlsBindingContent(subject, cert.RawSubjectPublicKeyInfo), sign); err != nil {
+		return "", err
+	}
+	return subject, nil
+}
+
+// The TLS configuration presenting the certificate of getCertificate, and accepting the peers whose certificate passes
+// verifyTLSPeer. The certificates are self-signed, so the chain is not verified.
+func newTLSConfig(getCertificate func() (*tls.Certificate, error), expected string, verifyBinding func(subject string, data, sign []byte) error) *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return getCertificate()
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return getCertificate()
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := verifyTLSPeer(rawCerts, expected, verifyBinding)
+			return err
+		},
+	}
+}
+
+// Dial the address and complete the handshake with the TLS configuration.
+func dialTLS(addr string, config *tls.Config) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: tlsHandshakeTimeout}, "tcp", addr, config)
+}
+
+// Complete the handshake of a connection accepted with the TLS configuration.
+func acceptTLS(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Server(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Select how the node connects to the other nodes and the clients. All the nodes and clients of a network use the same
+// security, and mutual TLS needs the TCP transport.
+func (p *pbft) setTransportSecurity(security transportSecurity) {
+	t, ok := p.transport.(*tcpTransport)
+	if !ok {
+		if security == transportMutualTLS {
+			log.Panic("mutual TLS needs the TCP transport")
+		}
+		p.security = security
+		return
+	}
+	p.security = security
+	if security == transportMutualTLS {
+		p.tlsIdentity = newTLSIdentity()
+		p.lock.Lock()
+		p.tlsPeers = make(map[string]string, len(p.nodeTable))
+		for nodeID, addr := range p.nodeTable {
+			p.tlsPeers[addr] = nodeID
+		}
+		p.lock.Unlock()
+		t.pool.dial = p.dialTLS
+		t.accept = p.acceptTLS
+	} else {
+		t.pool.dial = dialTCP
+		t.accept = nil
+	}
+}
+
+// The certificate of the node, bound to the key it signs with.
+func (p *pbft) tlsCertificate() (*tls.Certificate, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.tlsIdentity.certificateOf(p.node.nodeID, p.node.signer, p.node.keyFingerprint)
+}
+
+// The certificate of a validator must be bound to one of the keys its signatures are accepted with, and the certificate
+// of a client to its key. Whether the client may send requests is not checked: the allow-list is part of the replicated
+// state, and the requests of a client that is not allowed are rejected when they are executed.
+func (p *pbft) verifyTLSBinding(subject string, data, sign []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.nodeTable[subject]; ok {
+		keys, err := p.acceptedKeys(subject)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if v, err := p.keyVerifier(key); err == nil && v.Verify(data, sign) {
+				return nil
+			}
+		}
+		return fmt.Errorf("the certificate of %s is not bound to its key", subject)
+	}
+	v, err := p.clientVerifier(subject)
+	if err != nil {
+		return fmt.Errorf("%s is not a validator nor a known client", subject)
+	}
+	if !v.Verify(data, sign) {
+		return fmt.Errorf("the certificate of %s is not bound to its key", subject)
+	}
+	return nil
+}
+
+// Dial a node expecting the certificate of that node, or a client expecting the certificate of any known client.
+func (p *pbft) dialTLS(addr string) (net.Conn, error) {
+	return dialTLS(addr, newTLSConfig(p.tlsCertificate, p.tlsPeers[addr], p.verifyTLSBinding))
+}
+
+// Complete the handshake of a connection accepted by the node. A peer that fails it is refused, which is logged, and
+// its connection is closed. The failure isn't counted against anyone, as the peer has no identity yet.
+func (p *pbft) acceptTLS(conn net.Conn) (net.Conn, error) {
+	tlsConn, err := acceptTLS(conn, newTLSConfig(p.tlsCertificate, "", p.verifyTLSBinding))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// The client presents the certificate bound to its key, and accepts the certificates of the validators bound to their
+// keys, read from their public key files.
+func (c *client) useMutualTLS(nodeTable nodeTable) {
+	t, ok := c.transport.(*tcpTransport)
+	if !ok {
+		log.Panic("mutual TLS needs the TCP transport")
+	}
+	cert, err := newTLSIdentity().certificateOf(clientName(c.index), c.signer, "")
+	if err != nil {
+		log.Panic(err)
+	}
+	c.tlsCertificate = cert
+	c.tlsVerifiers = make(map[string]Verifier)
+	for nodeID := range nodeTable {
+		key, err := readPubKey(string(c.scheme), nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		if c.tlsVerifiers[nodeID], err = c.scheme.parseVerifier(key); err != nil {
+			log.Panic(err)
+		}
+	}
+	t.accept = func(conn net.Conn) (net.Conn, error) {
+		return acceptTLS(conn, c.tlsConfig(""))
+	}
+	t.pool.dial = func(addr string) (net.Conn, error) {
+		for nodeID, nodeAddr := range nodeTable {
+			if nodeAddr == addr {
+				return dialTLS(addr, c.tlsConfig(nodeID))
+			}
+		}
+		return nil, fmt.Errorf("%s is not the address of a validator", addr)
+	}
+}
+
+// The TLS configuration of the client, expecting the certificate of the node, or of any validator if empty.
+func (c *client) tlsConfig(expected string) *tls.Config {
+	getCertificate := func() (*tls.Certificate, error) {
+		return c.tlsCertificate, nil
+	}
+	return newTLSConfig(getCertificate, expected, func(subject string, data, sign []byte) error {
+		v, ok := c.tlsVerifiers[subject]
+		if !ok {
+			return fmt.Errorf("%s is not a validator", subject)
+		}
+		if !v.Verify(data, sign) {
+			return fmt.Errorf("the certificate of %s is not bound to its key", subject)
+		}
+		return nil
+	})
+}
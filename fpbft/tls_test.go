@@ -0,0 +1,37 @@
+package fpbft
+
+import "testing"
+
+// A client is admitted at the handshake whatever the allow-list, as long as its certificate is bound to its key,
+// and a node dials the validators expecting the certificates of the node table it started with.
+func TestTLSBindingIgnoresAllowList(t *testing.T) {
+	nodes := idleCluster(t)
+	genClientKeys(defaultSignatureScheme, 1)
+	p := nodes["N0"]
+	p.setAllowedClients("C2")
+	p.setTransportSecurity(transportMutualTLS)
+	key, err := readPrivKey(string(defaultSignatureScheme), "C1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := defaultSignatureScheme.parseSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hash of the TLS key of C1")
+	sign, err := signer.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.verifyTLSBinding("C1", data, sign); err != nil {
+		t.Fatalf("a client missing from the allow-list was refused: %v", err)
+	}
+	if err := p.verifyTLSBinding("C1", []byte("another TLS key"), sign); err == nil {
+		t.Fatal("a certificate not bound to the key of the client was accepted")
+	}
+	for nodeID, addr := range p.nodeTable {
+		if p.tlsPeers[addr] != nodeID {
+			t.Fatalf("%s is dialed expecting the certificate of %q", addr, p.tlsPeers[addr])
+		}
+	}
+}
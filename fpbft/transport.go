@@ -0,0 +1,226 @@
+package fpbft
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// How a node or a client exchanges messages with the others: over TCP, or over channels between the nodes and clients
+// of one process. Sending never waits for the message to be delivered, and the messages sent to a peer are delivered in
+// the order they were sent.
+type Transport interface {
+	//Start receiving the messages sent to the address, with the wire protocol of the node or client
+	Listen(addr string, wire wireProtocol) (<-chan received, error)
+	//Send the message to the address of a node or client
+	Send(addr string, message *outgoing)
+	//Send the message to every address, encoded once for all of them
+	Broadcast(addrs []string, message *outgoing)
+	//Stop receiving messages, Listen may be called again afterwards
+	Close()
+}
+
+// A message received, with the peer it came from, which rejected messages that are not signed are counted against,
+// and the version of the connection it came over.
+type received struct {
+	message []byte
+	peer    string
+	version int
+}
+
+// A message waiting to be sent to a peer, and when it is due there, once the latency of the sender has passed.
+type queued struct {
+	o   *outgoing
+	due time.Time
+}
+
+// Wait until the message is due. The goroutine of a peer waits for its messages one after the other, so they are
+// delivered in the order they were sent whatever their latency.
+func (q queued) wait() {
+	if d := time.Until(q.due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Queue the message to be due after a random latency up to the one of the sender. The oldest message of the queue is
+// dropped to make room for the new one, so a peer that is down doesn't block the sender.
+func enqueueDroppingOldest(queue chan queued, o *outgoing, latency float64, addr string) {
+	q := queued{o: o, due: time.Now()}
+	if latency > 0 {
+		q.due = q.due.Add(randomLatency(latency))
+	}
+	for {
+		select {
+		case queue <- q:
+			return
+		default:
+		}
+		select {
+		case <-queue:
+			log.Printf("the queue to %s is full, dropping its oldest message\n", addr)
+		default:
+		}
+	}
+}
+
+// The nodes and clients of a simulation running in one process, which exchange their messages over channels, without
+// sockets, so any number of networks can run side by side.
+type memoryNetwork struct {
+	lock      sync.Mutex
+	endpoints map[string]*memoryEndpoint
+}
+
+// The messages sent to a listening node or client.
+type memoryEndpoint struct {
+	wire  wireProtocol
+	inbox chan received
+	//Closed once the node or client stops listening
+	done chan struct{}
+}
+
+func newMemoryNetwork() *memoryNetwork {
+	return &memoryNetwork{endpoints: make(map[string]*memoryEndpoint)}
+}
+
+// The transport of the node or client at the address, with its bandwidth and latency. Its address is the host the
+// messages it sends come from.
+func (n *memoryNetwork) transport(addr string, bandwidthLimit int, latency float64) *memoryTransport {
+	return &memoryTransport{
+		network:        n,
+		addr:           addr,
+		bandwidthLimit: bandwidthLimit,
+		latency:        latency,
+		wire:           wireProtocol{version: currentProtocolVersion},
+		links:          make(map[string]*memoryLink),
+	}
+}
+
+func (n *memoryNetwork) endpoint(addr string) *memoryEndpoint {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.endpoints[addr]
+}
+
+type memoryTransport struct {
+	network        *memoryNetwork
+	addr           string
+	bandwidthLimit int
+	latency        float64
+	lock           sync.Mutex
+	wire           wireProtocol
+	listening      *memoryEndpoint
+	links          map[string]*memoryLink
+	//The uplink the links share, nil if every link has the bandwidth
+	uplink *sharedUplink
+}
+
+func (t *memoryTransport) Listen(addr string, wire wireProtocol) (<-chan received, error) {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	if _, ok := t.network.endpoints[addr]; ok {
+		return nil, fmt.Errorf("%s is already in use", addr)
+	}
+	e := &memoryEndpoint{wire: wire, inbox: make(chan received), done: make(chan struct{})}
+	t.network.endpoints[addr] = e
+	t.lock.Lock()
+	t.wire = wire
+	t.listening = e
+	t.lock.Unlock()
+	return e.inbox, nil
+}
+
+func (t *memoryTransport) Close() {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.listening == nil {
+		return
+	}
+	for addr, e := range t.network.endpoints {
+		if e == t.listening {
+			delete(t.network.endpoints, addr)
+		}
+	}
+	close(t.listening.done)
+	t.listening = nil
+}
+
+// Send the message to the address, where it is delivered once the latency has passed.
+func (t *memoryTransport) Send(addr string, message *outgoing) {
+	t.link(addr).enqueue(message)
+}
+
+func (t *memoryTransport) Broadcast(addrs []string, message *outgoing) {
+	for _, addr := range addrs {
+		t.Send(addr, message)
+	}
+}
+
+// The link to the address, started the first time a message is sent to it.
+func (t *memoryTransport) link(addr string) *memoryLink {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	l, ok := t.links[addr]
+	if !ok {
+		l = &memoryLink{transport: t, addr: addr, queue: make(chan queued, peerQueueLength)}
+		t.links[addr] = l
+		go l.run()
+	}
+	return l
+}
+
+// The messages of a node or client to one peer, delivered by their own goroutine in the order they were sent.
+type memoryLink struct {
+	transport *memoryTransport
+	addr      string
+	queue     chan queued
+}
+
+func (l *memoryLink) enqueue(o *outgoing) {
+	enqueueDroppingOldest(l.queue, o, l.transport.latency, l.addr)
+}
+
+// Deliver every message once it is due, with the highest version both ends speak, taking as long as sending its bytes
+// with the bandwidth of the sender. While the peer is not listening its messages are held back, like with a peer that is down,
+// and a message is dropped once the peer stopped listening maxSendAttempts times before getting it.
+func (l *memoryLink) run() {
+	for q := range l.queue {
+		q.wait()
+		for attempt := 0; attempt < maxSendAttempts; attempt++ {
+			e := l.waitForPeer()
+			l.transport.lock.Lock()
+			version := l.transport.wire.version
+			l.transport.lock.Unlock()
+			if e.wire.version < version {
+				version = e.wire.version
+			}
+			message := q.o.with(version)
+			if l.transport.uplink != nil {
+				l.transport.uplink.wait(len(message))
+			} else if l.transport.bandwidthLimit > 0 {
+				time.Sleep(time.Duration(len(message)) * time.Second / time.Duration(l.transport.bandwidthLimit))
+			}
+			select {
+			case e.inbox <- received{message: message, peer: l.transport.addr, version: version}:
+			case <-e.done:
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (l *memoryLink) waitForPeer() *memoryEndpoint {
+	backoff := minRedialBackoff
+	for {
+		if e := l.transport.network.endpoint(l.addr); e != nil {
+			return e
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRedialBackoff {
+			backoff = maxRedialBackoff
+		}
+	}
+}
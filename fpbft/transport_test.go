@@ -0,0 +1,59 @@
+package fpbft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// The messages to a peer are delivered in the order they were sent, however long the latency of every one is.
+func TestMemoryLinkKeepsOrder(t *testing.T) {
+	network := newMemoryNetwork()
+	sender := network.transport("memory/A", 0, 20)
+	receiver := network.transport("memory/B", 0, 0)
+	wire := wireProtocol{version: currentProtocolVersion}
+	messages, err := receiver.Listen("memory/B", wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	const count = 200
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		sender.Send("memory/B", wire.encode("A", cRequest, Request{Message: Message{ID: i}}))
+	}
+	for i := 0; i < count; i++ {
+		m := <-messages
+		e, err := parseMessage(m.message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r Request
+		if err := decodeMessage(e.Payload, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Message.ID != i {
+			t.Fatalf("the message %d was delivered as the %dth", r.Message.ID, i)
+		}
+	}
+	//The latency of a message runs from when it was sent, it doesn't add up along the queue
+	if elapsed := time.Since(start); elapsed > count*time.Millisecond {
+		t.Fatalf("delivering the messages took %v", elapsed)
+	}
+}
+
+// Many replicas run in the test binary over the in-memory transport, without sockets, and commit a request.
+func TestMemoryClusterCommits(t *testing.T) {
+	const n = 16
+	network, nt, _ := memoryCluster(t, n, func(p *pbft) {
+		p.transport.(*memoryTransport).latency = 5
+	})
+	c := memoryClient(network)
+	c.transport.(*memoryTransport).latency = 5
+	for i := 0; i < 2; i++ {
+		_, result := c.ClientSendMessageAndListen(nt, fmt.Sprintf("request %d", i), n)
+		if result.Rejected || 3*len(result.NodeIDs) <= n {
+			t.Fatalf("the request %d was answered with %+v", i, result)
+		}
+	}
+}
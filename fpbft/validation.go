@@ -0,0 +1,192 @@
+package fpbft
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// A peer is banned once defaultBanThreshold of its messages were rejected, for defaultBanDuration.
+const (
+	defaultBanThreshold = 10
+	defaultBanDuration  = time.Minute
+	//Peers whose rejected messages are counted, the ones that are not banned are forgotten beyond it
+	maxTrackedPeers = 4096
+)
+
+// Why a message received from a peer was rejected.
+type rejectReason string
+
+const (
+	reasonMalformed      rejectReason = "malformed message"
+	reasonUnknownCommand rejectReason = "unknown command"
+	reasonUnknownSender  rejectReason = "unknown sender"
+	reasonBannedSender   rejectReason = "banned sender"
+	reasonBadSignature   rejectReason = "invalid signature"
+	reasonBadDigest      rejectReason = "digest mismatch"
+	reasonInvalidMessage rejectReason = "invalid message"
+	reasonInvalidProof   rejectReason = "invalid proof"
+	reasonEquivocation   rejectReason = "conflicting messages"
+)
+
+// A message rejected by the validation. A message a node signed proves the misbehaviour of that node,
+// so it is blamed on the signer. Any other message is blamed on the connection it came from, as its sender can't be
+// trusted.
+type rejection struct {
+	reason rejectReason
+	//The node whose valid signature is on the rejected message, empty if it is not signed by the sender
+	signer string
+	detail string
+}
+
+func (r *rejection) Error() string {
+	return string(r.reason) + ": " + r.detail
+}
+
+func reject(reason rejectReason, format string, a ...interface{}) *rejection {
+	return &rejection{reason: reason, detail: fmt.Sprintf(format, a...)}
+}
+
+func rejectSigned(reason rejectReason, signer string, format string, a ...interface{}) *rejection {
+	return &rejection{reason: reason, signer: signer, detail: fmt.Sprintf(format, a...)}
+}
+
+// Rejected messages of a peer since it was last banned.
+type misbehaviour struct {
+	count       int
+	bannedUntil time.Time
+}
+
+// The peer the messages of a connection that are not signed by their sender are blamed on: the identity it proved in
+// the TLS handshake, or else the connection itself, its address and port. Never its host alone, which all the nodes and
+// clients of a simulation share.
+func remotePeer(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return certs[0].Subject.CommonName
+		}
+	}
+	return conn.RemoteAddr().String()
+}
+
+// Count a rejected message against the peer it is blamed on, and ban the peer once it reaches the threshold. A message
+// replayed from the temporary pools has no peer, its rejection is only counted if it is signed.
+func (p *pbft) recordRejection(from string, err error) {
+	var r *rejection
+	if !errors.As(err, &r) {
+		r = reject(reasonMalformed, "%v", err)
+	}
+	if r.reason == reasonBannedSender {
+		//Messages of banned peers are dropped without extending the ban
+		return
+	}
+	peer := from
+	if r.signer != "" {
+		peer = r.signer
+	}
+	if peer == "" {
+		fmt.Printf("%s rejected a replayed message: %v\n", p.node.nodeID, r)
+		return
+	}
+	fmt.Printf("%s rejected a message from %s: %v\n", p.node.nodeID, peer, r)
+	if len(p.misbehaviours) >= maxTrackedPeers {
+		p.forgetMisbehaviours()
+	}
+	m, ok := p.misbehaviours[peer]
+	if !ok {
+		m = new(misbehaviour)
+		p.misbehaviours[peer] = m
+	}
+	m.count++
+	if m.count >= p.banThreshold {
+		m.count = 0
+		m.bannedUntil = time.Now().Add(p.banDuration)
+		fmt.Printf("%s has banned %s for %v\n", p.node.nodeID, peer, p.banDuration)
+	}
+}
+
+// Forget the rejected messages of the peers that are not banned, so the connections of a peer that keeps reconnecting
+// don't pile up.
+func (p *pbft) forgetMisbehaviours() {
+	now := time.Now()
+	for peer, m := range p.misbehaviours {
+		if !now.Before(m.bannedUntil) {
+			delete(p.misbehaviours, peer)
+		}
+	}
+}
+
+// Whether the messages of the peer, a node or client ID or a connection, are being dropped.
+func (p *pbft) isBanned(peer string) bool {
+	m, ok := p.misbehaviours[peer]
+	return ok && time.Now().Before(m.bannedUntil)
+}
+
+// Check that a message claiming to come from the node can be accepted from it.
+func (p *pbft) checkSender(nodeID string) error {
+	if _, ok := p.nodeTable[nodeID]; !ok {
+		return reject(reasonUnknownSender, "%q is not in the node table", nodeID)
+	}
+	if p.isBanned(nodeID) {
+		return reject(reasonBannedSender, "%s is banned", nodeID)
+	}
+	return nil
+}
+
+// Verify the signature of the node on the data with the keys it may sign with. A node that is not in the node table,
+// or whose public key can't be read, is rejected like a bad signature instead of stopping the node.
+// Signatures carried in certificates are verified even if their signer is banned, as the ban is local to this node.
+func (p *pbft) verifySignature(nodeID string, data, sign []byte) error {
+	if _, ok := p.nodeTable[nodeID]; !ok {
+		return reject(reasonUnknownSender, "%q is not in the node table", nodeID)
+	}
+	keys, err := p.acceptedKeys(nodeID)
+	if err != nil {
+		return reject(reasonUnknownSender, "the public key of %s can't be read", nodeID)
+	}
+	for _, key := range keys {
+		if len(key) == 0 {
+			continue
+		}
+		if verifier, err := p.keyVerifier(key); err == nil && verifier.Verify(data, sign) {
+			return nil
+		}
+	}
+	return reject(reasonBadSignature, "the signature of %s doesn't verify", nodeID)
+}
+
+// Verify the signature of the node that sent the message, whose messages are dropped while it is banned.
+func (p *pbft) verifySender(nodeID string, data, sign []byte) error {
+	if err := p.checkSender(nodeID); err != nil {
+		return err
+	}
+	return p.verifySignature(nodeID, data, sign)
+}
+
+// Decode the content of a message, encoded with the binary codec or as JSON.
+func decodeMessage(content []byte, v interface{}) error {
+	if len(content) > 0 && content[0] == binaryPayloadTag {
+		if err := decodeBinary(content, v); err != nil {
+			return reject(reasonMalformed, "%v", err)
+		}
+		return nil
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return reject(reasonMalformed, "%v", err)
+	}
+	return nil
+}
+
+// Check the fields of a pre-prepare, prepare or commit message that don't depend on the state of the node.
+func checkVote(view, sequenceID int, digest string) error {
+	if view < 0 || sequenceID <= 0 {
+		return reject(reasonInvalidMessage, "view %d and sequence number %d", view, sequenceID)
+	}
+	if digest == "" {
+		return reject(reasonInvalidMessage, "the digest is empty")
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package fpbft
+
+// The validator set, the node ID corresponds to the voting power (stake) of the validator.
+// Nodes that are not in the set have no voting power.
+type validatorSet map[string]int
+
+// Every node of the node table gets the same voting power, which makes quorums plain node-count quorums.
+func equalValidatorSet(nodeTable nodeTable) validatorSet {
+	vs := make(validatorSet)
+	for nodeID := range nodeTable {
+		vs[nodeID] = 1
+	}
+	return vs
+}
+
+// Total voting power of the validator set
+func (vs validatorSet) totalPower() int {
+	total := 0
+	for _, power := range vs {
+		total += power
+	}
+	return total
+}
+
+// Sum of the voting power of the given nodes
+func (vs validatorSet) votingPower(nodes map[string]bool) int {
+	power := 0
+	for nodeID, ok := range nodes {
+		if ok {
+			power += vs[nodeID]
+		}
+	}
+	return power
+}
+
+// Whether the voting power is more than 2/3 of the total power. Any two quorums intersect in more
+// than 1/3 of the power, so they share an honest validator as long as faulty validators hold less than 1/3.
+func (vs validatorSet) isQuorum(power int) bool {
+	return 3*power > 2*vs.totalPower()
+}
+
+// Whether the voting power is more than 1/3 of the total power, so at least one honest validator is included.
+func (vs validatorSet) isWeakQuorum(power int) bool {
+	return 3*power > vs.totalPower()
+}
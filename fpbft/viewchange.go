@@ -0,0 +1,536 @@
+package fpbft
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Time a backup waits for a batch of requests to be executed before it suspects the primary.
+const defaultViewChangeTimeout = 10 * time.Second
+
+// The views above the current one whose messages a node keeps until it enters them. The timeout doubles with every
+// view a node moves to on its own, so even a node cut off for hours is not that far ahead of the others.
+const maxFutureViews = 8
+
+// Whether the node keeps the messages of the view, which is not too far above its own.
+func (p *pbft) inViewWindow(view int) bool {
+	return view <= p.view+maxFutureViews
+}
+
+// Start the timer of a batch of requests, or of a single request forwarded to the primary, the backup is waiting
+// to execute, if it is not already running. When it expires before it is executed, the node moves to the next view.
+func (p *pbft) startRequestTimer(digest string) {
+	if p.isPrimary() {
+		return
+	}
+	if _, ok := p.requestTimers[digest]; ok {
+		return
+	}
+	view := p.view
+	var timer *time.Timer
+	timer = time.AfterFunc(p.viewChangeTimeout, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		//The timer is removed once the batch or the request is executed
+		if p.requestTimers[digest] == timer && p.view == view && !p.viewChanging {
+			fmt.Printf("%s timed out waiting for %s to be executed, the primary %s is suspected to be faulty\n", p.node.nodeID, digest, p.primaryOf(view))
+			p.startViewChange(view + 1)
+		}
+	})
+	p.requestTimers[digest] = timer
+}
+
+// Stop the timer of a batch or a request that has been executed.
+func (p *pbft) stopRequestTimer(digest string) {
+	if timer, ok := p.requestTimers[digest]; ok {
+		timer.Stop()
+		delete(p.requestTimers, digest)
+	}
+}
+
+// Stop the timers of all batches and requests, used when the node leaves its view.
+func (p *pbft) stopRequestTimers() {
+	for digest := range p.requestTimers {
+		p.stopRequestTimer(digest)
+	}
+}
+
+// Leave the current view and broadcast a view-change message for newView.
+func (p *pbft) startViewChange(newView int) {
+	if newView <= p.view {
+		return
+	}
+	fmt.Printf("%s is changing to view %d...\n", p.node.nodeID, newView)
+	p.view = newView
+	p.viewChanging = true
+	p.stopRequestTimers()
+	p.dropBatch()
+	if p.viewChangeTimer != nil {
+		p.viewChangeTimer.Stop()
+		p.viewChangeTimer = nil
+	}
+	//P contains the prepared certificates for every request prepared by this node after the stable checkpoint C
+	vc := ViewChange{NewView: newView, StableSequenceID: p.stableSequenceID, CheckpointProof: p.stableCheckpointProof, NodeID: p.node.nodeID}
+	sequenceIDs := make([]int, 0, len(p.preparedCerts))
+	for sequenceID := range p.preparedCerts {
+		if sequenceID > vc.StableSequenceID {
+			sequenceIDs = append(sequenceIDs, sequenceID)
+		}
+	}
+	sort.Ints(sequenceIDs)
+	for _, sequenceID := range sequenceIDs {
+		vc.PreparedSet = append(vc.PreparedSet, p.preparedCerts[sequenceID])
+	}
+	if p.voteAuth == authMACs {
+		vc.PrePreparedSet = p.prePreparedList(vc.StableSequenceID)
+	}
+	vc.Sign = p.sign(vc.signContent())
+	p.broadcast(cViewChange, vc)
+	p.addViewChange(vc)
+}
+
+// Process the view-change message
+func (p *pbft) handleViewChange(content []byte) error {
+	vc := new(ViewChange)
+	if err := decodeMessage(content, vc); err != nil {
+		return err
+	}
+	if vc.NewView < p.view || (vc.NewView == p.view && !p.viewChanging) {
+		//The node is already in this view or a later one
+		return nil
+	}
+	if !p.inViewWindow(vc.NewView) {
+		//Rejected before its proofs are verified, so it is blamed on the peer that sent it
+		return reject(reasonInvalidMessage, "the view-change message is for view %d, too far above view %d", vc.NewView, p.view)
+	}
+	if err := p.checkSender(vc.NodeID); err != nil {
+		return err
+	}
+	if err := p.verifyViewChange(*vc); err != nil {
+		return err
+	}
+	p.addViewChange(*vc)
+	return nil
+}
+
+// Store a valid view-change message and check whether the view change can make progress.
+func (p *pbft) addViewChange(vc ViewChange) {
+	if _, ok := p.viewChangePool[vc.NewView]; !ok {
+		p.viewChangePool[vc.NewView] = make(map[string]ViewChange)
+	}
+	p.viewChangePool[vc.NewView][vc.NodeID] = vc
+
+	//If nodes with more than 1/3 of the voting power want to move to views higher than the current one, the primary is not suspected by this node alone,
+	//so join the smallest of these views without waiting for the timers to expire.
+	nodes := make(map[string]bool)
+	smallestView := -1
+	for view, viewChanges := range p.viewChangePool {
+		if view <= p.view {
+			continue
+		}
+		for nodeID := range viewChanges {
+			nodes[nodeID] = true
+		}
+		if smallestView < 0 || view < smallestView {
+			smallestView = view
+		}
+	}
+	if p.validators.isWeakQuorum(p.validators.votingPower(nodes)) {
+		p.startViewChange(smallestView)
+	}
+
+	senders := make(map[string]bool)
+	for nodeID := range p.viewChangePool[p.view] {
+		senders[nodeID] = true
+	}
+	if !p.viewChanging || !p.validators.isQuorum(p.validators.votingPower(senders)) {
+		return
+	}
+	if p.isPrimary() && !p.isNewViewBroadcast[p.view] {
+		p.broadcastNewView()
+		return
+	}
+	//With a quorum of view-change messages, wait for the new primary and move on to the next view if it does not show up either
+	if p.viewChangeTimer == nil {
+		view := p.view
+		p.viewChangeTimer = time.AfterFunc(p.viewChangeTimeout, func() {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			if p.viewChanging && p.view == view {
+				fmt.Printf("%s timed out waiting for the new-view message of view %d\n", p.node.nodeID, view)
+				p.viewChangeTimeout *= 2
+				p.startViewChange(view + 1)
+			}
+		})
+	}
+}
+
+// Verify the signature of a view-change message and the prepared certificates it carries.
+// Once the signature verifies, an invalid view-change message is blamed on its sender.
+func (p *pbft) verifyViewChange(vc ViewChange) error {
+	if err := p.verifySignature(vc.NodeID, vc.signContent(), vc.Sign); err != nil {
+		return err
+	}
+	if vc.NewView <= 0 || vc.StableSequenceID < 0 {
+		return rejectSigned(reasonInvalidMessage, vc.NodeID, "view-change to view %d from the checkpoint %d", vc.NewView, vc.StableSequenceID)
+	}
+	if !p.verifyCheckpointProof(vc.StableSequenceID, vc.CheckpointProof) {
+		return rejectSigned(reasonInvalidProof, vc.NodeID, "the view-change message carries an invalid proof of the checkpoint %d", vc.StableSequenceID)
+	}
+	for _, cert := range vc.PreparedSet {
+		if cert.PrePrepare.SequenceID <= vc.StableSequenceID || cert.PrePrepare.View >= vc.NewView || !p.verifyPreparedCert(cert) {
+			return rejectSigned(reasonInvalidProof, vc.NodeID, "the view-change message carries an invalid prepared certificate for %d", cert.PrePrepare.SequenceID)
+		}
+	}
+	for _, pp := range vc.PrePreparedSet {
+		if pp.SequenceID <= vc.StableSequenceID || pp.View >= vc.NewView || !p.verifyPrePrepare(pp) {
+			return rejectSigned(reasonInvalidProof, vc.NodeID, "the view-change message carries an invalid pre-prepare for %d", pp.SequenceID)
+		}
+	}
+	return nil
+}
+
+// Verify that a pre-prepare carries its batch and is signed by the primary of its view.
+func (p *pbft) verifyPrePrepare(pp PrePrepare) bool {
+	if checkVote(pp.View, pp.SequenceID, pp.Digest) != nil {
+		return false
+	}
+	if len(pp.RequestBatch) == 0 || getBatchDigest(pp.RequestBatch) != pp.Digest {
+		return false
+	}
+	return p.verifySignature(p.primaryOf(pp.View), voteSignContent(cPrePrepare, pp.View, pp.SequenceID, pp.Digest), pp.Sign) == nil
+}
+
+// Verify that a prepared certificate holds a pre-prepare signed by the primary of its view
+// and matching prepares signed by different backups, which together carry more than 2/3 of the voting power,
+// or a matching prepare quorum certificate. In the MAC mode only the pre-prepare of the claim is verified.
+func (p *pbft) verifyPreparedCert(cert PreparedCert) bool {
+	pp := cert.PrePrepare
+	if !p.verifyPrePrepare(pp) {
+		return false
+	}
+	if p.voteAuth == authMACs {
+		return true
+	}
+	primary := p.primaryOf(pp.View)
+	if qc := cert.PrepareCert; qc != nil {
+		//The prepare quorum certificate holds the vote of the primary too
+		return qc.Phase == cPrepare && qc.View == pp.View && qc.SequenceID == pp.SequenceID && qc.Digest == pp.Digest && p.verifyQuorumCert(*qc) == nil
+	}
+	signers := make(map[string]bool)
+	for _, pre := range cert.Prepares {
+		if _, ok := p.nodeTable[pre.NodeID]; !ok || pre.NodeID == primary || signers[pre.NodeID] {
+			continue
+		}
+		if pre.View != pp.View || pre.SequenceID != pp.SequenceID || pre.Digest != pp.Digest {
+			continue
+		}
+		if p.verifySignature(pre.NodeID, voteSignContent(cPrepare, pre.View, pre.SequenceID, pre.Digest), pre.Sign) == nil {
+			signers[pre.NodeID] = true
+		}
+	}
+	signers[primary] = true
+	return p.validators.isQuorum(p.validators.votingPower(signers))
+}
+
+// The new primary collects a quorum of view-change messages, re-proposes the prepared requests and enters the new view.
+func (p *pbft) broadcastNewView() {
+	nv := NewView{View: p.view, NodeID: p.node.nodeID}
+	for _, vc := range p.viewChangePool[p.view] {
+		nv.ViewChanges = append(nv.ViewChanges, vc)
+	}
+	sort.Slice(nv.ViewChanges, func(i, j int) bool {
+		return nv.ViewChanges[i].NodeID < nv.ViewChanges[j].NodeID
+	})
+	prePrepares, ok := p.newViewPrePrepares(p.view, nv.ViewChanges)
+	if !ok {
+		fmt.Printf("The view-change messages don't decide every request yet, %s is waiting for more view-change messages\n", p.node.nodeID)
+		return
+	}
+	nv.PrePrepares = prePrepares
+	for i, pp := range nv.PrePrepares {
+		nv.PrePrepares[i].Sign = p.sign(voteSignContent(cPrePrepare, pp.View, pp.SequenceID, pp.Digest))
+	}
+	nv.Sign = p.sign(nv.signContent())
+	fmt.Printf("%s is the new primary, broadcasting the new-view message of view %d...\n", p.node.nodeID, p.view)
+	p.broadcast(cNewView, nv)
+	p.isNewViewBroadcast[p.view] = true
+	p.enterNewView(nv)
+}
+
+// The (unsigned) pre-prepares O of a new-view message computed from the view-change messages V,
+// ok is false if V doesn't decide them yet.
+func (p *pbft) newViewPrePrepares(view int, viewChanges []ViewChange) (prePrepares []PrePrepare, ok bool) {
+	if p.voteAuth == authMACs {
+		return p.decideNewViewPrePrepares(view, viewChanges)
+	}
+	return computeNewViewPrePrepares(view, viewChanges), true
+}
+
+// Compute the (unsigned) pre-prepares O of a new-view message from the view-change messages V:
+// every sequence number between the latest stable checkpoint and the highest prepared request
+// gets the batch prepared in the highest view, or the null request if none was prepared.
+func computeNewViewPrePrepares(view int, viewChanges []ViewChange) []PrePrepare {
+	minS := 0
+	for _, vc := range viewChanges {
+		if vc.StableSequenceID > minS {
+			minS = vc.StableSequenceID
+		}
+	}
+	maxS := minS
+	chosen := make(map[int]PrePrepare)
+	for _, vc := range viewChanges {
+		for _, cert := range vc.PreparedSet {
+			pp := cert.PrePrepare
+			if pp.SequenceID <= minS {
+				continue
+			}
+			if old, ok := chosen[pp.SequenceID]; !ok || pp.View > old.View {
+				chosen[pp.SequenceID] = pp
+			}
+			if pp.SequenceID > maxS {
+				maxS = pp.SequenceID
+			}
+		}
+	}
+	prePrepares := make([]PrePrepare, 0, maxS-minS)
+	for n := minS + 1; n <= maxS; n++ {
+		if pp, ok := chosen[n]; ok {
+			prePrepares = append(prePrepares, PrePrepare{RequestBatch: pp.RequestBatch, Digest: pp.Digest, View: view, SequenceID: n})
+		} else {
+			batch := nullBatch(n)
+			prePrepares = append(prePrepares, PrePrepare{RequestBatch: batch, Digest: getBatchDigest(batch), View: view, SequenceID: n})
+		}
+	}
+	return prePrepares
+}
+
+// In the MAC mode the prepares can't convince other nodes, so the prepared set of a view-change message only
+// claims what its sender prepared, and the pre-prepared set claims what it accepted. For every sequence number
+// the new primary chooses, from the claims of V, a batch prepared in view v such that
+//
+//	A1: the nodes claiming nothing prepared at that number, or a prepare in an earlier view, or the same batch in v,
+//	    carry more than 2/3 of the voting power, and
+//	A2: the nodes claiming to have accepted the batch in v or a later view carry more than 1/3 of it,
+//
+// and otherwise the null request if the nodes claiming nothing prepared there carry more than 2/3 of the voting power.
+// A batch committed in an earlier view was prepared by honest nodes with more than 1/3 of the voting power, so no
+// other batch passes A1, and A2 keeps the faulty nodes from choosing a batch no honest node has accepted.
+// V may not decide every sequence number while the claims of faulty nodes are in it, then ok is false and the
+// new primary waits for more view-change messages.
+func (p *pbft) decideNewViewPrePrepares(view int, viewChanges []ViewChange) (prePrepares []PrePrepare, ok bool) {
+	minS := 0
+	for _, vc := range viewChanges {
+		if vc.StableSequenceID > minS {
+			minS = vc.StableSequenceID
+		}
+	}
+	maxS := minS
+	//The latest batch every node claims to have prepared at every sequence number
+	prepared := make([]map[int]PrePrepare, len(viewChanges))
+	for i, vc := range viewChanges {
+		prepared[i] = make(map[int]PrePrepare)
+		for _, cert := range vc.PreparedSet {
+			pp := cert.PrePrepare
+			if pp.SequenceID <= minS {
+				continue
+			}
+			if old, ok := prepared[i][pp.SequenceID]; !ok || pp.View > old.View {
+				prepared[i][pp.SequenceID] = pp
+			}
+			if pp.SequenceID > maxS {
+				maxS = pp.SequenceID
+			}
+		}
+	}
+	//Voting power of the nodes of V whose claims satisfy the condition
+	power := func(claims func(i int) bool) int {
+		nodes := make(map[string]bool)
+		for i, vc := range viewChanges {
+			if claims(i) {
+				nodes[vc.NodeID] = true
+			}
+		}
+		return p.validators.votingPower(nodes)
+	}
+	prePrepares = make([]PrePrepare, 0, maxS-minS)
+	for n := minS + 1; n <= maxS; n++ {
+		//The candidates are tried from the latest view on, in the order of their digests
+		var candidates []PrePrepare
+		seen := make(map[string]bool)
+		for i := range viewChanges {
+			pp, ok := prepared[i][n]
+			if key := fmt.Sprintf("%d:%s", pp.View, pp.Digest); ok && !seen[key] {
+				seen[key] = true
+				candidates = append(candidates, pp)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].View != candidates[j].View {
+				return candidates[i].View > candidates[j].View
+			}
+			return candidates[i].Digest < candidates[j].Digest
+		})
+		decided := false
+		for _, c := range candidates {
+			a1 := power(func(i int) bool {
+				pp, ok := prepared[i][n]
+				return !ok || pp.View < c.View || (pp.View == c.View && pp.Digest == c.Digest)
+			})
+			a2 := power(func(i int) bool {
+				for _, pp := range viewChanges[i].PrePreparedSet {
+					if pp.SequenceID == n && pp.Digest == c.Digest && pp.View >= c.View {
+						return true
+					}
+				}
+				return false
+			})
+			if p.validators.isQuorum(a1) && p.validators.isWeakQuorum(a2) {
+				prePrepares = append(prePrepares, PrePrepare{RequestBatch: c.RequestBatch, Digest: c.Digest, View: view, SequenceID: n})
+				decided = true
+				break
+			}
+		}
+		if decided {
+			continue
+		}
+		if !p.validators.isQuorum(power(func(i int) bool {
+			_, ok := prepared[i][n]
+			return !ok
+		})) {
+			return nil, false
+		}
+		batch := nullBatch(n)
+		prePrepares = append(prePrepares, PrePrepare{RequestBatch: batch, Digest: getBatchDigest(batch), View: view, SequenceID: n})
+	}
+	return prePrepares, true
+}
+
+// Keep an accepted pre-prepare as the latest one of its batch at its sequence number, claimed in the view-change messages of the MAC mode.
+func (p *pbft) recordPrePrepared(pp PrePrepare) {
+	if p.voteAuth != authMACs {
+		return
+	}
+	if _, ok := p.prePreparedSet[pp.SequenceID]; !ok {
+		p.prePreparedSet[pp.SequenceID] = make(map[string]PrePrepare)
+	}
+	if old, ok := p.prePreparedSet[pp.SequenceID][pp.Digest]; !ok || pp.View > old.View {
+		p.prePreparedSet[pp.SequenceID][pp.Digest] = pp
+	}
+}
+
+// The pre-prepares accepted after the stable checkpoint, in the order of their sequence numbers and digests.
+func (p *pbft) prePreparedList(stableSequenceID int) []PrePrepare {
+	var list []PrePrepare
+	for n, pps := range p.prePreparedSet {
+		if n <= stableSequenceID {
+			continue
+		}
+		for _, pp := range pps {
+			list = append(list, pp)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].SequenceID != list[j].SequenceID {
+			return list[i].SequenceID < list[j].SequenceID
+		}
+		return list[i].Digest < list[j].Digest
+	})
+	return list
+}
+
+// Process the new-view message
+func (p *pbft) handleNewView(content []byte) error {
+	nv := new(NewView)
+	if err := decodeMessage(content, nv); err != nil {
+		return err
+	}
+	if nv.View < p.view || (nv.View == p.view && !p.viewChanging) {
+		return nil
+	}
+	primary := p.primaryOf(nv.View)
+	if nv.NodeID != primary {
+		return reject(reasonInvalidMessage, "the new-view message of view %d was not sent by the primary %s", nv.View, primary)
+	}
+	if err := p.verifySender(primary, nv.signContent(), nv.Sign); err != nil {
+		return err
+	}
+	//V must hold valid view-change messages for this view from different nodes with more than 2/3 of the voting power
+	senders := make(map[string]bool)
+	for _, vc := range nv.ViewChanges {
+		if vc.NewView != nv.View || senders[vc.NodeID] {
+			return rejectSigned(reasonInvalidProof, primary, "the new-view message carries a view-change message of %s twice or for another view", vc.NodeID)
+		}
+		if err := p.verifyViewChange(vc); err != nil {
+			return rejectSigned(reasonInvalidProof, primary, "the new-view message carries an invalid view-change message (%v)", err)
+		}
+		senders[vc.NodeID] = true
+	}
+	if !p.validators.isQuorum(p.validators.votingPower(senders)) {
+		return rejectSigned(reasonInvalidProof, primary, "the new-view message does not carry enough view-change messages")
+	}
+	//O must be exactly what the new primary should have computed from V
+	expected, ok := p.newViewPrePrepares(nv.View, nv.ViewChanges)
+	if !ok {
+		return rejectSigned(reasonInvalidProof, primary, "the view-change messages don't decide every re-proposed request")
+	}
+	if len(expected) != len(nv.PrePrepares) {
+		return rejectSigned(reasonInvalidProof, primary, "the re-proposed requests don't match the view-change messages")
+	}
+	for i, pp := range nv.PrePrepares {
+		if pp.View != expected[i].View || pp.SequenceID != expected[i].SequenceID || pp.Digest != expected[i].Digest ||
+			len(pp.RequestBatch) == 0 || getBatchDigest(pp.RequestBatch) != pp.Digest ||
+			p.verifySignature(primary, voteSignContent(cPrePrepare, pp.View, pp.SequenceID, pp.Digest), pp.Sign) != nil {
+			return rejectSigned(reasonInvalidProof, primary, "the re-proposed requests don't match the view-change messages")
+		}
+	}
+	p.enterNewView(*nv)
+	return nil
+}
+
+// Enter the view of a valid new-view message and run the re-proposed requests through the normal protocol again.
+func (p *pbft) enterNewView(nv NewView) {
+	fmt.Printf("%s has entered view %d, the primary is %s\n", p.node.nodeID, nv.View, p.primaryOf(nv.View))
+	p.view = nv.View
+	p.viewChanging = false
+	if p.viewChangeTimer != nil {
+		p.viewChangeTimer.Stop()
+		p.viewChangeTimer = nil
+	}
+	p.viewChangeTimeout = defaultViewChangeTimeout
+	for view := range p.viewChangePool {
+		if view <= nv.View {
+			delete(p.viewChangePool, view)
+		}
+	}
+
+	//Votes from the previous views don't count in the new view
+	p.discardInstances(func(key instanceKey) bool {
+		return key.view < nv.View
+	})
+
+	//The new view starts from the latest stable checkpoint in V
+	p.sequenceID = p.stableSequenceID
+	for _, vc := range nv.ViewChanges {
+		if vc.StableSequenceID > p.sequenceID {
+			p.sequenceID = vc.StableSequenceID
+			p.stabilizeCheckpoint(vc.StableSequenceID, vc.CheckpointProof)
+		}
+	}
+	//Re-proposed batches that were executed already are not executed twice
+	for _, pp := range nv.PrePrepares {
+		p.sequenceID = pp.SequenceID
+		if p.isPrimary() {
+			p.messagePool[pp.Digest] = pp.RequestBatch
+			p.prePreparePool[instanceKey{pp.View, pp.SequenceID}] = pp
+			p.recordPrePrepared(pp)
+			if p.voteAuth == authQuorumCerts {
+				p.collectPrimaryPrepare(pp)
+			}
+		} else {
+			p.acceptPrePrepare(pp)
+		}
+	}
+	p.handleTempPool()
+}
@@ -0,0 +1,73 @@
+package fpbft
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// The prepare of the node for the instance, encoded as it is sent.
+func signedPrepare(p *pbft, view, sequenceID int, digest string) []byte {
+	pre := Prepare{Digest: digest, View: view, SequenceID: sequenceID, NodeID: p.node.nodeID}
+	pre.Sign = p.signVote(cPrepare, view, sequenceID, digest)
+	payload, _ := encodeBinary(pre)
+	return payload
+}
+
+// When the primary goes silent, the backups move to the next view, whose primary orders the request.
+func TestViewChangeAfterSilentPrimary(t *testing.T) {
+	network, nt, nodes := memoryCluster(t, 4, func(p *pbft) {
+		p.viewChangeTimeout = 300 * time.Millisecond
+	})
+	nodes["N0"].transport.Close()
+	c := memoryClient(network)
+	c.retransmitTimeout = 200 * time.Millisecond
+	_, result := c.ClientSendMessageAndListen(nt, "ordered in view 1", len(nt))
+	if result.Rejected || 3*len(result.NodeIDs) <= len(nt) {
+		t.Fatalf("the request was answered with %+v", result)
+	}
+	for _, nodeID := range []string{"N1", "N2", "N3"} {
+		p := nodes[nodeID]
+		p.lock.Lock()
+		view, changing := p.view, p.viewChanging
+		p.lock.Unlock()
+		if view != 1 || changing {
+			t.Errorf("%s is in view %d, changing: %v", nodeID, view, changing)
+		}
+	}
+}
+
+// The messages of the views the node has not entered are kept once per node and instance, and only for the views
+// close above its own, the messages of the views further ahead count toward the ban.
+func TestTempPoolsBounded(t *testing.T) {
+	nodes := idleCluster(t)
+	p, n2 := nodes["N1"], nodes["N2"]
+	for i := 0; i < 3; i++ {
+		if err := p.handlePrepare(signedPrepare(n2, 1, 1, "digest")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var r *rejection
+	if err := p.handlePrepare(signedPrepare(n2, 1+maxFutureViews, 1, "digest")); !errors.As(err, &r) || r.signer != "N2" {
+		t.Fatalf("a prepare too far ahead was not blamed on its signer: %v", err)
+	}
+	if len(p.tempPreparePool) != 1 {
+		t.Fatalf("%d prepares are kept", len(p.tempPreparePool))
+	}
+	vc := ViewChange{NewView: 1 + maxFutureViews, NodeID: "N2"}
+	vc.Sign = n2.sign(vc.signContent())
+	payload, _ := json.Marshal(vc)
+	if err := p.handleViewChange(payload); !errors.As(err, &r) {
+		t.Fatalf("a view-change message too far ahead was not rejected: %v", err)
+	}
+	if len(p.viewChangePool) != 0 {
+		t.Fatalf("the view-change messages of %d views are kept", len(p.viewChangePool))
+	}
+	for i := 0; i < p.banThreshold; i++ {
+		p.recordRejection("", p.handlePrepare(signedPrepare(n2, 1+maxFutureViews+i, 1, "digest")))
+	}
+	if !p.isBanned("N2") {
+		t.Fatal("the node flooding messages of views far ahead is not banned")
+	}
+}
@@ -0,0 +1,67 @@
+package fpbft
+
+// How the nodes authenticate their prepare and commit votes.
+type voteAuthentication int
+
+const (
+	//Every vote is signed with the signature scheme of the network and broadcast to all the nodes
+	authSignatures voteAuthentication = iota
+	//Every vote is BLS signed and sent to the primary of its view only, which collects the votes of a quorum
+	//into a quorum certificate and broadcasts it, so a node verifies one pairing per phase instead of a signature per vote
+	authQuorumCerts
+	//Every vote is broadcast with an authenticator, a MAC for every other node under the session key the two nodes share.
+	//MACs are much cheaper than signatures, but only convince the node they are meant for, so the view changes work
+	//from the signed claims of the nodes instead of certificates.
+	authMACs
+)
+
+// Select how the node authenticates its votes, reading its BLS private key in the quorum certificate mode,
+// and agreeing on the session keys with the other nodes in the MAC mode. All the nodes of a network use the same mode.
+func (p *pbft) setVoteAuthentication(auth voteAuthentication) {
+	p.voteAuth = auth
+	switch auth {
+	case authQuorumCerts:
+		p.node.blsKey = getBlsSecretKey(p.node.nodeID)
+	case authMACs:
+		p.establishSessionKeys()
+	}
+}
+
+// Sign a prepare or commit vote of the node.
+func (p *pbft) signVote(phase command, view, sequenceID int, digest string) []byte {
+	data := voteSignContent(phase, view, sequenceID, digest)
+	if p.voteAuth == authQuorumCerts {
+		return p.blsSign(data)
+	}
+	return p.sign(data)
+}
+
+// Authenticate a prepare or commit vote of the node, with a signature, or with an authenticator in the MAC mode.
+func (p *pbft) authenticateVote(phase command, view, sequenceID int, digest string) (sign []byte, authenticator map[string][]byte) {
+	if p.voteAuth == authMACs {
+		return nil, p.authenticator(voteSignContent(phase, view, sequenceID, digest))
+	}
+	return p.signVote(phase, view, sequenceID, digest), nil
+}
+
+// Verify a prepare or commit vote of the node that sent it.
+func (p *pbft) verifyVote(nodeID string, phase command, view, sequenceID int, digest string, sign []byte, authenticator map[string][]byte) error {
+	data := voteSignContent(phase, view, sequenceID, digest)
+	switch p.voteAuth {
+	case authQuorumCerts:
+		if err := p.checkSender(nodeID); err != nil {
+			return err
+		}
+		//The vote is aggregated into a certificate naming its voter in the signer bitmap
+		if _, err := p.signerIndex(nodeID); err != nil {
+			return err
+		}
+		return p.verifyBlsSignature(nodeID, data, sign)
+	case authMACs:
+		if err := p.checkSender(nodeID); err != nil {
+			return err
+		}
+		return p.verifyAuthenticator(nodeID, data, authenticator)
+	}
+	return p.verifySender(nodeID, data, sign)
+}
@@ -0,0 +1,620 @@
+package fpbft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Versions of the wire protocol. A node speaks every version up to its own, so the nodes of a network can be upgraded
+// one by one: two nodes agree on the highest version they both speak when one connects to the other.
+const (
+	//A message is its command, zero-padded to 12 bytes, followed by its JSON content
+	protocolV1 = 1
+	//A message is an envelope, and the requests, pre-prepares, prepares, commits and replies are encoded with the binary codec
+	protocolV2 = 2
+	//The version the nodes and the clients speak unless they are configured otherwise
+	currentProtocolVersion = protocolV2
+)
+
+const (
+	//The first byte of an envelope, never the first byte of a command name
+	envelopeMagic = 0xfb
+	//The first byte of a payload of the binary codec, never the first byte of JSON content
+	binaryPayloadTag = 0x00
+)
+
+// The first message on a connection from protocolV2 on, with the highest version the node that connected speaks.
+// The other node answers with the version of the connection, the highest version they both speak.
+const cHello command = "hello"
+
+// The wire protocol of a node or a client: the highest version it speaks, and the chain ID of its network, which the
+// envelopes carry so that the messages of another network are rejected.
+type wireProtocol struct {
+	version int
+	chainID uint64
+}
+
+// A message from protocolV2 on: the version it is encoded with, the chain ID, the node or client that sent it,
+// its command and its payload.
+type envelope struct {
+	Version int
+	ChainID uint64
+	Sender  string
+	Command command
+	Payload []byte
+}
+
+func (e envelope) marshal() []byte {
+	w := &binaryWriter{b: []byte{envelopeMagic}}
+	w.uvarint(uint64(e.Version))
+	w.uvarint(e.ChainID)
+	w.string(e.Sender)
+	w.string(string(e.Command))
+	return append(w.b, e.Payload...)
+}
+
+// Parse a message of any version. A message of protocolV1 has no envelope, and is returned as one without sender and chain ID.
+func parseMessage(message []byte) (envelope, error) {
+	if len(message) == 0 || message[0] != envelopeMagic {
+		cmd, content, err := splitMessage(message)
+		return envelope{Version: protocolV1, Command: command(cmd), Payload: content}, err
+	}
+	r := &binaryReader{b: message[1:]}
+	e := envelope{Version: int(r.uvarint()), ChainID: r.uvarint(), Sender: r.string(), Command: command(r.string())}
+	if r.err != nil {
+		return e, fmt.Errorf("the envelope is malformed: %v", r.err)
+	}
+	if e.Version < protocolV2 {
+		return e, fmt.Errorf("an envelope of version %d", e.Version)
+	}
+	e.Payload = r.b
+	return e, nil
+}
+
+// Check that the node may handle the message received over a connection of the version: it speaks the version of the
+// message, the message is for its network, and it is not encoded with an older version than the connection, since a
+// message of protocolV1 carries no chain ID.
+func (w wireProtocol) check(e envelope, connVersion int) error {
+	if e.Version > w.version {
+		return reject(reasonMalformed, "the message is encoded with the version %d, the node speaks up to %d", e.Version, w.version)
+	}
+	if e.Version < connVersion {
+		return reject(reasonMalformed, "the message is encoded with the version %d over a connection of version %d", e.Version, connVersion)
+	}
+	if e.Version >= protocolV2 && e.ChainID != w.chainID {
+		return reject(reasonInvalidMessage, "the message of %s is for the chain %d, not %d", e.Sender, e.ChainID, w.chainID)
+	}
+	return nil
+}
+
+// The hello a node sends when it connects as the sender, or the answer of the other node.
+func (w wireProtocol) hello(sender string, version int) []byte {
+	return envelope{Version: version, ChainID: w.chainID, Sender: sender, Command: cHello}.marshal()
+}
+
+// The version of a connection, the highest version both nodes speak, from the hello of the node that connected.
+// A hello for another network gets no answer, and the connection is closed.
+func (w wireProtocol) answerHello(e envelope) (int, error) {
+	if e.ChainID != w.chainID {
+		return 0, fmt.Errorf("%s runs the chain %d, not %d", e.Sender, e.ChainID, w.chainID)
+	}
+	if e.Version < w.version {
+		return e.Version, nil
+	}
+	return w.version, nil
+}
+
+// A message to send. It is encoded with the version of the sender right away, and with an older version only once it
+// is sent over a connection of that version, so most messages are encoded once for all the peers.
+type outgoing struct {
+	cmd    command
+	sender string
+	wire   wireProtocol
+	msg    interface{}
+	//Guards the encodings, the goroutines of the peers encode the message concurrently
+	lock sync.Mutex
+	//The JSON content, marshalled at most once: the message of protocolV1, and the payload of the envelope without a binary codec
+	content []byte
+	encoded map[int][]byte
+}
+
+// The message of the sender, encoded with the version it speaks.
+func (w wireProtocol) encode(sender string, cmd command, msg interface{}) *outgoing {
+	o := &outgoing{cmd: cmd, sender: sender, wire: w, msg: msg, encoded: make(map[int][]byte)}
+	o.with(w.version)
+	return o
+}
+
+// The message encoded with the version of a connection, with an envelope from protocolV2 on.
+func (o *outgoing) with(version int) []byte {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if message, ok := o.encoded[version]; ok {
+		return message
+	}
+	var message []byte
+	if version >= protocolV2 {
+		payload, ok := encodeBinary(o.msg)
+		if !ok {
+			payload = o.json()
+		}
+		message = envelope{Version: version, ChainID: o.wire.chainID, Sender: o.sender, Command: o.cmd, Payload: payload}.marshal()
+	} else {
+		message = jointMessage(o.cmd, o.json())
+	}
+	o.encoded[version] = message
+	return message
+}
+
+func (o *outgoing) json() []byte {
+	if o.content == nil {
+		content, err := json.Marshal(o.msg)
+		if err != nil {
+			log.Panic(err)
+		}
+		o.content = content
+	}
+	return o.content
+}
+
+// The binary encoding of the requests, pre-prepares (also down the dissemination tree), prepares, commits and replies. The fields are written in the order
+// of their declaration: integers as varints, strings, byte slices and lists prefixed with their length, a nil byte
+// slice or list apart from an empty one, maps in the order of their keys, and a message a pointer may point to as a
+// boolean followed by its fields if it is set, so the encoding of a message is unique. Every other message (view
+// changes and new views, checkpoints, state transfer, quorum certificates, the threshold ECDSA messages) has no binary codec and
+// is the payload of its envelope as JSON, which decodeMessage tells apart by its first byte.
+func encodeBinary(msg interface{}) ([]byte, bool) {
+	w := &binaryWriter{b: []byte{binaryPayloadTag}}
+	switch m := msg.(type) {
+	case Request:
+		w.request(m)
+	case PrePrepare:
+		w.prePrepare(m)
+	case Prepare:
+		w.vote(m.Digest, m.View, m.SequenceID, m.NodeID, m.Sign, m.Authenticator)
+	case Commit:
+		w.vote(m.Digest, m.View, m.SequenceID, m.NodeID, m.Sign, m.Authenticator)
+	case Reply:
+		w.reply(m)
+	case TreePrePrepare:
+		w.prePrepare(m.PrePrepare)
+		w.strings(m.Tree)
+		w.varint(int64(m.Fanout))
+		w.bytes(m.Sign)
+	default:
+		return nil, false
+	}
+	return w.b, true
+}
+
+// Decode a payload of the binary codec into the message v points to. The whole payload must be consumed.
+func decodeBinary(payload []byte, v interface{}) error {
+	if len(payload) == 0 || payload[0] != binaryPayloadTag {
+		return errors.New("not a payload of the binary codec")
+	}
+	r := &binaryReader{b: payload[1:]}
+	switch m := v.(type) {
+	case *Request:
+		*m = r.request()
+	case *PrePrepare:
+		*m = r.prePrepare()
+	case *Prepare:
+		m.Digest, m.View, m.SequenceID, m.NodeID, m.Sign, m.Authenticator = r.vote()
+	case *Commit:
+		m.Digest, m.View, m.SequenceID, m.NodeID, m.Sign, m.Authenticator = r.vote()
+	case *Reply:
+		*m = r.reply()
+	case *TreePrePrepare:
+		m.PrePrepare = r.prePrepare()
+		m.Tree = r.strings()
+		m.Fanout = r.int()
+		m.Sign = r.bytes()
+	default:
+		return fmt.Errorf("the binary codec doesn't encode %T", v)
+	}
+	if r.err == nil && len(r.b) > 0 {
+		r.err = fmt.Errorf("%d bytes after the message", len(r.b))
+	}
+	return r.err
+}
+
+type binaryWriter struct {
+	b []byte
+}
+
+func (w *binaryWriter) uvarint(x uint64) {
+	w.b = binary.AppendUvarint(w.b, x)
+}
+
+func (w *binaryWriter) varint(x int64) {
+	w.b = binary.AppendVarint(w.b, x)
+}
+
+func (w *binaryWriter) bool(x bool) {
+	if x {
+		w.b = append(w.b, 1)
+	} else {
+		w.b = append(w.b, 0)
+	}
+}
+
+func (w *binaryWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+// The length of a list or a byte slice plus one, 0 for nil.
+func (w *binaryWriter) length(n int, isNil bool) {
+	if isNil {
+		w.uvarint(0)
+	} else {
+		w.uvarint(uint64(n) + 1)
+	}
+}
+
+func (w *binaryWriter) bytes(b []byte) {
+	w.length(len(b), b == nil)
+	w.b = append(w.b, b...)
+}
+
+func (w *binaryWriter) strings(list []string) {
+	w.length(len(list), list == nil)
+	for _, s := range list {
+		w.string(s)
+	}
+}
+
+func (w *binaryWriter) byteMap(m map[string][]byte) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.length(len(keys), m == nil)
+	for _, k := range keys {
+		w.string(k)
+		w.bytes(m[k])
+	}
+}
+
+func (w *binaryWriter) request(r Request) {
+	w.string(r.Content)
+	w.varint(int64(r.ID))
+	w.varint(r.Timestamp)
+	w.string(r.ClientAddr)
+	w.string(r.Client)
+	w.bool(r.ReadOnly)
+	w.bool(r.KeyChange != nil)
+	if kc := r.KeyChange; kc != nil {
+		w.string(kc.NodeID)
+		w.bytes(kc.PublicKey)
+		w.varint(int64(kc.EffectiveSequenceID))
+		w.string(kc.ReplacedKey)
+		w.bool(kc.Revocation)
+		w.bytes(kc.Sign)
+		w.bytes(kc.NewKeySign)
+		w.approvals(kc.Approvals)
+	}
+	w.bool(r.DKG != nil)
+	if m := r.DKG; m != nil {
+		w.dkgMessage(*m)
+	}
+	w.bool(r.ClientChange != nil)
+	if cc := r.ClientChange; cc != nil {
+		w.string(cc.ClientID)
+		w.bool(cc.Allowed)
+		w.varint(int64(cc.Version))
+		w.approvals(cc.Approvals)
+	}
+	w.bytes(r.Sign)
+}
+
+func (w *binaryWriter) approvals(approvals []KeyApproval) {
+	w.length(len(approvals), approvals == nil)
+	for _, a := range approvals {
+		w.string(a.NodeID)
+		w.bytes(a.Sign)
+	}
+}
+
+func (w *binaryWriter) dkgMessage(m DKGMessage) {
+	w.bool(m.Deal != nil)
+	if d := m.Deal; d != nil {
+		w.string(d.Session)
+		w.string(d.Dealer)
+		w.length(len(d.Commitments), d.Commitments == nil)
+		for _, c := range d.Commitments {
+			w.bytes(c)
+		}
+		w.byteMap(d.Shares)
+		w.bytes(d.Sign)
+	}
+	w.bool(m.Complaint != nil)
+	if c := m.Complaint; c != nil {
+		w.string(c.Session)
+		w.string(c.NodeID)
+		w.strings(c.Dealers)
+		w.bytes(c.Sign)
+	}
+	w.bool(m.Justification != nil)
+	if j := m.Justification; j != nil {
+		w.string(j.Session)
+		w.string(j.Dealer)
+		w.byteMap(j.Shares)
+		w.bytes(j.Sign)
+	}
+	w.bool(m.PhaseEnd != nil)
+	if e := m.PhaseEnd; e != nil {
+		w.string(e.Session)
+		w.varint(int64(e.Phase))
+		w.string(e.NodeID)
+	}
+}
+
+func (w *binaryWriter) prePrepare(pp PrePrepare) {
+	w.length(len(pp.RequestBatch), pp.RequestBatch == nil)
+	for _, r := range pp.RequestBatch {
+		w.request(r)
+	}
+	w.string(pp.Digest)
+	w.varint(int64(pp.View))
+	w.varint(int64(pp.SequenceID))
+	w.bytes(pp.Sign)
+}
+
+func (w *binaryWriter) vote(digest string, view, sequenceID int, nodeID string, sign []byte, authenticator map[string][]byte) {
+	w.string(digest)
+	w.varint(int64(view))
+	w.varint(int64(sequenceID))
+	w.string(nodeID)
+	w.bytes(sign)
+	w.byteMap(authenticator)
+}
+
+func (w *binaryWriter) reply(r Reply) {
+	w.varint(int64(r.View))
+	w.varint(r.Timestamp)
+	w.string(r.ClientID)
+	w.string(r.Client)
+	w.string(r.NodeID)
+	w.string(r.Result)
+	w.bool(r.Rejected)
+	w.bytes(r.Sign)
+}
+
+// Reads the fields of a payload, keeping the first error, after which every field reads as its zero value.
+type binaryReader struct {
+	b   []byte
+	err error
+}
+
+func (r *binaryReader) fail(format string, a ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, a...)
+	}
+	r.b = nil
+}
+
+// A varint must be encoded in as few bytes as possible, so every message has one encoding.
+func (r *binaryReader) uvarint() uint64 {
+	x, n := binary.Uvarint(r.b)
+	if n <= 0 || n != len(binary.AppendUvarint(nil, x)) {
+		r.fail("malformed varint")
+		return 0
+	}
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *binaryReader) varint() int64 {
+	x, n := binary.Varint(r.b)
+	if n <= 0 || n != len(binary.AppendVarint(nil, x)) {
+		r.fail("malformed varint")
+		return 0
+	}
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *binaryReader) int() int {
+	x := r.varint()
+	if int64(int(x)) != x {
+		r.fail("the integer %d overflows", x)
+		return 0
+	}
+	return int(x)
+}
+
+func (r *binaryReader) bool() bool {
+	if len(r.b) == 0 || r.b[0] > 1 {
+		r.fail("malformed boolean")
+		return false
+	}
+	x := r.b[0] == 1
+	r.b = r.b[1:]
+	return x
+}
+
+func (r *binaryReader) next(n uint64) []byte {
+	if n > uint64(len(r.b)) {
+		r.fail("%d bytes expected, %d left", n, len(r.b))
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *binaryReader) string() string {
+	return string(r.next(r.uvarint()))
+}
+
+// The length of a list or a byte slice, and whether it is nil. Every item takes at least a byte, so a list can't be
+// longer than the rest of the payload.
+func (r *binaryReader) length() (int, bool) {
+	n := r.uvarint()
+	if n == 0 {
+		return 0, true
+	}
+	if n-1 > uint64(len(r.b)) {
+		r.fail("%d items expected, %d bytes left", n-1, len(r.b))
+		return 0, true
+	}
+	return int(n - 1), false
+}
+
+func (r *binaryReader) bytes() []byte {
+	n, isNil := r.length()
+	if isNil {
+		return nil
+	}
+	return append([]byte{}, r.next(uint64(n))...)
+}
+
+func (r *binaryReader) strings() []string {
+	n, isNil := r.length()
+	if isNil {
+		return nil
+	}
+	list := make([]string, n)
+	for i := range list {
+		list[i] = r.string()
+	}
+	return list
+}
+
+func (r *binaryReader) byteMap() map[string][]byte {
+	n, isNil := r.length()
+	if isNil {
+		return nil
+	}
+	m := make(map[string][]byte, n)
+	last := ""
+	for i := 0; i < n; i++ {
+		k := r.string()
+		if i > 0 && k <= last {
+			r.fail("the keys of a map are not in order")
+		}
+		m[k] = r.bytes()
+		last = k
+	}
+	return m
+}
+
+func (r *binaryReader) request() Request {
+	var req Request
+	req.Content = r.string()
+	req.ID = r.int()
+	req.Timestamp = r.varint()
+	req.ClientAddr = r.string()
+	req.Client = r.string()
+	req.ReadOnly = r.bool()
+	if r.bool() {
+		kc := &KeyChange{}
+		kc.NodeID = r.string()
+		kc.PublicKey = r.bytes()
+		kc.EffectiveSequenceID = r.int()
+		kc.ReplacedKey = r.string()
+		kc.Revocation = r.bool()
+		kc.Sign = r.bytes()
+		kc.NewKeySign = r.bytes()
+		kc.Approvals = r.approvals()
+		req.KeyChange = kc
+	}
+	if r.bool() {
+		m := r.dkgMessage()
+		req.DKG = &m
+	}
+	if r.bool() {
+		req.ClientChange = &ClientChange{ClientID: r.string(), Allowed: r.bool(), Version: r.int(), Approvals: r.approvals()}
+	}
+	req.Sign = r.bytes()
+	return req
+}
+
+func (r *binaryReader) approvals() []KeyApproval {
+	n, isNil := r.length()
+	if isNil {
+		return nil
+	}
+	approvals := make([]KeyApproval, n)
+	for i := range approvals {
+		approvals[i] = KeyApproval{NodeID: r.string(), Sign: r.bytes()}
+	}
+	return approvals
+}
+
+func (r *binaryReader) dkgMessage() DKGMessage {
+	var m DKGMessage
+	if r.bool() {
+		d := &DKGDeal{Session: r.string(), Dealer: r.string()}
+		if n, isNil := r.length(); !isNil {
+			d.Commitments = make([][]byte, n)
+			for i := range d.Commitments {
+				d.Commitments[i] = r.bytes()
+			}
+		}
+		d.Shares = r.byteMap()
+		d.Sign = r.bytes()
+		m.Deal = d
+	}
+	if r.bool() {
+		m.Complaint = &DKGComplaint{Session: r.string(), NodeID: r.string(), Dealers: r.strings(), Sign: r.bytes()}
+	}
+	if r.bool() {
+		m.Justification = &DKGJustification{Session: r.string(), Dealer: r.string(), Shares: r.byteMap(), Sign: r.bytes()}
+	}
+	if r.bool() {
+		m.PhaseEnd = &DKGPhaseEnd{Session: r.string(), Phase: r.int(), NodeID: r.string()}
+	}
+	return m
+}
+
+func (r *binaryReader) prePrepare() PrePrepare {
+	var pp PrePrepare
+	if n, isNil := r.length(); !isNil {
+		pp.RequestBatch = make([]Request, n)
+		for i := range pp.RequestBatch {
+			pp.RequestBatch[i] = r.request()
+		}
+	}
+	pp.Digest = r.string()
+	pp.View = r.int()
+	pp.SequenceID = r.int()
+	pp.Sign = r.bytes()
+	return pp
+}
+
+func (r *binaryReader) vote() (digest string, view, sequenceID int, nodeID string, sign []byte, authenticator map[string][]byte) {
+	digest = r.string()
+	view = r.int()
+	sequenceID = r.int()
+	nodeID = r.string()
+	sign = r.bytes()
+	authenticator = r.byteMap()
+	return
+}
+
+func (r *binaryReader) reply() Reply {
+	var rep Reply
+	rep.View = r.int()
+	rep.Timestamp = r.varint()
+	rep.ClientID = r.string()
+	rep.Client = r.string()
+	rep.NodeID = r.string()
+	rep.Result = r.string()
+	rep.Rejected = r.bool()
+	rep.Sign = r.bytes()
+	return rep
+}
+
+// Select the highest version of the wire protocol the node speaks and the chain ID of its network, before the node
+// starts. An upgraded node keeps talking protocolV1 to the nodes that are not upgraded yet.
+func (p *pbft) setWireProtocol(version int, chainID uint64) {
+	p.wire = wireProtocol{version: version, chainID: chainID}
+}
@@ -0,0 +1,174 @@
+package fpbft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// Messages of every type the binary codec encodes, with nil and empty lists and maps, and every optional message set.
+func binaryMessages() []interface{} {
+	approvals := []KeyApproval{{NodeID: "N1", Sign: []byte{1}}, {NodeID: "N2", Sign: []byte{}}}
+	batch := []Request{
+		{Message: Message{Content: "plain", ID: -3}, Timestamp: 1 << 40, ClientAddr: "127.0.0.1:8888", Client: "C1", Sign: []byte{0, 1, 2}},
+		{ReadOnly: true, KeyChange: &KeyChange{NodeID: "N1", PublicKey: []byte{4}, EffectiveSequenceID: 20, ReplacedKey: "ab", Revocation: true, Approvals: approvals}},
+		{DKG: &DKGMessage{
+			Deal:          &DKGDeal{Session: "s", Dealer: "N0", Commitments: [][]byte{{1}, nil, {}}, Shares: map[string][]byte{"N2": {2}, "N1": nil}},
+			Complaint:     &DKGComplaint{Session: "s", NodeID: "N3", Dealers: []string{}},
+			Justification: &DKGJustification{Session: "s", Dealer: "N0", Shares: map[string][]byte{}},
+			PhaseEnd:      &DKGPhaseEnd{Session: "s", Phase: 2, NodeID: "N2"},
+		}},
+		{ClientChange: &ClientChange{ClientID: "C2", Allowed: true, Version: 3, Approvals: approvals}},
+	}
+	pp := PrePrepare{RequestBatch: batch, Digest: "digest", View: 2, SequenceID: 9, Sign: []byte{9}}
+	return []interface{}{
+		batch[0], batch[1], batch[2], batch[3],
+		pp,
+		PrePrepare{RequestBatch: []Request{}},
+		Prepare{Digest: "digest", View: 1, SequenceID: 2, NodeID: "N1", Authenticator: map[string][]byte{"N2": {1}, "N0": {2}}},
+		Commit{Digest: "digest", SequenceID: 2, NodeID: "N3", Sign: []byte{}},
+		Reply{View: 1, Timestamp: -1, ClientID: "C1", Client: "C1", NodeID: "N0", Result: "ok", Rejected: true},
+		TreePrePrepare{PrePrepare: pp, Tree: []string{"N0", "N1"}, Fanout: 2},
+	}
+}
+
+func decodeAs(t *testing.T, m interface{}, payload []byte) (interface{}, error) {
+	t.Helper()
+	v := reflect.New(reflect.TypeOf(m))
+	err := decodeBinary(payload, v.Interface())
+	return v.Elem().Interface(), err
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	for _, m := range binaryMessages() {
+		payload, ok := encodeBinary(m)
+		if !ok {
+			t.Fatalf("%T has no binary codec", m)
+		}
+		decoded, err := decodeAs(t, m, payload)
+		if err != nil {
+			t.Fatalf("%T: %v", m, err)
+		}
+		if !reflect.DeepEqual(decoded, m) {
+			t.Fatalf("%T decoded as %+v, not %+v", m, decoded, m)
+		}
+		again, _ := encodeBinary(decoded)
+		if !bytes.Equal(again, payload) {
+			t.Fatalf("%T is encoded differently once decoded", m)
+		}
+	}
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	for _, m := range binaryMessages() {
+		payload, _ := encodeBinary(m)
+		for n := 0; n < len(payload); n++ {
+			if _, err := decodeAs(t, m, payload[:n]); err == nil {
+				t.Fatalf("%T truncated to %d of %d bytes was decoded", m, n, len(payload))
+			}
+		}
+		if _, err := decodeAs(t, m, append(payload, 0)); err == nil {
+			t.Fatalf("%T with a trailing byte was decoded", m)
+		}
+	}
+}
+
+// A varint that isn't encoded in as few bytes as possible is rejected, in the payload and in the envelope.
+func TestNonMinimalVarints(t *testing.T) {
+	payload, _ := encodeBinary(Prepare{Digest: "d", View: 1, SequenceID: 2, NodeID: "N1"})
+	if payload[1] != 1 || payload[2] != 'd' {
+		t.Fatalf("the payload starts with %x", payload[:3])
+	}
+	//The length of the digest, 1, in two bytes
+	padded := append([]byte{binaryPayloadTag, 0x81, 0x00}, payload[2:]...)
+	if err := decodeBinary(padded, new(Prepare)); err == nil {
+		t.Fatal("a non-minimal uvarint was decoded")
+	}
+	//The view, 1, is the zigzag varint 2 after the digest
+	if payload[3] != 2 {
+		t.Fatalf("the view is encoded as %x", payload[3])
+	}
+	padded = append(append([]byte{}, payload[:3]...), 0x82, 0x80, 0x00)
+	padded = append(padded, payload[4:]...)
+	if err := decodeBinary(padded, new(Prepare)); err == nil {
+		t.Fatal("a non-minimal varint was decoded")
+	}
+	message := envelope{Version: protocolV2, ChainID: 1, Sender: "N0", Command: cPrepare, Payload: payload}.marshal()
+	if _, err := parseMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	padded = append([]byte{envelopeMagic, 0x82, 0x00}, message[2:]...)
+	if _, err := parseMessage(padded); err == nil {
+		t.Fatal("an envelope with a non-minimal version was parsed")
+	}
+}
+
+// A message is encoded with the version of the sender when it is sent, with JSON only for an older connection or a
+// message without a binary codec, and marshalled as JSON at most once.
+func TestOutgoingEncodedLazily(t *testing.T) {
+	w := wireProtocol{version: protocolV2, chainID: 7}
+	r := binaryMessages()[0].(Request)
+	o := w.encode("C1", cRequest, r)
+	if o.content != nil || len(o.encoded) != 1 {
+		t.Fatal("the request was encoded with JSON for a connection of protocolV2")
+	}
+	e, err := parseMessage(o.with(protocolV2))
+	if err != nil || e.Version != protocolV2 || e.ChainID != 7 || e.Sender != "C1" || e.Payload[0] != binaryPayloadTag {
+		t.Fatalf("the envelope %+v, %v", e, err)
+	}
+	e, err = parseMessage(o.with(protocolV1))
+	if err != nil || e.Version != protocolV1 || e.Command != cRequest {
+		t.Fatalf("the message of protocolV1 %+v, %v", e, err)
+	}
+	var decoded Request
+	if err := json.Unmarshal(e.Payload, &decoded); err != nil || !reflect.DeepEqual(decoded, r) {
+		t.Fatalf("the JSON content decoded as %+v, %v", decoded, err)
+	}
+	c := w.encode("N0", cCheckpoint, Checkpoint{SequenceID: 4, NodeID: "N0"})
+	e, err = parseMessage(c.with(protocolV2))
+	if err != nil || !bytes.Equal(e.Payload, c.content) {
+		t.Fatal("the checkpoint isn't carried as its JSON content")
+	}
+	content := c.content
+	c.with(protocolV1)
+	if &content[0] != &c.content[0] {
+		t.Fatal("the checkpoint was marshalled again")
+	}
+}
+
+// Once a connection has agreed on protocolV2, the messages of protocolV1, which carry no chain ID, are rejected.
+func TestConnectionRejectsOlderVersion(t *testing.T) {
+	w := wireProtocol{version: protocolV2, chainID: 7}
+	v1, err := parseMessage(jointMessage(cPrepare, []byte("{}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.check(v1, protocolV1); err != nil {
+		t.Fatalf("a message of protocolV1 over a connection of protocolV1: %v", err)
+	}
+	if err := w.check(v1, protocolV2); err == nil {
+		t.Fatal("a message of protocolV1 over a connection of protocolV2 was accepted")
+	}
+	for _, version := range []int{protocolV1, protocolV2} {
+		client, server := net.Pipe()
+		versions := make(chan int, 2)
+		go serveFrames(server, wireProtocol{version: version, chainID: 7}, func(message []byte, version int) {
+			versions <- version
+		})
+		c := &peerConn{addr: "pipe", sender: "N0", wire: w}
+		agreed, err := c.hello(client, bufio.NewReader(client))
+		if err != nil || agreed != version {
+			t.Fatalf("a node speaking up to %d agreed on %d: %v", version, agreed, err)
+		}
+		if err := writeFrame(client, jointMessage(cPrepare, []byte("{}"))); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-versions; got != version {
+			t.Fatalf("the message came over a connection of %d, not %d", got, version)
+		}
+		client.Close()
+	}
+}
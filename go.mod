@@ -2,14 +2,17 @@ module proof-of-training
 
 go 1.20
 
+require (
+	github.com/btcsuite/btcd v0.21.0-beta.0.20201114000516-e9c7a5ac6401
+	github.com/coinbase/kryptology v1.8.0
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+)
+
 require (
 	filippo.io/edwards25519 v1.0.0-rc.1 // indirect
-	github.com/btcsuite/btcd v0.21.0-beta.0.20201114000516-e9c7a5ac6401 // indirect
 	github.com/bwesterb/go-ristretto v1.2.0 // indirect
-	github.com/coinbase/kryptology v1.8.0 // indirect
 	github.com/consensys/gnark-crypto v0.5.3 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
 )
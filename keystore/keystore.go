@@ -0,0 +1,164 @@
+// Package keystore keeps the private keys of the nodes encrypted on disk, in a JSON format modelled on the v3 keystore
+// of Ethereum: the key is encrypted with AES-256-GCM under a key derived from a password with scrypt.
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Version of the keystore format
+const Version = 1
+
+// The cost parameters of scrypt, kept in every keystore file so that a key can be read whatever it was written with.
+type ScryptParams struct {
+	N int
+	R int
+	P int
+}
+
+var (
+	//The parameters of the keys created with the command line, about a second and 256 MB to derive the key
+	StandardScrypt = ScryptParams{N: 1 << 18, R: 8, P: 1}
+	//The parameters of the keys of the simulated networks, which unlock the keys of all their nodes in one process
+	LightScrypt = ScryptParams{N: 1 << 12, R: 8, P: 6}
+)
+
+// A private key of a node encrypted with a password. Tag is the kind of the key, the signature scheme or the
+// kind of key of its key files. The public key is kept in the clear, so the keys can be listed without the password.
+type Key struct {
+	Version   int
+	ID        string
+	NodeID    string
+	Tag       string
+	Created   time.Time
+	PublicKey string
+	Crypto    CryptoJSON
+}
+
+type CryptoJSON struct {
+	Cipher       string
+	CipherText   string
+	CipherParams CipherParamsJSON
+	KDF          string
+	KDFParams    KDFParamsJSON
+}
+
+type CipherParamsJSON struct {
+	Nonce string
+}
+
+type KDFParamsJSON struct {
+	N     int
+	R     int
+	P     int
+	DKLen int
+	Salt  string
+}
+
+// Encrypt the PEM encoded private key of the node with the password. The node, the tag and the public key are
+// authenticated with the private key, so none of them can be swapped in the file.
+func Encrypt(nodeID, tag string, prvkey, pubkey []byte, password string, params ScryptParams) (*Key, error) {
+	if password == "" {
+		return nil, errors.New("the password is empty")
+	}
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	//A random UUID of version 4
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	k := &Key{
+		Version:   Version,
+		ID:        fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]),
+		NodeID:    nodeID,
+		Tag:       tag,
+		Created:   time.Now().UTC(),
+		PublicKey: string(pubkey),
+	}
+	k.Crypto.Cipher = "aes-256-gcm"
+	k.Crypto.KDF = "scrypt"
+	k.Crypto.KDFParams = KDFParamsJSON{N: params.N, R: params.R, P: params.P, DKLen: 32, Salt: hex.EncodeToString(salt)}
+	gcm, err := k.cipher(password)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	k.Crypto.CipherParams.Nonce = hex.EncodeToString(nonce)
+	k.Crypto.CipherText = hex.EncodeToString(gcm.Seal(nil, nonce, prvkey, k.additionalData()))
+	return k, nil
+}
+
+// Decrypt the private key with the password.
+func (k *Key) Decrypt(password string) ([]byte, error) {
+	if k.Version != Version {
+		return nil, fmt.Errorf("keystore version %d is not supported", k.Version)
+	}
+	if k.Crypto.Cipher != "aes-256-gcm" || k.Crypto.KDF != "scrypt" {
+		return nil, fmt.Errorf("the cipher %s with the KDF %s is not supported", k.Crypto.Cipher, k.Crypto.KDF)
+	}
+	gcm, err := k.cipher(password)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(k.Crypto.CipherParams.Nonce)
+	if err != nil || len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("the nonce is malformed")
+	}
+	ciphertext, err := hex.DecodeString(k.Crypto.CipherText)
+	if err != nil {
+		return nil, errors.New("the ciphertext is malformed")
+	}
+	prvkey, err := gcm.Open(nil, nonce, ciphertext, k.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("the key of %s can't be decrypted, the password is wrong or the keystore was modified", k.NodeID)
+	}
+	return prvkey, nil
+}
+
+// The AES-GCM cipher under the key derived from the password.
+func (k *Key) cipher(password string) (cipher.AEAD, error) {
+	params := k.Crypto.KDFParams
+	if params.DKLen != 32 {
+		return nil, fmt.Errorf("the derived key is %d bytes long", params.DKLen)
+	}
+	salt, err := hex.DecodeString(params.Salt)
+	if err != nil {
+		return nil, errors.New("the salt is malformed")
+	}
+	key, err := scrypt.Key([]byte(password), salt, params.N, params.R, params.P, params.DKLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The fields of the keystore authenticated with the private key.
+func (k *Key) additionalData() []byte {
+	b, err := json.Marshal([]interface{}{k.Version, k.ID, k.NodeID, k.Tag, k.PublicKey, k.Crypto.KDFParams})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
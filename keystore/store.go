@@ -0,0 +1,215 @@
+package keystore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The password of the keystores is read from this environment variable.
+const PasswordEnv = "PBFT_KEYSTORE_PASSWORD"
+
+// The password of the simulated networks when PasswordEnv is not set. It protects nothing, every simulation knows it.
+const SimulationPassword = "proof-of-training simulation"
+
+var (
+	warnOnce   sync.Once
+	simulation atomic.Bool
+)
+
+// Let Password fall back to SimulationPassword when PasswordEnv is not set. Only the simulated networks, which unlock
+// the keys of all their nodes in one process, call it.
+func EnableSimulation() {
+	simulation.Store(true)
+}
+
+// The password of the keystores: PasswordEnv, or in the simulation mode the simulation password with a warning if it is
+// not set. Outside the simulation mode a keystore is never locked or unlocked with the well-known password.
+func Password() (string, error) {
+	if password := os.Getenv(PasswordEnv); password != "" {
+		return password, nil
+	}
+	if !simulation.Load() {
+		return "", fmt.Errorf("%s is not set", PasswordEnv)
+	}
+	warnOnce.Do(func() {
+		fmt.Printf("%s is not set, the keystores are locked with the simulation password\n", PasswordEnv)
+	})
+	return SimulationPassword, nil
+}
+
+// A directory of key files, Keys/<id>/<id>_<tag>_KEYSTORE for the encrypted private keys
+// and Keys/<id>/<id>_<tag>_PUB for the public keys the other nodes read.
+type Store struct {
+	Dir string
+}
+
+// The store in the 'Keys' directory of the current directory.
+var DefaultStore = Store{Dir: "Keys"}
+
+// Path of a key file of the node.
+func (s Store) path(nodeID, tag, kind string) string {
+	return filepath.Join(s.Dir, nodeID, nodeID+"_"+tag+"_"+kind)
+}
+
+// Path of the keystore of the node.
+func (s Store) Path(nodeID, tag string) string {
+	return s.path(nodeID, tag, "KEYSTORE")
+}
+
+// Path of the public key file of the node.
+func (s Store) PublicPath(nodeID, tag string) string {
+	return s.path(nodeID, tag, "PUB")
+}
+
+// Whether the node has a keystore of the tag.
+func (s Store) Has(nodeID, tag string) bool {
+	_, err := os.Stat(s.Path(nodeID, tag))
+	return err == nil
+}
+
+// Encrypt the private key of the node into its keystore and write its public key file. Only the owner can read the keystore.
+func (s Store) Write(nodeID, tag string, prvkey, pubkey []byte, password string, params ScryptParams) error {
+	k, err := Encrypt(nodeID, tag, prvkey, pubkey, password, params)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.Dir, nodeID), 0700); err != nil {
+		return err
+	}
+	//Write to a temporary file first, so that a crash never leaves a truncated keystore
+	tmp := s.Path(nodeID, tag) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.Path(nodeID, tag)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.PublicPath(nodeID, tag), pubkey, 0644)
+}
+
+// Read the keystore of the node.
+func (s Store) Read(nodeID, tag string) (*Key, error) {
+	b, err := ioutil.ReadFile(s.Path(nodeID, tag))
+	if err != nil {
+		return nil, err
+	}
+	k := new(Key)
+	if err := json.Unmarshal(b, k); err != nil {
+		return nil, fmt.Errorf("%s: %v", s.Path(nodeID, tag), err)
+	}
+	if k.NodeID != nodeID || k.Tag != tag {
+		return nil, fmt.Errorf("%s holds the %s key of %s", s.Path(nodeID, tag), k.Tag, k.NodeID)
+	}
+	return k, nil
+}
+
+// Decrypt the private key of the node with the password.
+func (s Store) ReadPrivateKey(nodeID, tag, password string) ([]byte, error) {
+	k, err := s.Read(nodeID, tag)
+	if err != nil {
+		return nil, err
+	}
+	return k.Decrypt(password)
+}
+
+// Read the public key file of the node.
+func (s Store) ReadPublicKey(nodeID, tag string) ([]byte, error) {
+	return ioutil.ReadFile(s.PublicPath(nodeID, tag))
+}
+
+// Replace the key of the node with a new one. The keystore and the public key file of the old key are kept
+// with the time of the rotation appended to their names, and the old key is only unlocked to check the password.
+func (s Store) Rotate(nodeID, tag string, prvkey, pubkey []byte, password string, params ScryptParams) error {
+	if _, err := s.ReadPrivateKey(nodeID, tag, password); err != nil {
+		return err
+	}
+	suffix := "." + strconv.FormatInt(time.Now().Unix(), 10)
+	if err := os.Rename(s.Path(nodeID, tag), s.Path(nodeID, tag)+suffix); err != nil {
+		return err
+	}
+	if err := os.Rename(s.PublicPath(nodeID, tag), s.PublicPath(nodeID, tag)+suffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.Write(nodeID, tag, prvkey, pubkey, password, params)
+}
+
+// The keystores of the store, in the order of the nodes and the tags. Rotated keys are not listed.
+func (s Store) List() ([]*Key, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*", "*_KEYSTORE"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*Key
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), "_KEYSTORE")
+		nodeID := filepath.Base(filepath.Dir(path))
+		if !strings.HasPrefix(name, nodeID+"_") {
+			continue
+		}
+		k, err := s.Read(nodeID, strings.TrimPrefix(name, nodeID+"_"))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].NodeID != keys[j].NodeID {
+			return nodeLess(keys[i].NodeID, keys[j].NodeID)
+		}
+		return keys[i].Tag < keys[j].Tag
+	})
+	return keys, nil
+}
+
+// N2 comes before N10.
+func nodeLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// Encrypt a plaintext private key file of the node, as written before the keystores, into its keystore,
+// and remove the plaintext file once the keystore decrypts to the same key.
+func (s Store) Migrate(nodeID, tag string, password string, params ScryptParams) error {
+	plain := s.path(nodeID, tag, "PIV")
+	prvkey, err := ioutil.ReadFile(plain)
+	if err != nil {
+		return err
+	}
+	pubkey, err := s.ReadPublicKey(nodeID, tag)
+	if err != nil {
+		return err
+	}
+	if err := s.Write(nodeID, tag, prvkey, pubkey, password, params); err != nil {
+		return err
+	}
+	check, err := s.ReadPrivateKey(nodeID, tag, password)
+	if err != nil {
+		return err
+	}
+	if string(check) != string(prvkey) {
+		return errors.New("the keystore doesn't hold the migrated key")
+	}
+	return os.Remove(plain)
+}
+
+// Whether the node has a plaintext private key file of the tag, as written before the keystores.
+func (s Store) HasPlaintext(nodeID, tag string) bool {
+	_, err := os.Stat(s.path(nodeID, tag, "PIV"))
+	return err == nil
+}
@@ -0,0 +1,19 @@
+package keystore
+
+import "testing"
+
+func TestPasswordNeedsSimulationMode(t *testing.T) {
+	t.Setenv(PasswordEnv, "")
+	if password, err := Password(); err == nil {
+		t.Fatalf("the password %q was returned without %s or the simulation mode", password, PasswordEnv)
+	}
+	t.Setenv(PasswordEnv, "secret")
+	if password, err := Password(); err != nil || password != "secret" {
+		t.Fatalf("the password is %q, %v", password, err)
+	}
+	t.Setenv(PasswordEnv, "")
+	EnableSimulation()
+	if password, err := Password(); err != nil || password != SimulationPassword {
+		t.Fatalf("the password in the simulation mode is %q, %v", password, err)
+	}
+}
@@ -11,17 +11,21 @@ import (
 	"time"
 )
 
-func clientSendMessageAndListen(clientAddr string, nodeTable nodeTable, data string, numNodes int) float64 {
+func clientSendMessageAndListen(transport Transport, clientAddr string, nodeTable nodeTable, data string, numNodes int) float64 {
 	var wg sync.WaitGroup
 
-	//Start local monitoring of the client (mainly used to receive reply information from nodes).
+	//Start local monitoring of the client (mainly used to receive reply information from nodes) before the request is sent,
+	//so no reply arrives before the client listens.
+	frames, err := transport.Listen(clientAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+	wg.Add(1) // Expect numNodes number of replies
 	go func() {
 		defer wg.Done()
-		clientTcpListen(clientAddr, numNodes)
+		clientListen(transport, frames, numNodes)
 	}()
 
-	wg.Add(1) // Expect numNodes number of replies
-
 	r := new(Request)
 	r.Timestamp = time.Now().UnixNano()
 	r.ClientAddr = clientAddr
@@ -36,7 +40,7 @@ func clientSendMessageAndListen(clientAddr string, nodeTable nodeTable, data str
 	content := jointMessage(cRequest, br)
 	currentTime := time.Now()
 	//N0 is the primary node, and the request information is sent directly to N0 by default
-	tcpDial(content, nodeTable["N0"])
+	transport.Send(nodeTable["N0"], content)
 
 	wg.Wait() // Wait for all the replies before proceeding
 
@@ -44,6 +48,16 @@ func clientSendMessageAndListen(clientAddr string, nodeTable nodeTable, data str
 
 }
 
+// Listening from clinet side, until numNodes replies were received
+func clientListen(transport Transport, frames <-chan frame, numNodes int) {
+	defer transport.Close()
+	for count := 0; count < numNodes; count++ {
+		b := (<-frames).message
+		//fmt.Println("client received" + string(b))
+		_ = b
+	}
+}
+
 // 返回一个十位数的随机数，作为msgid
 func getRandom() int {
 	x := big.NewInt(10000000000)
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 )
 
@@ -75,8 +76,12 @@ func jointMessage(cmd command, content []byte) []byte {
 }
 
 // Split command and content in bytes.
-// The default first twelve bytes are the command name.
-func splitMessage(message []byte) (cmd string, content []byte) {
+// The default first twelve bytes are the command name, a shorter message is malformed.
+func splitMessage(message []byte) (cmd string, content []byte, err error) {
+	if len(message) < prefixCMDLength {
+		err = fmt.Errorf("the message is %d bytes long, shorter than the command", len(message))
+		return
+	}
 	cmdBytes := message[:prefixCMDLength]
 	newCMDBytes := make([]byte, 0)
 	for _, v := range cmdBytes {
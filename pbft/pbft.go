@@ -8,6 +8,9 @@ import (
 	"log"
 	"strconv"
 	"sync"
+	"time"
+
+	"proof-of-training/keystore"
 )
 
 // Node table for broadcasting
@@ -53,6 +56,16 @@ type pbft struct {
 
 	// Local message pool (simulating the persistence layer), only after the confirmation of successful commit will the messages be stored in this pool.
 	localMessagePool []Message
+
+	//Rejected messages of the connections the node received them from
+	misbehaviours map[string]*misbehaviour
+
+	//A connection is banned for banDuration once banThreshold of its messages were rejected
+	banThreshold int
+	banDuration  time.Duration
+
+	//Exchanges the messages with the other nodes and the clients, over TCP unless it is set otherwise
+	transport Transport
 }
 
 func NewPBFT(nodeID, addr string, nodeTable nodeTable, nodeCount int) *pbft {
@@ -70,32 +83,52 @@ func NewPBFT(nodeID, addr string, nodeTable nodeTable, nodeCount int) *pbft {
 	p.nodeTable = nodeTable
 	p.nodeCount = nodeCount
 	p.localMessagePool = []Message{}
+	p.misbehaviours = make(map[string]*misbehaviour)
+	p.banThreshold = defaultBanThreshold
+	p.banDuration = defaultBanDuration
+	p.transport = newTCPTransport()
 	return p
 }
 
-func (p *pbft) handleRequest(data []byte) {
+// Handle a message received from the peer. A message that doesn't pass the validation is dropped
+// and counted against the connection it came from, and the messages of banned connections are dropped.
+func (p *pbft) handleRequest(data []byte, peer string) {
+	if p.isBanned(peer) {
+		return
+	}
 	//Split the message and call different functions based on the message command.
-	cmd, content := splitMessage(data)
+	cmd, content, err := splitMessage(data)
+	if err != nil {
+		p.recordRejection(peer, reject(reasonMalformed, "%v", err))
+		return
+	}
 	switch command(cmd) {
 	case cRequest:
-		p.handleClientRequest(content)
+		err = p.handleClientRequest(content)
 	case cPrePrepare:
-		p.handlePrePrepare(content)
+		err = p.handlePrePrepare(content)
 	case cPrepare:
-		p.handlePrepare(content, p.nodeCount)
+		err = p.handlePrepare(content, p.nodeCount)
 	case cCommit:
-		p.handleCommit(content, p.nodeCount)
+		err = p.handleCommit(content, p.nodeCount)
+	default:
+		err = reject(reasonUnknownCommand, "%q", cmd)
+	}
+	if err != nil {
+		p.recordRejection(peer, err)
 	}
 }
 
 // Handle requests coming from the client.
-func (p *pbft) handleClientRequest(content []byte) {
+func (p *pbft) handleClientRequest(content []byte) error {
 	fmt.Println("The primary node has received a request from the client...")
 	//Parsing the Request structure using JSON.
 	r := new(Request)
-	err := json.Unmarshal(content, r)
-	if err != nil {
-		log.Panic(err)
+	if err := decodeMessage(content, r); err != nil {
+		return err
+	}
+	if r.ClientAddr == "" {
+		return reject(reasonInvalidMessage, "the request has no client address")
 	}
 	//add sequence number
 	p.sequenceIDAdd()
@@ -117,26 +150,27 @@ func (p *pbft) handleClientRequest(content []byte) {
 	//Broadcast PrePrepare
 	p.broadcast(cPrePrepare, b)
 	fmt.Println("PrePrepare broadcast completed.")
+	return nil
 }
 
 // Process PrePrepare message
-func (p *pbft) handlePrePrepare(content []byte) {
+func (p *pbft) handlePrePrepare(content []byte) error {
 	//fmt.Println("This node has received the PrePrepare message sent by the primary node ...")
 	//Parse out the PrePrepare structure using JSON
 	pp := new(PrePrepare)
-	err := json.Unmarshal(content, pp)
-	if err != nil {
-		log.Panic(err)
+	if err := decodeMessage(content, pp); err != nil {
+		return err
 	}
-	//To obtain the public key of the primary node for digital signature verification
-	primaryNodePubKey := p.getPubKey("N0")
-	digestByte, _ := hex.DecodeString(pp.Digest)
 	if digest := getDigest(pp.RequestMessage); digest != pp.Digest {
-		fmt.Println("The digest doesn't match, refuse to broadcast prepare")
-	} else if p.sequenceID+1 != pp.SequenceID {
+		return reject(reasonBadDigest, "the request doesn't match the digest of the pre-prepare")
+	}
+	//Verify the signature of the primary node
+	if err := p.verifySignature("N0", pp.Digest, pp.Sign); err != nil {
+		return err
+	}
+	digestByte, _ := hex.DecodeString(pp.Digest)
+	if p.sequenceID+1 != pp.SequenceID {
 		fmt.Println("The message sequence number doesn't match, refuse to broadcast prepare")
-	} else if !p.RsaVerySignWithSha256(digestByte, pp.Sign, primaryNodePubKey) {
-		fmt.Println("The primary node signature verification failed! Refusing to broadcast prepare")
 	} else {
 		//Assigning the sequence number
 		p.sequenceID = pp.SequenceID
@@ -156,26 +190,30 @@ func (p *pbft) handlePrePrepare(content []byte) {
 		p.broadcast(cPrepare, bPre)
 		//fmt.Println("Prepare broadcast is completed.")
 	}
+	return nil
 }
 
 // Process the Prepare message
-func (p *pbft) handlePrepare(content []byte, nodeCount int) {
+func (p *pbft) handlePrepare(content []byte, nodeCount int) error {
 	//Parse out the Prepare structure using JSON
 	pre := new(Prepare)
-	err := json.Unmarshal(content, pre)
-	if err != nil {
-		log.Panic(err)
+	if err := decodeMessage(content, pre); err != nil {
+		return err
 	}
 	//fmt.Printf("The node has received Prepare from node %s ... \n", pre.NodeID)
-	//To obtain the public key of the message source node for digital signature verification
-	MessageNodePubKey := p.getPubKey(pre.NodeID)
+	if pre.NodeID == "N0" {
+		//The primary node does not send Prepare, its pre-prepare signature must not be counted as one
+		return reject(reasonInvalidMessage, "a prepare from the primary node")
+	}
+	//Verify the signature of the message source node
+	if err := p.verifySignature(pre.NodeID, pre.Digest, pre.Sign); err != nil {
+		return err
+	}
 	digestByte, _ := hex.DecodeString(pre.Digest)
 	if _, ok := p.messagePool[pre.Digest]; !ok {
 		fmt.Println("The current temporary message pool does not have this digest. Refusing to execute commit broadcast")
 	} else if p.sequenceID != pre.SequenceID {
 		fmt.Println("The message sequence number doesn't match. Refusing to execute commit broadcast")
-	} else if !p.RsaVerySignWithSha256(digestByte, pre.Sign, MessageNodePubKey) {
-		fmt.Println("The node signature verification failed! Refusing to execute commit broadcast")
 	} else {
 		p.setPrePareConfirmMap(pre.Digest, pre.NodeID, true)
 		count := 0
@@ -210,26 +248,25 @@ func (p *pbft) handlePrepare(content []byte, nodeCount int) {
 		}
 		p.lock.Unlock()
 	}
+	return nil
 }
 
 // Processing the commit
-func (p *pbft) handleCommit(content []byte, nodeCount int) {
+func (p *pbft) handleCommit(content []byte, nodeCount int) error {
 	//Parse out the Commit structure using JSON
 	c := new(Commit)
-	err := json.Unmarshal(content, c)
-	if err != nil {
-		log.Panic(err)
+	if err := decodeMessage(content, c); err != nil {
+		return err
 	}
 	//fmt.Printf("The node has received Commit from node %s ... \n", c.NodeID)
-	//To obtain the public key of the message source node for digital signature verification
-	MessageNodePubKey := p.getPubKey(c.NodeID)
-	digestByte, _ := hex.DecodeString(c.Digest)
+	//Verify the signature of the message source node
+	if err := p.verifySignature(c.NodeID, c.Digest, c.Sign); err != nil {
+		return err
+	}
 	if _, ok := p.prePareConfirmCount[c.Digest]; !ok {
 		fmt.Println("The current Prepare pool does not have this digest. Refusing to persist the information to the local message pool")
 	} else if p.sequenceID != c.SequenceID {
 		fmt.Println("The message sequence number doesn't match. Refusing to persist the information to the local message pool")
-	} else if !p.RsaVerySignWithSha256(digestByte, c.Sign, MessageNodePubKey) {
-		fmt.Println("The node signature verification failed! Refusing to persist the information to the local message pool")
 	} else {
 		p.setCommitConfirmMap(c.Digest, c.NodeID, true)
 		count := 0
@@ -247,12 +284,13 @@ func (p *pbft) handleCommit(content []byte, nodeCount int) {
 			info := p.node.nodeID + "node has put msgid:" + strconv.Itoa(p.messagePool[c.Digest].ID) + "into the local message pool,message content：" + p.messagePool[c.Digest].Content
 			//fmt.Println(info)
 			//fmt.Println("Replying to client ...")
-			tcpDial([]byte(info), p.messagePool[c.Digest].ClientAddr)
+			p.transport.Send(p.messagePool[c.Digest].ClientAddr, []byte(info))
 			p.isReply[c.Digest] = true
 			//fmt.Println("replying done!")
 		}
 		p.lock.Unlock()
 	}
+	return nil
 }
 
 // Add sequenceID
@@ -264,12 +302,26 @@ func (p *pbft) sequenceIDAdd() {
 
 // Broadcasting to other nodes except itself
 func (p *pbft) broadcast(cmd command, content []byte) {
+	addrs := make([]string, 0, len(p.nodeTable))
 	for i := range p.nodeTable {
 		if i == p.node.nodeID {
 			continue
 		}
-		message := jointMessage(cmd, content)
-		go tcpDial(message, p.nodeTable[i])
+		addrs = append(addrs, p.nodeTable[i])
+	}
+	p.transport.Broadcast(addrs, jointMessage(cmd, content))
+}
+
+// Listen on the address of the node, and handle the messages the transport receives one after the other
+func (p *pbft) listen(ready chan<- bool) {
+	frames, err := p.transport.Listen(p.node.addr)
+	if err != nil {
+		log.Panic(err)
+	}
+	//fmt.Printf("Node listening starts, address：%s\n", p.node.addr)
+	ready <- true // Signal that the server is ready
+	for f := range frames {
+		p.handleRequest(f.message, f.peer)
 	}
 }
 
@@ -298,9 +350,13 @@ func (p *pbft) getPubKey(nodeID string) []byte {
 	return key
 }
 
-// Pass the node number and obtain the corresponding private key
+// Pass the node number and obtain the corresponding private key, decrypted from its keystore
 func (p *pbft) getPivKey(nodeID string) []byte {
-	key, err := ioutil.ReadFile("Keys/" + nodeID + "/" + nodeID + "_RSA_PIV")
+	password, err := keystore.Password()
+	if err != nil {
+		log.Panic(err)
+	}
+	key, err := keystore.DefaultStore.ReadPrivateKey(nodeID, rsaKeyTag, password)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -308,23 +364,46 @@ func (p *pbft) getPivKey(nodeID string) []byte {
 }
 
 func genPBFTSynchronize(numNodes int, data string, clientAddr string) float64 {
-
-	var wg sync.WaitGroup
-	var elapsedTime float64
-
-	genRsaKeys(numNodes)
-
 	nodeTable := make(map[string]string) // Initialize the map
 	for i := 0; i < numNodes; i++ {
 		nodeID := fmt.Sprintf("N%d", i)
 		nodeTable[nodeID] = fmt.Sprintf("127.0.0.1:%d", 8000+i)
 	}
+	return runPBFTSynchronize(nodeTable, data, clientAddr, nil)
+}
+
+// Run numNodes nodes and the client in this process over an in-memory network, which exchanges their messages over
+// channels instead of sockets. No port is bound, so several networks can run side by side.
+func genMemoryPBFTSynchronize(numNodes int, data string) float64 {
+	network := newMemoryNetwork()
+	nodeTable := make(map[string]string)
+	for i := 0; i < numNodes; i++ {
+		nodeID := fmt.Sprintf("N%d", i)
+		nodeTable[nodeID] = "memory/" + nodeID
+	}
+	return runPBFTSynchronize(nodeTable, data, "memory/C", func(addr string) Transport {
+		return network.transport(addr)
+	})
+}
+
+// Every node and the client exchange their messages over the transport of their address, over TCP if transport is nil.
+func runPBFTSynchronize(nodeTable nodeTable, data string, clientAddr string, transport func(addr string) Transport) float64 {
+	keystore.EnableSimulation()
+
+	var wg sync.WaitGroup
+	var elapsedTime float64
+	numNodes := len(nodeTable)
+
+	genRsaKeys(numNodes)
 
 	ready := make(chan bool, numNodes) // Create a buffered channel
 	for i := 0; i < numNodes; i++ {
 		nodeID := fmt.Sprintf("N%d", i)
 		p := NewPBFT(nodeID, nodeTable[nodeID], nodeTable, numNodes)
-		go p.tcpListen(ready) // Pass the 'ready' channel to tcpListen
+		if transport != nil {
+			p.transport = transport(nodeTable[nodeID])
+		}
+		go p.listen(ready) // Pass the 'ready' channel to listen
 	}
 
 	for i := 0; i < numNodes; i++ {
@@ -333,9 +412,13 @@ func genPBFTSynchronize(numNodes int, data string, clientAddr string) float64 {
 
 	// Now all nodes are ready, initiate the client node
 	println("initiating client...")
+	var clientTransport Transport = newTCPTransport()
+	if transport != nil {
+		clientTransport = transport(clientAddr)
+	}
 	wg.Add(1) // We are adding 1 goroutine we want to wait for
 	go func() {
-		elapsedTime = clientSendMessageAndListen(clientAddr, nodeTable, data, numNodes)
+		elapsedTime = clientSendMessageAndListen(clientTransport, clientAddr, nodeTable, data, numNodes)
 		wg.Done() // Signal that the goroutine is finished
 	}()
 	wg.Wait() // Wait until all goroutines have finished
@@ -0,0 +1,33 @@
+package pbft
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// The nodes and the client of a network run in the test binary over the in-memory network, and the client gets the
+// replies of every node.
+func TestMemoryPBFTSynchronize(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The key files are written to the directory of the test
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	done := make(chan float64, 1)
+	go func() {
+		done <- genMemoryPBFTSynchronize(4, "request over the in-memory network")
+	}()
+	select {
+	case elapsed := <-done:
+		if elapsed <= 0 {
+			t.Fatalf("the request took %v seconds", elapsed)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("the client didn't get the replies of every node")
+	}
+}
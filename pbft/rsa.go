@@ -10,43 +10,45 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"os"
 	"strconv"
+
+	"proof-of-training/keystore"
 )
 
-// If the 'Keys' directory does not exist in the current directory, create the directory,
-// and generate RSA public and private keys for each node.
+// Tag of the RSA key files: Keys/<id>/<id>_RSA_KEYSTORE and Keys/<id>/<id>_RSA_PUB.
+const rsaKeyTag = "RSA"
+
+// If the RSA keystores do not exist in the 'Keys' directory of the current directory, generate RSA public and private
+// keys for each node, the private keys encrypted into their keystores. The plaintext private key files written before
+// the keystores are moved into the keystores instead.
 func genRsaKeys(numNodes int) {
-	if !isExist("./Keys") {
-		fmt.Println("the public and private key directory has not been generated yet, generating public and private keys...")
-		err := os.Mkdir("Keys", 0755)
+	generated := false
+	for i := 0; i <= numNodes; i++ {
+		nodeID := "N" + strconv.Itoa(i)
+		if keystore.DefaultStore.Has(nodeID, rsaKeyTag) {
+			continue
+		}
+		password, err := keystore.Password()
 		if err != nil {
-			log.Panic()
+			log.Panic(err)
 		}
-		for i := 0; i <= numNodes; i++ {
-			if !isExist("./Keys/N" + strconv.Itoa(i)) {
-				err := os.Mkdir("./Keys/N"+strconv.Itoa(i), 0755)
-				if err != nil {
-					log.Panic()
-				}
-			}
-			priv, pub := getKeyPair()
-			privFileName := "Keys/N" + strconv.Itoa(i) + "/N" + strconv.Itoa(i) + "_RSA_PIV"
-			file, err := os.OpenFile(privFileName, os.O_RDWR|os.O_CREATE, 0755)
-			if err != nil {
-				log.Panic(err)
-			}
-			defer file.Close()
-			file.Write(priv)
-
-			pubFileName := "Keys/N" + strconv.Itoa(i) + "/N" + strconv.Itoa(i) + "_RSA_PUB"
-			file2, err := os.OpenFile(pubFileName, os.O_RDWR|os.O_CREATE, 0755)
-			if err != nil {
+		if keystore.DefaultStore.HasPlaintext(nodeID, rsaKeyTag) {
+			if err := keystore.DefaultStore.Migrate(nodeID, rsaKeyTag, password, keystore.LightScrypt); err != nil {
 				log.Panic(err)
 			}
-			defer file2.Close()
-			file2.Write(pub)
+			fmt.Printf("the RSA private key of %s has been moved into its keystore\n", nodeID)
+			continue
 		}
+		if !generated {
+			fmt.Println("the public and private key directory has not been generated yet, generating public and private keys...")
+			generated = true
+		}
+		priv, pub := getKeyPair()
+		if err := keystore.DefaultStore.Write(nodeID, rsaKeyTag, priv, pub, password, keystore.LightScrypt); err != nil {
+			log.Panic(err)
+		}
+	}
+	if generated {
 		fmt.Println("RSA public and private keys have been generated for the nodes.")
 	}
 }
@@ -77,22 +79,6 @@ func getKeyPair() (prvkey, pubkey []byte) {
 	return
 }
 
-// Determine whether the file or folder exists.
-func isExist(path string) bool {
-	_, err := os.Stat(path)
-	if err != nil {
-		if os.IsExist(err) {
-			return true
-		}
-		if os.IsNotExist(err) {
-			return false
-		}
-		fmt.Println(err)
-		return false
-	}
-	return true
-}
-
 // Digital signature
 func (p *pbft) RsaSignWithSha256(data []byte, keyBytes []byte) []byte {
 	h := sha256.New()
@@ -117,21 +103,21 @@ func (p *pbft) RsaSignWithSha256(data []byte, keyBytes []byte) []byte {
 	return signature
 }
 
-// Verify signature
+// Verify signature. A malformed key or signature fails the verification.
 func (p *pbft) RsaVerySignWithSha256(data, signData, keyBytes []byte) bool {
 	block, _ := pem.Decode(keyBytes)
 	if block == nil {
-		panic(errors.New("public key error"))
+		return false
 	}
 	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		panic(err)
+		return false
+	}
+	rsaPubKey, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		return false
 	}
 
 	hashed := sha256.Sum256(data)
-	err = rsa.VerifyPKCS1v15(pubKey.(*rsa.PublicKey), crypto.SHA256, hashed[:], signData)
-	if err != nil {
-		panic(err)
-	}
-	return true
+	return rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA256, hashed[:], signData) == nil
 }
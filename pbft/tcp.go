@@ -1,74 +1,240 @@
 package pbft
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
-// TCP listening from clinet side
-func clientTcpListen(clientAddr string, numNodes int) {
-	listen, err := net.Listen("tcp", clientAddr)
+// The messages are sent over one long-lived connection per peer, as frames: the length of the message as 4 big-endian
+// bytes followed by the message. A frame longer than maxFrameSize closes the connection.
+const (
+	maxFrameSize = 64 << 20
+	//Messages waiting for the connection to a peer, the oldest one is dropped to make room for a new one
+	peerQueueLength = 4096
+	//A message is dropped once writing it failed maxSendAttempts times
+	maxSendAttempts = 5
+	//Time to wait before redialing a peer that is down, doubling up to maxRedialBackoff
+	minRedialBackoff = 50 * time.Millisecond
+	maxRedialBackoff = time.Second
+)
+
+var errFrameTooLarge = errors.New("the frame is longer than the maximum frame size")
+
+// A message received, with the peer it came from: the address of its connection, or the sender over a memory network.
+type frame struct {
+	message []byte
+	peer    string
+}
+
+// The TCP transport: the messages are sent over the connections of a peer pool, and received over the connections the
+// listener accepts.
+type tcpTransport struct {
+	pool     *peerPool
+	lock     sync.Mutex
+	listener net.Listener
+	//Closed by Close, which closes the accepted connections
+	done chan bool
+}
+
+func newTCPTransport() *tcpTransport {
+	return &tcpTransport{pool: newPeerPool()}
+}
+
+func (t *tcpTransport) Listen(addr string) (<-chan frame, error) {
+	listen, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Panic(err)
-	}
-	defer listen.Close()
-	count := 0
-	for {
-		conn, err := listen.Accept()
-		if err != nil {
-			log.Panic(err)
-		}
-		b, err := ioutil.ReadAll(conn)
-		if err != nil {
-			log.Panic(err)
-		}
-		//fmt.Println("client received" + string(b))
-		_ = b
-		count++
-		if count == numNodes {
-			break
-		}
+		return nil, err
 	}
+	done := make(chan bool)
+	t.lock.Lock()
+	t.listener, t.done = listen, done
+	t.lock.Unlock()
+	frames := make(chan frame)
+	go acceptFrames(listen, frames, done)
+	return frames, nil
+}
 
+func (t *tcpTransport) Send(addr string, message []byte) {
+	t.pool.send(message, addr)
 }
 
-// TCP listening from node side
-func (p *pbft) tcpListen(ready chan<- bool) {
+func (t *tcpTransport) Broadcast(addrs []string, message []byte) {
+	for _, addr := range addrs {
+		t.pool.send(message, addr)
+	}
+}
 
-	//println("starting")
-	listen, err := net.Listen("tcp", p.node.addr)
-	if err != nil {
-		log.Panic(err)
+func (t *tcpTransport) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.listener == nil {
+		return
 	}
-	//fmt.Printf("Node listening starts, address：%s\n", p.node.addr)
-	defer listen.Close()
-	ready <- true // Signal that the server is ready
+	t.listener.Close()
+	close(t.done)
+	t.listener = nil
+}
+
+// Accept the connections of the listener and pass on the frames they carry until done is closed, which closes them.
+func acceptFrames(listen net.Listener, frames chan<- frame, done <-chan bool) {
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			log.Panic(err)
+			//The listener has been closed
+			return
 		}
-		b, err := ioutil.ReadAll(conn)
-		if err != nil {
-			log.Panic(err)
-		}
-		p.handleRequest(b)
+		go func() {
+			<-done
+			conn.Close()
+		}()
+		go func() {
+			defer conn.Close()
+			peer := remotePeer(conn)
+			r := bufio.NewReader(conn)
+			for {
+				b, err := readFrame(r)
+				if err != nil {
+					if err != io.EOF {
+						log.Println(fmt.Errorf("the connection from %s: %v", conn.RemoteAddr(), err))
+					}
+					return
+				}
+				select {
+				case frames <- frame{b, peer}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Write the message as a frame.
+func writeFrame(w io.Writer, message []byte) error {
+	if len(message) > maxFrameSize {
+		return errFrameTooLarge
+	}
+	frame := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	copy(frame[4:], message)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Read the next frame, the message it holds.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
 	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	message := make([]byte, n)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
 
+// The connections of a node or a client to its peers, corresponding according to the address.
+type peerPool struct {
+	lock  sync.Mutex
+	peers map[string]*peerConn
 }
 
-// TCP send messages
-func tcpDial(context []byte, addr string) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		log.Println("connect error", err)
+func newPeerPool() *peerPool {
+	return &peerPool{peers: make(map[string]*peerConn)}
+}
+
+// TCP send messages, without waiting for the message to be written
+func (pool *peerPool) send(message []byte, addr string) {
+	if len(message) > maxFrameSize {
+		log.Printf("the message to %s is %d bytes long, longer than the maximum frame size\n", addr, len(message))
 		return
 	}
+	pool.lock.Lock()
+	c, ok := pool.peers[addr]
+	if !ok {
+		c = &peerConn{addr: addr, queue: make(chan []byte, peerQueueLength)}
+		pool.peers[addr] = c
+		go c.run()
+	}
+	pool.lock.Unlock()
+	enqueueDroppingOldest(c.queue, message, addr)
+}
 
-	_, err = conn.Write(context)
-	if err != nil {
-		log.Fatal(err)
+// The connection to a peer, written by its own goroutine in the order the messages were queued.
+type peerConn struct {
+	addr  string
+	queue chan []byte
+	conn  net.Conn
+	//Closed once the peer has closed the connection
+	closed chan struct{}
+}
+
+func (c *peerConn) run() {
+	for message := range c.queue {
+		for attempt := 0; attempt < maxSendAttempts; attempt++ {
+			c.connect()
+			if err := writeFrame(c.conn, message); err != nil {
+				log.Println(err)
+				c.disconnect()
+				continue
+			}
+			break
+		}
+	}
+}
+
+// Dial the peer unless the connection is open, and while the peer is down redial it after a backoff doubling up to
+// maxRedialBackoff, holding the queued messages back.
+func (c *peerConn) connect() {
+	if c.conn != nil {
+		select {
+		case <-c.closed:
+			c.disconnect()
+		default:
+			return
+		}
+	}
+	backoff := minRedialBackoff
+	for {
+		conn, err := net.Dial("tcp", c.addr)
+		if err == nil {
+			if backoff > minRedialBackoff {
+				log.Printf("%s is up again\n", c.addr)
+			}
+			c.conn = conn
+			break
+		}
+		if backoff == minRedialBackoff {
+			log.Println("connect error", err)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRedialBackoff {
+			backoff = maxRedialBackoff
+		}
 	}
-	conn.Close()
+	//The peer never writes to the connection, reading it only tells when the peer has closed it
+	closed := make(chan struct{})
+	c.closed = closed
+	go func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}(c.conn)
+}
+
+func (c *peerConn) disconnect() {
+	c.conn.Close()
+	c.conn = nil
 }
@@ -0,0 +1,180 @@
+package pbft
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// How a node or the client exchanges messages with the others: over TCP, or over channels between the nodes and the
+// client of one process. Sending never waits for the message to be delivered, and the messages sent to a peer are
+// delivered in the order they were sent.
+type Transport interface {
+	//Start receiving the messages sent to the address
+	Listen(addr string) (<-chan frame, error)
+	//Send the message to the address of a node or the client
+	Send(addr string, message []byte)
+	//Send the message to every address
+	Broadcast(addrs []string, message []byte)
+	//Stop receiving messages, Listen may be called again afterwards
+	Close()
+}
+
+// Drop the oldest message of the queue to make room for the new one, so a peer that is down doesn't block the sender.
+func enqueueDroppingOldest(queue chan []byte, message []byte, addr string) {
+	for {
+		select {
+		case queue <- message:
+			return
+		default:
+		}
+		select {
+		case <-queue:
+			log.Printf("the queue to %s is full, dropping its oldest message\n", addr)
+		default:
+		}
+	}
+}
+
+// The nodes and the client of a simulation running in one process, which exchange their messages over channels,
+// without sockets, so any number of networks can run side by side. The messages to an address go through one queue,
+// whatever node or client sent them, and a broadcast is queued to all its addresses at once, so a message is never
+// delivered before a message it answers. The nodes of this package drop the votes they receive before the message
+// they vote on.
+type memoryNetwork struct {
+	lock      sync.Mutex
+	endpoints map[string]*memoryEndpoint
+	//The queues of the messages to every address, each delivered by its own goroutine
+	queues map[string]chan frame
+}
+
+// The messages sent to a listening node or client.
+type memoryEndpoint struct {
+	inbox chan frame
+	//Closed once the node or client stops listening
+	done chan struct{}
+}
+
+func newMemoryNetwork() *memoryNetwork {
+	return &memoryNetwork{endpoints: make(map[string]*memoryEndpoint), queues: make(map[string]chan frame)}
+}
+
+// The transport of the node or client at the address, which the messages it sends come from.
+func (n *memoryNetwork) transport(addr string) *memoryTransport {
+	return &memoryTransport{network: n, addr: addr}
+}
+
+func (n *memoryNetwork) endpoint(addr string) *memoryEndpoint {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.endpoints[addr]
+}
+
+// Queue the message to every address, dropping the oldest message of a full queue so a peer that is down doesn't
+// block the sender.
+func (n *memoryNetwork) send(from string, addrs []string, message []byte) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, addr := range addrs {
+		queue, ok := n.queues[addr]
+		if !ok {
+			queue = make(chan frame, peerQueueLength)
+			n.queues[addr] = queue
+			go n.deliver(addr, queue)
+		}
+		enqueueFrameDroppingOldest(queue, frame{message, from}, addr)
+	}
+}
+
+// Like enqueueDroppingOldest, for the queues of the in-memory network, which keep the sender of every message.
+func enqueueFrameDroppingOldest(queue chan frame, f frame, addr string) {
+	for {
+		select {
+		case queue <- f:
+			return
+		default:
+		}
+		select {
+		case <-queue:
+			log.Printf("the queue to %s is full, dropping its oldest message\n", addr)
+		default:
+		}
+	}
+}
+
+// Deliver the messages to the address in the order they were queued. While the peer is not listening its messages are
+// held back, like with a peer that is down, and a message is dropped once the peer stopped listening maxSendAttempts
+// times before getting it.
+func (n *memoryNetwork) deliver(addr string, queue <-chan frame) {
+	for f := range queue {
+		for attempt := 0; attempt < maxSendAttempts; attempt++ {
+			e := n.waitForPeer(addr)
+			select {
+			case e.inbox <- f:
+			case <-e.done:
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (n *memoryNetwork) waitForPeer(addr string) *memoryEndpoint {
+	backoff := minRedialBackoff
+	for {
+		if e := n.endpoint(addr); e != nil {
+			return e
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRedialBackoff {
+			backoff = maxRedialBackoff
+		}
+	}
+}
+
+type memoryTransport struct {
+	network   *memoryNetwork
+	addr      string
+	lock      sync.Mutex
+	listening *memoryEndpoint
+}
+
+func (t *memoryTransport) Listen(addr string) (<-chan frame, error) {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	if _, ok := t.network.endpoints[addr]; ok {
+		return nil, fmt.Errorf("%s is already in use", addr)
+	}
+	e := &memoryEndpoint{inbox: make(chan frame), done: make(chan struct{})}
+	t.network.endpoints[addr] = e
+	t.lock.Lock()
+	t.listening = e
+	t.lock.Unlock()
+	return e.inbox, nil
+}
+
+func (t *memoryTransport) Send(addr string, message []byte) {
+	t.network.send(t.addr, []string{addr}, message)
+}
+
+func (t *memoryTransport) Broadcast(addrs []string, message []byte) {
+	t.network.send(t.addr, addrs, message)
+}
+
+func (t *memoryTransport) Close() {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.listening == nil {
+		return
+	}
+	for addr, e := range t.network.endpoints {
+		if e == t.listening {
+			delete(t.network.endpoints, addr)
+		}
+	}
+	close(t.listening.done)
+	t.listening = nil
+}
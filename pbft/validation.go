@@ -0,0 +1,125 @@
+package pbft
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// A peer is banned once defaultBanThreshold of its messages were rejected, for defaultBanDuration.
+const (
+	defaultBanThreshold = 10
+	defaultBanDuration  = time.Minute
+	//Connections whose rejected messages are counted, the ones that are not banned are forgotten beyond it
+	maxTrackedPeers = 4096
+)
+
+// Why a message received from a peer was rejected.
+type rejectReason string
+
+const (
+	reasonMalformed      rejectReason = "malformed message"
+	reasonUnknownCommand rejectReason = "unknown command"
+	reasonUnknownSender  rejectReason = "unknown sender"
+	reasonBadSignature   rejectReason = "invalid signature"
+	reasonBadDigest      rejectReason = "digest mismatch"
+	reasonInvalidMessage rejectReason = "invalid message"
+)
+
+// A message rejected by the validation. The signatures cover the message digest only, so a signed message
+// doesn't prove who sent it, and every rejected message is blamed on the connection it came from.
+type rejection struct {
+	reason rejectReason
+	detail string
+}
+
+func (r *rejection) Error() string {
+	return string(r.reason) + ": " + r.detail
+}
+
+func reject(reason rejectReason, format string, a ...interface{}) *rejection {
+	return &rejection{reason: reason, detail: fmt.Sprintf(format, a...)}
+}
+
+// Rejected messages of a connection since it was last banned.
+type misbehaviour struct {
+	count       int
+	bannedUntil time.Time
+}
+
+// The peer the rejected messages of a connection are blamed on, its address and port. Never its host alone, which all
+// the nodes and clients of a simulation share.
+func remotePeer(conn net.Conn) string {
+	return conn.RemoteAddr().String()
+}
+
+// Count a rejected message against the connection it came from, and ban the connection once it reaches the threshold.
+func (p *pbft) recordRejection(peer string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var r *rejection
+	if !errors.As(err, &r) {
+		r = reject(reasonMalformed, "%v", err)
+	}
+	fmt.Printf("%s rejected a message from %s: %v\n", p.node.nodeID, peer, r)
+	if len(p.misbehaviours) >= maxTrackedPeers {
+		//Forget the connections that are not banned, so the connections of a peer that keeps reconnecting don't pile up
+		now := time.Now()
+		for tracked, m := range p.misbehaviours {
+			if !now.Before(m.bannedUntil) {
+				delete(p.misbehaviours, tracked)
+			}
+		}
+	}
+	m, ok := p.misbehaviours[peer]
+	if !ok {
+		m = new(misbehaviour)
+		p.misbehaviours[peer] = m
+	}
+	m.count++
+	if m.count >= p.banThreshold {
+		m.count = 0
+		m.bannedUntil = time.Now().Add(p.banDuration)
+		fmt.Printf("%s has banned %s for %v\n", p.node.nodeID, peer, p.banDuration)
+	}
+}
+
+// Whether the messages of the connection are being dropped.
+func (p *pbft) isBanned(peer string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	m, ok := p.misbehaviours[peer]
+	return ok && time.Now().Before(m.bannedUntil)
+}
+
+// Verify the signature of the node on the message digest. A node that is not in the node table, or whose
+// public key can't be read, is rejected like a bad signature instead of stopping the node.
+func (p *pbft) verifySignature(nodeID string, digest string, sign []byte) error {
+	if _, ok := p.nodeTable[nodeID]; !ok {
+		return reject(reasonUnknownSender, "%q is not in the node table", nodeID)
+	}
+	digestByte, err := hex.DecodeString(digest)
+	if err != nil {
+		return reject(reasonMalformed, "the digest is not hex encoded")
+	}
+	key, err := ioutil.ReadFile("Keys/" + nodeID + "/" + nodeID + "_RSA_PUB")
+	if err != nil {
+		return reject(reasonUnknownSender, "the public key of %s can't be read", nodeID)
+	}
+	if !p.RsaVerySignWithSha256(digestByte, sign, key) {
+		return reject(reasonBadSignature, "the signature of %s doesn't verify", nodeID)
+	}
+	return nil
+}
+
+// Decode the JSON content of a message.
+func decodeMessage(content []byte, v interface{}) error {
+	if err := json.Unmarshal(content, v); err != nil {
+		return reject(reasonMalformed, "%v", err)
+	}
+	return nil
+}